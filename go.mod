@@ -6,7 +6,13 @@ require (
 	github.com/asticode/go-astiav v0.14.2-0.20240514161420-d8844951c978
 	github.com/asticode/go-astikit v0.42.0
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/pion/interceptor v0.1.37
+	github.com/pion/rtcp v1.2.14
+	github.com/pion/rtp v1.8.9
+	github.com/pion/sdp/v3 v3.0.9
+	github.com/pion/transport/v3 v3.0.7
 	github.com/pion/webrtc/v3 v3.1.47
+	github.com/pion/webrtc/v4 v4.0.1
 	github.com/stretchr/testify v1.9.0
 	github.com/szatmary/gocaption v0.0.0-20220607192049-fdd59655f0c3
 	go.uber.org/fx v1.20.1
@@ -21,25 +27,19 @@ require (
 	github.com/pion/dtls/v3 v3.0.3 // indirect
 	github.com/pion/ice/v2 v2.2.11 // indirect
 	github.com/pion/ice/v4 v4.0.2 // indirect
-	github.com/pion/interceptor v0.1.37 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.5 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.14 // indirect
-	github.com/pion/rtp v1.8.9 // indirect
 	github.com/pion/sctp v1.8.33 // indirect
-	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v2 v2.0.10 // indirect
 	github.com/pion/srtp/v3 v3.0.4 // indirect
 	github.com/pion/stun v0.3.5 // indirect
 	github.com/pion/stun/v3 v3.0.0 // indirect
 	github.com/pion/transport v0.13.1 // indirect
-	github.com/pion/transport/v3 v3.0.7 // indirect
 	github.com/pion/turn/v2 v2.0.8 // indirect
 	github.com/pion/turn/v4 v4.0.0 // indirect
 	github.com/pion/udp v0.1.1 // indirect
-	github.com/pion/webrtc/v4 v4.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/wlynxg/anet v0.0.3 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
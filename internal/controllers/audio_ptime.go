@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// withAudioPtime advertises the audio packet duration in the audio section of the local description,
+// the attribute goes before the section's first attribute since pion doesn't set it.
+func withAudioPtime(sdp string, ptime int) string {
+	if ptime <= 0 {
+		return sdp
+	}
+
+	lines := strings.Split(sdp, "\r\n")
+	result := make([]string, 0, len(lines)+1)
+	inAudio, added := false, false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			inAudio = strings.HasPrefix(line, "m=audio")
+		}
+		if inAudio && strings.HasPrefix(line, "a=ptime:") {
+			continue
+		}
+		if inAudio && !added && strings.HasPrefix(line, "a=") {
+			result = append(result, fmt.Sprintf("a=ptime:%d", ptime))
+			added = true
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\r\n")
+}
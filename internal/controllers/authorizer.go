@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// Authorizer decides whether a signaling request (ex: starting a WHEP session) is allowed, it returns
+// an error wrapping entities.ErrUnauthorized otherwise. Integrators validating against their own
+// system (ex: a webhook) provide their own implementation replacing the default one, ex: fx.Decorate.
+type Authorizer interface {
+	Authorize(r *http.Request, params entities.RequestParams) error
+}
+
+// NewAuthorizer creates the authorizer selected by Config.AuthMode.
+func NewAuthorizer(c *entities.Config) (Authorizer, error) {
+	switch c.AuthMode {
+	case entities.AuthModeNone:
+		return noAuthorizer{}, nil
+	case entities.AuthModeToken:
+		if c.AuthToken == "" {
+			return nil, fmt.Errorf("%w: token requires AuthToken", entities.ErrInvalidAuthMode)
+		}
+		return &tokenAuthorizer{token: c.AuthToken}, nil
+	case entities.AuthModeJWT:
+		if c.AuthJWTSecret == "" {
+			return nil, fmt.Errorf("%w: jwt requires AuthJWTSecret", entities.ErrInvalidAuthMode)
+		}
+		return &jwtAuthorizer{secret: []byte(c.AuthJWTSecret), now: time.Now}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", entities.ErrInvalidAuthMode, c.AuthMode)
+}
+
+type noAuthorizer struct{}
+
+func (noAuthorizer) Authorize(_ *http.Request, _ entities.RequestParams) error {
+	return nil
+}
+
+// tokenAuthorizer expects a static bearer token.
+type tokenAuthorizer struct {
+	token string
+}
+
+func (a *tokenAuthorizer) Authorize(r *http.Request, _ entities.RequestParams) error {
+	token := requestToken(r)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return fmt.Errorf("%w: invalid token", entities.ErrUnauthorized)
+	}
+	return nil
+}
+
+// jwtAuthorizer expects a JWT signed with HS256, it must not be expired (exp) nor used
+// before its nbf. When the token has a stream_id claim, it must match the requested stream. Publishing
+// requires the publish claim, the viewers' tokens can't publish.
+type jwtAuthorizer struct {
+	secret []byte
+	now    func() time.Time
+}
+
+type jwtClaims struct {
+	ExpiresAt *int64 `json:"exp"`
+	NotBefore *int64 `json:"nbf"`
+	StreamID  string `json:"stream_id"`
+	Publish   bool   `json:"publish"`
+}
+
+func (a *jwtAuthorizer) Authorize(r *http.Request, params entities.RequestParams) error {
+	token := requestToken(r)
+	if token == "" {
+		return fmt.Errorf("%w: missing token", entities.ErrUnauthorized)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", entities.ErrUnauthorized)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return fmt.Errorf("%w: unsupported token algorithm", entities.ErrUnauthorized)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", entities.ErrUnauthorized)
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("%w: invalid signature", entities.ErrUnauthorized)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("%w: malformed claims", entities.ErrUnauthorized)
+	}
+	now := a.now().Unix()
+	if claims.ExpiresAt != nil && now >= *claims.ExpiresAt {
+		return fmt.Errorf("%w: token expired", entities.ErrUnauthorized)
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return fmt.Errorf("%w: token not valid yet", entities.ErrUnauthorized)
+	}
+	if claims.StreamID != "" && params.StreamID != "" && claims.StreamID != params.StreamID {
+		return fmt.Errorf("%w: token not valid for stream %s", entities.ErrUnauthorized, params.StreamID)
+	}
+	if params.Publish && !claims.Publish {
+		return fmt.Errorf("%w: token not allowed to publish", entities.ErrUnauthorized)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// requestToken reads the bearer token from the Authorization header,
+// or from the token query parameter for signed URLs.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func signJWT(secret, claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthorizer(t *testing.T) {
+	a := &jwtAuthorizer{secret: []byte("secret"), now: func() time.Time { return time.Unix(1000, 0) }}
+	params := entities.RequestParams{StreamID: "live"}
+
+	for name, tc := range map[string]struct {
+		token string
+		valid bool
+	}{
+		"valid":         {token: signJWT("secret", `{"exp":2000,"stream_id":"live"}`), valid: true},
+		"expired":       {token: signJWT("secret", `{"exp":1000}`)},
+		"not valid yet": {token: signJWT("secret", `{"nbf":1500}`)},
+		"other stream":  {token: signJWT("secret", `{"stream_id":"other"}`)},
+		"wrong secret":  {token: signJWT("other", `{"exp":2000}`)},
+		"missing token": {token: ""},
+		"malformed":     {token: "not.a-token"},
+	} {
+		r := httptest.NewRequest("POST", "/whep", nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		err := a.Authorize(r, params)
+
+		if tc.valid {
+			assert.Nil(t, err, name)
+		} else {
+			assert.ErrorIs(t, err, entities.ErrUnauthorized, name)
+		}
+	}
+}
+
+func TestJWTAuthorizerPublish(t *testing.T) {
+	a := &jwtAuthorizer{secret: []byte("secret"), now: func() time.Time { return time.Unix(1000, 0) }}
+	params := entities.RequestParams{Publish: true}
+
+	for name, tc := range map[string]struct {
+		token string
+		valid bool
+	}{
+		"publisher":     {token: signJWT("secret", `{"exp":2000,"publish":true}`), valid: true},
+		"viewer":        {token: signJWT("secret", `{"exp":2000,"stream_id":"live"}`)},
+		"without claim": {token: signJWT("secret", `{"exp":2000}`)},
+	} {
+		r := httptest.NewRequest("POST", "/whip", nil)
+		r.Header.Set("Authorization", "Bearer "+tc.token)
+
+		err := a.Authorize(r, params)
+
+		if tc.valid {
+			assert.Nil(t, err, name)
+		} else {
+			assert.ErrorIs(t, err, entities.ErrUnauthorized, name)
+		}
+	}
+}
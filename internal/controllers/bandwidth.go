@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WithVideoBandwidth caps the bit rate the remote peer sends on the video section of the local description
+// (b=AS, in kbps), replacing any bandwidth line. A non-positive bit rate leaves the sdp untouched.
+// ref https://datatracker.ietf.org/doc/html/rfc4566#section-5.8
+func WithVideoBandwidth(sdp string, bitRate int64) string {
+	if bitRate <= 0 {
+		return sdp
+	}
+
+	lines := strings.Split(sdp, "\r\n")
+	result := make([]string, 0, len(lines)+1)
+	inVideo := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			inVideo = strings.HasPrefix(line, "m=video")
+		}
+		if inVideo && strings.HasPrefix(line, "b=") {
+			continue
+		}
+		result = append(result, line)
+		// the bandwidth follows the connection line of the section
+		if inVideo && strings.HasPrefix(line, "c=") {
+			result = append(result, fmt.Sprintf("b=AS:%d", bitRate/1000))
+		}
+	}
+	return strings.Join(result, "\r\n")
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithVideoBandwidth(t *testing.T) {
+	sdp := strings.Join([]string{
+		"v=0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"c=IN IP4 0.0.0.0",
+		"b=AS:8000",
+		"a=mid:0",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"c=IN IP4 0.0.0.0",
+		"b=AS:64",
+		"a=mid:1",
+	}, "\r\n")
+
+	// the video bandwidth replaces the one offered, the audio section is left untouched
+	want := strings.Join([]string{
+		"v=0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"c=IN IP4 0.0.0.0",
+		"b=AS:2500",
+		"a=mid:0",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"c=IN IP4 0.0.0.0",
+		"b=AS:64",
+		"a=mid:1",
+	}, "\r\n")
+	assert.Equal(t, want, WithVideoBandwidth(sdp, 2_500_000))
+
+	// no limit keeps the SDP as it is
+	assert.Equal(t, sdp, WithVideoBandwidth(sdp, 0))
+}
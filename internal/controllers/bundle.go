@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"strings"
+)
+
+const bundleGroupPrefix = "a=group:BUNDLE"
+
+// BundlesMedia tells whether the offer bundles all its media sections (RFC 8843), the rejected ones
+// (port 0) don't need to be bundled.
+func BundlesMedia(offerSDP string) bool {
+	bundled, hasBundle := bundledMids(offerSDP)
+	if !hasBundle {
+		return false
+	}
+	for _, mid := range offeredMids(offerSDP) {
+		if !bundled[mid] {
+			return false
+		}
+	}
+	return true
+}
+
+// withOfferTransports makes the answer follow the BUNDLE grouping of the offer over the single transport pion
+// uses: the media sections the offer bundles are kept, the other ones are rejected (port 0). An offer without
+// BUNDLE negotiates a transport per media section, a legacy client then gets a single media section, the first
+// one sending or receiving media (the video first), and the ICE candidates move to it. Pion itself rejects
+// every media section of such an offer (v4) or bundles them all (v3).
+func withOfferTransports(remoteSDP, localSDP string) string {
+	if BundlesMedia(remoteSDP) {
+		return localSDP
+	}
+
+	lines := strings.Split(localSDP, "\r\n")
+	sections := mediaSectionsOf(lines)
+	kept, hasBundle := bundledMids(remoteSDP)
+	if !hasBundle {
+		kept = map[string]bool{}
+		if mid, ok := singleTransportMid(sections); ok {
+			kept[mid] = true
+		}
+	}
+
+	var keptMids, candidates []string
+	for _, s := range sections {
+		if kept[s.mid] {
+			keptMids = append(keptMids, s.mid)
+		}
+		for _, line := range lines[s.start:s.end] {
+			if strings.HasPrefix(line, "a=candidate:") || line == "a=end-of-candidates" {
+				candidates = append(candidates, line)
+			}
+		}
+	}
+	if len(keptMids) == 0 {
+		return localSDP
+	}
+
+	result := make([]string, 0, len(lines))
+	for _, line := range lines[:sections[0].start] {
+		if !strings.HasPrefix(line, bundleGroupPrefix) {
+			result = append(result, line)
+		}
+	}
+	if hasBundle {
+		result = append(result, bundleGroupPrefix+" "+strings.Join(keptMids, " "))
+	}
+	for _, s := range sections {
+		for i, line := range lines[s.start:s.end] {
+			if i == 0 {
+				line = withMediaPort(line, kept[s.mid])
+			}
+			if strings.HasPrefix(line, "a=candidate:") || line == "a=end-of-candidates" || line == "" {
+				continue
+			}
+			result = append(result, line)
+		}
+		if s.mid == keptMids[0] {
+			result = append(result, candidates...)
+		}
+	}
+	return strings.Join(result, "\r\n") + "\r\n"
+}
+
+type sdpMediaSection struct {
+	// start is the index of the m= line, end the one of the next section or the end of the lines
+	start, end int
+	media, mid string
+	direction  string
+}
+
+func mediaSectionsOf(lines []string) []sdpMediaSection {
+	var sections []sdpMediaSection
+	for i, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			if len(sections) > 0 {
+				sections[len(sections)-1].end = i
+			}
+			// ex: m=video 9 UDP/TLS/RTP/SAVPF 96
+			media, _, _ := strings.Cut(strings.TrimPrefix(line, "m="), " ")
+			sections = append(sections, sdpMediaSection{start: i, end: len(lines), media: media})
+			continue
+		}
+		if len(sections) == 0 {
+			continue
+		}
+		s := &sections[len(sections)-1]
+		switch line {
+		case "a=sendrecv", "a=sendonly", "a=recvonly", "a=inactive":
+			s.direction = strings.TrimPrefix(line, "a=")
+		}
+		if strings.HasPrefix(line, "a=mid:") {
+			s.mid = strings.TrimPrefix(line, "a=mid:")
+		}
+	}
+	return sections
+}
+
+// singleTransportMid returns the media section a non-bundled answer keeps, the first one otherwise. Pion
+// doesn't give a mid to the sections it rejects for lack of a codec.
+func singleTransportMid(sections []sdpMediaSection) (string, bool) {
+	for _, media := range []string{"video", "audio"} {
+		for _, s := range sections {
+			if s.media == media && s.mid != "" && s.direction != "" && s.direction != "inactive" {
+				return s.mid, true
+			}
+		}
+	}
+	for _, s := range sections {
+		if s.mid != "" {
+			return s.mid, true
+		}
+	}
+	return "", false
+}
+
+// withMediaPort rejects (port 0) or accepts a media section, pion's accepted sections use the discard port (9)
+// since the transport address is in the ICE candidates.
+func withMediaPort(mLine string, accepted bool) string {
+	fields := strings.Split(mLine, " ")
+	if len(fields) < 2 {
+		return mLine
+	}
+	if !accepted {
+		fields[1] = "0"
+	} else if fields[1] == "0" {
+		fields[1] = "9"
+	}
+	return strings.Join(fields, " ")
+}
+
+// bundledMids returns the mids of the offer's BUNDLE group, false when the offer doesn't use BUNDLE.
+func bundledMids(sdp string) (map[string]bool, bool) {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, bundleGroupPrefix) {
+			continue
+		}
+		mids := map[string]bool{}
+		for _, mid := range strings.Fields(strings.TrimPrefix(line, bundleGroupPrefix)) {
+			mids[mid] = true
+		}
+		return mids, true
+	}
+	return nil, false
+}
+
+// offeredMids returns the mids of the media sections the offer doesn't reject.
+func offeredMids(sdp string) []string {
+	var mids []string
+	rejected := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			// ex: m=video 0 UDP/TLS/RTP/SAVPF 96
+			fields := strings.Fields(line)
+			rejected = len(fields) > 1 && fields[1] == "0"
+			continue
+		}
+		if strings.HasPrefix(line, "a=mid:") && !rejected {
+			mids = append(mids, strings.TrimPrefix(line, "a=mid:"))
+		}
+	}
+	return mids
+}
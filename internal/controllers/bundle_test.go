@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundlesMedia(t *testing.T) {
+	bundled := "v=0\r\na=group:BUNDLE 0 1\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:1\r\n"
+	assert.True(t, BundlesMedia(bundled))
+
+	notBundled := strings.Replace(bundled, "a=group:BUNDLE 0 1\r\n", "", 1)
+	assert.False(t, BundlesMedia(notBundled))
+
+	partiallyBundled := strings.Replace(bundled, "a=group:BUNDLE 0 1", "a=group:BUNDLE 0", 1)
+	assert.False(t, BundlesMedia(partiallyBundled))
+
+	// a rejected media section isn't bundled
+	rejected := strings.Replace(partiallyBundled, "m=audio 9", "m=audio 0", 1)
+	assert.True(t, BundlesMedia(rejected))
+}
+
+func TestWithOfferTransports_Bundled(t *testing.T) {
+	offer := "v=0\r\na=group:BUNDLE 0 1\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\n"
+	answer := "v=0\r\na=group:BUNDLE 0 1\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendonly\r\n" +
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=sendonly\r\n"
+
+	assert.Equal(t, answer, withOfferTransports(offer, answer))
+}
+
+// TestWithOfferTransports_NotBundled answers a legacy client over a single transport, pion (v4) rejects
+// every media section of its offer.
+func TestWithOfferTransports_NotBundled(t *testing.T) {
+	offer := "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:2\r\n"
+	answer := "v=0\r\nm=audio 0 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendonly\r\n" +
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host\r\na=end-of-candidates\r\n" +
+		"m=video 0 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=sendonly\r\n" +
+		"m=application 0 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:2\r\n"
+
+	want := "v=0\r\nm=audio 0 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendonly\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=sendonly\r\n" +
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host\r\na=end-of-candidates\r\n" +
+		"m=application 0 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:2\r\n"
+	assert.Equal(t, want, withOfferTransports(offer, answer))
+
+	// the audio is kept when the video is inactive
+	inactive := strings.Replace(answer, "a=mid:1\r\na=sendonly", "a=mid:1\r\na=inactive", 1)
+	assert.Contains(t, withOfferTransports(offer, inactive), "m=audio 9 ")
+	assert.Contains(t, withOfferTransports(offer, inactive), "m=video 0 ")
+}
+
+// TestWithOfferTransports_PartiallyBundled rejects the media sections the offer doesn't bundle, pion (v3)
+// bundles them all.
+func TestWithOfferTransports_PartiallyBundled(t *testing.T) {
+	offer := "v=0\r\na=group:BUNDLE 1 2\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:2\r\n"
+	answer := "v=0\r\na=group:BUNDLE 0 1 2\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendonly\r\n" +
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=sendonly\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:2\r\n"
+
+	want := "v=0\r\na=group:BUNDLE 1 2\r\nm=audio 0 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\na=sendonly\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=sendonly\r\n" +
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:2\r\n"
+	assert.Equal(t, want, withOfferTransports(offer, answer))
+}
+
+// negotiate answers the offer of a viewer receiving video and audio, with a data channel. The answerer
+// sends video.
+func negotiate(t *testing.T, withoutBundle bool) (offer, answer string) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer offerer.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		_, err = offerer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		require.NoError(t, err)
+	}
+	_, err = offerer.CreateDataChannel(entities.MetadataChannelID, nil)
+	require.NoError(t, err)
+	desc, err := offerer.CreateOffer(nil)
+	require.NoError(t, err)
+	if withoutBundle {
+		var lines []string
+		for _, line := range strings.SplitAfter(desc.SDP, "\r\n") {
+			if !strings.HasPrefix(line, bundleGroupPrefix) {
+				lines = append(lines, line)
+			}
+		}
+		desc.SDP = strings.Join(lines, "")
+	}
+
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer answerer.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "donut")
+	require.NoError(t, err)
+	_, err = answerer.AddTrack(track)
+	require.NoError(t, err)
+	require.NoError(t, answerer.SetRemoteDescription(desc))
+	answerDesc, err := answerer.CreateAnswer(nil)
+	require.NoError(t, err)
+	return desc.SDP, answerDesc.SDP
+}
+
+func TestOfferTransportsNegotiation(t *testing.T) {
+	offer, answer := negotiate(t, false)
+	require.True(t, BundlesMedia(offer))
+	got := withOfferTransports(offer, answer)
+	assert.Equal(t, answer, got)
+	answered, ok := bundledMids(got)
+	require.True(t, ok)
+	assert.Len(t, answered, 3)
+
+	offer, answer = negotiate(t, true)
+	require.False(t, BundlesMedia(offer))
+	got = withOfferTransports(offer, answer)
+	assert.NotContains(t, got, bundleGroupPrefix)
+	assert.Contains(t, got, "m=video 9 ")
+	assert.Contains(t, got, "m=audio 0 ")
+	assert.Contains(t, got, "m=application 0 ")
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// dataChannelQueue holds the messages sent before the metadata data channel opens (ex: the pipeline events
+// or a poster), they're sent once it does. pion keeps a single OnOpen handler per channel, every early message
+// must go through the same queue.
+type dataChannelQueue struct {
+	l *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pending map[*webrtc.DataChannel][]string
+}
+
+func newDataChannelQueue(l *zap.SugaredLogger) *dataChannelQueue {
+	return &dataChannelQueue{l: l, pending: map[*webrtc.DataChannel][]string{}}
+}
+
+// send sends the message right away when the channel is open and nothing is queued before it.
+func (q *dataChannelQueue) send(dc *webrtc.DataChannel, msg string) error {
+	q.mu.Lock()
+	queued, waiting := q.pending[dc]
+	if !waiting && dc.ReadyState() == webrtc.DataChannelStateOpen {
+		q.mu.Unlock()
+		return dc.SendText(msg)
+	}
+	q.pending[dc] = append(queued, msg)
+	q.mu.Unlock()
+
+	if !waiting {
+		dc.OnOpen(func() { q.flush(dc) })
+		dc.OnClose(func() { q.drop(dc) })
+	}
+	return nil
+}
+
+func (q *dataChannelQueue) flush(dc *webrtc.DataChannel) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, msg := range q.pending[dc] {
+		if err := dc.SendText(msg); err != nil {
+			q.l.Errorw("error while sending a queued message", "error", err)
+			break
+		}
+	}
+	delete(q.pending, dc)
+}
+
+// drop forgets the messages of a channel closed before opening.
+func (q *dataChannelQueue) drop(dc *webrtc.DataChannel) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, dc)
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// TestDataChannelQueue sends messages before the channel opens (ex: the recipe warnings and a poster),
+// they all reach the peer, in order, once it does.
+func TestDataChannelQueue(t *testing.T) {
+	sender, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	received := make(chan string, 3)
+	receiver.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) { received <- string(msg.Data) })
+	})
+
+	dc, err := sender.CreateDataChannel("metadata", nil)
+	require.NoError(t, err)
+	q := newDataChannelQueue(zap.NewNop().Sugar())
+	for _, msg := range []string{"warning 1", "warning 2", "poster"} {
+		require.NoError(t, q.send(dc, msg))
+	}
+
+	offer, err := sender.CreateOffer(nil)
+	require.NoError(t, err)
+	gathered := webrtc.GatheringCompletePromise(sender)
+	require.NoError(t, sender.SetLocalDescription(offer))
+	<-gathered
+	require.NoError(t, receiver.SetRemoteDescription(*sender.LocalDescription()))
+	answer, err := receiver.CreateAnswer(nil)
+	require.NoError(t, err)
+	gathered = webrtc.GatheringCompletePromise(receiver)
+	require.NoError(t, receiver.SetLocalDescription(answer))
+	<-gathered
+	require.NoError(t, sender.SetRemoteDescription(*receiver.LocalDescription()))
+
+	var messages []string
+	for len(messages) < 3 {
+		select {
+		case msg := <-received:
+			messages = append(messages, msg)
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "the queued messages weren't sent", "received %v", messages)
+		}
+	}
+	assert.Equal(t, []string{"warning 1", "warning 2", "poster"}, messages)
+
+	// the channel is open, the next message isn't queued
+	require.NoError(t, q.send(dc, "event"))
+	assert.Empty(t, q.pending)
+	select {
+	case msg := <-received:
+		assert.Equal(t, "event", msg)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "the message wasn't sent")
+	}
+}
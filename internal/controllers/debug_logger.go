@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewDebugLogger returns a named sub-logger writing its debug logs whatever the level of l, it's used by
+// the opt-in verbose logs (ex: Config.LogSDP) instead of raising the level of the whole application.
+func NewDebugLogger(l *zap.SugaredLogger, name string) *zap.SugaredLogger {
+	return l.Desugar().Named(name).WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelCore{Core: core, level: zapcore.DebugLevel}
+	})).Sugar()
+}
+
+// levelCore enables the entries from level, the wrapped core writes them regardless of its own level.
+type levelCore struct {
+	zapcore.Core
+	level zapcore.Level
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNewDebugLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	l := zap.New(core).Sugar().With("session", "a")
+
+	NewDebugLogger(l, "sdp").Debugw("sdp", "kind", "offer")
+	// the application logger keeps its level
+	l.Debugw("hidden")
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "sdp", entries[0].LoggerName)
+	assert.Equal(t, zapcore.DebugLevel, entries[0].Level)
+	assert.Equal(t, map[string]interface{}{"session": "a", "kind": "offer"}, entries[0].ContextMap())
+}
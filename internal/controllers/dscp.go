@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// DSCPMarker marks the RTP and RTCP packets leaving the ICE sockets with the DSCP of their media type
+// (Config.DSCPAudio and Config.DSCPVideo). The bundled media share the socket so they're marked per packet,
+// the tracks are told apart by their SSRC (unencrypted by SRTP).
+type DSCPMarker struct {
+	l *zap.SugaredLogger
+	// audio and video are the TOS bytes (DSCP << 2), 0 leaves the packets unmarked
+	audio, video int
+
+	mu    sync.RWMutex
+	ssrcs map[uint32]int
+}
+
+// NewDSCPMarker creates the marker, it's a no-op when neither media type has a DSCP.
+func NewDSCPMarker(c *entities.Config, l *zap.SugaredLogger) (*DSCPMarker, error) {
+	audio, err := ParseDSCP(c.DSCPAudio)
+	if err != nil {
+		return nil, err
+	}
+	video, err := ParseDSCP(c.DSCPVideo)
+	if err != nil {
+		return nil, err
+	}
+	return &DSCPMarker{l: l, audio: audio << 2, video: video << 2, ssrcs: map[uint32]int{}}, nil
+}
+
+// ParseDSCP returns the code point of a per-hop behavior name (ex: EF, AF41, CS5) or a value from 0 to 63,
+// empty is the default (0).
+func ParseDSCP(v string) (int, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	switch {
+	case v == "" || v == "BE" || v == "DF":
+		return 0, nil
+	case v == "EF":
+		return 46, nil
+	case len(v) == 3 && strings.HasPrefix(v, "CS") && v[2] >= '0' && v[2] <= '7':
+		return int(v[2]-'0') * 8, nil
+	case len(v) == 4 && strings.HasPrefix(v, "AF") && v[2] >= '1' && v[2] <= '4' && v[3] >= '1' && v[3] <= '3':
+		return int(v[2]-'0')*8 + int(v[3]-'0')*2, nil
+	}
+	dscp, err := strconv.Atoi(v)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("%w: %s", entities.ErrInvalidDSCP, v)
+	}
+	return dscp, nil
+}
+
+// Enabled is false when no media type is marked.
+func (m *DSCPMarker) Enabled() bool {
+	return m.audio != 0 || m.video != 0
+}
+
+// TrackPeer marks the packets of the peer's tracks until its connection is closed, it must be called once
+// the tracks are added and it sets the peer's OnConnectionStateChange.
+func (m *DSCPMarker) TrackPeer(peer *webrtc.PeerConnection) {
+	if !m.Enabled() {
+		return
+	}
+	var video, audio []uint32
+	for _, sender := range peer.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+		for _, e := range sender.GetParameters().Encodings {
+			if track.Kind() == webrtc.RTPCodecTypeAudio {
+				audio = append(audio, uint32(e.SSRC))
+			} else {
+				video = append(video, uint32(e.SSRC))
+			}
+		}
+	}
+	untrack := m.TrackSSRCs(video, audio)
+
+	peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			untrack()
+		}
+	})
+}
+
+// TrackSSRCs marks the packets of the video and audio SSRCs until untrack is called, it tracks the
+// peer connections of any pion version (ex: the v4 WHEP ones).
+func (m *DSCPMarker) TrackSSRCs(video, audio []uint32) (untrack func()) {
+	if !m.Enabled() {
+		return func() {}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ssrc := range video {
+		m.ssrcs[ssrc] = m.video
+	}
+	for _, ssrc := range audio {
+		m.ssrcs[ssrc] = m.audio
+	}
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, ssrc := range append(video, audio...) {
+			delete(m.ssrcs, ssrc)
+		}
+	}
+}
+
+// tosFor returns the TOS byte of a packet, false for the unmarked ones (ex: STUN, DTLS or unknown SSRCs).
+func (m *DSCPMarker) tosFor(packet []byte) (int, bool) {
+	ssrc, ok := packetSSRC(packet)
+	if !ok {
+		return 0, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tos, ok := m.ssrcs[ssrc]
+	return tos, ok && tos != 0
+}
+
+// packetSSRC returns the SSRC of an RTP packet or the sender SSRC of an RTCP one.
+// ref https://datatracker.ietf.org/doc/html/rfc7983#section-7 and https://datatracker.ietf.org/doc/html/rfc5761#section-4
+func packetSSRC(packet []byte) (uint32, bool) {
+	if len(packet) < 8 || packet[0] < 128 || packet[0] > 191 {
+		return 0, false
+	}
+	if packet[1] >= 192 && packet[1] <= 223 {
+		return binary.BigEndian.Uint32(packet[4:8]), true
+	}
+	if len(packet) < 12 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[8:12]), true
+}
+
+// UDPMsgConn is a UDP socket writing packets with control messages, ex: *net.UDPConn.
+type UDPMsgConn interface {
+	LocalAddr() net.Addr
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error)
+}
+
+// DSCPSocket marks the packets written to a single socket.
+type DSCPSocket struct {
+	m *DSCPMarker
+	// unsupported is set once the system rejected a marked packet, the socket sends them unmarked then
+	unsupported atomic.Bool
+}
+
+// NewSocket returns the marking of a socket, each socket falls back to unmarked packets on its own.
+func (m *DSCPMarker) NewSocket() *DSCPSocket {
+	return &DSCPSocket{m: m}
+}
+
+// WriteTo writes a packet to the socket, marked when it belongs to a tracked SSRC.
+func (s *DSCPSocket) WriteTo(conn UDPMsgConn, b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || s.unsupported.Load() {
+		return conn.WriteTo(b, addr)
+	}
+	tos, ok := s.m.tosFor(b)
+	if !ok {
+		return conn.WriteTo(b, addr)
+	}
+
+	n, err := writeMarked(conn, b, udpAddr, tos)
+	if err != nil {
+		// the marking isn't supported (ex: the system rejects the control message), the media must flow anyway
+		if s.unsupported.CompareAndSwap(false, true) {
+			s.m.l.Warnw("marking the media packets failed, the socket sends them unmarked from now on",
+				"socket", conn.LocalAddr(),
+				"error", err,
+			)
+		}
+		return conn.WriteTo(b, addr)
+	}
+	return n, nil
+}
+
+// dscpPacketConn marks the packets written to the UDP mux socket.
+type dscpPacketConn struct {
+	*net.UDPConn
+	s *DSCPSocket
+}
+
+func (c *dscpPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.s.WriteTo(c.UDPConn, b, addr)
+}
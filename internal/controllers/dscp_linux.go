@@ -0,0 +1,31 @@
+//go:build linux
+
+package controllers
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// writeMarked writes a packet with its traffic class.
+func writeMarked(conn UDPMsgConn, b []byte, addr *net.UDPAddr, tos int) (int, error) {
+	n, _, err := conn.WriteMsgUDP(b, tosControlMessage(addr, tos), addr)
+	return n, err
+}
+
+// tosControlMessage sets the traffic class of a single packet, IP_TOS for IPv4 destinations
+// (including the v4-mapped ones of dual-stack sockets) and IPV6_TCLASS otherwise.
+func tosControlMessage(addr *net.UDPAddr, tos int) []byte {
+	level, typ := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr.IP.To4() == nil {
+		level, typ = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	b := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = int32(tos)
+	return b
+}
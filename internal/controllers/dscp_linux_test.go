@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// recordingConn records the traffic class of the packets written to it.
+type recordingConn struct {
+	failMarked bool
+	marked     int
+	unmarked   int
+}
+
+func (c *recordingConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+func (c *recordingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.unmarked++
+	return len(b), nil
+}
+
+func (c *recordingConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (int, int, error) {
+	if c.failMarked {
+		return 0, 0, errors.New("invalid argument")
+	}
+	c.marked++
+	return len(b), len(oob), nil
+}
+
+func TestDSCPSocketFallsBackPerSocket(t *testing.T) {
+	m := &DSCPMarker{l: zap.NewNop().Sugar(), video: 34 << 2, ssrcs: map[uint32]int{}}
+	untrack := m.TrackSSRCs([]uint32{0xdeadbeef}, nil)
+	rtp := []byte{0x80, 0x60, 0x00, 0x01, 0, 0, 0, 0, 0xde, 0xad, 0xbe, 0xef}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	rejecting, accepting := &recordingConn{failMarked: true}, &recordingConn{}
+	rejectingSocket, acceptingSocket := m.NewSocket(), m.NewSocket()
+	for i := 0; i < 2; i++ {
+		_, err := rejectingSocket.WriteTo(rejecting, rtp, addr)
+		assert.NoError(t, err)
+		_, err = acceptingSocket.WriteTo(accepting, rtp, addr)
+		assert.NoError(t, err)
+	}
+	// the socket rejecting the marking sends unmarked packets, the other one keeps marking them
+	assert.Equal(t, 2, rejecting.unmarked)
+	assert.Equal(t, 2, accepting.marked)
+	assert.Equal(t, 0, accepting.unmarked)
+
+	untrack()
+	_, err := acceptingSocket.WriteTo(accepting, rtp, addr)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, accepting.unmarked)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package controllers
+
+import (
+	"net"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// writeMarked fails, the per packet traffic class relies on linux control messages.
+func writeMarked(conn UDPMsgConn, b []byte, addr *net.UDPAddr, tos int) (int, error) {
+	return 0, entities.ErrDSCPUnsupported
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDSCP(t *testing.T) {
+	tests := map[string]int{
+		"":     0,
+		"BE":   0,
+		"EF":   46,
+		"ef":   46,
+		"AF41": 34,
+		"AF11": 10,
+		"AF43": 38,
+		"CS5":  40,
+		"26":   26,
+	}
+	for v, want := range tests {
+		got, err := ParseDSCP(v)
+		if assert.NoError(t, err, v) {
+			assert.Equal(t, want, got, v)
+		}
+	}
+
+	for _, v := range []string{"AF51", "AF44", "CS8", "64", "-1", "premium"} {
+		_, err := ParseDSCP(v)
+		assert.ErrorIs(t, err, entities.ErrInvalidDSCP, v)
+	}
+}
+
+func TestPacketSSRC(t *testing.T) {
+	rtp := []byte{0x80, 0x60, 0x00, 0x01, 0, 0, 0, 0, 0xde, 0xad, 0xbe, 0xef}
+	ssrc, ok := packetSSRC(rtp)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0xdeadbeef), ssrc)
+
+	// sender report
+	rtcp := []byte{0x80, 200, 0x00, 0x06, 0xca, 0xfe, 0xba, 0xbe}
+	ssrc, ok = packetSSRC(rtcp)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(0xcafebabe), ssrc)
+
+	// STUN binding request, it has no ssrc
+	stun := []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42, 0, 0, 0, 0}
+	_, ok = packetSSRC(stun)
+	assert.False(t, ok)
+}
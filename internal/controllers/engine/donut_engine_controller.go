@@ -1,14 +1,19 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/asticode/go-astiav"
 	"github.com/flavioribeiro/donut/internal/controllers/probers"
 	"github.com/flavioribeiro/donut/internal/controllers/streamers"
 	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/flavioribeiro/donut/internal/mapper"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 type DonutEngine interface {
@@ -24,14 +29,34 @@ type DonutEngineParams struct {
 	Streamers []streamers.DonutStreamer `group:"streamers"`
 	Probers   []probers.DonutProber     `group:"probers"`
 	Mapper    *mapper.Mapper
+	Config    *entities.Config
+	Logger    *zap.SugaredLogger
 }
 
 type DonutEngineController struct {
-	p DonutEngineParams
+	p     DonutEngineParams
+	rules []entities.DonutRecipeRule
 }
 
-func NewDonutEngineController(p DonutEngineParams) *DonutEngineController {
-	return &DonutEngineController{p}
+func NewDonutEngineController(p DonutEngineParams) (*DonutEngineController, error) {
+	rules, err := ParseRecipeRules(p.Config.RecipeRules)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Config.SRTReadStrategy.Valid() {
+		return nil, fmt.Errorf("%w: %s", entities.ErrInvalidReadStrategy, p.Config.SRTReadStrategy)
+	}
+	if !entities.IsSRTPayloadSize(p.Config.SRTReadBufferSizeBytes) {
+		return nil, fmt.Errorf("%w: %d", entities.ErrInvalidSRTReadBufferSize, p.Config.SRTReadBufferSizeBytes)
+	}
+	if p.Config.SRTPollIntervalMS <= 0 {
+		return nil, fmt.Errorf("%w: %d", entities.ErrInvalidSRTPollInterval, p.Config.SRTPollIntervalMS)
+	}
+	if p.Config.FallbackTestPattern && (p.Config.FallbackRetryMS <= 0 || p.Config.FallbackProbeTimeoutMS <= 0) {
+		return nil, fmt.Errorf("%w: retry %dms, probe timeout %dms", entities.ErrInvalidFallbackRetry,
+			p.Config.FallbackRetryMS, p.Config.FallbackProbeTimeoutMS)
+	}
+	return &DonutEngineController{p: p, rules: rules}, nil
 }
 
 func (c *DonutEngineController) EngineFor(req *entities.RequestParams) (DonutEngine, error) {
@@ -50,6 +75,9 @@ func (c *DonutEngineController) EngineFor(req *entities.RequestParams) (DonutEng
 		streamer: streamer,
 		mapper:   c.p.Mapper,
 		req:      req,
+		rules:    c.rules,
+		c:        c.p.Config,
+		l:        c.p.Logger,
 	}, nil
 }
 
@@ -78,6 +106,11 @@ type donutEngine struct {
 	streamer streamers.DonutStreamer
 	mapper   *mapper.Mapper
 	req      *entities.RequestParams
+	rules    []entities.DonutRecipeRule
+	c        *entities.Config
+	l        *zap.SugaredLogger
+	// fallback is set when the source was unavailable and the test pattern is served instead
+	fallback bool
 }
 
 func (d *donutEngine) ServerIngredients() (*entities.StreamInfo, error) {
@@ -85,7 +118,16 @@ func (d *donutEngine) ServerIngredients() (*entities.StreamInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return d.prober.StreamInfo(appetizer)
+	// the streamer reads again what the prober consumed
+	if appetizer.Reader == stdin {
+		appetizer.Reader = stdin.Probing()
+	}
+	info, err := d.probe(appetizer)
+	if err != nil && d.c.FallbackTestPattern {
+		d.fallback = true
+		return testPatternStreamInfo(), nil
+	}
+	return info, err
 }
 
 func (d *donutEngine) ClientIngredients() (*entities.StreamInfo, error) {
@@ -93,40 +135,386 @@ func (d *donutEngine) ClientIngredients() (*entities.StreamInfo, error) {
 }
 
 func (d *donutEngine) Serve(p *entities.DonutParameters) {
+	if d.fallback {
+		d.serveFallback(p)
+		return
+	}
 	d.streamer.Stream(p)
 }
 
 func (d *donutEngine) RecipeFor(server, client *entities.StreamInfo) (*entities.DonutRecipe, error) {
-	appetizer, err := d.Appetizer()
-	if err != nil {
-		return nil, err
+	isTestPattern := server.Format == entities.DonutLavfiFormat
+	appetizer := testPatternAppetizer()
+	if !isTestPattern {
+		var err error
+		if appetizer, err = d.Appetizer(); err != nil {
+			return nil, err
+		}
+	}
+	// the streamer must use the format confirmed while probing instead of guessing it
+	if server.Format != "" {
+		appetizer.Format = server.Format
+	}
+	if !d.c.TimestampDiscontinuity.Valid() {
+		return nil, fmt.Errorf("%w: %s", entities.ErrInvalidTimestampDiscontinuity, d.c.TimestampDiscontinuity)
+	}
+	if !d.c.OfferMissingMedia.Valid() {
+		return nil, fmt.Errorf("%w: %s", entities.ErrInvalidOfferMissingMedia, d.c.OfferMissingMedia)
+	}
+
+	video := entities.DonutMediaTask{
+		Action:                entities.DonutBypass,
+		Codec:                 entities.H264,
+		DonutBitStreamFilters: []entities.DonutBitStreamFilter{entities.DonutH264AnnexB},
+	}
+	if isTestPattern {
+		video = testPatternVideoTask(client)
+	} else if videoStreams := server.VideoStreams(); len(videoStreams) > 0 {
+		source := videoStreams[0]
+		if task, ok := videoTaskFor(d.rules, appetizer.Format, source.Codec); ok {
+			video = task
+		}
+		// transcoding would convert it to SDR, bypassing keeps the HDR metadata intact
+		if d.c.HDRPassthrough && source.HDR {
+			if playableBy(client, entities.VideoType, source.Codec) == nil && d.negotiable(source.Codec) {
+				video = bypassVideoTask(source.Codec)
+			} else {
+				video.PreserveColor = video.Action == entities.DonutTranscode
+			}
+		}
+	}
+	if videoStreams := server.VideoStreams(); len(videoStreams) > 0 && !isTestPattern {
+		source := videoStreams[0]
+		if height := ResolutionHeight(d.req.Resolution, source); height > 0 {
+			// scaling needs the decoded frames
+			if video.Action == entities.DonutBypass {
+				video = transcodeVideoTask(scalableVideoCodec(source.Codec))
+				video.PreserveColor = d.c.HDRPassthrough && source.HDR
+			}
+			d.l.Infow("scaling the video down", "resolution", d.req.Resolution, "source_height", source.Height)
+			video.Height = height
+		}
+	}
+	video.DecoderCodecContextOptions = d.videoDecoderOptions()
+	if video.Action == entities.DonutBypass {
+		for _, name := range d.c.BypassBitStreamFilters {
+			video.DonutBitStreamFilters = append(video.DonutBitStreamFilters, entities.DonutBitStreamFilter(name))
+		}
+		if videoStreams := server.VideoStreams(); d.c.H264SpropParameterSets && video.Codec == entities.H264 && len(videoStreams) > 0 {
+			video.ParameterSets = videoStreams[0].ParameterSets
+		}
+	}
+	if video.Action == entities.DonutTranscode {
+		video.ContentType = d.c.VideoContentType
+		if d.req.ContentType != "" {
+			video.ContentType = d.req.ContentType
+		}
+		if !video.ContentType.Valid() {
+			return nil, fmt.Errorf("%w: %s", entities.ErrInvalidContentType, video.ContentType)
+		}
+		video.LatencyMode = d.c.VideoLatencyMode
+		if d.req.LatencyMode != "" {
+			video.LatencyMode = d.req.LatencyMode
+		}
+		if video.LatencyMode != "" && !video.LatencyMode.Valid() {
+			return nil, fmt.Errorf("%w: %s", entities.ErrInvalidLatencyMode, video.LatencyMode)
+		}
+		deinterlace := d.c.VideoDeinterlace
+		if d.req.Deinterlace != "" {
+			deinterlace = d.req.Deinterlace
+		}
+		if deinterlace != "" {
+			if !deinterlace.Valid() {
+				return nil, fmt.Errorf("%w: %s", entities.ErrInvalidDeinterlaceMode, deinterlace)
+			}
+			if !entities.IsDeinterlacer(d.c.VideoDeinterlacer) {
+				return nil, fmt.Errorf("%w: %s", entities.ErrInvalidDeinterlacer, d.c.VideoDeinterlacer)
+			}
+			video.Deinterlace = deinterlace
+			video.DonutStreamFilter = entities.DeinterlaceFilter(video.DonutStreamFilter, d.c.VideoDeinterlacer, deinterlace)
+		}
+		video.FrameRate = d.c.VideoMaxFrameRate
+		video.PixelFormat = d.c.VideoPixelFormat
+		if d.c.VideoColorRange != "" && !d.c.VideoColorRange.Valid() {
+			return nil, fmt.Errorf("%w: %s", entities.ErrInvalidColorRange, d.c.VideoColorRange)
+		}
+		video.ColorRange = d.c.VideoColorRange
+		video.MuxerCodec = d.c.MuxerVideoCodec
+		video.PrivateOptions = d.c.VideoEncoderPrivateOptions
+		if (video.Codec == entities.VP9 || video.Codec == entities.AV1) && d.c.VideoScalabilityMode != "" {
+			if err := CheckScalabilityMode(video.Codec, d.c.VideoScalabilityMode); err != nil {
+				return nil, err
+			}
+			video.ScalabilityMode = d.c.VideoScalabilityMode
+		}
+		if d.c.WatermarkPath != "" {
+			video.DonutStreamFilter = entities.OverlayFilter(video.DonutStreamFilter, entities.DonutOverlay{
+				ImagePath: d.c.WatermarkPath,
+				X:         d.c.WatermarkX,
+				Y:         d.c.WatermarkY,
+				Opacity:   d.c.WatermarkOpacity,
+			})
+		}
+	}
+
+	sampleRate := d.c.AudioSampleRate
+	if d.req.AudioSampleRate > 0 {
+		sampleRate = d.req.AudioSampleRate
+	}
+	if !entities.IsOpusSampleRate(sampleRate) {
+		return nil, fmt.Errorf("%w: %d", entities.ErrInvalidAudioSampleRate, sampleRate)
+	}
+	if !entities.IsOpusPtime(d.c.AudioPtimeMS) {
+		return nil, fmt.Errorf("%w: %d", entities.ErrInvalidAudioPtime, d.c.AudioPtimeMS)
+	}
+	if !d.c.AudioFormatChange.Valid() {
+		return nil, fmt.Errorf("%w: %s", entities.ErrInvalidAudioFormatChange, d.c.AudioFormatChange)
+	}
+	audioFilter := entities.AudioResamplerFilter(sampleRate)
+	loudness := d.c.AudioLoudnessLUFS
+	if d.req.AudioLoudnessLUFS != 0 {
+		loudness = d.req.AudioLoudnessLUFS
+	}
+	if loudness != 0 {
+		if !entities.IsLoudnessTarget(loudness) {
+			return nil, fmt.Errorf("%w: %g", entities.ErrInvalidLoudnessTarget, loudness)
+		}
+		audioFilter = entities.LoudnormFilter(loudness, audioFilter)
+	}
+	mono := d.c.AudioMono || d.req.AudioMono
+	audioBitRate := int64(128000)
+	channels := 2
+	if mono {
+		channels = 1
+		audioFilter = entities.MonoFilter(audioFilter)
+		audioBitRate = 64000
+	}
+
+	audioStreams := server.AudioStreams()
+	if len(audioStreams) > 0 && d.req.AudioStreamIndex >= len(audioStreams) {
+		return nil, fmt.Errorf("%w: %d of %d", entities.ErrInvalidAudioStreamIndex, d.req.AudioStreamIndex, len(audioStreams))
+	}
+
+	// FLV can't carry Opus, an RTMP relay gets the audio encoded a second time
+	relayURL := entities.RelayURLOf(d.c, d.req)
+	muxerAudioCodec := d.c.MuxerAudioCodec
+	if muxerAudioCodec == "" && entities.IsFLVRelayURL(relayURL) {
+		muxerAudioCodec = entities.AAC
 	}
 
 	r := &entities.DonutRecipe{
 		Input: appetizer,
-		Video: entities.DonutMediaTask{
-			Action:               entities.DonutBypass,
-			Codec:                entities.H264,
-			DonutBitStreamFilter: &entities.DonutH264AnnexB,
-		},
+		Video: video,
 		Audio: entities.DonutMediaTask{
 			Action:            entities.DonutTranscode,
 			Codec:             entities.Opus,
-			DonutStreamFilter: entities.AudioResamplerFilter(48000),
+			StreamIndex:       d.req.AudioStreamIndex,
+			Mono:              mono,
+			MuxerCodec:        muxerAudioCodec,
+			DonutStreamFilter: audioFilter,
+			PtimeMS:           entities.NegotiateAudioPtime(d.c.AudioPtimeMS, d.req.Offer.SDP),
 			CodecContextOptions: []entities.LibAVOptionsCodecContext{
-				entities.SetSampleRate(48000),
-				entities.SetBitRate(128000),
+				entities.SetSampleRate(sampleRate),
+				entities.SetBitRate(audioBitRate),
 				entities.SetSampleFormat("s16"),
 			},
 		},
 	}
 
+	if d.c.AudioOpusPassthrough && loudness == 0 && r.Audio.MuxerCodec == "" && d.c.HLSDir == "" &&
+		d.req.AudioStreamIndex < len(audioStreams) && opusPassthrough(audioStreams[d.req.AudioStreamIndex], sampleRate, channels) {
+		// the source packet duration is kept, whatever the negotiated ptime
+		d.l.Infow("forwarding the source Opus audio", "sample_rate", sampleRate, "channels", channels)
+		r.Audio = entities.DonutMediaTask{
+			Action:      entities.DonutBypass,
+			Codec:       entities.Opus,
+			StreamIndex: d.req.AudioStreamIndex,
+		}
+	}
+
+	// the answer only has the tracks of the media offered by the client, ex: an audio-only offer of a stream with video
+	for _, media := range []struct {
+		mediaType entities.MediaType
+		task      *entities.DonutMediaTask
+	}{{entities.VideoType, &r.Video}, {entities.AudioType, &r.Audio}} {
+		streamed, err := OfferedMedia(server, client, media.mediaType, d.c.OfferMissingMedia)
+		if err != nil {
+			return nil, err
+		}
+		if !streamed {
+			d.l.Infow("not streaming the media", "media_type", media.mediaType)
+			*media.task = entities.DonutMediaTask{Action: entities.DonutDrop}
+		}
+	}
+
+	// failing before answering the client, the streamer would only fail after it
+	if err := d.ensureEncoder(r.Video); err != nil {
+		return nil, err
+	}
+	// the video is still served without an audio encoder (ex: ffmpeg built without libopus)
+	if err := d.ensureEncoder(r.Audio); err != nil {
+		var notFound *entities.EncoderNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, err
+		}
+		r.Audio = d.audioFallback(server, client, d.req.AudioStreamIndex, err)
+		r.Warnings = append(r.Warnings, audioFallbackWarning(r.Audio, err))
+	}
+	for _, muxerCodec := range []entities.Codec{r.Video.MuxerCodec, r.Audio.MuxerCodec} {
+		if muxerCodec == "" {
+			continue
+		}
+		if err := d.ensureEncoder(entities.DonutMediaTask{Action: entities.DonutTranscode, Codec: muxerCodec}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := playableBy(client, entities.VideoType, r.Video.Codec); r.Video.Action != entities.DonutDrop && err != nil {
+		return nil, err
+	}
+	if err := playableBy(client, entities.AudioType, r.Audio.Codec); r.Audio.Action != entities.DonutDrop && err != nil {
+		r.Audio = d.audioFallback(server, client, d.req.AudioStreamIndex, err)
+		r.Warnings = append(r.Warnings, audioFallbackWarning(r.Audio, err))
+	}
+	if r.Video.Action == entities.DonutDrop && r.Audio.Action == entities.DonutDrop {
+		return nil, fmt.Errorf("no media to stream: %w", entities.ErrMissingCompatibleStreams)
+	}
+	// ex: the source Opus bypassed by the fallback, the relay would only fail once the stream started
+	if entities.IsFLVRelayURL(relayURL) && r.Audio.Action == entities.DonutBypass && r.Audio.Codec == entities.Opus {
+		return nil, fmt.Errorf("relaying to %s: %w", entities.RedactURL(relayURL), entities.ErrRelayAudioCodec)
+	}
+
 	return r, nil
 }
 
+// audioFallback bypasses the selected source audio when the client plays it, otherwise the audio
+// is dropped rather than negotiating a track the client can't decode.
+func (d *donutEngine) audioFallback(server, client *entities.StreamInfo, streamIndex int, reason error) entities.DonutMediaTask {
+	if audioStreams := server.AudioStreams(); streamIndex < len(audioStreams) {
+		source := audioStreams[streamIndex]
+		if client.Plays(entities.AudioType, source.Codec) {
+			d.l.Warnw("bypassing the source audio", "codec", source.Codec, "reason", reason)
+			return entities.DonutMediaTask{
+				Action:      entities.DonutBypass,
+				Codec:       source.Codec,
+				StreamIndex: streamIndex,
+			}
+		}
+	}
+	d.l.Warnw("dropping the audio", "reason", reason)
+	return entities.DonutMediaTask{Action: entities.DonutDrop}
+}
+
+// audioFallbackWarning tells the client how the audio fallback degraded the audio.
+func audioFallbackWarning(task entities.DonutMediaTask, reason error) string {
+	if task.Action == entities.DonutDrop {
+		return fmt.Sprintf("the audio is unavailable: %s", reason.Error())
+	}
+	return fmt.Sprintf("the source %s audio is forwarded without transcoding: %s", task.Codec, reason.Error())
+}
+
+func (d *donutEngine) videoDecoderOptions() []entities.LibAVOptionsCodecContext {
+	var options []entities.LibAVOptionsCodecContext
+	if d.c.DecoderLowDelay {
+		options = append(options, entities.SetLowDelay())
+	}
+	if d.c.DecoderThreads > 0 {
+		options = append(options, entities.SetThreadCount(d.c.DecoderThreads))
+	}
+	return options
+}
+
+func (d *donutEngine) ensureEncoder(task entities.DonutMediaTask) error {
+	if task.Action != entities.DonutTranscode {
+		return nil
+	}
+	codecID, err := d.mapper.FromStreamCodecToLibAVCodecID(task.Codec)
+	if err != nil {
+		return err
+	}
+	encoder := astiav.FindEncoder(codecID)
+	if encoder == nil {
+		return entities.NewEncoderNotFoundError(task.Codec)
+	}
+	if task.PixelFormat != "" {
+		if _, err := entities.EncoderPixelFormat(encoder, task.PixelFormat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// playableBy checks whether the client advertised the output codec,
+// a client without advertised streams is assumed to accept anything.
+func playableBy(client *entities.StreamInfo, mediaType entities.MediaType, codec entities.Codec) error {
+	if client.Plays(mediaType, codec) {
+		return nil
+	}
+	return fmt.Errorf("client does not support %s %s: %w", mediaType, codec, entities.ErrMissingCompatibleStreams)
+}
+
+// negotiable tells whether the handler's media engine registers the video codec, a client may offer
+// codecs it doesn't (ex: H265).
+func (d *donutEngine) negotiable(codec entities.Codec) bool {
+	if len(d.req.VideoCodecs) == 0 {
+		return true
+	}
+	for _, c := range d.req.VideoCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *donutEngine) Appetizer() (entities.DonutAppetizer, error) {
+	appetizer, err := d.sourceAppetizer()
+	if err != nil {
+		return appetizer, err
+	}
+	for k, v := range ProbeOptions(d.c, d.req.FastProbe) {
+		if appetizer.Options == nil {
+			appetizer.Options = map[entities.DonutInputOptionKey]string{}
+		}
+		appetizer.Options[k] = v
+	}
+	return appetizer, nil
+}
+
+func (d *donutEngine) sourceAppetizer() (entities.DonutAppetizer, error) {
 	isRTMP := strings.Contains(strings.ToLower(d.req.StreamURL), "rtmp")
 	isSRT := strings.Contains(strings.ToLower(d.req.StreamURL), "srt")
+	isPipe := entities.IsPipeURL(d.req.StreamURL)
+	manifestFormat := entities.ManifestFormat(d.req.StreamURL)
+
+	if isPipe {
+		return entities.DonutAppetizer{
+			URL:    d.req.StreamURL,
+			Format: "mpegts",
+			Reader: stdin,
+		}, nil
+	}
+
+	// checked before RTMP/SRT, the url of a manifest might contain any of those words
+	if manifestFormat == entities.DonutHLSFormat {
+		return entities.DonutAppetizer{
+			URL: d.req.StreamURL,
+			Options: map[entities.DonutInputOptionKey]string{
+				entities.DonutHLSLiveStartIndex: strconv.Itoa(d.c.HLSLiveStartIndex),
+				entities.DonutHTTPPersistent:    "1",
+			},
+			Format:  entities.DonutHLSFormat,
+			StartAt: time.Duration(d.req.StartAtMS) * time.Millisecond,
+		}, nil
+	}
+
+	if manifestFormat == entities.DonutDASHFormat {
+		return entities.DonutAppetizer{
+			URL:     d.req.StreamURL,
+			Format:  entities.DonutDASHFormat,
+			StartAt: time.Duration(d.req.StartAtMS) * time.Millisecond,
+		}, nil
+	}
 
 	if isRTMP {
 		return entities.DonutAppetizer{
@@ -139,14 +527,25 @@ func (d *donutEngine) Appetizer() (entities.DonutAppetizer, error) {
 	}
 
 	if isSRT {
+		readBufferSize := d.c.SRTReadBufferSizeBytes
+		if d.req.SRTReadBufferSizeBytes > 0 {
+			readBufferSize = d.req.SRTReadBufferSizeBytes
+		}
+		readStrategy := d.c.SRTReadStrategy
+		if d.req.SRTReadStrategy != "" {
+			readStrategy = d.req.SRTReadStrategy
+		}
+
+		// there's no format, SRT might carry something other than MPEG-TS and the prober discovers it
 		return entities.DonutAppetizer{
-			URL:    d.req.StreamURL,
-			Format: "mpegts", // TODO: check how to get format for srt
+			URL: d.req.StreamURL,
 			Options: map[entities.DonutInputOptionKey]string{
-				entities.DonutSRTStreamID:  d.req.StreamID,
-				entities.DonutSRTTranstype: "live",
-				entities.DonutSRTsmoother:  "live",
+				entities.DonutSRTStreamID:    d.req.SRTAccessControlStreamID(),
+				entities.DonutSRTTranstype:   "live",
+				entities.DonutSRTsmoother:    "live",
+				entities.DonutSRTPayloadSize: strconv.Itoa(readBufferSize),
 			},
+			ReadStrategy: readStrategy,
 		}, nil
 	}
 
@@ -0,0 +1,192 @@
+package engine_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/controllers/engine"
+	"github.com/flavioribeiro/donut/internal/controllers/probers"
+	"github.com/flavioribeiro/donut/internal/controllers/streamers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type matchAll struct{}
+
+func (matchAll) Match(*entities.RequestParams) bool { return true }
+
+func (matchAll) StreamInfo(entities.DonutAppetizer) (*entities.StreamInfo, error) { return nil, nil }
+
+func (matchAll) Stream(*entities.DonutParameters) {}
+
+func newTestEngine(t *testing.T, c *entities.Config, req *entities.RequestParams) engine.DonutEngine {
+	l := zap.NewNop().Sugar()
+	controller, err := engine.NewDonutEngineController(engine.DonutEngineParams{
+		Streamers: []streamers.DonutStreamer{matchAll{}},
+		Probers:   []probers.DonutProber{matchAll{}},
+		Mapper:    mapper.NewMapper(l),
+		Config:    c,
+		Logger:    l,
+	})
+	require.NoError(t, err)
+	e, err := controller.EngineFor(req)
+	require.NoError(t, err)
+	return e
+}
+
+func newTestConfig() *entities.Config {
+	return &entities.Config{
+		AudioSampleRate:        48000,
+		AudioPtimeMS:           20,
+		AudioFormatChange:      entities.AudioFormatChangeReconfigure,
+		AudioOpusPassthrough:   true,
+		TimestampDiscontinuity: entities.TimestampDiscontinuityReset,
+		OfferMissingMedia:      entities.OfferMissingMediaOmit,
+		SRTReadStrategy:        entities.DonutReadBlocking,
+		SRTReadBufferSizeBytes: 1316,
+		SRTPollIntervalMS:      5,
+	}
+}
+
+func TestRecipeForOpusPassthrough(t *testing.T) {
+	server := &entities.StreamInfo{Streams: []entities.Stream{
+		{Type: entities.VideoType, Codec: entities.H264},
+		{Type: entities.AudioType, Codec: entities.Opus, SampleRate: 48000, Channels: 2},
+	}}
+	client := &entities.StreamInfo{Streams: []entities.Stream{
+		{Type: entities.VideoType, Codec: entities.H264},
+		{Type: entities.AudioType, Codec: entities.Opus},
+	}}
+	req := &entities.RequestParams{StreamURL: "rtmp://localhost/live", StreamID: "live"}
+
+	recipe, err := newTestEngine(t, newTestConfig(), req).RecipeFor(server, client)
+	require.NoError(t, err)
+	assert.Equal(t, entities.DonutBypass, recipe.Audio.Action)
+	assert.Equal(t, entities.Opus, recipe.Audio.Codec)
+	// the source packets are forwarded as they are, the answer advertises no ptime
+	assert.Zero(t, recipe.Audio.PtimeMS)
+
+	// downmixing to mono, resampling or an unknown format needs the encoder
+	for name, source := range map[string]entities.Stream{
+		"mono":     {Type: entities.AudioType, Codec: entities.Opus, SampleRate: 48000, Channels: 1},
+		"resample": {Type: entities.AudioType, Codec: entities.Opus, SampleRate: 24000, Channels: 2},
+		"unknown":  {Type: entities.AudioType, Codec: entities.Opus},
+	} {
+		server.Streams[1] = source
+		recipe, err := newTestEngine(t, newTestConfig(), req).RecipeFor(server, client)
+		require.NoError(t, err, name)
+		assert.Equal(t, entities.DonutTranscode, recipe.Audio.Action, name)
+		assert.Equal(t, 20, recipe.Audio.PtimeMS, name)
+	}
+}
+
+// TestRecipeForAudioFallback streams the source audio when the client doesn't play the Opus answer, the
+// client is warned about the degraded audio.
+func TestRecipeForAudioFallback(t *testing.T) {
+	server := &entities.StreamInfo{Streams: []entities.Stream{
+		{Type: entities.VideoType, Codec: entities.H264},
+		{Type: entities.AudioType, Codec: entities.AAC, SampleRate: 44100, Channels: 2},
+	}}
+	client := &entities.StreamInfo{Streams: []entities.Stream{
+		{Type: entities.VideoType, Codec: entities.H264},
+		{Type: entities.AudioType, Codec: entities.AAC},
+	}}
+	req := &entities.RequestParams{StreamURL: "rtmp://localhost/live", StreamID: "live"}
+
+	recipe, err := newTestEngine(t, newTestConfig(), req).RecipeFor(server, client)
+	require.NoError(t, err)
+	assert.Equal(t, entities.DonutBypass, recipe.Audio.Action)
+	assert.Equal(t, entities.AAC, recipe.Audio.Codec)
+	require.Len(t, recipe.Warnings, 1)
+	assert.Contains(t, recipe.Warnings[0], "forwarded without transcoding")
+
+	// the audio is dropped when the client doesn't play the source either
+	client.Streams = client.Streams[:1]
+	recipe, err = newTestEngine(t, newTestConfig(), req).RecipeFor(server, client)
+	require.NoError(t, err)
+	assert.Equal(t, entities.DonutDrop, recipe.Audio.Action)
+	require.Len(t, recipe.Warnings, 1)
+	assert.Contains(t, recipe.Warnings[0], "the audio is unavailable")
+}
+
+func TestRecipeForHDRPassthrough(t *testing.T) {
+	server := &entities.StreamInfo{Streams: []entities.Stream{
+		{Type: entities.VideoType, Codec: entities.H265, HDR: true},
+		{Type: entities.AudioType, Codec: entities.AAC, SampleRate: 48000, Channels: 2},
+	}}
+	client := &entities.StreamInfo{Streams: []entities.Stream{
+		{Type: entities.VideoType, Codec: entities.H265},
+		{Type: entities.VideoType, Codec: entities.H264},
+		{Type: entities.AudioType, Codec: entities.Opus},
+	}}
+	c := newTestConfig()
+	c.HDRPassthrough = true
+	c.RecipeRules = []string{"h265=transcode:h264"}
+
+	req := &entities.RequestParams{StreamURL: "rtmp://localhost/live", StreamID: "live"}
+	recipe, err := newTestEngine(t, c, req).RecipeFor(server, client)
+	require.NoError(t, err)
+	assert.Equal(t, entities.DonutBypass, recipe.Video.Action)
+	assert.Equal(t, entities.H265, recipe.Video.Codec)
+
+	// the client offers H265 but the handler can't negotiate it
+	req.VideoCodecs = []entities.Codec{entities.H264, entities.VP8, entities.VP9, entities.AV1}
+	recipe, err = newTestEngine(t, c, req).RecipeFor(server, client)
+	require.NoError(t, err)
+	assert.Equal(t, entities.DonutTranscode, recipe.Video.Action)
+	assert.Equal(t, entities.H264, recipe.Video.Codec)
+	assert.True(t, recipe.Video.PreserveColor)
+}
+
+func TestAppetizerStartAt(t *testing.T) {
+	for _, url := range []string{"https://cdn.example.com/vod/index.m3u8", "https://cdn.example.com/vod/manifest.mpd?token=abc"} {
+		req := &entities.RequestParams{StreamURL: url, StreamID: "vod", StartAtMS: 90000}
+		require.NoError(t, req.Valid(), url)
+
+		appetizer, err := newTestEngine(t, newTestConfig(), req).Appetizer()
+		require.NoError(t, err, url)
+		assert.Equal(t, 90*time.Second, appetizer.StartAt, url)
+	}
+
+	// a live source can't be sought
+	req := &entities.RequestParams{StreamURL: "srt://localhost:40052", StreamID: "live", StartAtMS: 90000}
+	assert.ErrorIs(t, req.Valid(), entities.ErrUnseekableInput)
+	req = &entities.RequestParams{StreamURL: "https://cdn.example.com/vod/index.m3u8", StreamID: "vod", StartAtMS: -1}
+	assert.ErrorIs(t, req.Valid(), entities.ErrInvalidStartAt)
+}
+
+func TestNewDonutEngineControllerFallbackRetry(t *testing.T) {
+	for _, retry := range []int{0, -1} {
+		c := newTestConfig()
+		c.FallbackTestPattern = true
+		c.FallbackRetryMS = retry
+		c.FallbackProbeTimeoutMS = 3000
+		l := zap.NewNop().Sugar()
+		_, err := engine.NewDonutEngineController(engine.DonutEngineParams{Mapper: mapper.NewMapper(l), Config: c, Logger: l})
+
+		assert.ErrorIs(t, err, entities.ErrInvalidFallbackRetry, retry)
+	}
+}
+
+func TestNewDonutEngineControllerSRTPolling(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	newController := func(c *entities.Config) error {
+		_, err := engine.NewDonutEngineController(engine.DonutEngineParams{Mapper: mapper.NewMapper(l), Config: c, Logger: l})
+		return err
+	}
+
+	c := newTestConfig()
+	c.SRTPollIntervalMS = 0
+	assert.ErrorIs(t, newController(c), entities.ErrInvalidSRTPollInterval)
+
+	c = newTestConfig()
+	c.SRTReadBufferSizeBytes = 1504
+	assert.ErrorIs(t, newController(c), entities.ErrInvalidSRTReadBufferSize)
+
+	c = newTestConfig()
+	c.SRTReadStrategy = "epoll"
+	assert.ErrorIs(t, newController(c), entities.ErrInvalidReadStrategy)
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// testPatternGraph generates color bars and a 1kHz tone, paced in real time since lavfi
+// sources produce frames as fast as they're read.
+const testPatternGraph = "smptebars=size=1280x720:rate=30,realtime[out0];" +
+	"sine=frequency=1000:sample_rate=48000,arealtime[out1]"
+
+func testPatternAppetizer() entities.DonutAppetizer {
+	return entities.DonutAppetizer{
+		URL:    testPatternGraph,
+		Format: entities.DonutLavfiFormat,
+	}
+}
+
+func testPatternStreamInfo() *entities.StreamInfo {
+	return &entities.StreamInfo{
+		Format: entities.DonutLavfiFormat,
+		Streams: []entities.Stream{
+			{Type: entities.VideoType, Codec: entities.UnknownCodec, Index: 0},
+			{Type: entities.AudioType, Codec: entities.UnknownCodec, Index: 1},
+		},
+	}
+}
+
+// testPatternVideoTask transcodes the raw pattern to the first codec the client plays.
+func testPatternVideoTask(client *entities.StreamInfo) entities.DonutMediaTask {
+	codec := entities.H264
+	for _, c := range []entities.Codec{entities.H264, entities.VP8, entities.VP9} {
+		if playableBy(client, entities.VideoType, c) == nil {
+			codec = c
+			break
+		}
+	}
+
+	task := entities.DonutMediaTask{
+		Action: entities.DonutTranscode,
+		Codec:  codec,
+	}
+	if codec == entities.H264 {
+		task.CodecContextOptions = []entities.LibAVOptionsCodecContext{
+			entities.SetBaselineProfile(),
+		}
+	}
+	return task
+}
+
+// probe bounds how long an SRT listener waits for the encoder when falling back is possible,
+// otherwise an absent encoder blocks the probing forever.
+func (d *donutEngine) probe(appetizer entities.DonutAppetizer) (*entities.StreamInfo, error) {
+	isSRTListener := strings.Contains(strings.ToLower(appetizer.URL), "srt://") && !entities.IsSRTCallerURL(appetizer.URL)
+	if d.c.FallbackTestPattern && isSRTListener {
+		options := map[entities.DonutInputOptionKey]string{}
+		for k, v := range appetizer.Options {
+			options[k] = v
+		}
+		// microseconds
+		options[entities.DonutSRTListenTimeout] = strconv.Itoa(d.c.FallbackProbeTimeoutMS * 1000)
+		appetizer.Options = options
+	}
+	return d.prober.StreamInfo(appetizer)
+}
+
+// serveFallback streams the test pattern until the source comes up, then it switches to the live media.
+// The pattern isn't written to the muxers, the recording starts with the live media.
+func (d *donutEngine) serveFallback(p *entities.DonutParameters) {
+	ctx, cancel := context.WithCancel(p.Ctx)
+	defer cancel()
+
+	pattern := *p
+	pattern.Ctx = ctx
+	pattern.Cancel = cancel
+	pattern.Sinks = nil
+	for _, sink := range p.Sinks {
+		if _, ok := sink.(entities.DonutMuxer); !ok {
+			pattern.Sinks = append(pattern.Sinks, sink)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.streamer.Stream(&pattern)
+	}()
+
+	recipe := d.waitForSource(ctx, &p.Recipe)
+	cancel()
+	<-done
+	if recipe == nil {
+		return
+	}
+
+	live := *p
+	live.Recipe = *recipe
+	d.streamer.Stream(&live)
+}
+
+// waitForSource probes the source every Config.FallbackRetryMS, it returns the live recipe
+// or nil when the context is done first.
+func (d *donutEngine) waitForSource(ctx context.Context, pattern *entities.DonutRecipe) *entities.DonutRecipe {
+	ticker := time.NewTicker(time.Duration(d.c.FallbackRetryMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		appetizer, err := d.Appetizer()
+		if err != nil {
+			return nil
+		}
+		server, err := d.probe(appetizer)
+		if err != nil {
+			continue
+		}
+		client, err := d.ClientIngredients()
+		if err != nil {
+			continue
+		}
+		recipe, err := d.RecipeFor(server, client)
+		if err != nil {
+			continue
+		}
+		// the WebRTC tracks were negotiated for the pattern codec and its baseline profile fmtp, a bypassed
+		// source of the same codec may carry another profile, so the live video keeps the pattern transcoding.
+		if recipe.Video.Codec != pattern.Video.Codec || recipe.Video.Action != entities.DonutTranscode {
+			recipe.Video = pattern.Video
+		}
+		return recipe
+	}
+}
@@ -0,0 +1,22 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// OfferedMedia tells whether the media is streamed to the client, both the source provides it and the client
+// offered an m-line for it. The mode decides between omitting and rejecting a media missing from the offer.
+func OfferedMedia(server, client *entities.StreamInfo, mediaType entities.MediaType, mode entities.OfferMissingMedia) (bool, error) {
+	if !server.Has(mediaType) {
+		return false, nil
+	}
+	if client.Has(mediaType) {
+		return true, nil
+	}
+	if mode == entities.OfferMissingMediaReject {
+		return false, fmt.Errorf("%w: %s", entities.ErrMissingOfferedMedia, mediaType)
+	}
+	return false, nil
+}
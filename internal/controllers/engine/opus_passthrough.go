@@ -0,0 +1,9 @@
+package engine
+
+import "github.com/flavioribeiro/donut/internal/entities"
+
+// opusPassthrough tells whether the source audio is already the Opus the viewers would get, then
+// resampling and encoding it again is pure overhead. Unknown sample rates or channels never match.
+func opusPassthrough(source entities.Stream, sampleRate, channels int) bool {
+	return source.Codec == entities.Opus && source.SampleRate == sampleRate && source.Channels == channels
+}
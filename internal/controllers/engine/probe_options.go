@@ -0,0 +1,39 @@
+package engine
+
+import (
+	"strconv"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// fastProbeSizeBytes and fastProbeAnalyzeDurationMS are enough for the PMT and the first key frame
+// of a regular MPEG-TS or FLV source.
+const (
+	fastProbeSizeBytes         = 64 * 1024
+	fastProbeAnalyzeDurationMS = 500
+)
+
+// ProbeOptions returns the input options bounding how much of the source FindStreamInfo reads, empty keeps
+// the libav defaults. The configured sizes take precedence over the fast probe ones.
+func ProbeOptions(c *entities.Config, fast bool) map[entities.DonutInputOptionKey]string {
+	probeSize, analyzeDurationMS := c.ProbeSizeBytes, c.ProbeAnalyzeDurationMS
+	options := map[entities.DonutInputOptionKey]string{}
+	if fast || c.FastProbe {
+		if probeSize <= 0 {
+			probeSize = fastProbeSizeBytes
+		}
+		if analyzeDurationMS <= 0 {
+			analyzeDurationMS = fastProbeAnalyzeDurationMS
+		}
+		// the frame rate is guessed from the timestamps instead
+		options[entities.DonutFPSProbeSize] = "0"
+	}
+	if probeSize > 0 {
+		options[entities.DonutProbeSize] = strconv.Itoa(probeSize)
+	}
+	if analyzeDurationMS > 0 {
+		// in microseconds
+		options[entities.DonutAnalyzeDuration] = strconv.Itoa(analyzeDurationMS * 1000)
+	}
+	return options
+}
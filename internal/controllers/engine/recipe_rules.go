@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+const anyCodec = "*"
+
+// ParseRecipeRules parses rules following the syntax [format/]codec=action[:codec]
+// ex: "mpegts/h265=transcode:h264", "h264=bypass", "*=transcode:h264"
+func ParseRecipeRules(rules []string) ([]entities.DonutRecipeRule, error) {
+	var result []entities.DonutRecipeRule
+	for _, raw := range rules {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		rule, err := parseRecipeRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func parseRecipeRule(raw string) (entities.DonutRecipeRule, error) {
+	rule := entities.DonutRecipeRule{}
+
+	source, task, found := strings.Cut(raw, "=")
+	if !found {
+		return rule, fmt.Errorf("%w %q: missing '='", entities.ErrInvalidRecipeRule, raw)
+	}
+
+	if format, codec, hasFormat := strings.Cut(source, "/"); hasFormat {
+		rule.Format = entities.DonutInputFormat(strings.ToLower(format))
+		source = codec
+	}
+	if source != anyCodec {
+		rule.Codec = entities.Codec(strings.ToLower(source))
+	}
+
+	action, target, _ := strings.Cut(task, ":")
+	rule.Action = entities.DonutMediaTaskAction(strings.ToLower(action))
+	rule.TargetCodec = entities.Codec(strings.ToLower(target))
+
+	switch rule.Action {
+	case entities.DonutBypass:
+		if rule.TargetCodec != "" {
+			return rule, fmt.Errorf("%w %q: bypass does not accept a target codec", entities.ErrInvalidRecipeRule, raw)
+		}
+	case entities.DonutTranscode:
+		if rule.TargetCodec == "" {
+			return rule, fmt.Errorf("%w %q: transcode requires a target codec", entities.ErrInvalidRecipeRule, raw)
+		}
+	default:
+		return rule, fmt.Errorf("%w %q: unknown action %s", entities.ErrInvalidRecipeRule, raw, action)
+	}
+
+	return rule, nil
+}
+
+// videoTaskFor builds the video task for the source codec according to the first matching rule,
+// it returns false when no rule matches.
+func videoTaskFor(rules []entities.DonutRecipeRule, format entities.DonutInputFormat, codec entities.Codec) (entities.DonutMediaTask, bool) {
+	for _, rule := range rules {
+		if !rule.Match(format, codec) {
+			continue
+		}
+
+		if rule.Action == entities.DonutBypass {
+			return bypassVideoTask(codec), true
+		}
+		return transcodeVideoTask(rule.TargetCodec), true
+	}
+	return entities.DonutMediaTask{}, false
+}
+
+func transcodeVideoTask(codec entities.Codec) entities.DonutMediaTask {
+	task := entities.DonutMediaTask{
+		Action: entities.DonutTranscode,
+		Codec:  codec,
+	}
+	if codec == entities.H264 {
+		task.CodecContextOptions = []entities.LibAVOptionsCodecContext{
+			entities.SetBaselineProfile(),
+		}
+	}
+	return task
+}
+
+func bypassVideoTask(codec entities.Codec) entities.DonutMediaTask {
+	task := entities.DonutMediaTask{
+		Action: entities.DonutBypass,
+		Codec:  codec,
+	}
+	if codec == entities.H264 {
+		task.DonutBitStreamFilters = []entities.DonutBitStreamFilter{entities.DonutH264AnnexB}
+	} else if codec == entities.H265 {
+		task.DonutBitStreamFilters = []entities.DonutBitStreamFilter{entities.DonutH265AnnexB}
+	}
+	return task
+}
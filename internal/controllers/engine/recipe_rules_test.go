@@ -0,0 +1,86 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/controllers/engine"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRecipeRules(t *testing.T) {
+	rules, err := engine.ParseRecipeRules([]string{"mpegts/h265=transcode:h264", "h264=bypass", "*=transcode:vp8"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []entities.DonutRecipeRule{
+		{Format: "mpegts", Codec: entities.H265, Action: entities.DonutTranscode, TargetCodec: entities.H264},
+		{Codec: entities.H264, Action: entities.DonutBypass},
+		{Action: entities.DonutTranscode, TargetCodec: entities.VP8},
+	}, rules)
+}
+
+func TestParseRecipeRules_Invalid(t *testing.T) {
+	for _, rule := range []string{"h264", "h264=transcode", "h264=bypass:h265", "h264=drop"} {
+		_, err := engine.ParseRecipeRules([]string{rule})
+
+		assert.ErrorIs(t, err, entities.ErrInvalidRecipeRule, rule)
+	}
+}
+
+func TestResolutionHeight(t *testing.T) {
+	fullHD := entities.Stream{Codec: entities.H264, Type: entities.VideoType, Width: 1920, Height: 1080}
+
+	assert.Equal(t, 480, engine.ResolutionHeight(entities.Resolution480p, fullHD))
+	assert.Equal(t, 0, engine.ResolutionHeight(entities.Resolution1080p, fullHD), "same height")
+	assert.Equal(t, 0, engine.ResolutionHeight(entities.Resolution720p, entities.Stream{Height: 480}), "upscaling")
+	assert.Equal(t, 0, engine.ResolutionHeight(entities.ResolutionAuto, fullHD))
+	assert.Equal(t, 0, engine.ResolutionHeight("", fullHD))
+	assert.Equal(t, 360, engine.ResolutionHeight(entities.Resolution360p, entities.Stream{}), "unknown source height")
+}
+
+func TestProbeOptions(t *testing.T) {
+	assert.Empty(t, engine.ProbeOptions(&entities.Config{}, false))
+
+	assert.Equal(t, map[entities.DonutInputOptionKey]string{
+		entities.DonutProbeSize:       "65536",
+		entities.DonutAnalyzeDuration: "500000",
+		entities.DonutFPSProbeSize:    "0",
+	}, engine.ProbeOptions(&entities.Config{}, true))
+
+	assert.Equal(t, map[entities.DonutInputOptionKey]string{
+		entities.DonutProbeSize:       "32768",
+		entities.DonutAnalyzeDuration: "500000",
+		entities.DonutFPSProbeSize:    "0",
+	}, engine.ProbeOptions(&entities.Config{FastProbe: true, ProbeSizeBytes: 32768}, false), "the configured size wins")
+
+	assert.Equal(t, map[entities.DonutInputOptionKey]string{
+		entities.DonutAnalyzeDuration: "2000000",
+	}, engine.ProbeOptions(&entities.Config{ProbeAnalyzeDurationMS: 2000}, false))
+}
+
+func TestOfferedMedia(t *testing.T) {
+	server := &entities.StreamInfo{Streams: []entities.Stream{
+		{Codec: entities.H264, Type: entities.VideoType},
+		{Codec: entities.AAC, Type: entities.AudioType},
+	}}
+	audioOnly := &entities.StreamInfo{Streams: []entities.Stream{{Codec: entities.Opus, Type: entities.AudioType}}}
+
+	streamed, err := engine.OfferedMedia(server, audioOnly, entities.AudioType, entities.OfferMissingMediaOmit)
+	assert.Nil(t, err)
+	assert.True(t, streamed)
+
+	streamed, err = engine.OfferedMedia(server, audioOnly, entities.VideoType, entities.OfferMissingMediaOmit)
+	assert.Nil(t, err)
+	assert.False(t, streamed, "omitted from the offer")
+
+	_, err = engine.OfferedMedia(server, audioOnly, entities.VideoType, entities.OfferMissingMediaReject)
+	assert.ErrorIs(t, err, entities.ErrMissingOfferedMedia)
+
+	streamed, err = engine.OfferedMedia(&entities.StreamInfo{Streams: audioOnly.Streams}, server, entities.VideoType, entities.OfferMissingMediaReject)
+	assert.Nil(t, err)
+	assert.False(t, streamed, "missing from the source")
+
+	streamed, err = engine.OfferedMedia(server, &entities.StreamInfo{}, entities.VideoType, entities.OfferMissingMediaReject)
+	assert.Nil(t, err)
+	assert.True(t, streamed, "offer without advertised streams")
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// stdin is the source of the pipe inputs, it's read once by the prober then by the streamer.
+var stdin = NewReplayReader(os.Stdin)
+
+// ReplayReader replays to its readers the bytes the prober consumed from a source that can't be
+// reopened (ex: stdin), the stream would otherwise miss its beginning (ex: the first keyframe).
+type ReplayReader struct {
+	mu     sync.Mutex
+	source io.Reader
+	// probed are the bytes read through Probing, not read yet through Read
+	probed []byte
+}
+
+func NewReplayReader(source io.Reader) *ReplayReader {
+	return &ReplayReader{source: source}
+}
+
+// Read returns the probed bytes first, then the source ones.
+func (r *ReplayReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.probed) > 0 {
+		n := copy(p, r.probed)
+		r.probed = r.probed[n:]
+		return n, nil
+	}
+	return r.source.Read(p)
+}
+
+// Probing returns a reader of the source keeping what it reads for Read.
+func (r *ReplayReader) Probing() io.Reader {
+	return probingReader{r}
+}
+
+type probingReader struct {
+	r *ReplayReader
+}
+
+func (p probingReader) Read(b []byte) (int, error) {
+	p.r.mu.Lock()
+	defer p.r.mu.Unlock()
+	n, err := p.r.source.Read(b)
+	p.r.probed = append(p.r.probed, b[:n]...)
+	return n, err
+}
@@ -0,0 +1,25 @@
+package engine_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/controllers/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayReader(t *testing.T) {
+	r := engine.NewReplayReader(strings.NewReader("0123456789"))
+
+	probed := make([]byte, 4)
+	_, err := io.ReadFull(r.Probing(), probed)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(probed))
+
+	// the streamer reads the source from its beginning
+	streamed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(streamed))
+}
@@ -0,0 +1,23 @@
+package engine
+
+import "github.com/flavioribeiro/donut/internal/entities"
+
+// ResolutionHeight returns the height the source video is scaled down to for the preset, 0 keeps the source
+// resolution: auto or a preset at least as tall as the source. Unknown source heights are clamped by the streamer.
+func ResolutionHeight(preset entities.ResolutionPreset, source entities.Stream) int {
+	height := preset.Height()
+	if source.Height > 0 && source.Height <= height {
+		return 0
+	}
+	return height
+}
+
+// scalableVideoCodec is the codec a bypassed video is transcoded to for scaling, the same one when
+// the WebRTC encoders produce it, H264 otherwise (ex: H265).
+func scalableVideoCodec(codec entities.Codec) entities.Codec {
+	switch codec {
+	case entities.H264, entities.VP8, entities.VP9, entities.AV1:
+		return codec
+	}
+	return entities.H264
+}
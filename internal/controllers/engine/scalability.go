@@ -0,0 +1,17 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// CheckScalabilityMode fails when the encoder of the codec can't produce the layers of the mode: the libvpx
+// wrapper (VP9) exposes the temporal layers, the AV1 ones none, though a single layer (L1T1) needs nothing.
+func CheckScalabilityMode(codec entities.Codec, mode entities.ScalabilityMode) error {
+	layers := mode.TemporalLayers()
+	if layers == 0 || (layers > 1 && codec != entities.VP9) {
+		return fmt.Errorf("%w %s for %s", entities.ErrUnsupportedScalabilityMode, mode, codec)
+	}
+	return nil
+}
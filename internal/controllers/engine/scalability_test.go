@@ -0,0 +1,19 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/controllers/engine"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckScalabilityMode(t *testing.T) {
+	for _, mode := range []entities.ScalabilityMode{entities.ScalabilityModeL1T1, entities.ScalabilityModeL1T2, entities.ScalabilityModeL1T3} {
+		assert.NoError(t, engine.CheckScalabilityMode(entities.VP9, mode), mode)
+	}
+	assert.NoError(t, engine.CheckScalabilityMode(entities.AV1, entities.ScalabilityModeL1T1))
+
+	assert.ErrorIs(t, engine.CheckScalabilityMode(entities.AV1, entities.ScalabilityModeL1T3), entities.ErrUnsupportedScalabilityMode)
+	assert.ErrorIs(t, engine.CheckScalabilityMode(entities.VP9, "L2T3"), entities.ErrUnsupportedScalabilityMode)
+}
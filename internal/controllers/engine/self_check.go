@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// requiredFilters are used by every transcoding pipeline
+var requiredFilters = []string{"buffer", "buffersink", "abuffer", "abuffersink", "null", "anull", "aresample", "asetnsamples"}
+
+// RegisterSelfCheck verifies, at startup, that the linked ffmpeg provides the encoders, decoders,
+// filters and bit stream filters required by the configured recipes. It fails fast listing what's
+// missing instead of letting sessions fail with cryptic errors.
+func RegisterSelfCheck(lc fx.Lifecycle, c *DonutEngineController, l *zap.SugaredLogger) {
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			missing := c.missingLibAVComponents()
+			if len(missing) > 0 {
+				err := fmt.Errorf("%w: %s", entities.ErrFFmpegLibAVMissingComponents, strings.Join(missing, ", "))
+				l.Errorw("self check failed", "error", err)
+				return err
+			}
+			l.Infow("self check succeeded")
+			return nil
+		},
+	})
+}
+
+func (c *DonutEngineController) missingLibAVComponents() []string {
+	var missing []string
+	m := c.p.Mapper
+
+	encoders := []entities.Codec{entities.Opus}
+	decoders := []entities.Codec{entities.H264, entities.AAC}
+	bsfs := []entities.DonutBitStreamFilter{entities.DonutH264AnnexB}
+	for _, name := range c.p.Config.BypassBitStreamFilters {
+		bsfs = append(bsfs, entities.DonutBitStreamFilter(name))
+	}
+	filters := requiredFilters
+	if c.p.Config.VideoMaxFrameRate > 0 {
+		filters = append(filters, "fps", "settb")
+	}
+	if c.p.Config.WatermarkPath != "" {
+		filters = append(filters, "movie", "format", "colorchannelmixer", "overlay")
+	}
+
+	for _, rule := range c.rules {
+		if rule.Codec != "" {
+			decoders = append(decoders, rule.Codec)
+		}
+		if rule.Action == entities.DonutTranscode {
+			encoders = append(encoders, rule.TargetCodec)
+		}
+		if rule.Action == entities.DonutBypass && rule.Codec == entities.H265 {
+			bsfs = append(bsfs, entities.DonutH265AnnexB)
+		}
+	}
+
+	for _, codec := range encoders {
+		codecID, err := m.FromStreamCodecToLibAVCodecID(codec)
+		if err != nil || astiav.FindEncoder(codecID) == nil {
+			missing = append(missing, fmt.Sprintf("%s encoder not found", codec))
+		}
+	}
+	for _, codec := range decoders {
+		codecID, err := m.FromStreamCodecToLibAVCodecID(codec)
+		if err != nil || astiav.FindDecoder(codecID) == nil {
+			missing = append(missing, fmt.Sprintf("%s decoder not found", codec))
+		}
+	}
+	for _, name := range filters {
+		if astiav.FindFilterByName(name) == nil {
+			missing = append(missing, fmt.Sprintf("%s filter not found", name))
+		}
+	}
+	for _, name := range bsfs {
+		if astiav.FindBitStreamFilterByName(string(name)) == nil {
+			missing = append(missing, fmt.Sprintf("%s bit stream filter not found", name))
+		}
+	}
+	return dedup(missing)
+}
+
+func dedup(values []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
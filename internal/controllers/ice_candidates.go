@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// FilterICECandidates removes, from the local description, the candidates whose type
+// (host, srflx, prflx, relay) or address family (ipv4, ipv6) isn't allowed by the config,
+// ex: a relay-only deployment answering only TURN candidates.
+func FilterICECandidates(c *entities.Config, sdp string) string {
+	types := allowed(c.ICECandidateTypes)
+	families := allowed(c.ICEAddressFamilies)
+
+	lines := strings.Split(sdp, "\r\n")
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidateType, family := describeCandidate(line)
+			if !types[candidateType] || (family != "" && !families[family]) {
+				continue
+			}
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\r\n")
+}
+
+// PreferICEAddressFamily moves the candidates of the family (ipv4 or ipv6) ahead of the others, within each
+// run of candidates, keeping their relative order. Empty leaves the SDP untouched.
+// ex: a dual-stack deployment preferring ipv6 answers its IPv6 candidates first.
+func PreferICEAddressFamily(sdp, family string) string {
+	family = strings.ToLower(strings.TrimSpace(family))
+	if family == "" {
+		return sdp
+	}
+
+	lines := strings.Split(sdp, "\r\n")
+	result := make([]string, 0, len(lines))
+	var preferred, others []string
+	flush := func() {
+		result = append(result, preferred...)
+		result = append(result, others...)
+		preferred, others = nil, nil
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			flush()
+			result = append(result, line)
+			continue
+		}
+		if _, candidateFamily := describeCandidate(line); candidateFamily == family {
+			preferred = append(preferred, line)
+		} else {
+			others = append(others, line)
+		}
+	}
+	flush()
+	return strings.Join(result, "\r\n")
+}
+
+// PreferredICEAddressFamily returns the family answered first, the request overrides the config.
+func PreferredICEAddressFamily(c *entities.Config, params *entities.RequestParams) string {
+	if params != nil && params.ICEPreferredAddressFamily != "" {
+		return params.ICEPreferredAddressFamily
+	}
+	return c.ICEPreferredAddressFamily
+}
+
+// FilterICEMuxCandidates removes, from the local description, the candidates not advertised in mux mode
+// (Config.EnableICEMux): the types missing from Config.ICEMuxCandidateTypes and the UDP candidates listening
+// elsewhere than Config.UDPICEPort (ex: srflx or relay ports), leaving a single UDP port to the clients.
+func FilterICEMuxCandidates(c *entities.Config, sdp string) string {
+	types := allowed(c.ICEMuxCandidateTypes)
+
+	lines := strings.Split(sdp, "\r\n")
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidateType, _ := describeCandidate(line)
+			protocol, port := candidateTransport(line)
+			if !types[candidateType] || (protocol == "udp" && port != c.UDPICEPort) {
+				continue
+			}
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\r\n")
+}
+
+// iceUfrag returns the first ICE username fragment of a session description, empty when it has none.
+func iceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return ""
+}
+
+func allowed(values []string) map[string]bool {
+	result := map[string]bool{}
+	for _, v := range values {
+		result[strings.ToLower(strings.TrimSpace(v))] = true
+	}
+	return result
+}
+
+// candidateTransport returns the candidate protocol (udp, tcp) and its port, 0 when it can't be parsed.
+// ex: a=candidate:1 1 udp 2130706431 192.168.0.1 8094 typ host
+func candidateTransport(line string) (protocol string, port int) {
+	fields := strings.Fields(strings.TrimPrefix(line, "a="))
+	if len(fields) < 6 {
+		return "", 0
+	}
+	port, _ = strconv.Atoi(fields[5])
+	return strings.ToLower(fields[2]), port
+}
+
+// describeCandidate returns the candidate type and its address family, the family is empty for mDNS (.local) addresses.
+// ex: a=candidate:1 1 udp 2130706431 192.168.0.1 8094 typ host
+func describeCandidate(line string) (candidateType, family string) {
+	fields := strings.Fields(strings.TrimPrefix(line, "a="))
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "typ" {
+			candidateType = fields[i+1]
+			break
+		}
+	}
+
+	if len(fields) > 4 {
+		address := fields[4]
+		switch {
+		case strings.HasSuffix(address, ".local"):
+		case strings.Contains(address, ":"):
+			family = "ipv6"
+		default:
+			family = "ipv4"
+		}
+	}
+	return candidateType, family
+}
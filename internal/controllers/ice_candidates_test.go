@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterICEMuxCandidatesKeepsTheMuxPort(t *testing.T) {
+	c := &entities.Config{UDPICEPort: 8094, ICEMuxCandidateTypes: []string{"host"}}
+	sdp := strings.Join([]string{
+		"v=0",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+		"a=candidate:2 1 udp 2130706431 203.0.113.1 53211 typ host",
+		"a=candidate:3 1 tcp 1671430143 203.0.113.1 8081 typ host tcptype passive",
+		"a=candidate:4 1 udp 1694498815 198.51.100.7 40213 typ srflx raddr 0.0.0.0 rport 40213",
+		"a=end-of-candidates",
+	}, "\r\n")
+
+	got := FilterICEMuxCandidates(c, sdp)
+
+	want := strings.Join([]string{
+		"v=0",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+		"a=candidate:3 1 tcp 1671430143 203.0.113.1 8081 typ host tcptype passive",
+		"a=end-of-candidates",
+	}, "\r\n")
+	assert.Equal(t, want, got)
+}
+
+// TestLocalDescriptionSDPFiltersTheMuxCandidates covers the answers of every API (signaling, WHEP and WHIP).
+func TestLocalDescriptionSDPFiltersTheMuxCandidates(t *testing.T) {
+	c := &entities.Config{
+		UDPICEPort:           8094,
+		ICEMuxCandidateTypes: []string{"host"},
+		ICECandidateTypes:    []string{"host", "srflx"},
+		ICEAddressFamilies:   []string{"ipv4"},
+	}
+	sdp := strings.Join([]string{
+		"v=0",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+		"a=candidate:2 1 udp 1694498815 198.51.100.7 40213 typ srflx raddr 0.0.0.0 rport 40213",
+	}, "\r\n")
+
+	got, err := LocalDescriptionSDP(c, NewSDPRewriter(), sdp, sdp, nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, sdp, got)
+
+	c.EnableICEMux = true
+	got, err = LocalDescriptionSDP(c, NewSDPRewriter(), sdp, sdp, nil, "")
+	require.NoError(t, err)
+	assert.NotContains(t, got, "typ srflx")
+	assert.Contains(t, got, "8094 typ host")
+}
+
+func TestPreferICEAddressFamilyPlacesIPv6First(t *testing.T) {
+	sdp := strings.Join([]string{
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+		"a=candidate:2 1 udp 2130706431 2001:db8::1 8094 typ host",
+		"a=candidate:3 1 udp 2130706431 abcd.local 8094 typ host",
+		"a=candidate:4 1 udp 1694498815 2001:db8::2 40213 typ srflx raddr :: rport 40213",
+		"a=end-of-candidates",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+		"a=candidate:2 1 udp 2130706431 2001:db8::1 8094 typ host",
+	}, "\r\n")
+
+	got := PreferICEAddressFamily(sdp, "ipv6")
+
+	want := strings.Join([]string{
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"a=candidate:2 1 udp 2130706431 2001:db8::1 8094 typ host",
+		"a=candidate:4 1 udp 1694498815 2001:db8::2 40213 typ srflx raddr :: rport 40213",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+		"a=candidate:3 1 udp 2130706431 abcd.local 8094 typ host",
+		"a=end-of-candidates",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"a=candidate:2 1 udp 2130706431 2001:db8::1 8094 typ host",
+		"a=candidate:1 1 udp 2130706431 203.0.113.1 8094 typ host",
+	}, "\r\n")
+	assert.Equal(t, want, got)
+	// no preference keeps the gathering order
+	assert.Equal(t, sdp, PreferICEAddressFamily(sdp, ""))
+}
+
+func TestPreferredICEAddressFamilyRequestOverridesConfig(t *testing.T) {
+	c := &entities.Config{ICEPreferredAddressFamily: "ipv4"}
+	assert.Equal(t, "ipv6", PreferredICEAddressFamily(c, &entities.RequestParams{ICEPreferredAddressFamily: "ipv6"}))
+	assert.Equal(t, "ipv4", PreferredICEAddressFamily(c, &entities.RequestParams{}))
+}
@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v3"
+)
+
+// CheckICETransportPolicy validates Config.ICETransportPolicy, the relay one requires TURN servers: it gathers
+// only their candidates, hiding the server addresses. In mux mode the relay candidates must be advertised
+// (Config.ICEMuxCandidateTypes), the clients would get none otherwise. Empty means all.
+func CheckICETransportPolicy(c *entities.Config) error {
+	switch c.ICETransportPolicy {
+	case entities.ICETransportPolicyAll, "":
+		return nil
+	case entities.ICETransportPolicyRelay:
+		if len(c.TURNServers) == 0 {
+			return entities.ErrRelayWithoutTURNServers
+		}
+		if c.EnableICEMux && !allowed(c.ICEMuxCandidateTypes)[webrtc.ICECandidateTypeRelay.String()] {
+			return entities.ErrRelayWithoutMuxRelayCandidates
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", entities.ErrInvalidICETransportPolicy, c.ICETransportPolicy)
+	}
+}
+
+// PeerConnectionConfiguration returns the ICE servers and the ICE transport policy of the peer connections.
+// All the STUN servers are used, gathering candidates from several of them makes it resilient to a server
+// being unreachable. They're skipped when withSTUN is false (ex: in mux mode), the TURN ones are always used.
+func PeerConnectionConfiguration(c *entities.Config, withSTUN bool) (webrtc.Configuration, error) {
+	configuration := webrtc.Configuration{}
+	if err := CheckICETransportPolicy(c); err != nil {
+		return configuration, err
+	}
+	if c.ICETransportPolicy == entities.ICETransportPolicyRelay {
+		configuration.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	if withSTUN && len(c.StunServers) > 0 {
+		configuration.ICEServers = append(configuration.ICEServers, webrtc.ICEServer{URLs: c.StunServers})
+	}
+	if len(c.TURNServers) > 0 {
+		configuration.ICEServers = append(configuration.ICEServers, webrtc.ICEServer{
+			URLs:       c.TURNServers,
+			Username:   c.TURNUsername,
+			Credential: c.TURNCredential,
+		})
+	}
+	return configuration, nil
+}
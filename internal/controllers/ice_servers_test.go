@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerConnectionConfiguration(t *testing.T) {
+	c := &entities.Config{
+		StunServers:        []string{"stun:stun.example.com:19302"},
+		TURNServers:        []string{"turn:turn.example.com:3478?transport=udp"},
+		TURNUsername:       "donut",
+		TURNCredential:     "secret",
+		ICETransportPolicy: entities.ICETransportPolicyRelay,
+	}
+	configuration, err := PeerConnectionConfiguration(c, true)
+	require.NoError(t, err)
+	assert.Equal(t, webrtc.ICETransportPolicyRelay, configuration.ICETransportPolicy)
+	require.Len(t, configuration.ICEServers, 2)
+	assert.Equal(t, "donut", configuration.ICEServers[1].Username)
+	assert.Equal(t, "secret", configuration.ICEServers[1].Credential)
+
+	// mux mode skips the STUN servers
+	configuration, err = PeerConnectionConfiguration(c, false)
+	require.NoError(t, err)
+	require.Len(t, configuration.ICEServers, 1)
+	assert.Equal(t, c.TURNServers, configuration.ICEServers[0].URLs)
+
+	c.TURNServers = nil
+	_, err = PeerConnectionConfiguration(c, true)
+	assert.ErrorIs(t, err, entities.ErrRelayWithoutTURNServers)
+	c.ICETransportPolicy = "none"
+	_, err = PeerConnectionConfiguration(c, true)
+	assert.ErrorIs(t, err, entities.ErrInvalidICETransportPolicy)
+	c.ICETransportPolicy = entities.ICETransportPolicyAll
+	configuration, err = PeerConnectionConfiguration(c, true)
+	require.NoError(t, err)
+	assert.Equal(t, webrtc.ICETransportPolicyAll, configuration.ICETransportPolicy)
+	assert.Len(t, configuration.ICEServers, 1)
+}
+
+func TestCheckICETransportPolicyMux(t *testing.T) {
+	c := &entities.Config{
+		TURNServers:          []string{"turn:turn.example.com:3478?transport=udp"},
+		ICETransportPolicy:   entities.ICETransportPolicyRelay,
+		EnableICEMux:         true,
+		ICEMuxCandidateTypes: []string{"host"},
+	}
+	// only the relay candidates are gathered, the host ones advertised
+	assert.ErrorIs(t, CheckICETransportPolicy(c), entities.ErrRelayWithoutMuxRelayCandidates)
+
+	c.ICEMuxCandidateTypes = []string{"host", "relay"}
+	assert.NoError(t, CheckICETransportPolicy(c))
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"io"
+	"net"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v3"
+)
+
+// ICETCPMux accepts the ICE-TCP connections of every peer on Config.TCPICEPort. The same mux is
+// shared by the pion v3 (signaling) and v4 (WHEP/WHIP) APIs, both of them accept its method set.
+type ICETCPMux interface {
+	io.Closer
+	GetConnByUfrag(ufrag string, isIPv6 bool, local net.IP) (net.PacketConn, error)
+	RemoveConnByUfrag(ufrag string)
+}
+
+// NewICETCPMux creates the ICE-TCP mux, letting viewers behind UDP-blocking firewalls connect.
+func NewICETCPMux(c *entities.Config, tcpListener net.Listener) ICETCPMux {
+	return webrtc.NewICETCPMux(nil, tcpListener, c.ICEReadBufferSize)
+}
+
+// WebRTCNetworkTypes parses the Config.ICENetworkTypes, the WHEP/WHIP API converts them to v4.
+func WebRTCNetworkTypes(c *entities.Config) ([]webrtc.NetworkType, error) {
+	var networkTypes []webrtc.NetworkType
+	for _, raw := range c.ICENetworkTypes {
+		networkType, err := webrtc.NewNetworkType(raw)
+		if err != nil {
+			return nil, err
+		}
+		networkTypes = append(networkTypes, networkType)
+	}
+	return networkTypes, nil
+}
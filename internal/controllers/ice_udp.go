@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"io"
+	"net"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICEUDPMux receives the ICE-UDP packets of every peer on Config.UDPICEPort. Like ICETCPMux, the same mux
+// is shared by the pion v3 (signaling) and v4 (WHEP/WHIP) APIs, their host candidates share a single port.
+type ICEUDPMux interface {
+	io.Closer
+	GetConn(ufrag string, addr net.Addr) (net.PacketConn, error)
+	RemoveConnByUfrag(ufrag string)
+	GetListenAddresses() []net.Addr
+}
+
+// NewICEUDPMux creates the ICE-UDP mux on the UDP ICE server.
+func NewICEUDPMux(udpListener net.PacketConn) ICEUDPMux {
+	return webrtc.NewICEUDPMux(nil, udpListener)
+}
@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+)
+
+// RTCPReader reads the RTCP received by a track's sender, ex: webrtc.RTPSender (v3 or v4).
+type RTCPReader interface {
+	ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error)
+}
+
+// ForwardKeyFrameRequests reads the sender's RTCP until it fails (ex: the peer connection is closed), the
+// viewer's key frame requests (PLI or FIR) are sent to requests without blocking: a pending request covers them.
+func ForwardKeyFrameRequests(sender RTCPReader, requests chan<- struct{}) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				select {
+				case requests <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
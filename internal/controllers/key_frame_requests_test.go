@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"io"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRTCPReader struct {
+	reads [][]rtcp.Packet
+}
+
+func (r *fakeRTCPReader) ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error) {
+	if len(r.reads) == 0 {
+		return nil, nil, io.EOF
+	}
+	packets := r.reads[0]
+	r.reads = r.reads[1:]
+	return packets, nil, nil
+}
+
+func TestForwardKeyFrameRequests(t *testing.T) {
+	reader := &fakeRTCPReader{reads: [][]rtcp.Packet{
+		{&rtcp.ReceiverReport{}},
+		{&rtcp.PictureLossIndication{MediaSSRC: 1}},
+		{&rtcp.FullIntraRequest{MediaSSRC: 1}, &rtcp.PictureLossIndication{MediaSSRC: 1}},
+	}}
+	requests := make(chan struct{}, 1)
+
+	// it returns once the sender fails, the pending request covers the following ones
+	ForwardKeyFrameRequests(reader, requests)
+	assert.Len(t, requests, 1)
+
+	// the receiver reports aren't key frame requests
+	<-requests
+	reader.reads = [][]rtcp.Packet{{&rtcp.ReceiverReport{}}}
+	ForwardKeyFrameRequests(reader, requests)
+	assert.Empty(t, requests)
+}
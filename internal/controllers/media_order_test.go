@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAnswerMediaOrder negotiates with pion, it answers the offer's m-lines in their order whatever the
+// order the tracks are added in (video then audio).
+func TestAnswerMediaOrder(t *testing.T) {
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer offerer.Close()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		_, err = offerer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		require.NoError(t, err)
+	}
+	_, err = offerer.CreateDataChannel(entities.MetadataChannelID, nil)
+	require.NoError(t, err)
+	offer, err := offerer.CreateOffer(nil)
+	require.NoError(t, err)
+
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer answerer.Close()
+	for _, media := range []struct{ id, mimeType string }{{"video", webrtc.MimeTypeH264}, {"audio", webrtc.MimeTypeOpus}} {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: media.mimeType}, media.id, "live")
+		require.NoError(t, err)
+		_, err = answerer.AddTrack(track)
+		require.NoError(t, err)
+	}
+	require.NoError(t, answerer.SetRemoteDescription(offer))
+	answer, err := answerer.CreateAnswer(nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"audio", "video", "application"}, mediaKinds(offer.SDP))
+	assert.Equal(t, mediaKinds(offer.SDP), mediaKinds(answer.SDP))
+}
+
+// mediaKinds returns the kind of every m-line (ex: video, audio, application), in order.
+func mediaKinds(sdp string) []string {
+	var kinds []string
+	for _, line := range strings.Split(sdp, "\n") {
+		if fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "m=")); strings.HasPrefix(line, "m=") && len(fields) > 0 {
+			kinds = append(kinds, fields[0])
+		}
+	}
+	return kinds
+}
@@ -0,0 +1,32 @@
+package muxers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HLSPlaylist is the name of the playlist written into the HLS directory.
+const HLSPlaylist = "index.m3u8"
+
+// NewHLSMuxer writes a live HLS stream (a sliding window playlist and its mpegts segments) into dir.
+// The audio must be AAC, the players don't support Opus in mpegts.
+func NewHLSMuxer(l *zap.SugaredLogger, dir string, segmentDuration, reorderWindow time.Duration) (*LibAVFFmpegMuxer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("muxer %s: creating the HLS directory failed %w", dir, err)
+	}
+	m, err := NewLibAVFFmpegMuxer(l, filepath.Join(dir, HLSPlaylist), "hls", reorderWindow)
+	if err != nil {
+		return nil, err
+	}
+	m.options = map[string]string{
+		"hls_time":      strconv.FormatFloat(segmentDuration.Seconds(), 'f', -1, 64),
+		"hls_list_size": "6",
+		"hls_flags":     "delete_segments+independent_segments",
+	}
+	return m, nil
+}
@@ -0,0 +1,79 @@
+package muxers
+
+import (
+	"sort"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+type muxerPacket struct {
+	mediaType entities.MediaType
+	data      []byte
+	c         entities.MediaFrameContext
+	// dts in microseconds, it allows comparing streams with distinct time bases
+	dts int64
+}
+
+// interleaver orders packets from multiple streams by DTS.
+// A packet is released once every stream has a queued packet (nothing earlier can arrive)
+// or when the queue spans more than the reorder window (a stream stalled).
+type interleaver struct {
+	window     time.Duration
+	numStreams int
+	queue      []*muxerPacket
+	queued     map[entities.MediaType]int
+}
+
+func newInterleaver(window time.Duration) *interleaver {
+	return &interleaver{
+		window: window,
+		queued: map[entities.MediaType]int{},
+	}
+}
+
+func (i *interleaver) push(pkt *muxerPacket) []*muxerPacket {
+	// keeps dts order, packets with the same dts keep their arrival order
+	idx := sort.Search(len(i.queue), func(n int) bool { return i.queue[n].dts > pkt.dts })
+	i.queue = append(i.queue, nil)
+	copy(i.queue[idx+1:], i.queue[idx:])
+	i.queue[idx] = pkt
+	i.queued[pkt.mediaType]++
+
+	var ready []*muxerPacket
+	for len(i.queue) > 0 && (i.allStreamsQueued() || i.windowExceeded()) {
+		ready = append(ready, i.pop())
+	}
+	return ready
+}
+
+func (i *interleaver) flush() []*muxerPacket {
+	var ready []*muxerPacket
+	for len(i.queue) > 0 {
+		ready = append(ready, i.pop())
+	}
+	return ready
+}
+
+func (i *interleaver) pop() *muxerPacket {
+	head := i.queue[0]
+	i.queue[0] = nil
+	i.queue = i.queue[1:]
+	i.queued[head.mediaType]--
+	return head
+}
+
+func (i *interleaver) allStreamsQueued() bool {
+	streams := 0
+	for _, n := range i.queued {
+		if n > 0 {
+			streams++
+		}
+	}
+	return streams >= i.numStreams
+}
+
+func (i *interleaver) windowExceeded() bool {
+	span := i.queue[len(i.queue)-1].dts - i.queue[0].dts
+	return time.Duration(span)*time.Microsecond > i.window
+}
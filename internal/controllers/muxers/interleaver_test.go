@@ -0,0 +1,45 @@
+package muxers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterleaver_OrdersByDTS(t *testing.T) {
+	i := newInterleaver(time.Second)
+	i.numStreams = 2
+
+	var written []int64
+	for _, pkt := range []*muxerPacket{
+		{mediaType: entities.VideoType, dts: 0},
+		{mediaType: entities.VideoType, dts: 33_000},
+		{mediaType: entities.AudioType, dts: 20_000},
+		{mediaType: entities.VideoType, dts: 66_000},
+		{mediaType: entities.AudioType, dts: 40_000},
+	} {
+		for _, ready := range i.push(pkt) {
+			written = append(written, ready.dts)
+		}
+	}
+	for _, ready := range i.flush() {
+		written = append(written, ready.dts)
+	}
+
+	assert.Equal(t, []int64{0, 20_000, 33_000, 40_000, 66_000}, written)
+}
+
+func TestInterleaver_BoundedByWindow(t *testing.T) {
+	i := newInterleaver(100 * time.Millisecond)
+	i.numStreams = 2
+
+	// audio never arrives, video must not be held longer than the window
+	assert.Empty(t, i.push(&muxerPacket{mediaType: entities.VideoType, dts: 0}))
+	assert.Empty(t, i.push(&muxerPacket{mediaType: entities.VideoType, dts: 100_000}))
+
+	ready := i.push(&muxerPacket{mediaType: entities.VideoType, dts: 133_000})
+	assert.Len(t, ready, 1)
+	assert.Equal(t, int64(0), ready[0].dts)
+}
@@ -0,0 +1,205 @@
+package muxers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/asticode/go-astikit"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"go.uber.org/zap"
+)
+
+var microsecondTimeBase = astiav.NewRational(1, int(time.Second/time.Microsecond))
+
+type muxerStream struct {
+	stream *astiav.Stream
+	// timeBase is the time base of the incoming frames
+	timeBase astiav.Rational
+}
+
+// LibAVFFmpegMuxer writes interleaved audio and video into an output (ex: an mp4 file).
+type LibAVFFmpegMuxer struct {
+	l *zap.SugaredLogger
+
+	// name is the redacted url (ex: without the RTMP stream key) used by the logs and the errors
+	name                string
+	closer              *astikit.Closer
+	outputFormatContext *astiav.FormatContext
+	streams             map[entities.MediaType]*muxerStream
+	interleaver         *interleaver
+	pkt                 *astiav.Packet
+	headerWritten       bool
+	// options are the format specific options set when writing the header (ex: hls_time)
+	options map[string]string
+}
+
+// NewLibAVFFmpegMuxer creates a muxer writing to url using the format (libav muxer name, ex: matroska).
+// When the format is empty it's guessed from the url extension, unless it's a network destination (ex: flv for rtmp).
+func NewLibAVFFmpegMuxer(l *zap.SugaredLogger, url, format string, reorderWindow time.Duration) (*LibAVFFmpegMuxer, error) {
+	closer := astikit.NewCloser()
+
+	if format == "" {
+		format = outputFormatFor(url)
+	}
+	outputFormatContext, err := astiav.AllocOutputFormatContext(nil, format, url)
+	if err != nil {
+		closer.Close()
+		return nil, fmt.Errorf("ffmpeg/libav: allocating output format context failed %w", err)
+	}
+	if outputFormatContext == nil {
+		closer.Close()
+		return nil, entities.ErrFFmpegLibAVFormatContextIsNil
+	}
+	closer.Add(outputFormatContext.Free)
+
+	if !outputFormatContext.OutputFormat().Flags().Has(astiav.IOFormatFlagNofile) {
+		ioContext, err := astiav.OpenIOContext(url, astiav.NewIOContextFlags(astiav.IOContextFlagWrite))
+		if err != nil {
+			closer.Close()
+			return nil, fmt.Errorf("ffmpeg/libav: opening output %s failed %w", entities.RedactURL(url), err)
+		}
+		closer.AddWithError(ioContext.Close)
+		outputFormatContext.SetPb(ioContext)
+	}
+
+	pkt := astiav.AllocPacket()
+	closer.Add(pkt.Free)
+
+	return &LibAVFFmpegMuxer{
+		l:                   l,
+		name:                entities.RedactURL(url),
+		closer:              closer,
+		outputFormatContext: outputFormatContext,
+		streams:             map[entities.MediaType]*muxerStream{},
+		interleaver:         newInterleaver(reorderWindow),
+		pkt:                 pkt,
+	}, nil
+}
+
+// outputFormatFor returns the container of the network destinations, empty lets libav guess it.
+func outputFormatFor(url string) string {
+	lower := strings.ToLower(url)
+	switch {
+	case strings.HasPrefix(lower, "rtmp://"), strings.HasPrefix(lower, "rtmps://"):
+		return "flv"
+	case strings.HasPrefix(lower, "srt://"):
+		return "mpegts"
+	}
+	return ""
+}
+
+func (m *LibAVFFmpegMuxer) AddStream(mediaType entities.MediaType, codecParameters *astiav.CodecParameters, timeBase astiav.Rational) error {
+	if m.headerWritten {
+		return fmt.Errorf("muxer %s: cannot add %s stream after writing the header", m.name, mediaType)
+	}
+
+	s := m.outputFormatContext.NewStream(nil)
+	if s == nil {
+		return fmt.Errorf("muxer %s: output stream is nil", m.name)
+	}
+	if err := codecParameters.Copy(s.CodecParameters()); err != nil {
+		return fmt.Errorf("muxer %s: copying codec parameters failed %w", m.name, err)
+	}
+	s.CodecParameters().SetCodecTag(0)
+	s.SetTimeBase(timeBase)
+
+	m.streams[mediaType] = &muxerStream{stream: s, timeBase: timeBase}
+	m.interleaver.numStreams = len(m.streams)
+	return nil
+}
+
+func (m *LibAVFFmpegMuxer) WriteVideo(data []byte, c entities.MediaFrameContext) error {
+	return m.write(entities.VideoType, data, c)
+}
+
+func (m *LibAVFFmpegMuxer) WriteAudio(data []byte, c entities.MediaFrameContext) error {
+	return m.write(entities.AudioType, data, c)
+}
+
+// Close writes the buffered packets and the trailer, the muxer must not be used afterwards.
+func (m *LibAVFFmpegMuxer) Close() error {
+	defer m.closer.Close()
+
+	if !m.headerWritten {
+		return nil
+	}
+	for _, pkt := range m.interleaver.flush() {
+		if err := m.writePacket(pkt); err != nil {
+			return err
+		}
+	}
+	if err := m.outputFormatContext.WriteTrailer(); err != nil {
+		return fmt.Errorf("muxer %s: writing trailer failed %w", m.name, err)
+	}
+	m.l.Infow("muxer closed", "url", m.name)
+	return nil
+}
+
+func (m *LibAVFFmpegMuxer) write(mediaType entities.MediaType, data []byte, c entities.MediaFrameContext) error {
+	s, ok := m.streams[mediaType]
+	if !ok {
+		return nil
+	}
+
+	if !m.headerWritten {
+		if err := m.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	for _, pkt := range m.interleaver.push(&muxerPacket{
+		mediaType: mediaType,
+		data:      data,
+		c:         c,
+		dts:       astiav.RescaleQ(int64(c.DTS), s.timeBase, microsecondTimeBase),
+	}) {
+		if err := m.writePacket(pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader flushes the output after every packet, what's written survives an abrupt termination.
+func (m *LibAVFFmpegMuxer) writeHeader() error {
+	options := astiav.NewDictionary()
+	defer options.Free()
+	if err := options.Set("flush_packets", "1", 0); err != nil {
+		return fmt.Errorf("muxer %s: setting options failed %w", m.name, err)
+	}
+	for key, value := range m.options {
+		if err := options.Set(key, value, 0); err != nil {
+			return fmt.Errorf("muxer %s: setting option %s failed %w", m.name, key, err)
+		}
+	}
+
+	if err := m.outputFormatContext.WriteHeader(options); err != nil {
+		return fmt.Errorf("muxer %s: writing header failed %w", m.name, err)
+	}
+	m.headerWritten = true
+	return nil
+}
+
+func (m *LibAVFFmpegMuxer) writePacket(pkt *muxerPacket) error {
+	s := m.streams[pkt.mediaType]
+	defer m.pkt.Unref()
+
+	if err := m.pkt.FromData(pkt.data); err != nil {
+		return fmt.Errorf("muxer %s: creating packet failed %w", m.name, err)
+	}
+	// the muxer might have changed the stream time base while writing the header
+	m.pkt.SetPts(astiav.RescaleQ(int64(pkt.c.PTS), s.timeBase, s.stream.TimeBase()))
+	m.pkt.SetDts(astiav.RescaleQ(int64(pkt.c.DTS), s.timeBase, s.stream.TimeBase()))
+	m.pkt.SetDuration(astiav.RescaleQ(int64(pkt.c.Duration/time.Microsecond), microsecondTimeBase, s.stream.TimeBase()))
+	m.pkt.SetStreamIndex(s.stream.Index())
+	if pkt.c.KeyFrame {
+		m.pkt.SetFlags(m.pkt.Flags().Add(astiav.PacketFlagKey))
+	}
+
+	if err := m.outputFormatContext.WriteFrame(m.pkt); err != nil {
+		return fmt.Errorf("muxer %s: writing %s frame failed %w", m.name, pkt.mediaType, err)
+	}
+	return nil
+}
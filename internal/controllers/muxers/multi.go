@@ -0,0 +1,67 @@
+package muxers
+
+import (
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"go.uber.org/zap"
+)
+
+// MultiMuxer writes the same packets into several outputs (ex: a recording and a relay).
+// An output failing to write is closed and dropped, it must not stop the others nor the WebRTC delivery.
+type MultiMuxer struct {
+	l       *zap.SugaredLogger
+	outputs []entities.DonutMuxer
+}
+
+func NewMultiMuxer(l *zap.SugaredLogger, outputs ...entities.DonutMuxer) *MultiMuxer {
+	return &MultiMuxer{
+		l:       l,
+		outputs: outputs,
+	}
+}
+
+func (m *MultiMuxer) AddStream(mediaType entities.MediaType, codecParameters *astiav.CodecParameters, timeBase astiav.Rational) error {
+	for _, o := range m.outputs {
+		if err := o.AddStream(mediaType, codecParameters, timeBase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiMuxer) WriteVideo(data []byte, c entities.MediaFrameContext) error {
+	m.write(func(o entities.DonutMuxer) error { return o.WriteVideo(data, c) })
+	return nil
+}
+
+func (m *MultiMuxer) WriteAudio(data []byte, c entities.MediaFrameContext) error {
+	m.write(func(o entities.DonutMuxer) error { return o.WriteAudio(data, c) })
+	return nil
+}
+
+// Close closes every output, it returns the first error.
+func (m *MultiMuxer) Close() error {
+	var result error
+	for _, o := range m.outputs {
+		if err := o.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	m.outputs = nil
+	return result
+}
+
+func (m *MultiMuxer) write(write func(o entities.DonutMuxer) error) {
+	healthy := m.outputs[:0]
+	for _, o := range m.outputs {
+		if err := write(o); err != nil {
+			m.l.Errorw("dropping muxer output", "error", err)
+			if err := o.Close(); err != nil {
+				m.l.Warnw("closing muxer output failed", "error", err)
+			}
+			continue
+		}
+		healthy = append(healthy, o)
+	}
+	m.outputs = healthy
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// NegotiatedMedia is the codec selected for a transceiver, MimeType is empty when none was. It's pion
+// version agnostic, the signaling uses v3 and the WHEP/WHIP endpoints v4.
+type NegotiatedMedia struct {
+	Kind        string
+	Mid         string
+	MimeType    string
+	ClockRate   uint32
+	PayloadType uint8
+}
+
+// LogNegotiatedMedia logs, in a single line, the codec and payload type selected for each transceiver
+// of the endpoint (ex: whep).
+func LogNegotiatedMedia(l *zap.SugaredLogger, endpoint string, media []NegotiatedMedia) {
+	var lines []string
+	for _, m := range media {
+		if m.MimeType == "" {
+			lines = append(lines, fmt.Sprintf("%s(mid=%s) none", m.Kind, m.Mid))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s(mid=%s) %s/%d pt=%d", m.Kind, m.Mid, m.MimeType, m.ClockRate, m.PayloadType))
+	}
+	l.Infow("Negotiated media",
+		"endpoint", endpoint,
+		"media", strings.Join(lines, ", "),
+	)
+}
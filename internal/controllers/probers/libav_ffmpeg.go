@@ -1,11 +1,16 @@
 package probers
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/asticode/go-astiav"
 	"github.com/asticode/go-astikit"
+	"github.com/flavioribeiro/donut/internal/controllers"
 	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/flavioribeiro/donut/internal/mapper"
 	"go.uber.org/fx"
@@ -16,6 +21,8 @@ type LibAVFFmpeg struct {
 	c *entities.Config
 	l *zap.SugaredLogger
 	m *mapper.Mapper
+	// srtStreamIDs checks the publisher accepted by an SRT listener
+	srtStreamIDs *controllers.SRTStreamIDs
 }
 
 type ResultLibAVFFmpeg struct {
@@ -28,12 +35,14 @@ func NewLibAVFFmpeg(
 	c *entities.Config,
 	l *zap.SugaredLogger,
 	m *mapper.Mapper,
+	srtStreamIDs *controllers.SRTStreamIDs,
 ) ResultLibAVFFmpeg {
 	return ResultLibAVFFmpeg{
 		LibAVFFmpegProber: &LibAVFFmpeg{
-			c: c,
-			l: l,
-			m: m,
+			c:            c,
+			l:            l,
+			m:            m,
+			srtStreamIDs: srtStreamIDs,
 		},
 	}
 }
@@ -42,8 +51,10 @@ func NewLibAVFFmpeg(
 func (c *LibAVFFmpeg) Match(req *entities.RequestParams) bool {
 	isRTMP := strings.Contains(strings.ToLower(req.StreamURL), "rtmp")
 	isSRT := strings.Contains(strings.ToLower(req.StreamURL), "srt")
+	isPipe := entities.IsPipeURL(req.StreamURL)
+	isManifest := entities.IsManifestURL(req.StreamURL)
 
-	return isRTMP || isSRT
+	return isRTMP || isSRT || isPipe || isManifest
 }
 
 // StreamInfo connects to the SRT stream to discover media properties.
@@ -58,16 +69,8 @@ func (c *LibAVFFmpeg) StreamInfo(req entities.DonutAppetizer) (*entities.StreamI
 	}
 	closer.Add(inputFormatContext.Free)
 
-	inputURL := req.URL
-	if strings.Contains(strings.ToLower(inputURL), "srt://") {
-		urlParts := strings.Split(inputURL, "://")
-		if len(urlParts) == 2 {
-			hostPort := strings.Split(strings.Split(urlParts[1], "?")[0], ":")
-			if len(hostPort) == 2 {
-				inputURL = fmt.Sprintf("srt://0.0.0.0:%s", hostPort[1])
-			}
-		}
-	}
+	inputURL := mapper.NormalizeSRTListenerURL(req.URL)
+	isSRTCaller := entities.IsSRTCallerURL(inputURL)
 
 	inputFormat, err := c.defineInputFormat(req.Format.String())
 	if err != nil {
@@ -83,16 +86,47 @@ func (c *LibAVFFmpeg) StreamInfo(req entities.DonutAppetizer) (*entities.StreamI
 		}
 	}
 
-	if strings.Contains(strings.ToLower(inputURL), "srt://") {
+	if isSRTCaller {
+		inputOptions.Set("mode", "caller", 0)
+		inputOptions.Set("connect_timeout", strconv.Itoa(c.c.SRTConnectTimeoutMS), 0)
+	} else if strings.Contains(strings.ToLower(inputURL), "srt://") {
 		inputOptions.Set("mode", "listener", 0)
 	}
 
-	if err := inputFormatContext.OpenInput(inputURL, inputFormat, inputOptions); err != nil {
+	if req.Reader != nil {
+		ioContext, err := c.defineInputIOContext(req.Reader, closer)
+		if err != nil {
+			return nil, err
+		}
+		inputFormatContext.SetPb(ioContext)
+	}
+
+	// the libav log callback, set by the streamer, records the streamid accepted by a listener
+	isSRTListener := strings.Contains(strings.ToLower(inputURL), "srt://") && !isSRTCaller
+
+	started := time.Now()
+	srtStreamID := c.srtStreamIDs.Watch()
+	err = inputFormatContext.OpenInput(inputURL, inputFormat, inputOptions)
+	srtStreamID.Stop()
+	if err != nil {
+		if isSRTCaller && SRTConnectTimedOut(err, started, c.c.SRTConnectTimeoutMS) {
+			return nil, fmt.Errorf("%w %s: %s", entities.ErrSRTConnectTimeout, inputURL, err.Error())
+		}
+		c.l.Errorw("opening the source failed", "url", inputURL, "error", err)
+		if sourceErr := c.m.FromLibAVOpenInputErrorToSourceError(err, strings.HasPrefix(strings.ToLower(inputURL), "srt://")); sourceErr != err {
+			return nil, sourceErr
+		}
 		return nil, fmt.Errorf("error while inputFormatContext.OpenInput: (%s, %#v, %#v) %w", inputURL, inputFormat, inputOptions, err)
 	}
 	closer.Add(inputFormatContext.CloseInput)
 
-	if err := inputFormatContext.FindStreamInfo(nil); err != nil {
+	if isSRTListener {
+		if err := srtStreamID.Check(req.Options[entities.DonutSRTStreamID]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := FindStreamInfo(c.c, c.l, c.m, inputFormatContext, c.c.FindStreamInfoMediaTypes); err != nil {
 		return nil, fmt.Errorf("error while inputFormatContext.FindStreamInfo %w", err)
 	}
 
@@ -112,13 +146,63 @@ func (c *LibAVFFmpeg) StreamInfo(req entities.DonutAppetizer) (*entities.StreamI
 			is.AvgFrameRate().String(),
 			is.RFrameRate().String())
 
-		streams = append(streams, c.m.FromLibAVStreamToEntityStream(is))
+		st := c.m.FromLibAVStreamToEntityStream(is)
+		if color := st.ColorDescription(); color != "" {
+			c.l.Infof("Stream #%d: color=%s colorspace=%s", is.Index(), color, st.ColorSpace)
+		}
+		streams = append(streams, st)
 	}
 	si := entities.StreamInfo{Streams: streams}
+	if inputFormat := inputFormatContext.InputFormat(); inputFormat != nil {
+		// demuxers might have multiple names, ex: "mov,mp4,m4a,3gp,3g2,mj2"
+		name, _, _ := strings.Cut(inputFormat.Name(), ",")
+		si.Format = entities.DonutInputFormat(name)
+	}
 
 	return &si, nil
 }
 
+// FindStreamInfo runs FindStreamInfo until every expected media type is found or the Config.FindStreamInfoAttempts
+// are exhausted, then it settles for the streams found so far (ex: a video only source), a slow-starting source
+// might miss some at first. The streamer shares it, it doesn't await the dropped medias.
+func FindStreamInfo(c *entities.Config, l *zap.SugaredLogger, m *mapper.Mapper, inputFormatContext *astiav.FormatContext, expected []entities.MediaType) error {
+	for attempt := 1; ; attempt++ {
+		if err := inputFormatContext.FindStreamInfo(nil); err != nil {
+			return err
+		}
+		missing := missingMediaTypes(m, inputFormatContext, expected)
+		if len(missing) == 0 || attempt >= c.FindStreamInfoAttempts {
+			if len(missing) > 0 {
+				l.Warnw("source streams missing after probing", "missing", missing, "attempts", attempt)
+			}
+			return nil
+		}
+		l.Infow("source streams missing, probing again", "missing", missing, "attempt", attempt)
+		time.Sleep(time.Duration(c.FindStreamInfoIntervalMS) * time.Millisecond)
+	}
+}
+
+// SRTConnectTimedOut tells whether a caller failed for not reaching the listener in time,
+// depending on the libsrt version it's either ETIMEDOUT or a generic error after the timeout.
+func SRTConnectTimedOut(err error, started time.Time, timeoutMS int) bool {
+	return errors.Is(err, astiav.ErrEtimedout) || time.Since(started) >= time.Duration(timeoutMS)*time.Millisecond
+}
+
+// missingMediaTypes returns the expected media types without a stream in the input.
+func missingMediaTypes(m *mapper.Mapper, inputFormatContext *astiav.FormatContext, expected []entities.MediaType) []entities.MediaType {
+	found := map[entities.MediaType]bool{}
+	for _, is := range inputFormatContext.Streams() {
+		found[m.FromLibAVMediaTypeToEntityMediaType(is.CodecParameters().MediaType())] = true
+	}
+	var missing []entities.MediaType
+	for _, mediaType := range expected {
+		if !found[mediaType] {
+			missing = append(missing, mediaType)
+		}
+	}
+	return missing
+}
+
 // TODO: merge common behavior (streamer / prober)
 func (c *LibAVFFmpeg) defineInputFormat(streamFormat string) (*astiav.InputFormat, error) {
 	var inputFormat *astiav.InputFormat
@@ -131,6 +215,22 @@ func (c *LibAVFFmpeg) defineInputFormat(streamFormat string) (*astiav.InputForma
 	return inputFormat, nil
 }
 
+func (c *LibAVFFmpeg) defineInputIOContext(r io.Reader, closer *astikit.Closer) (*astiav.IOContext, error) {
+	ioContext, err := astiav.AllocIOContext(c.c.PipeReadBufferSizeBytes, func(b []byte) (int, error) {
+		n, err := r.Read(b)
+		if errors.Is(err, io.EOF) {
+			// libav only understands its own EOF
+			return n, astiav.ErrEof
+		}
+		return n, err
+	}, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg/libav: allocating io context failed %w", err)
+	}
+	closer.Add(ioContext.Free)
+	return ioContext, nil
+}
+
 func (c *LibAVFFmpeg) defineInputOptions(opts map[entities.DonutInputOptionKey]string, closer *astikit.Closer) *astiav.Dictionary {
 	var dic *astiav.Dictionary
 	if len(opts) > 0 {
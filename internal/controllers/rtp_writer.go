@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+)
+
+// rtpOutboundMTU is the size of the RTP packets, it leaves room for the SRTP and tunneling (ex: TURN) overheads.
+const rtpOutboundMTU = 1200
+
+// RTPTrack is a local track fed with RTP packets, ex: webrtc.TrackLocalStaticRTP (v3 or v4).
+// The track stamps the SSRC and the payload type negotiated with each peer connection it's bound to.
+type RTPTrack interface {
+	WriteRTP(p *rtp.Packet) error
+}
+
+// TransportSequence numbers the packets of all the tracks of a peer connection (transport-cc).
+type TransportSequence struct {
+	n atomic.Uint32
+}
+
+func (s *TransportSequence) next() uint16 {
+	return uint16(s.n.Add(1))
+}
+
+// RTPWriter packetizes the encoded frames of a codec and writes them to a track, the packets of a frame
+// share its RTP timestamp (entities.MediaFrameContext.RTPTimestamp).
+type RTPWriter struct {
+	track      RTPTrack
+	packetizer rtp.Packetizer
+	// extensions are the negotiated header extensions (abs-send-time and transport-cc) required by
+	// the receiver's bandwidth estimation, sequence numbers the transport-cc ones.
+	extensions entities.RTPHeaderExtensions
+	sequence   *TransportSequence
+}
+
+// NewRTPWriter returns a writer adding the negotiated header extensions, they might be nil. The sequence is
+// required along with transport-cc.
+func NewRTPWriter(track RTPTrack, codec entities.Codec, extensions entities.RTPHeaderExtensions, sequence *TransportSequence) (*RTPWriter, error) {
+	payloader, err := rtpPayloaderFor(codec)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := extensions[sdp.TransportCCURI]; ok && sequence == nil {
+		return nil, fmt.Errorf("%w: transport-cc", entities.ErrMissingTransportSequence)
+	}
+	return &RTPWriter{
+		track:      track,
+		packetizer: rtp.NewPacketizer(rtpOutboundMTU, 0, 0, payloader, rtp.NewRandomSequencer(), codec.RTPClockRate()),
+		extensions: extensions,
+		sequence:   sequence,
+	}, nil
+}
+
+// Write sends an encoded frame (ex: an H264 access unit or an Opus packet).
+func (w *RTPWriter) Write(data []byte, c entities.MediaFrameContext) error {
+	// the packetizer's own timestamp is random, the streamer's one keeps the media in sync
+	for _, p := range w.packetizer.Packetize(data, 0) {
+		p.Timestamp = c.RTPTimestamp
+		if err := w.setHeaderExtensions(&p.Header); err != nil {
+			return err
+		}
+		if err := w.track.WriteRTP(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *RTPWriter) setHeaderExtensions(h *rtp.Header) error {
+	if id, ok := w.extensions[sdp.ABSSendTimeURI]; ok {
+		payload, err := rtp.NewAbsSendTimeExtension(time.Now()).Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal abs-send-time extension: %w", err)
+		}
+		if err := h.SetExtension(id, payload); err != nil {
+			return fmt.Errorf("failed to set abs-send-time extension: %w", err)
+		}
+	}
+
+	if id, ok := w.extensions[sdp.TransportCCURI]; ok {
+		payload, err := (&rtp.TransportCCExtension{TransportSequence: w.sequence.next()}).Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to marshal transport-cc extension: %w", err)
+		}
+		if err := h.SetExtension(id, payload); err != nil {
+			return fmt.Errorf("failed to set transport-cc extension: %w", err)
+		}
+	}
+	return nil
+}
+
+// rtpPayloaderFor returns the payloader pion uses for the codec's tracks. The VP9 one writes no layer
+// indices (L bit, TID/SID), the temporal layers are in the bitstream but a receiver can't tell them apart.
+func rtpPayloaderFor(codec entities.Codec) (rtp.Payloader, error) {
+	switch codec {
+	case entities.H264:
+		return &codecs.H264Payloader{}, nil
+	case entities.VP8:
+		return &codecs.VP8Payloader{EnablePictureID: true}, nil
+	case entities.VP9:
+		return &codecs.VP9Payloader{}, nil
+	case entities.AV1:
+		return &codecs.AV1Payloader{}, nil
+	case entities.Opus:
+		return &codecs.OpusPayloader{}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", entities.ErrMissingRTPPayloader, codec)
+}
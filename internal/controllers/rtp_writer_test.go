@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingTrack struct {
+	packets []*rtp.Packet
+}
+
+func (t *recordingTrack) WriteRTP(p *rtp.Packet) error {
+	t.packets = append(t.packets, p)
+	return nil
+}
+
+func TestRTPWriter(t *testing.T) {
+	track := &recordingTrack{}
+	w, err := NewRTPWriter(track, entities.H264, nil, nil)
+	require.NoError(t, err)
+
+	// an access unit larger than the MTU is fragmented (FU-A), every packet carries the frame's timestamp
+	nalu := append([]byte{0x00, 0x00, 0x00, 0x01, 0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	require.NoError(t, w.Write(nalu, entities.MediaFrameContext{RTPTimestamp: 90000}))
+	require.Greater(t, len(track.packets), 1)
+	for i, p := range track.packets {
+		assert.Equal(t, uint32(90000), p.Timestamp)
+		assert.LessOrEqual(t, p.MarshalSize(), rtpOutboundMTU)
+		assert.Equal(t, i == len(track.packets)-1, p.Marker)
+		if i > 0 {
+			assert.Equal(t, track.packets[i-1].SequenceNumber+1, p.SequenceNumber)
+		}
+	}
+	// the payload is the NAL unit, not an RTP packet wrapped in a sample
+	assert.Equal(t, byte(28), track.packets[0].Payload[0]&0x1f)
+}
+
+func TestRTPWriterCodecs(t *testing.T) {
+	for _, codec := range []entities.Codec{entities.H264, entities.VP8, entities.VP9, entities.AV1, entities.Opus} {
+		_, err := NewRTPWriter(&recordingTrack{}, codec, nil, nil)
+		assert.NoError(t, err, codec)
+	}
+	_, err := NewRTPWriter(&recordingTrack{}, entities.H265, nil, nil)
+	assert.ErrorIs(t, err, entities.ErrMissingRTPPayloader)
+}
+
+func TestRTPWriterHeaderExtensions(t *testing.T) {
+	extensions := entities.RTPHeaderExtensions{sdp.ABSSendTimeURI: 3, sdp.TransportCCURI: 5}
+	_, err := NewRTPWriter(&recordingTrack{}, entities.Opus, extensions, nil)
+	assert.ErrorIs(t, err, entities.ErrMissingTransportSequence)
+
+	// the transport-cc sequence is shared by the tracks of the peer connection
+	sequence := &TransportSequence{}
+	video, audio := &recordingTrack{}, &recordingTrack{}
+	videoWriter, err := NewRTPWriter(video, entities.VP8, extensions, sequence)
+	require.NoError(t, err)
+	audioWriter, err := NewRTPWriter(audio, entities.Opus, extensions, sequence)
+	require.NoError(t, err)
+	require.NoError(t, videoWriter.Write([]byte{0x10, 0x02}, entities.MediaFrameContext{}))
+	require.NoError(t, audioWriter.Write([]byte{0xfc}, entities.MediaFrameContext{}))
+	require.NoError(t, videoWriter.Write([]byte{0x11, 0x02}, entities.MediaFrameContext{}))
+
+	var sequences []uint16
+	for _, p := range []*rtp.Packet{video.packets[0], audio.packets[0], video.packets[1]} {
+		assert.Len(t, p.GetExtension(3), 3)
+		var ext rtp.TransportCCExtension
+		require.NoError(t, ext.Unmarshal(p.GetExtension(5)))
+		sequences = append(sequences, ext.TransportSequence)
+	}
+	assert.Equal(t, []uint16{1, 2, 3}, sequences)
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// SDPRewriter post-processes the local description right before it's sent to the client,
+// ex: reordering codecs, adding bandwidth lines or dropping header extensions beyond what the config exposes.
+// Integrators provide their own implementation replacing the default one, ex: fx.Decorate.
+type SDPRewriter interface {
+	Rewrite(sdp string) (string, error)
+}
+
+type passthroughSDPRewriter struct{}
+
+func (passthroughSDPRewriter) Rewrite(sdp string) (string, error) {
+	return sdp, nil
+}
+
+// NewSDPRewriter creates the default rewriter, it leaves the SDP untouched.
+func NewSDPRewriter() SDPRewriter {
+	return passthroughSDPRewriter{}
+}
+
+// LocalDescriptionSDP returns the SDP sent to the client, its media sections follow the BUNDLE grouping of
+// the remote description (see withOfferTransports), the ICE candidates are filtered (see
+// FilterICEMuxCandidates in mux mode) and ordered (the preferredFamily first, see PreferredICEAddressFamily), the audio ptime of the transcoded audio and the
+// H264 parameter sets of a bypassed source are advertised before the rewriter is called. The recipe is nil
+// when donut doesn't send media (ex: WHIP).
+func LocalDescriptionSDP(c *entities.Config, r SDPRewriter, remoteSDP, localSDP string, recipe *entities.DonutRecipe, preferredFamily string) (string, error) {
+	localSDP = withOfferTransports(remoteSDP, localSDP)
+	if c.EnableICEMux {
+		localSDP = FilterICEMuxCandidates(c, localSDP)
+	}
+	sdp := PreferICEAddressFamily(FilterICECandidates(c, localSDP), preferredFamily)
+	if recipe != nil {
+		// the bypassed audio keeps the source packet duration, it has no ptime
+		sdp = withAudioPtime(sdp, recipe.Audio.PtimeMS)
+		sdp = withH264ParameterSets(sdp, recipe.Video.ParameterSets)
+	}
+	rewritten, err := r.Rewrite(sdp)
+	if err != nil {
+		return "", fmt.Errorf("rewriting sdp failed: %w", err)
+	}
+	return rewritten, nil
+}
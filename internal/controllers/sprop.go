@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+const spropParameterSets = "sprop-parameter-sets="
+
+// withH264ParameterSets advertises the SPS and PPS of a bypassed source in the H264 fmtp of the local description,
+// letting the browser initialize its decoder before the first key frame arrives.
+// ref https://datatracker.ietf.org/doc/html/rfc6184#section-8.1
+func withH264ParameterSets(sdp string, sets [][]byte) string {
+	if len(sets) == 0 {
+		return sdp
+	}
+	encoded := make([]string, 0, len(sets))
+	for _, set := range sets {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(set))
+	}
+	sprop := spropParameterSets + strings.Join(encoded, ",")
+
+	lines := strings.Split(sdp, "\r\n")
+	h264 := map[string]bool{}
+	withFmtp := map[string]bool{}
+	for _, line := range lines {
+		if pt, codec, ok := rtpmap(line); ok && strings.EqualFold(codec, "H264/90000") {
+			h264[pt] = true
+		}
+		if pt, _, ok := fmtp(line); ok {
+			withFmtp[pt] = true
+		}
+	}
+	if len(h264) == 0 {
+		return sdp
+	}
+
+	result := make([]string, 0, len(lines)+len(h264))
+	for _, line := range lines {
+		if pt, params, ok := fmtp(line); ok && h264[pt] {
+			kept := []string{}
+			for _, param := range strings.Split(params, ";") {
+				if param != "" && !strings.HasPrefix(strings.TrimSpace(param), spropParameterSets) {
+					kept = append(kept, param)
+				}
+			}
+			line = "a=fmtp:" + pt + " " + strings.Join(append(kept, sprop), ";")
+		}
+		result = append(result, line)
+		if pt, _, ok := rtpmap(line); ok && h264[pt] && !withFmtp[pt] {
+			result = append(result, "a=fmtp:"+pt+" "+sprop)
+		}
+	}
+	return strings.Join(result, "\r\n")
+}
+
+// rtpmap splits an a=rtpmap line, ex: a=rtpmap:96 H264/90000.
+func rtpmap(line string) (pt, codec string, ok bool) {
+	return attribute(line, "a=rtpmap:")
+}
+
+// fmtp splits an a=fmtp line, ex: a=fmtp:96 packetization-mode=1;profile-level-id=42e01f.
+func fmtp(line string) (pt, params string, ok bool) {
+	return attribute(line, "a=fmtp:")
+}
+
+func attribute(line, prefix string) (pt, value string, ok bool) {
+	if !strings.HasPrefix(line, prefix) {
+		return "", "", false
+	}
+	pt, value, _ = strings.Cut(strings.TrimPrefix(line, prefix), " ")
+	return pt, value, true
+}
@@ -0,0 +1,34 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func TestWithH264ParameterSets(t *testing.T) {
+	sdp := "m=video 9 UDP/TLS/RTP/SAVPF 96 98\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\n" +
+		"a=rtpmap:98 VP8/90000\r\n"
+
+	expected := "m=video 9 UDP/TLS/RTP/SAVPF 96 98\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f;sprop-parameter-sets=Z0LAHw==,aM48gA==\r\n" +
+		"a=rtpmap:98 VP8/90000\r\n"
+
+	assert.Equal(t, expected, withH264ParameterSets(sdp, [][]byte{testSPS, testPPS}))
+}
+
+func TestWithH264ParameterSets_MissingFmtp(t *testing.T) {
+	sdp := "a=rtpmap:102 H264/90000\r\na=rtcp-fb:102 nack\r\n"
+
+	expected := "a=rtpmap:102 H264/90000\r\na=fmtp:102 sprop-parameter-sets=Z0LAHw==\r\na=rtcp-fb:102 nack\r\n"
+
+	assert.Equal(t, expected, withH264ParameterSets(sdp, [][]byte{testSPS}))
+}
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"go.uber.org/zap"
+)
+
+// srtAcceptLogPrefix starts the libav (libsrt) log line of an accepted publisher, ex: accept streamid [live], length 4.
+// It's the only place libav exposes the streamid of a listener's connection.
+const srtAcceptLogPrefix = "accept streamid ["
+
+// SRTStreamIDs checks the streamid of the publishers accepted by the SRT listeners (Config.SRTStreamIDMismatch).
+// libav accepts any publisher and only logs its streamid, the log callback feeds it through Observe and
+// the prober and the streamer check it once the input is open.
+// libsrt logs the accept on the thread opening the input, the log callback runs there too: the listeners
+// accepting at the same time are told apart by their thread (on linux, see threadID).
+type SRTStreamIDs struct {
+	l    *zap.SugaredLogger
+	mode entities.SRTStreamIDMismatch
+
+	mu sync.Mutex
+	// watching are the listeners being opened, by thread
+	watching map[int]*SRTStreamIDWatch
+}
+
+func NewSRTStreamIDs(c *entities.Config, l *zap.SugaredLogger) (*SRTStreamIDs, error) {
+	if !c.SRTStreamIDMismatch.Valid() {
+		return nil, fmt.Errorf("%w: %s", entities.ErrInvalidSRTStreamIDMismatch, c.SRTStreamIDMismatch)
+	}
+	return &SRTStreamIDs{l: l, mode: c.SRTStreamIDMismatch, watching: map[int]*SRTStreamIDWatch{}}, nil
+}
+
+// SRTStreamIDWatch records the streamid accepted by the listener a goroutine opens.
+type SRTStreamIDWatch struct {
+	s      *SRTStreamIDs
+	thread int
+
+	// accepted is the streamid of the publisher, logged is false until libav logs it
+	accepted string
+	logged   bool
+	stopped  bool
+}
+
+// Observe records the streamid of an accepted publisher, it's given every libav log.
+func (s *SRTStreamIDs) Observe(format, msg string) {
+	streamID, ok := parseSRTAccept(format, msg)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w, ok := s.watching[threadID()]; ok {
+		w.accepted, w.logged = streamID, true
+	}
+}
+
+// Watch starts recording the streamid accepted by the listener the calling goroutine opens, it must be called
+// right before opening the input. The goroutine is locked to its thread until the watch is stopped.
+func (s *SRTStreamIDs) Watch() *SRTStreamIDWatch {
+	runtime.LockOSThread()
+	w := &SRTStreamIDWatch{s: s, thread: threadID()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watching[w.thread] = w
+	return w
+}
+
+// Stop stops recording, it must be called by the watching goroutine once the input is open (or failed to).
+// It's safe to call it multiple times.
+func (w *SRTStreamIDWatch) Stop() {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	if w.s.watching[w.thread] == w {
+		delete(w.s.watching, w.thread)
+	}
+	runtime.UnlockOSThread()
+}
+
+// Check stops the watch and validates the accepted streamid against the expected one, it returns
+// an ErrSRTStreamIDMismatch in reject mode. A publisher whose streamid wasn't logged (or is empty)
+// can't be verified, it's rejected as well.
+func (w *SRTStreamIDWatch) Check(expected string) error {
+	w.Stop()
+	if w.s.mode == entities.SRTStreamIDMismatchIgnore || expected == "" {
+		return nil
+	}
+	w.s.mu.Lock()
+	logged, accepted := w.logged, w.accepted
+	w.s.mu.Unlock()
+
+	var err error
+	switch {
+	case !logged:
+		err = fmt.Errorf("%w: expected %q, libav didn't log the accepted one", entities.ErrSRTStreamIDMismatch, expected)
+	case !srtStreamIDMatches(expected, accepted):
+		err = fmt.Errorf("%w: expected %q, got %q", entities.ErrSRTStreamIDMismatch, expected, accepted)
+	default:
+		return nil
+	}
+	if w.s.mode == entities.SRTStreamIDMismatchWarn {
+		w.s.l.Warnf("accepting the SRT publisher anyway: %s", err.Error())
+		return nil
+	}
+	w.s.l.Errorw("rejecting the SRT publisher", "error", err)
+	return err
+}
+
+// parseSRTAccept returns the streamid of an accepted publisher log. The message is matched rather than the
+// format, libsrt versions word the rest of the line differently.
+func parseSRTAccept(_, msg string) (string, bool) {
+	if !strings.HasPrefix(msg, srtAcceptLogPrefix) {
+		return "", false
+	}
+	msg = strings.TrimPrefix(msg, srtAcceptLogPrefix)
+	i := strings.LastIndex(msg, "]")
+	if i < 0 {
+		return "", false
+	}
+	return msg[:i], true
+}
+
+// srtStreamIDMatches compares the resource names (r=) when either streamid follows the access control
+// syntax, ex: the publisher's #!::r=live,m=publish matches live. An empty streamid matches none.
+func srtStreamIDMatches(expected, accepted string) bool {
+	if accepted == "" {
+		return false
+	}
+	return srtResourceName(expected) == srtResourceName(accepted)
+}
+
+// srtResourceName returns the r= key of an access control streamid, the streamid itself otherwise.
+func srtResourceName(streamID string) string {
+	if !strings.HasPrefix(streamID, entities.SRTAccessControlPrefix) {
+		return streamID
+	}
+	params := strings.TrimPrefix(streamID, entities.SRTAccessControlPrefix)
+	for _, param := range strings.Split(params, ",") {
+		if key, value, _ := strings.Cut(param, "="); key == "r" {
+			return value
+		}
+	}
+	return ""
+}
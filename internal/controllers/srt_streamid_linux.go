@@ -0,0 +1,10 @@
+//go:build linux
+
+package controllers
+
+import "syscall"
+
+// threadID identifies the thread running the calling goroutine.
+func threadID() int {
+	return syscall.Gettid()
+}
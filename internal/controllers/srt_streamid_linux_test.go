@@ -0,0 +1,49 @@
+//go:build linux
+
+package controllers
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// TestSRTStreamIDsConcurrentListeners opens two listeners at once, each one gets the streamid of its publisher.
+func TestSRTStreamIDsConcurrentListeners(t *testing.T) {
+	s, err := NewSRTStreamIDs(&entities.Config{SRTStreamIDMismatch: entities.SRTStreamIDMismatchReject}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	watching := sync.WaitGroup{}
+	watching.Add(2)
+	accepted := sync.WaitGroup{}
+	accepted.Add(2)
+	results := map[string]error{}
+	var mu sync.Mutex
+	var done sync.WaitGroup
+	for _, streamID := range []string{"live", "other"} {
+		done.Add(1)
+		go func(streamID string) {
+			defer done.Done()
+			w := s.Watch()
+			watching.Done()
+			// both listeners are waiting for their publisher when they accept
+			watching.Wait()
+			s.Observe("", "accept streamid ["+streamID+"], length 4\n")
+			accepted.Done()
+			accepted.Wait()
+
+			err := w.Check(streamID)
+			mu.Lock()
+			defer mu.Unlock()
+			results[streamID] = err
+		}(streamID)
+	}
+	done.Wait()
+
+	assert.NoError(t, results["live"])
+	assert.NoError(t, results["other"])
+}
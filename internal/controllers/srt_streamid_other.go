@@ -0,0 +1,8 @@
+//go:build !linux
+
+package controllers
+
+// threadID can't tell the threads apart, the listeners accepting at the same time might see each other's streamid.
+func threadID() int {
+	return 0
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseSRTAccept(t *testing.T) {
+	streamID, ok := parseSRTAccept("accept streamid [%s], length %d\n", "accept streamid [#!::r=live,m=publish], length 19\n")
+	assert.True(t, ok)
+	assert.Equal(t, "#!::r=live,m=publish", streamID)
+
+	// the format isn't matched, only the message
+	streamID, ok = parseSRTAccept("%s", "accept streamid [live]\n")
+	assert.True(t, ok)
+	assert.Equal(t, "live", streamID)
+
+	_, ok = parseSRTAccept("%s\n", "srt listening on port 40052\n")
+	assert.False(t, ok)
+}
+
+func TestSRTStreamIDMatches(t *testing.T) {
+	tests := []struct {
+		expected, accepted string
+		want               bool
+	}{
+		{"live", "live", true},
+		{"live", "other", false},
+		{"live", "", false},
+		{"live", "#!::r=live,m=publish", true},
+		{"#!::r=live,m=request", "#!::r=live,m=publish", true},
+		{"#!::r=live,m=request", "#!::r=other,m=publish", false},
+		{"live", "#!::m=publish", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, srtStreamIDMatches(tt.expected, tt.accepted), "%q %q", tt.expected, tt.accepted)
+	}
+}
+
+func TestSRTStreamIDsCheck(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	reject, err := NewSRTStreamIDs(&entities.Config{SRTStreamIDMismatch: entities.SRTStreamIDMismatchReject}, l)
+	require.NoError(t, err)
+
+	// a publisher whose streamid wasn't logged can't be verified
+	assert.ErrorIs(t, reject.Watch().Check("live"), entities.ErrSRTStreamIDMismatch)
+
+	// libav logs the accept on the thread opening the input
+	w := reject.Watch()
+	reject.Observe("", "accept streamid [other], length 5\n")
+	assert.ErrorIs(t, w.Check("live"), entities.ErrSRTStreamIDMismatch)
+
+	w = reject.Watch()
+	reject.Observe("", "accept streamid [live], length 4\n")
+	w.Stop()
+	// the accepts logged once the input is open are ignored
+	reject.Observe("", "accept streamid [other], length 5\n")
+	assert.NoError(t, w.Check("live"))
+	// nothing is checked without an expected streamid
+	assert.NoError(t, reject.Watch().Check(""))
+
+	warn, err := NewSRTStreamIDs(&entities.Config{SRTStreamIDMismatch: entities.SRTStreamIDMismatchWarn}, l)
+	require.NoError(t, err)
+	w = warn.Watch()
+	warn.Observe("", "accept streamid [other], length 5\n")
+	assert.NoError(t, w.Check("live"), "warn keeps the publisher")
+
+	_, err = NewSRTStreamIDs(&entities.Config{SRTStreamIDMismatch: "drop"}, l)
+	assert.ErrorIs(t, err, entities.ErrInvalidSRTStreamIDMismatch)
+}
@@ -0,0 +1,26 @@
+package streamers
+
+// squarePixelsSize returns the size displaying an anamorphic picture (non-square pixels) at the same aspect
+// with square pixels, the width is stretched (or shrunk) and kept even. It's false for square or unknown SARs.
+// ex: a 720x480 DVD with SAR 32:27 (16:9) becomes 852x480.
+func squarePixelsSize(width, height, sarNum, sarDen int) (int, int, bool) {
+	if sarNum <= 0 || sarDen <= 0 || sarNum == sarDen {
+		return width, height, false
+	}
+	squareWidth := ((width*sarNum + sarDen/2) / sarDen) &^ 1
+	if squareWidth <= 0 {
+		return width, height, false
+	}
+	return squareWidth, height, true
+}
+
+// scaledDownSize returns the size of a picture scaled down to maxHeight, the width keeps the aspect ratio
+// and both are kept even (as scale=-2:maxHeight). It's false when the picture isn't taller, it's never upscaled.
+// ex: a 1920x1080 picture scaled down to 480 becomes 854x480.
+func scaledDownSize(width, height, maxHeight int) (int, int, bool) {
+	if maxHeight <= 0 || width <= 0 || height <= maxHeight {
+		return width, height, false
+	}
+	maxHeight &^= 1
+	return (width*maxHeight + height) / (2 * height) * 2, maxHeight, true
+}
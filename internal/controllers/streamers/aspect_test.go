@@ -0,0 +1,59 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSquarePixelsSize(t *testing.T) {
+	tests := []struct {
+		name           string
+		width, height  int
+		sarNum, sarDen int
+		expectedWidth  int
+		expectedScaled bool
+	}{
+		{name: "square pixels", width: 1920, height: 1080, sarNum: 1, sarDen: 1, expectedWidth: 1920},
+		{name: "unknown sar", width: 1920, height: 1080, sarNum: 0, sarDen: 1, expectedWidth: 1920},
+		{name: "ntsc dvd 16:9", width: 720, height: 480, sarNum: 32, sarDen: 27, expectedWidth: 852, expectedScaled: true},
+		{name: "ntsc dvd 4:3", width: 720, height: 480, sarNum: 8, sarDen: 9, expectedWidth: 640, expectedScaled: true},
+		{name: "pal dvd 16:9", width: 720, height: 576, sarNum: 64, sarDen: 45, expectedWidth: 1024, expectedScaled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, scaled := squarePixelsSize(tt.width, tt.height, tt.sarNum, tt.sarDen)
+
+			assert.Equal(t, tt.expectedWidth, width)
+			assert.Equal(t, tt.height, height)
+			assert.Equal(t, tt.expectedScaled, scaled)
+		})
+	}
+}
+
+func TestScaledDownSize(t *testing.T) {
+	tests := []struct {
+		name                          string
+		width, height, maxHeight      int
+		expectedWidth, expectedHeight int
+		expectedScaled                bool
+	}{
+		{name: "1080p to 480p", width: 1920, height: 1080, maxHeight: 480, expectedWidth: 854, expectedHeight: 480, expectedScaled: true},
+		{name: "720p to 360p", width: 1280, height: 720, maxHeight: 360, expectedWidth: 640, expectedHeight: 360, expectedScaled: true},
+		{name: "4:3 to 480p", width: 1440, height: 1080, maxHeight: 480, expectedWidth: 640, expectedHeight: 480, expectedScaled: true},
+		{name: "never upscaled", width: 1280, height: 720, maxHeight: 1080, expectedWidth: 1280, expectedHeight: 720},
+		{name: "same height", width: 854, height: 480, maxHeight: 480, expectedWidth: 854, expectedHeight: 480},
+		{name: "auto", width: 1920, height: 1080, expectedWidth: 1920, expectedHeight: 1080},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, scaled := scaledDownSize(tt.width, tt.height, tt.maxHeight)
+
+			assert.Equal(t, tt.expectedWidth, width)
+			assert.Equal(t, tt.expectedHeight, height)
+			assert.Equal(t, tt.expectedScaled, scaled)
+		})
+	}
+}
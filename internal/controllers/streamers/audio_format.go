@@ -0,0 +1,57 @@
+package streamers
+
+import (
+	"fmt"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// audioFormat is the format of the decoded audio frames entering a filter graph.
+type audioFormat struct {
+	sampleRate    int
+	sampleFormat  string
+	channelLayout string
+}
+
+func audioFormatOf(f *astiav.Frame) audioFormat {
+	return audioFormat{
+		sampleRate:    f.SampleRate(),
+		sampleFormat:  f.SampleFormat().Name(),
+		channelLayout: f.ChannelLayout().String(),
+	}
+}
+
+func (f audioFormat) String() string {
+	return fmt.Sprintf("%dHz %s %s", f.sampleRate, f.sampleFormat, f.channelLayout)
+}
+
+// audioFormatChange tells whether the filter graph configured for current must be rebuilt for next,
+// it fails with ErrAudioFormatChanged when the mode doesn't allow it.
+func audioFormatChange(current, next audioFormat, mode entities.AudioFormatChange) (reconfigure bool, err error) {
+	if current == next {
+		return false, nil
+	}
+	if mode == entities.AudioFormatChangeFail {
+		return false, fmt.Errorf("%w: from %s to %s", entities.ErrAudioFormatChanged, current, next)
+	}
+	return true, nil
+}
+
+// followAudioFormat rebuilds the filter graph of s when the decoded frame f changes the audio format
+// (Config.AudioFormatChange), ex: an MPEG-TS source switching from 44.1kHz to 48kHz. The filters keep
+// the output format, the encoder is left untouched. drain flushes the frames buffered by the current graph.
+func (c *LibAVFFmpegStreamer) followAudioFormat(s *streamContext, f *astiav.Frame, drain func() error) error {
+	format := audioFormatOf(f)
+	reconfigure, err := audioFormatChange(s.audioFormat, format, c.c.AudioFormatChange)
+	if !reconfigure {
+		return err
+	}
+
+	c.l.Infof("the audio format changed from %s to %s, reconfiguring the filters", s.audioFormat, format)
+	if err := drain(); err != nil {
+		return fmt.Errorf("draining filter failed: %w", err)
+	}
+	s.audioFormat = format
+	return c.configureFilterGraph(s, s.filter)
+}
@@ -0,0 +1,32 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAudioFormatChange(t *testing.T) {
+	ts44 := audioFormat{sampleRate: 44100, sampleFormat: "fltp", channelLayout: "stereo"}
+	ts48 := audioFormat{sampleRate: 48000, sampleFormat: "fltp", channelLayout: "stereo"}
+
+	// the same format is kept
+	reconfigure, err := audioFormatChange(ts48, ts48, entities.AudioFormatChangeFail)
+	assert.NoError(t, err)
+	assert.False(t, reconfigure)
+
+	reconfigure, err = audioFormatChange(ts48, ts44, entities.AudioFormatChangeReconfigure)
+	assert.NoError(t, err)
+	assert.True(t, reconfigure)
+
+	reconfigure, err = audioFormatChange(ts44, ts48, entities.AudioFormatChangeFail)
+	assert.ErrorIs(t, err, entities.ErrAudioFormatChanged)
+	assert.False(t, reconfigure)
+
+	// a channel layout change reconfigures as well
+	mono := ts48
+	mono.channelLayout = "mono"
+	reconfigure, _ = audioFormatChange(ts48, mono, entities.AudioFormatChangeReconfigure)
+	assert.True(t, reconfigure)
+}
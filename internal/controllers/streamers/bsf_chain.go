@@ -0,0 +1,27 @@
+package streamers
+
+//#cgo pkg-config: libavcodec
+//#include <libavcodec/bsf.h>
+import "C"
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/asticode/go-astiav"
+)
+
+// chainBitStreamFilter initializes the next filter of a chain with the output of the previous one, which
+// is initialized. astiav doesn't expose the output parameters of a filter (par_out and time_base_out).
+func chainBitStreamFilter(previous, next *astiav.BitStreamFilterContext) error {
+	p, n := bsfContextC(previous), bsfContextC(next)
+	if ret := C.avcodec_parameters_copy(n.par_in, p.par_out); ret < 0 {
+		return fmt.Errorf("copying the output codec parameters failed: %d", int(ret))
+	}
+	n.time_base_in = p.time_base_out
+	return nil
+}
+
+// bsfContextC returns the AVBSFContext wrapped by astiav, it's the only field of its context.
+func bsfContextC(c *astiav.BitStreamFilterContext) *C.struct_AVBSFContext {
+	return *(**C.struct_AVBSFContext)(unsafe.Pointer(c))
+}
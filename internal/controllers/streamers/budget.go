@@ -0,0 +1,59 @@
+package streamers
+
+import (
+	"time"
+)
+
+// budgetOverruns is the number of consecutive windows over budget before downgrading,
+// a single slow window (ex: a scene change) is tolerated.
+const budgetOverruns = 2
+
+// minBudgetHeight and minBudgetFrameRate bound the downgrades, below them the stream is barely watchable.
+const (
+	minBudgetHeight    = 180
+	minBudgetFrameRate = 10
+)
+
+// encodeBudget tracks the time spent decoding, filtering and encoding the frames against
+// their media duration, it tells when a stream consistently fails to keep up with real time.
+type encodeBudget struct {
+	limit  float64
+	window time.Duration
+
+	spent    time.Duration
+	media    time.Duration
+	overruns int
+}
+
+// newEncodeBudget creates a budget allowing percent of the real time, ex: 80 leaves 20% of headroom.
+func newEncodeBudget(percent int, window time.Duration) *encodeBudget {
+	return &encodeBudget{
+		limit:  float64(percent) / 100,
+		window: window,
+	}
+}
+
+// track accounts spent processing media, it returns true when the budget was exceeded
+// for budgetOverruns consecutive windows. The media is 0 for the time spent decoding a packet
+// that yields no frame (ex: the decoder buffering B-frames).
+func (b *encodeBudget) track(spent, media time.Duration) bool {
+	b.spent += spent
+	b.media += media
+	if b.media < b.window {
+		return false
+	}
+
+	exceeded := float64(b.spent) > b.limit*float64(b.media)
+	b.spent, b.media = 0, 0
+	if !exceeded {
+		b.overruns = 0
+		return false
+	}
+
+	b.overruns++
+	if b.overruns < budgetOverruns {
+		return false
+	}
+	b.overruns = 0
+	return true
+}
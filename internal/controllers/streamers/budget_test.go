@@ -0,0 +1,36 @@
+package streamers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeBudget_Overruns(t *testing.T) {
+	b := newEncodeBudget(80, time.Second)
+
+	// a single slow window is tolerated
+	assert.False(t, b.track(900*time.Millisecond, time.Second))
+	assert.True(t, b.track(900*time.Millisecond, time.Second))
+	// the overruns start over once downgraded
+	assert.False(t, b.track(900*time.Millisecond, time.Second))
+}
+
+func TestEncodeBudget_DecodingWithoutFrames(t *testing.T) {
+	b := newEncodeBudget(80, time.Second)
+
+	// the packets buffered by the decoder count against the window of the next frames
+	for i := 0; i < 2; i++ {
+		assert.False(t, b.track(100*time.Millisecond, 0))
+		assert.False(t, b.track(600*time.Millisecond, time.Second))
+	}
+	assert.Equal(t, 0, b.overruns)
+
+	b = newEncodeBudget(80, time.Second)
+	for i := 0; i < 2; i++ {
+		assert.False(t, b.track(300*time.Millisecond, 0))
+	}
+	assert.False(t, b.track(300*time.Millisecond, time.Second))
+	assert.Equal(t, 1, b.overruns)
+}
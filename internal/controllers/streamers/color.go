@@ -0,0 +1,64 @@
+package streamers
+
+import (
+	"strconv"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// encoderColorRange returns the range signaled by the video encoder, the source one unless the recipe overrides it.
+// The range of an RGB source doesn't apply to the YUV frames the filters convert it to, it's left unspecified.
+func encoderColorRange(source astiav.ColorRange, space astiav.ColorSpace, override entities.ColorRange) astiav.ColorRange {
+	switch override {
+	case entities.ColorRangeTV:
+		return astiav.ColorRangeMpeg
+	case entities.ColorRangeFull:
+		return astiav.ColorRangeJpeg
+	}
+	if space == astiav.ColorSpaceRgb || (source != astiav.ColorRangeMpeg && source != astiav.ColorRangeJpeg) {
+		return astiav.ColorRangeUnspecified
+	}
+	return source
+}
+
+// scaleColorRange names the range for the scale filter, empty when it's unspecified.
+func scaleColorRange(r astiav.ColorRange) string {
+	switch r {
+	case astiav.ColorRangeMpeg:
+		return "tv"
+	case astiav.ColorRangeJpeg:
+		return "pc"
+	}
+	return ""
+}
+
+// encoderColorOptions returns the color metadata options of the video encoder, the source primaries, transfer
+// and matrix along with the encoder's range, so the browser displays the colors as the source ones (ex: a full
+// range source isn't washed out). The enums are accepted by their numeric values, the unspecified ones are left out.
+// The HDR transfer and gamut are only kept along with the bit depth (preserve), the metadata of an RGB source
+// doesn't apply to the YUV frames the filters convert it to.
+func encoderColorOptions(primaries astiav.ColorPrimaries, transfer astiav.ColorTransferCharacteristic,
+	space astiav.ColorSpace, colorRange astiav.ColorRange, preserve bool) map[string]string {
+	options := map[string]string{}
+	if colorRange != astiav.ColorRangeUnspecified {
+		options["color_range"] = strconv.Itoa(int(colorRange))
+	}
+
+	hdr := transfer == astiav.ColorTransferCharacteristicSmpte2084 || transfer == astiav.ColorTransferCharacteristicAribStdB67
+	if space == astiav.ColorSpaceRgb || (hdr && !preserve) {
+		return options
+	}
+	if primaries != astiav.ColorPrimariesUnspecified && primaries != astiav.ColorPrimariesReserved0 &&
+		primaries != astiav.ColorPrimariesReserved {
+		options["color_primaries"] = strconv.Itoa(int(primaries))
+	}
+	if transfer != astiav.ColorTransferCharacteristicUnspecified && transfer != astiav.ColorTransferCharacteristicReserved0 &&
+		transfer != astiav.ColorTransferCharacteristicReserved {
+		options["color_trc"] = strconv.Itoa(int(transfer))
+	}
+	if space != astiav.ColorSpaceUnspecified && space != astiav.ColorSpaceReserved {
+		options["colorspace"] = strconv.Itoa(int(space))
+	}
+	return options
+}
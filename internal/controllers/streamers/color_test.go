@@ -0,0 +1,52 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncoderColorRange(t *testing.T) {
+	assert.Equal(t, astiav.ColorRangeJpeg, encoderColorRange(astiav.ColorRangeJpeg, astiav.ColorSpaceBt709, entities.ColorRangeAuto))
+	assert.Equal(t, astiav.ColorRangeMpeg, encoderColorRange(astiav.ColorRangeMpeg, astiav.ColorSpaceBt709, ""))
+	assert.Equal(t, astiav.ColorRangeUnspecified, encoderColorRange(astiav.ColorRangeUnspecified, astiav.ColorSpaceBt709, entities.ColorRangeAuto))
+	assert.Equal(t, astiav.ColorRangeUnspecified, encoderColorRange(astiav.ColorRangeJpeg, astiav.ColorSpaceRgb, entities.ColorRangeAuto), "rgb source")
+	assert.Equal(t, astiav.ColorRangeJpeg, encoderColorRange(astiav.ColorRangeMpeg, astiav.ColorSpaceBt709, entities.ColorRangeFull), "override")
+	assert.Equal(t, astiav.ColorRangeMpeg, encoderColorRange(astiav.ColorRangeUnspecified, astiav.ColorSpaceRgb, entities.ColorRangeTV), "override")
+}
+
+func TestEncoderColorOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		primary  astiav.ColorPrimaries
+		transfer astiav.ColorTransferCharacteristic
+		space    astiav.ColorSpace
+		rng      astiav.ColorRange
+		preserve bool
+		expected []string
+	}{
+		{"full range sdr", astiav.ColorPrimariesBt709, astiav.ColorTransferCharacteristicBt709, astiav.ColorSpaceBt709, astiav.ColorRangeJpeg, false,
+			[]string{"color_range", "color_primaries", "color_trc", "colorspace"}},
+		{"unspecified", astiav.ColorPrimariesUnspecified, astiav.ColorTransferCharacteristicUnspecified, astiav.ColorSpaceUnspecified, astiav.ColorRangeUnspecified, false,
+			nil},
+		{"hdr converted", astiav.ColorPrimariesBt2020, astiav.ColorTransferCharacteristicSmpte2084, astiav.ColorSpaceBt2020Ncl, astiav.ColorRangeMpeg, false,
+			[]string{"color_range"}},
+		{"hdr preserved", astiav.ColorPrimariesBt2020, astiav.ColorTransferCharacteristicSmpte2084, astiav.ColorSpaceBt2020Ncl, astiav.ColorRangeMpeg, true,
+			[]string{"color_range", "color_primaries", "color_trc", "colorspace"}},
+		{"rgb", astiav.ColorPrimariesBt709, astiav.ColorTransferCharacteristicIec6196621, astiav.ColorSpaceRgb, astiav.ColorRangeUnspecified, false,
+			nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := encoderColorOptions(tt.primary, tt.transfer, tt.space, tt.rng, tt.preserve)
+
+			var keys []string
+			for key := range options {
+				keys = append(keys, key)
+			}
+			assert.ElementsMatch(t, tt.expected, keys)
+		})
+	}
+}
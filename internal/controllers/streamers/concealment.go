@@ -0,0 +1,65 @@
+package streamers
+
+import (
+	"bytes"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// conceal reports whether a bypassed video packet must be dropped. A corrupt packet (ex: the
+// mpegts demuxer detected lost TS packets) or an access unit missing its first slice is dropped
+// along with every following packet up to the next keyframe, since they reference a broken picture.
+// The viewer sees a brief freeze instead of garbled frames.
+func (c *LibAVFFmpegStreamer) conceal(s *streamContext, pkt *astiav.Packet, codec entities.Codec) bool {
+	if pkt.Flags().Has(astiav.PacketFlagCorrupt) || missingFirstSlice(codec, pkt.Data()) {
+		if !s.awaitingKeyFrame {
+			c.l.Warnw("dropping corrupt video frames up to the next keyframe", "pts", pkt.Pts())
+		}
+		s.awaitingKeyFrame = true
+		return true
+	}
+
+	if s.awaitingKeyFrame {
+		if !pkt.Flags().Has(astiav.PacketFlagKey) {
+			return true
+		}
+		c.l.Infow("video recovered at keyframe", "pts", pkt.Pts())
+		s.awaitingKeyFrame = false
+	}
+	return false
+}
+
+// missingFirstSlice checks the first slice of an annex B access unit starts the picture:
+// first_mb_in_slice is 0 for H264 (ue(v) coded as a single 1 bit) and first_slice_segment_in_pic_flag
+// is set for H265. Other codecs aren't inspected.
+func missingFirstSlice(codec entities.Codec, data []byte) bool {
+	startCode := []byte{0x00, 0x00, 0x01}
+	for {
+		i := bytes.Index(data, startCode)
+		if i < 0 {
+			return false
+		}
+		data = data[i+len(startCode):]
+		if len(data) == 0 {
+			return false
+		}
+
+		switch codec {
+		case entities.H264:
+			unitType := entities.NALUnitType(data[0] & 0x1f)
+			if unitType != entities.CodedSliceNonIDRPicture && unitType != entities.CodedSliceIDRPicture {
+				continue
+			}
+			return len(data) < 2 || data[1]&0x80 == 0
+		case entities.H265:
+			// VCL NAL unit types are 0 to 31
+			if (data[0]>>1)&0x3f > 31 {
+				continue
+			}
+			return len(data) < 3 || data[2]&0x80 == 0
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var (
+	// H264: IDR and non-IDR slices starting the picture (first_mb_in_slice 0) and a non-IDR one starting
+	// at macroblock 1, along with the parameter sets
+	h264IDR         = []byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84}
+	h264NonIDR      = []byte{0x00, 0x00, 0x01, 0x41, 0x9a, 0x02}
+	h264NonIDRTail  = []byte{0x00, 0x00, 0x01, 0x41, 0x40, 0x02}
+	h264ParamSets   = []byte{0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0xc0, 0x1f, 0x00, 0x00, 0x00, 0x01, 0x68, 0xce, 0x3c, 0x80}
+	h265IDR         = []byte{0x00, 0x00, 0x00, 0x01, 0x26, 0x01, 0xaf}
+	h265TrailTail   = []byte{0x00, 0x00, 0x01, 0x02, 0x01, 0x2f}
+	h265VPS         = []byte{0x00, 0x00, 0x00, 0x01, 0x40, 0x01, 0x0c}
+	h264AVCCLengths = []byte{0x00, 0x00, 0x00, 0x03, 0x41, 0x40, 0x02}
+)
+
+func concat(units ...[]byte) []byte {
+	var data []byte
+	for _, u := range units {
+		data = append(data, u...)
+	}
+	return data
+}
+
+func TestMissingFirstSlice(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		codec entities.Codec
+		data  []byte
+		want  bool
+	}{
+		{"h264 IDR", entities.H264, h264IDR, false},
+		{"h264 IDR after the parameter sets", entities.H264, concat(h264ParamSets, h264IDR), false},
+		{"h264 non-IDR", entities.H264, h264NonIDR, false},
+		{"h264 non-IDR first_mb 1", entities.H264, h264NonIDRTail, true},
+		{"h264 non-IDR first_mb 1 after the parameter sets", entities.H264, concat(h264ParamSets, h264NonIDRTail), true},
+		{"h264 truncated slice", entities.H264, []byte{0x00, 0x00, 0x01, 0x65}, true},
+		{"h264 parameter sets only", entities.H264, h264ParamSets, false},
+		{"h265 IDR", entities.H265, h265IDR, false},
+		{"h265 IDR after the VPS", entities.H265, concat(h265VPS, h265IDR), false},
+		{"h265 first_slice_segment_in_pic_flag unset", entities.H265, h265TrailTail, true},
+		{"h265 truncated slice", entities.H265, []byte{0x00, 0x00, 0x01, 0x26, 0x01}, true},
+		{"missing start code", entities.H264, h264AVCCLengths, false},
+		{"start code without a unit", entities.H264, []byte{0x00, 0x00, 0x01}, false},
+		{"empty", entities.H264, nil, false},
+		{"other codec", entities.VP8, h264NonIDRTail, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, missingFirstSlice(tt.codec, tt.data))
+		})
+	}
+}
+
+func newVideoPacket(t *testing.T, data []byte, flags ...astiav.PacketFlag) *astiav.Packet {
+	pkt := astiav.AllocPacket()
+	t.Cleanup(pkt.Free)
+	require.NoError(t, pkt.FromData(data))
+	pkt.SetFlags(astiav.NewPacketFlags(flags...))
+	return pkt
+}
+
+func TestConceal(t *testing.T) {
+	c := &LibAVFFmpegStreamer{c: &entities.Config{}, l: zap.NewNop().Sugar()}
+	s := &streamContext{}
+
+	for _, tt := range []struct {
+		name  string
+		pkt   *astiav.Packet
+		codec entities.Codec
+		drop  bool
+	}{
+		{"keyframe", newVideoPacket(t, h264IDR, astiav.PacketFlagKey), entities.H264, false},
+		{"intact frame", newVideoPacket(t, h264NonIDR), entities.H264, false},
+		{"corrupt frame", newVideoPacket(t, h264NonIDR, astiav.PacketFlagCorrupt), entities.H264, true},
+		{"frame referencing the corrupt one", newVideoPacket(t, h264NonIDR), entities.H264, true},
+		{"next keyframe", newVideoPacket(t, h264IDR, astiav.PacketFlagKey), entities.H264, false},
+		{"frame missing its first slice", newVideoPacket(t, h264NonIDRTail), entities.H264, true},
+		{"corrupt keyframe", newVideoPacket(t, h264IDR, astiav.PacketFlagKey, astiav.PacketFlagCorrupt), entities.H264, true},
+		{"keyframe missing its first slice", newVideoPacket(t, h265TrailTail, astiav.PacketFlagKey), entities.H265, true},
+		{"h265 keyframe", newVideoPacket(t, h265IDR, astiav.PacketFlagKey), entities.H265, false},
+		{"h265 frame", newVideoPacket(t, concat(h265VPS, h265IDR)), entities.H265, false},
+	} {
+		assert.Equal(t, tt.drop, c.conceal(s, tt.pkt, tt.codec), tt.name)
+	}
+	assert.False(t, s.awaitingKeyFrame)
+}
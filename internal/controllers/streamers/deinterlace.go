@@ -0,0 +1,21 @@
+package streamers
+
+import "github.com/flavioribeiro/donut/internal/entities"
+
+// encoderFrameRate returns the frame rate (num/den) fed to the encoder when it differs from the decoded one:
+// doubled when deinterlacing an interlaced source a frame per field (ex: 25 to 50 for 1080i50), then capped
+// to maxFrameRate (0 disables the cap). The deinterlacer passes the progressive frames through, their rate
+// isn't doubled. ok is false when the decoded frame rate is kept or unknown.
+func encoderFrameRate(num, den int, deinterlace entities.DeinterlaceMode, interlaced bool, maxFrameRate int) (outNum, outDen int, ok bool) {
+	if num <= 0 || den <= 0 {
+		return 0, 0, false
+	}
+	outNum, outDen = num, den
+	if deinterlace == entities.DeinterlaceModeField && interlaced {
+		outNum, ok = num*2, true
+	}
+	if maxFrameRate > 0 && float64(outNum)/float64(outDen) > float64(maxFrameRate) {
+		return maxFrameRate, 1, true
+	}
+	return outNum, outDen, ok
+}
@@ -0,0 +1,37 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncoderFrameRate(t *testing.T) {
+	tests := []struct {
+		name             string
+		num, den         int
+		deinterlace      entities.DeinterlaceMode
+		interlaced       bool
+		maxFrameRate     int
+		wantNum, wantDen int
+		wantOK           bool
+	}{
+		{"1080i50 a frame per field", 25, 1, entities.DeinterlaceModeField, true, 0, 50, 1, true},
+		{"1080i59.94 a frame per field", 30000, 1001, entities.DeinterlaceModeField, true, 0, 60000, 1001, true},
+		{"1080i50 a frame per frame", 25, 1, entities.DeinterlaceModeFrame, true, 0, 0, 0, false},
+		{"progressive a frame per field", 25, 1, entities.DeinterlaceModeField, false, 0, 0, 0, false},
+		{"doubled then capped", 30000, 1001, entities.DeinterlaceModeField, true, 30, 30, 1, true},
+		{"doubled under the cap", 25, 1, entities.DeinterlaceModeField, true, 60, 50, 1, true},
+		{"progressive capped", 60, 1, "", false, 30, 30, 1, true},
+		{"progressive under the cap", 25, 1, "", false, 30, 0, 0, false},
+		{"unknown frame rate", 0, 1, entities.DeinterlaceModeField, true, 30, 0, 0, false},
+	}
+	for _, tt := range tests {
+		num, den, ok := encoderFrameRate(tt.num, tt.den, tt.deinterlace, tt.interlaced, tt.maxFrameRate)
+		if assert.Equal(t, tt.wantOK, ok, tt.name) && ok {
+			assert.Equal(t, tt.wantNum, num, tt.name)
+			assert.Equal(t, tt.wantDen, den, tt.name)
+		}
+	}
+}
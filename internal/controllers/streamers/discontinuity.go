@@ -0,0 +1,110 @@
+package streamers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// discontinuityMinGap separates the packets around a jump when the stream spacing isn't known yet.
+const discontinuityMinGap = time.Millisecond
+
+// discontinuityTracker rebases the timestamps after a discontinuity of the source (Config.TimestampDiscontinuity),
+// ex: an MPEG-TS encoder restart jumping hours ahead or back to zero. The offset is shared by the streams, each
+// one absorbs the jump on its own first packet after it and they stay in sync.
+type discontinuityTracker struct {
+	threshold time.Duration
+	offset    time.Duration
+	// last is the last rebased dts of each stream, gap its spacing before that
+	last map[int]time.Duration
+	gap  map[int]time.Duration
+}
+
+func newDiscontinuityTracker(threshold time.Duration) *discontinuityTracker {
+	return &discontinuityTracker{
+		threshold: threshold,
+		last:      map[int]time.Duration{},
+		gap:       map[int]time.Duration{},
+	}
+}
+
+// rebase returns the offset to add to a packet of the stream at dts, duration long (0 when unknown).
+// jump is the source jump when the packet starts a discontinuity, it then follows the previous packet.
+func (d *discontinuityTracker) rebase(stream int, dts, duration time.Duration) (offset, jump time.Duration) {
+	dts += d.offset
+	last, ok := d.last[stream]
+	if ok {
+		delta := dts - last
+		if delta > d.threshold || delta < -d.threshold {
+			if duration <= 0 {
+				duration = d.gap[stream]
+			}
+			if duration <= 0 {
+				duration = discontinuityMinGap
+			}
+			jump = delta - duration
+			d.offset -= jump
+			dts = last + duration
+		} else if delta > 0 {
+			d.gap[stream] = delta
+		}
+	}
+	d.last[stream] = dts
+	return d.offset, jump
+}
+
+// rebaseTimestamps shifts the packet timestamps by the tracker's offset, the decoder of a transcoded stream
+// is restarted on a jump unless the mode only rebases them. The packets without timestamps are left alone.
+func (c *LibAVFFmpegStreamer) rebaseTimestamps(p *libAVParams, s *streamContext, pkt *astiav.Packet, donut *entities.DonutParameters) error {
+	dts := pkt.Dts()
+	if dts == astiav.NoPtsValue {
+		if dts = pkt.Pts(); dts == astiav.NoPtsValue {
+			return nil
+		}
+	}
+	tb := s.inputStream.TimeBase()
+	micro := astiav.NewRational(1, 1000000)
+	offset, jump := p.discontinuities.rebase(pkt.StreamIndex(),
+		time.Duration(astiav.RescaleQ(dts, tb, micro))*time.Microsecond,
+		time.Duration(astiav.RescaleQ(pkt.Duration(), tb, micro))*time.Microsecond)
+
+	if offset != 0 {
+		shift := astiav.RescaleQ(int64(offset/time.Microsecond), micro, tb)
+		if pkt.Pts() != astiav.NoPtsValue {
+			pkt.SetPts(pkt.Pts() + shift)
+		}
+		if pkt.Dts() != astiav.NoPtsValue {
+			pkt.SetDts(pkt.Dts() + shift)
+		}
+	}
+	if jump == 0 {
+		return nil
+	}
+
+	c.l.Warnf("timestamp discontinuity on stream #%d, the source jumped %s", s.inputStream.Index(), jump)
+	// bypassed streams aren't decoded, their packets only needed the new timestamps
+	if c.c.TimestampDiscontinuity != entities.TimestampDiscontinuityReset || s.encCodecContext == nil {
+		return nil
+	}
+	return c.resetDecoder(p, s, donut)
+}
+
+// resetDecoder drains the decoder of a transcoded stream then opens a new one, the frames after a discontinuity
+// must not be decoded against the references before it. libav's avcodec_flush_buffers isn't exposed and a
+// drained decoder can't be reused.
+func (c *LibAVFFmpegStreamer) resetDecoder(p *libAVParams, s *streamContext, donut *entities.DonutParameters) error {
+	if err := c.drainDecoder(p, s, donut); err != nil {
+		return err
+	}
+	drained := s.decCodecContext
+	if err := c.openDecoder(p, s, donut); err != nil {
+		return fmt.Errorf("reopening the decoder after a discontinuity failed: %w", err)
+	}
+	drained.Free()
+	if s.muxerEncoder != nil {
+		s.muxerEncoder.decCodecContext = s.decCodecContext
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package streamers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscontinuityTracker(t *testing.T) {
+	ms := time.Millisecond
+	d := newDiscontinuityTracker(10 * time.Second)
+
+	for _, dts := range []time.Duration{0, 40 * ms, 80 * ms} {
+		offset, jump := d.rebase(0, dts, 0)
+		require.Zero(t, offset, dts)
+		require.Zero(t, jump, dts)
+	}
+	offset, jump := d.rebase(1, 20*ms, 0)
+	require.Zero(t, offset)
+	require.Zero(t, jump)
+
+	// the encoder restarted an hour ahead, the video follows its last packet by its spacing
+	offset, jump = d.rebase(0, time.Hour, 0)
+	require.Equal(t, time.Hour-120*ms, jump)
+	require.Equal(t, 120*ms, time.Hour+offset)
+
+	offset, jump = d.rebase(0, time.Hour+40*ms, 0)
+	assert.Zero(t, jump)
+	assert.Equal(t, 160*ms, time.Hour+40*ms+offset)
+
+	// the audio is already past the jump, it stays in sync with the video
+	offset, jump = d.rebase(1, time.Hour+20*ms, 0)
+	assert.Zero(t, jump)
+	assert.Equal(t, 140*ms, time.Hour+20*ms+offset)
+
+	// back to zero, the packet duration takes precedence over the spacing
+	offset, jump = d.rebase(0, 0, 20*ms)
+	assert.Negative(t, int64(jump))
+	assert.Equal(t, 180*ms, offset)
+}
@@ -0,0 +1,17 @@
+package streamers
+
+//#cgo pkg-config: libavcodec
+//#include <libavcodec/avcodec.h>
+import "C"
+import (
+	"unsafe"
+
+	"github.com/asticode/go-astiav"
+)
+
+// interlaced is true when the stream's fields are coded separately (ex: 1080i50), an unknown field order
+// counts as progressive. astiav doesn't expose the field order of the codec parameters.
+func interlaced(cp *astiav.CodecParameters) bool {
+	fieldOrder := (*(**C.struct_AVCodecParameters)(unsafe.Pointer(cp))).field_order
+	return fieldOrder != C.AV_FIELD_UNKNOWN && fieldOrder != C.AV_FIELD_PROGRESSIVE
+}
@@ -0,0 +1,38 @@
+package streamers
+
+import "time"
+
+// maxFrameDuration bounds the durations derived from the timestamps, longer deltas are treated as gaps.
+const maxFrameDuration = time.Second
+
+// frameDurations derives the duration of the packets from the DTS of consecutive packets (the PTS
+// aren't monotonic with B-frames), it paces the video sources that don't tell their frame rate (ex: some
+// SRT sources) and the audio packets without a duration. A timestamp rollover (ex: the 33 bits of MPEG-TS)
+// steps back, the last duration is kept over it.
+type frameDurations struct {
+	// last is the DTS of the previous packet, hasLast is false until there's one
+	last    int64
+	hasLast bool
+	// duration is the last plausible one, the fallback until the timestamps tell (Config.VideoFallbackFrameRate)
+	duration time.Duration
+}
+
+func newFrameDurations(fallback time.Duration) frameDurations {
+	return frameDurations{duration: fallback}
+}
+
+// next returns the duration of the packet whose dts is in the num/den time base, ok is false when the packet
+// has no timestamp. The last duration is kept when the delta is implausible (ex: a discontinuity).
+func (d *frameDurations) next(dts int64, ok bool, num, den int) time.Duration {
+	if !ok || num <= 0 || den <= 0 {
+		return d.duration
+	}
+	if d.hasLast && dts > d.last {
+		delta := time.Duration(float64(dts-d.last) * float64(num) / float64(den) * float64(time.Second))
+		if delta < maxFrameDuration {
+			d.duration = delta
+		}
+	}
+	d.last, d.hasLast = dts, true
+	return d.duration
+}
@@ -0,0 +1,30 @@
+package streamers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameDurations(t *testing.T) {
+	d := newFrameDurations(time.Second / 30)
+
+	// the fallback is used until two timestamps tell the duration (90kHz, 25 fps)
+	assert.Equal(t, time.Second/30, d.next(0, true, 1, 90000))
+	assert.Equal(t, 40*time.Millisecond, d.next(3600, true, 1, 90000))
+	// a variable frame rate follows the timestamps
+	assert.Equal(t, 20*time.Millisecond, d.next(5400, true, 1, 90000))
+	// a missing timestamp, a gap or a step back keep the last duration
+	assert.Equal(t, 20*time.Millisecond, d.next(0, false, 1, 90000))
+	assert.Equal(t, 20*time.Millisecond, d.next(5400+2*90000, true, 1, 90000))
+	assert.Equal(t, 20*time.Millisecond, d.next(0, true, 1, 90000))
+	assert.Equal(t, 40*time.Millisecond, d.next(3600, true, 1, 90000))
+}
+
+func TestFrameDurationsWithoutFallback(t *testing.T) {
+	d := newFrameDurations(0)
+
+	assert.Zero(t, d.next(0, true, 1, 1000))
+	assert.Equal(t, 33*time.Millisecond, d.next(33, true, 1, 1000))
+}
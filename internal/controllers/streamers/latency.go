@@ -0,0 +1,35 @@
+package streamers
+
+import "time"
+
+// readTimesSize bounds the packets tracked per stream, encoders buffer far fewer frames.
+const readTimesSize = 256
+
+type readTime struct {
+	pts int64
+	at  time.Time
+}
+
+// readTimes remembers when the packets were read from the source, by pts (input time base),
+// measuring how long the pipeline (decode, filter, encode) takes until the frame is written.
+type readTimes struct {
+	entries [readTimesSize]readTime
+	next    int
+}
+
+func (r *readTimes) mark(pts int64, at time.Time) {
+	r.entries[r.next%readTimesSize] = readTime{pts: pts, at: at}
+	r.next++
+}
+
+// since returns the time elapsed since the packet with the pts was read,
+// false when it's unknown (ex: the filters changed the timestamps).
+func (r *readTimes) since(pts int64, now time.Time) (time.Duration, bool) {
+	for i := 1; i <= readTimesSize && i <= r.next; i++ {
+		e := r.entries[(r.next-i)%readTimesSize]
+		if e.pts == pts && !e.at.IsZero() {
+			return now.Sub(e.at), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,78 @@
+package streamers
+
+import (
+	"strconv"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// latencyModeOptions returns the encoder options of the latency mode: the keyframe interval (g), which is
+// generic, and for the encoders known to accept them the preset, the B-frames (bf) and the lookahead.
+// ok is false when there's no tuning for the encoder. A zero frameRate keeps the keyframe interval.
+func latencyModeOptions(encoder string, mode entities.LatencyMode, frameRate float64) (options map[string]string, ok bool) {
+	if !mode.Valid() {
+		return nil, false
+	}
+
+	options = map[string]string{}
+	// a shorter keyframe interval lets the viewers join and recover faster
+	gopSeconds := 2.0
+	if mode == entities.LatencyModeQuality {
+		gopSeconds = 4
+	}
+	if frameRate > 0 {
+		options["g"] = strconv.Itoa(int(frameRate*gopSeconds + 0.5))
+	}
+
+	switch encoder {
+	case "libx264":
+		// the same as tune=zerolatency, which would replace the content type tune
+		switch mode {
+		case entities.LatencyModeRealtime:
+			options["preset"] = "veryfast"
+			options["bf"] = "0"
+			options["rc-lookahead"] = "0"
+			options["x264-params"] = "sync-lookahead=0:sliced-threads=1"
+		case entities.LatencyModeBalanced:
+			options["preset"] = "faster"
+			options["bf"] = "0"
+			options["rc-lookahead"] = "10"
+		case entities.LatencyModeQuality:
+			options["preset"] = "medium"
+			options["bf"] = "2"
+			options["rc-lookahead"] = "40"
+		}
+	case "libvpx", "libvpx-vp9":
+		// lag-in-frames is the libvpx lookahead, the alternate reference frames need it
+		switch mode {
+		case entities.LatencyModeRealtime:
+			options["deadline"] = "realtime"
+			options["cpu-used"] = "8"
+			options["lag-in-frames"] = "0"
+		case entities.LatencyModeBalanced:
+			options["deadline"] = "realtime"
+			options["cpu-used"] = "4"
+			options["lag-in-frames"] = "0"
+		case entities.LatencyModeQuality:
+			options["deadline"] = "good"
+			options["cpu-used"] = "2"
+			options["lag-in-frames"] = "16"
+			options["auto-alt-ref"] = "1"
+		}
+	default:
+		return options, false
+	}
+	return options, true
+}
+
+// mergeX264Params appends the user's x264-params to the tuned ones (ex: the realtime latency mode's), x264
+// applies them in order hence the user's win on the keys set by both.
+func mergeX264Params(tuned, user string) string {
+	if tuned == "" {
+		return user
+	}
+	if user == "" {
+		return tuned
+	}
+	return tuned + ":" + user
+}
@@ -0,0 +1,44 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyModeOptions(t *testing.T) {
+	realtime, ok := latencyModeOptions("libx264", entities.LatencyModeRealtime, 30)
+	assert.True(t, ok)
+	assert.Equal(t, "0", realtime["bf"])
+	assert.Equal(t, "0", realtime["rc-lookahead"])
+	assert.Equal(t, "60", realtime["g"])
+
+	quality, ok := latencyModeOptions("libx264", entities.LatencyModeQuality, 29.97)
+	assert.True(t, ok)
+	assert.NotEqual(t, "0", quality["bf"])
+	assert.NotEqual(t, "0", quality["rc-lookahead"])
+	assert.Equal(t, "120", quality["g"])
+
+	vp8, ok := latencyModeOptions("libvpx", entities.LatencyModeRealtime, 0)
+	assert.True(t, ok)
+	assert.Equal(t, "0", vp8["lag-in-frames"])
+	assert.Equal(t, "realtime", vp8["deadline"])
+	// the keyframe interval is kept for an unknown frame rate
+	assert.NotContains(t, vp8, "g")
+
+	// only the keyframe interval is generic
+	other, ok := latencyModeOptions("h264_nvenc", entities.LatencyModeBalanced, 25)
+	assert.False(t, ok)
+	assert.Equal(t, map[string]string{"g": "50"}, other)
+
+	options, ok := latencyModeOptions("libx264", "", 30)
+	assert.False(t, ok)
+	assert.Nil(t, options)
+}
+
+func TestMergeX264Params(t *testing.T) {
+	assert.Equal(t, "sync-lookahead=0:sliced-threads=1:keyint=30", mergeX264Params("sync-lookahead=0:sliced-threads=1", "keyint=30"))
+	assert.Equal(t, "keyint=30", mergeX264Params("", "keyint=30"))
+	assert.Equal(t, "sync-lookahead=0", mergeX264Params("sync-lookahead=0", ""))
+}
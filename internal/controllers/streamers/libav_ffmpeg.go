@@ -2,6 +2,7 @@ package streamers
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -11,9 +12,10 @@ import (
 
 	"github.com/asticode/go-astiav"
 	"github.com/asticode/go-astikit"
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/controllers/probers"
 	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/flavioribeiro/donut/internal/mapper"
-	"github.com/pion/rtp"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
@@ -22,9 +24,8 @@ type LibAVFFmpegStreamer struct {
 	c *entities.Config
 	l *zap.SugaredLogger
 	m *mapper.Mapper
-
-	lastAudioFrameDTS     float64
-	currentAudioFrameSize float64
+	// srtStreamIDs checks the publisher accepted by an SRT listener
+	srtStreamIDs *controllers.SRTStreamIDs
 }
 
 type LibAVFFmpegStreamerParams struct {
@@ -32,6 +33,8 @@ type LibAVFFmpegStreamerParams struct {
 	C *entities.Config
 	L *zap.SugaredLogger
 	M *mapper.Mapper
+
+	SRTStreamIDs *controllers.SRTStreamIDs
 }
 
 type ResultLibAVFFmpegStreamer struct {
@@ -40,20 +43,33 @@ type ResultLibAVFFmpegStreamer struct {
 }
 
 func NewLibAVFFmpegStreamer(p LibAVFFmpegStreamerParams) ResultLibAVFFmpegStreamer {
-	return ResultLibAVFFmpegStreamer{
-		LibAVFFmpegStreamer: &LibAVFFmpegStreamer{
-			c: p.C,
-			l: p.L,
-			m: p.M,
-		},
+	// the lavfi input (ex: the fallback test pattern) is a device
+	astiav.RegisterAllDevices()
+	c := &LibAVFFmpegStreamer{
+		c:            p.C,
+		l:            p.L,
+		m:            p.M,
+		srtStreamIDs: p.SRTStreamIDs,
 	}
+	// the libav log level and callback are process-wide, they're set once for the prober and the streams.
+	// libsrt logs the streamid accepted by a listener as verbose.
+	astiav.SetLogLevel(astiav.LogLevelDebug)
+	astiav.SetLogCallback(c.onLibAVLog)
+	return ResultLibAVFFmpegStreamer{LibAVFFmpegStreamer: c}
+}
+
+func (c *LibAVFFmpegStreamer) onLibAVLog(_ astiav.Classer, l astiav.LogLevel, fmt, msg string) {
+	c.l.Infof("ffmpeg %s: - %s", c.libAVLogToString(l), strings.TrimSpace(msg))
+	c.srtStreamIDs.Observe(fmt, msg)
 }
 
 func (c *LibAVFFmpegStreamer) Match(req *entities.RequestParams) bool {
 	isRTMP := strings.Contains(strings.ToLower(req.StreamURL), "rtmp")
 	isSRT := strings.Contains(strings.ToLower(req.StreamURL), "srt")
+	isPipe := entities.IsPipeURL(req.StreamURL)
+	isManifest := entities.IsManifestURL(req.StreamURL)
 
-	return isRTMP || isSRT
+	return isRTMP || isSRT || isPipe || isManifest
 }
 
 type streamContext struct {
@@ -73,15 +89,93 @@ type streamContext struct {
 	encCodec        *astiav.Codec
 	encCodecContext *astiav.CodecContext
 	encPkt          *astiav.Packet
+	// outputFrameRate is set when the frame rate is capped
+	outputFrameRate astiav.Rational
+	// bitRate is set when the target bit rate changed while streaming, it survives reopening the encoder
+	bitRate int64
+	// keyFrameRequested forces the next encoded video frame to be a key frame
+	keyFrameRequested bool
+	// outputPixelFormat is set when the recipe forces the encoder pixel format
+	outputPixelFormat string
+	// colorRange is the range signaled by the video encoder, the filters keep the samples in it
+	colorRange astiav.ColorRange
+	// outputWidth and outputHeight are set when the resolution is downscaled or the pixels made square
+	outputWidth  int
+	outputHeight int
+	// squarePixels is set when an anamorphic source is scaled to square pixels (Config.VideoSquarePixels)
+	squarePixels bool
+	// unknownFrameRate is set when the source doesn't tell its frame rate (ex: some SRT sources), the video
+	// duration is then derived from the timestamps of consecutive packets.
+	unknownFrameRate bool
+	frameDurations   frameDurations
+
+	// filter is the current filter, kept to rebuild the graph when the quality is downgraded
+	filter *entities.DonutStreamFilter
+	// audioFormat is the format of the decoded audio the filter graph was configured for
+	audioFormat audioFormat
+	// budget is nil when the encode time isn't tracked
+	budget *encodeBudget
+	// awaitingKeyFrame is set while bypassed frames are dropped after a corrupt one
+	awaitingKeyFrame bool
+	// readTimes measures the pipeline latency of each frame
+	readTimes readTimes
+	// timecode is nil unless the source metadata carries a start timecode
+	timecode *timecodeTracker
+	// samples accounts the transcoded audio samples
+	samples sampleCounter
+	// rtp timestamps the encoded packets (Config.RTPTimestampResetWindowS)
+	rtp rtpClock
+	// stats measures the throughput and frame rate logged every Config.StreamStatsIntervalMS
+	stats streamStats
+	// poster tracks the capture of the first video key frame (Config.PosterFrames)
+	poster posterState
+	// muxerEncoder encodes the decoded frames a second time for the muxers (DonutMediaTask.MuxerCodec),
+	// it's nil when they get the encoded packets of this stream.
+	muxerEncoder *streamContext
+	// startPTS is the position (in the input time base) the input was sought to, the decoded frames
+	// before it are discarded while seeking. Bypassed video starts at the preceding key frame.
+	startPTS int64
+	seeking  bool
+
+	// Bit stream filters, applied in sequence, each one has its output packet
+	bsfContexts []*astiav.BitStreamFilterContext
+	bsfPackets  []*astiav.Packet
+}
+
+// defaultSVCBitRate is used when SVC is enabled without a bit rate, libvpx requires per layer bit rates.
+const defaultSVCBitRate = 1_000_000
+
+// temporalLayersParameters builds the libvpx ts-parameters, the layering mode defines
+// the pattern (ex: 0,2,1,2 for 3 layers) and each layer gets a cumulative share of the bit rate (kbps).
+func temporalLayersParameters(layers int, bitRate int64) string {
+	shares := []int64{60, 100}
+	if layers == 3 {
+		shares = []int64{40, 60, 100}
+	}
 
-	// Bit stream filter
-	bsfContext *astiav.BitStreamFilterContext
-	bsfPacket  *astiav.Packet
+	var bitRates []string
+	for _, share := range shares {
+		bitRates = append(bitRates, strconv.FormatInt(bitRate*share/100/1000, 10))
+	}
+	return fmt.Sprintf("ts_layering_mode=%d:ts_target_bitrate=%s", layers, strings.Join(bitRates, ","))
 }
 
 type libAVParams struct {
 	inputFormatContext *astiav.FormatContext
 	streams            map[int]*streamContext
+	// dropped are the streams of a media the recipe drops, along with the audio streams it doesn't select
+	dropped map[int]bool
+	// data are the data streams (ex: SCTE-35, KLV), they never reach the decoders
+	data map[int]*astiav.Stream
+
+	// prebuffer is nil when there's no initial buffering
+	prebuffer *prebuffer
+
+	// events are the lifecycle events reported so far (Config.PipelineEvents)
+	events *pipelineEvents
+
+	// discontinuities is nil unless the input timestamps might jump (Config.TimestampDiscontinuity)
+	discontinuities *discontinuityTracker
 }
 
 func (c *LibAVFFmpegStreamer) Stream(donut *entities.DonutParameters) {
@@ -92,14 +186,15 @@ func (c *LibAVFFmpegStreamer) Stream(donut *entities.DonutParameters) {
 
 	p := &libAVParams{
 		streams: make(map[int]*streamContext),
+		dropped: make(map[int]bool),
+		data:    make(map[int]*astiav.Stream),
+		events:  newPipelineEvents(time.Now()),
 	}
 
-	// it's useful for debugging
-	// astiav.SetLogLevel(astiav.LogLevelDebug)
-	astiav.SetLogLevel(astiav.LogLevelDebug)
-	astiav.SetLogCallback(func(_ astiav.Classer, l astiav.LogLevel, fmt, msg string) {
-		c.l.Infof("ffmpeg %s: - %s", c.libAVLogToString(l), strings.TrimSpace(msg))
-	})
+	if c.c.PrebufferMS > 0 {
+		p.prebuffer = newPrebuffer(time.Duration(c.c.PrebufferMS) * time.Millisecond)
+		donut = p.prebuffer.wrap(donut)
+	}
 
 	c.l.Infof("preparing input")
 	if err := c.prepareInput(p, closer, donut); err != nil {
@@ -125,22 +220,54 @@ func (c *LibAVFFmpegStreamer) Stream(donut *entities.DonutParameters) {
 		return
 	}
 
+	if err := c.validateStreams(p, donut); err != nil {
+		c.onError(err, donut)
+		return
+	}
+
 	inPkt := astiav.AllocPacket()
 	closer.Add(inPkt.Free)
 
 	for {
 		select {
+		case u := <-donut.FilterUpdates:
+			// applied between two packets, the stream keeps going even when it fails
+			err := c.reconfigureFilter(p, donut, u)
+			if err != nil {
+				c.l.Warnf("reconfiguring filter failed: %s", err.Error())
+			}
+			if u.Done != nil {
+				u.Done <- err
+			}
+		case u := <-donut.BitRateUpdates:
+			err := c.updateBitRate(p, u)
+			if err != nil {
+				c.l.Warnf("updating bit rate failed: %s", err.Error())
+			}
+			if u.Done != nil {
+				u.Done <- err
+			}
+		case <-donut.KeyFrameRequests:
+			c.requestKeyFrame(p)
 		case <-donut.Ctx.Done():
 			if errors.Is(donut.Ctx.Err(), context.Canceled) {
 				c.l.Info("streaming has stopped due cancellation")
+				c.flush(p, donut)
 				return
 			}
 			c.onError(donut.Ctx.Err(), donut)
 			return
 		default:
 			if err := p.inputFormatContext.ReadFrame(inPkt); err != nil {
+				if errors.Is(err, astiav.ErrEagain) {
+					// only happens for the polling read strategy, there's no data yet
+					time.Sleep(time.Duration(c.c.SRTPollIntervalMS) * time.Millisecond)
+					continue
+				}
 				if errors.Is(err, astiav.ErrEof) || errors.Is(err, io.EOF) {
 					c.l.Info("End of stream reached")
+					c.flush(p, donut)
+					c.onEnd(donut)
 					return
 				}
 				if errors.Is(err, context.Canceled) || errors.Is(err, io.ErrClosedPipe) {
@@ -151,14 +278,39 @@ func (c *LibAVFFmpegStreamer) Stream(donut *entities.DonutParameters) {
 				return
 			}
 
+			if p.dropped[inPkt.StreamIndex()] {
+				inPkt.Unref()
+				continue
+			}
+			if ds, ok := p.data[inPkt.StreamIndex()]; ok {
+				if err := c.forwardCue(ds, inPkt, donut); err != nil {
+					c.l.Warnf("forwarding cue failed: %s", err.Error())
+				}
+				inPkt.Unref()
+				continue
+			}
 			s, ok := p.streams[inPkt.StreamIndex()]
 			if !ok {
-				c.l.Warnf("skipping to process stream id=%d", inPkt.StreamIndex())
+				// ex: a stream showing up after probing, it's ignored from now on
+				c.l.Infof("ignoring stream #%d unknown while probing", inPkt.StreamIndex())
+				p.dropped[inPkt.StreamIndex()] = true
+				inPkt.Unref()
 				continue
 			}
+			if p.discontinuities != nil {
+				if err := c.rebaseTimestamps(p, s, inPkt, donut); err != nil {
+					c.onError(err, donut)
+					return
+				}
+			}
+			s.readTimes.mark(inPkt.Pts(), time.Now())
+			// the bypassed packets are decoded only for the poster, before the bit stream filters change them
+			if donut.Recipe.Video.Action == entities.DonutBypass && c.wantsPoster(s, donut) {
+				c.decodePoster(s, inPkt, donut)
+			}
 
-			if s.bsfContext != nil {
-				if err := c.applyBitStreamFilter(p, inPkt, s, donut); err != nil {
+			if len(s.bsfContexts) > 0 {
+				if err := c.applyBitStreamFilter(p, inPkt, s, 0, donut); err != nil {
 					c.onError(err, donut)
 					return
 				}
@@ -173,30 +325,222 @@ func (c *LibAVFFmpegStreamer) Stream(donut *entities.DonutParameters) {
 	}
 }
 
+// forwardCue sends the packet of a data stream as a cue, ex: a SCTE-35 splice.
+func (c *LibAVFFmpegStreamer) forwardCue(is *astiav.Stream, pkt *astiav.Packet, donut *entities.DonutParameters) error {
+	if !c.c.DataStreamCues || donut.OnCue == nil {
+		return nil
+	}
+	return donut.OnCue(&entities.Cue{
+		Type:      is.CodecParameters().CodecID().Name(),
+		StartTime: astiav.RescaleQ(pkt.Pts(), is.TimeBase(), astiav.NewRational(1, 1000)),
+		Text:      base64.StdEncoding.EncodeToString(pkt.Data()),
+	})
+}
+
+// logStats accounts a frame written to the sinks, logging the stream throughput and frame rate once per interval.
+func (c *LibAVFFmpegStreamer) logStats(s *streamContext, mediaType entities.MediaType, size int) {
+	if c.c.StreamStatsIntervalMS <= 0 {
+		return
+	}
+	interval := time.Duration(c.c.StreamStatsIntervalMS) * time.Millisecond
+	if bitRate, frameRate, ok := s.stats.add(size, time.Now(), interval); ok {
+		c.l.Infof("stream #%d %s: %.1f Mbps, %.2f fps", s.inputStream.Index(), mediaType, bitRate/1e6, frameRate)
+	}
+}
+
+// wantsPoster is true for the video stream until its poster is captured, when Config.PosterFrames is enabled.
+func (c *LibAVFFmpegStreamer) wantsPoster(s *streamContext, donut *entities.DonutParameters) bool {
+	return c.c.PosterFrames && donut.OnPoster != nil && !s.poster.done &&
+		s.decCodecContext.MediaType() == astiav.MediaTypeVideo
+}
+
+// decodePoster decodes the bypassed packets, from the first key frame on, until the poster is captured.
+func (c *LibAVFFmpegStreamer) decodePoster(s *streamContext, pkt *astiav.Packet, donut *entities.DonutParameters) {
+	if !s.poster.started && !pkt.Flags().Has(astiav.PacketFlagKey) {
+		return
+	}
+	s.poster.started = true
+	if s.poster.packets++; s.poster.packets > posterMaxPackets {
+		c.l.Warnf("no poster decoded for stream #%d after %d packets", s.inputStream.Index(), posterMaxPackets)
+		s.poster.done = true
+		return
+	}
+
+	if err := s.decCodecContext.SendPacket(pkt); err != nil {
+		c.l.Warnf("decoding the poster failed: %s", err.Error())
+		s.poster.done = true
+		return
+	}
+	if err := s.decCodecContext.ReceiveFrame(s.decFrame); err != nil {
+		if !errors.Is(err, astiav.ErrEagain) {
+			c.l.Warnf("decoding the poster failed: %s", err.Error())
+			s.poster.done = true
+		}
+		return
+	}
+	defer s.decFrame.Unref()
+	c.capturePoster(s, s.decFrame, donut)
+}
+
+// capturePoster sends the frame as the poster, it's captured once even when it fails.
+func (c *LibAVFFmpegStreamer) capturePoster(s *streamContext, f *astiav.Frame, donut *entities.DonutParameters) {
+	s.poster.done = true
+	poster, err := encodePoster(f, c.c.PosterMaxWidth)
+	if err != nil {
+		c.l.Warnf("capturing the poster failed: %s", err.Error())
+		return
+	}
+	if err := donut.OnPoster(poster); err != nil {
+		c.l.Warnf("sending the poster failed: %s", err.Error())
+		return
+	}
+	c.l.Infof("poster of stream #%d captured (%d bytes)", s.inputStream.Index(), len(poster))
+}
+
+// reportTimecode sends the timecode of a video key frame (pts in the input time base), read from
+// its S12M side data when it's been decoded or derived from the source start timecode otherwise.
+func (c *LibAVFFmpegStreamer) reportTimecode(s *streamContext, pts int64, s12m []byte, donut *entities.DonutParameters) {
+	if !c.c.TimecodeReports || donut.OnTimecode == nil {
+		return
+	}
+	timecode, ok := s12mTimecode(s12m)
+	if !ok {
+		if s.timecode == nil {
+			return
+		}
+		timecode = s.timecode.at(pts)
+	}
+	if err := donut.OnTimecode(&entities.TimecodeInfo{
+		Timecode: timecode,
+		PTSMS:    astiav.RescaleQ(pts, s.inputStream.TimeBase(), astiav.NewRational(1, 1000)),
+	}); err != nil {
+		c.l.Warnf("reporting timecode failed: %s", err.Error())
+	}
+}
+
+// flush drains the frames still buffered by the decoders, filters and encoders,
+// otherwise the last frames of a finite stream would be lost.
+func (c *LibAVFFmpegStreamer) flush(p *libAVParams, donut *entities.DonutParameters) {
+	for _, s := range p.streams {
+		// bypassed streams have nothing buffered
+		if s.encCodecContext == nil {
+			continue
+		}
+		if err := c.flushStream(p, s, donut); err != nil {
+			c.l.Warnf("flushing stream %d failed: %s", s.inputStream.Index(), err.Error())
+		}
+	}
+
+	// a stream shorter than the prebuffer must still be written
+	if p.prebuffer != nil {
+		if err := p.prebuffer.release(); err != nil {
+			c.l.Warnf("releasing prebuffer failed: %s", err.Error())
+		}
+	}
+}
+
+func (c *LibAVFFmpegStreamer) flushStream(p *libAVParams, s *streamContext, donut *entities.DonutParameters) error {
+	if err := c.drainDecoder(p, s, donut); err != nil {
+		return err
+	}
+
+	// a nil frame signals EOF to the filter graph
+	if err := c.filterAndEncode(p, nil, s, donut); err != nil {
+		return fmt.Errorf("flushing filter failed: %w", err)
+	}
+
+	// a nil frame enters the encoder in draining mode
+	if err := c.encodeFrame(p, nil, s, donut); err != nil {
+		return fmt.Errorf("flushing encoder failed: %w", err)
+	}
+	if s.muxerEncoder != nil {
+		if err := c.encodeMuxerFrame(s.muxerEncoder, nil, donut); err != nil {
+			return fmt.Errorf("flushing muxer encoder failed: %w", err)
+		}
+	}
+
+	if s.decCodecContext.MediaType() == astiav.MediaTypeAudio {
+		c.l.Infow("audio samples",
+			"filtered", s.samples.filtered,
+			"encoded", s.samples.encoded,
+			"missing", s.samples.missing(),
+		)
+	}
+	return nil
+}
+
+// drainDecoder sends the frames still buffered by the decoder through the filters and the encoders,
+// the decoder can't take packets anymore.
+func (c *LibAVFFmpegStreamer) drainDecoder(p *libAVParams, s *streamContext, donut *entities.DonutParameters) error {
+	// a nil packet enters the decoder in draining mode
+	if err := s.decCodecContext.SendPacket(nil); err != nil && !errors.Is(err, astiav.ErrEof) {
+		return fmt.Errorf("flushing decoder failed: %w", err)
+	}
+	for {
+		if err := s.decCodecContext.ReceiveFrame(s.decFrame); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				break
+			}
+			return fmt.Errorf("draining decoder failed: %w", err)
+		}
+		if err := c.filterAndEncode(p, s.decFrame, s, donut); err != nil {
+			return err
+		}
+		if s.muxerEncoder != nil {
+			if err := c.encodeMuxerFrame(s.muxerEncoder, s.decFrame, donut); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateStreams fails fast when a stream is half set up, ex: a filter graph without an encoder,
+// instead of panicking on the first frame.
+func (c *LibAVFFmpegStreamer) validateStreams(p *libAVParams, donut *entities.DonutParameters) error {
+	for _, s := range p.streams {
+		var mediaType entities.MediaType
+		switch s.inputStream.CodecParameters().MediaType() {
+		case astiav.MediaTypeVideo:
+			mediaType = entities.VideoType
+		case astiav.MediaTypeAudio:
+			mediaType = entities.AudioType
+		default:
+			continue
+		}
+		stages := pipelineStages{
+			decoder:     s.decCodecContext != nil,
+			filterGraph: s.filterGraph != nil && s.buffersrcContext != nil && s.buffersinkContext != nil,
+			encoder:     s.encCodecContext != nil && s.encPkt != nil,
+		}
+		if err := stages.validate(mediaType, bypassed(mediaType, donut.Recipe)); err != nil {
+			return fmt.Errorf("stream %d: %w", s.inputStream.Index(), err)
+		}
+	}
+	return nil
+}
+
 func (c *LibAVFFmpegStreamer) onError(err error, p *entities.DonutParameters) {
 	if p.OnError != nil {
 		p.OnError(err)
 	}
 }
 
+func (c *LibAVFFmpegStreamer) onEnd(p *entities.DonutParameters) {
+	if p.OnEnd != nil {
+		p.OnEnd()
+	}
+}
+
 func (c *LibAVFFmpegStreamer) prepareInput(p *libAVParams, closer *astikit.Closer, donut *entities.DonutParameters) error {
 	if p.inputFormatContext = astiav.AllocFormatContext(); p.inputFormatContext == nil {
 		return errors.New("ffmpeg/libav: input format context is nil")
 	}
 	closer.Add(p.inputFormatContext.Free)
 
-	// Modify SRT URL to use 0.0.0.0 and remove query params
-	inputURL := donut.Recipe.Input.URL
-	if strings.Contains(strings.ToLower(inputURL), "srt://") {
-		urlParts := strings.Split(inputURL, "://")
-		if len(urlParts) == 2 {
-			// Remove any query parameters and just get host:port
-			hostPort := strings.Split(strings.Split(urlParts[1], "?")[0], ":")
-			if len(hostPort) == 2 {
-				inputURL = fmt.Sprintf("srt://0.0.0.0:%s", hostPort[1])
-			}
-		}
-	}
+	// listeners bind every interface, callers keep the remote listener address
+	inputURL := mapper.NormalizeSRTListenerURL(donut.Recipe.Input.URL)
+	isSRTCaller := entities.IsSRTCallerURL(inputURL)
 
 	inputFormat, err := c.defineInputFormat(donut.Recipe.Input.Format.String())
 	if err != nil {
@@ -214,27 +558,93 @@ func (c *LibAVFFmpegStreamer) prepareInput(p *libAVParams, closer *astikit.Close
 	}
 
 	// Add SRT listener mode
-	if strings.Contains(strings.ToLower(inputURL), "srt://") {
+	if isSRTCaller {
+		inputOptions.Set("mode", "caller", 0)
+		inputOptions.Set("connect_timeout", strconv.Itoa(c.c.SRTConnectTimeoutMS), 0)
+	} else if strings.Contains(strings.ToLower(inputURL), "srt://") {
 		inputOptions.Set("mode", "listener", 0)
 	}
 
-	if err := p.inputFormatContext.OpenInput(inputURL, inputFormat, inputOptions); err != nil {
-		return fmt.Errorf("ffmpeg/libav: opening input failed %w", err)
+	if donut.Recipe.Input.ReadStrategy == entities.DonutReadPolling {
+		p.inputFormatContext.SetFlags(p.inputFormatContext.Flags().Add(astiav.FormatContextFlagNonblock))
+	}
+
+	// Read from the given reader (ex: stdin) instead of letting libav open the url
+	if donut.Recipe.Input.Reader != nil {
+		ioContext, err := c.defineInputIOContext(donut.Recipe.Input.Reader, closer)
+		if err != nil {
+			return err
+		}
+		p.inputFormatContext.SetPb(ioContext)
+	}
+
+	started := time.Now()
+	srtStreamID := c.srtStreamIDs.Watch()
+	err = p.inputFormatContext.OpenInput(inputURL, inputFormat, inputOptions)
+	srtStreamID.Stop()
+	if err != nil {
+		if isSRTCaller && probers.SRTConnectTimedOut(err, started, c.c.SRTConnectTimeoutMS) {
+			return fmt.Errorf("%w %s: %s", entities.ErrSRTConnectTimeout, inputURL, err.Error())
+		}
+		return fmt.Errorf("ffmpeg/libav: opening input failed %w", c.m.FromLibAVOpenInputErrorToSourceError(err, strings.HasPrefix(strings.ToLower(inputURL), "srt://")))
 	}
 	closer.Add(p.inputFormatContext.CloseInput)
+	c.reportPipelineEvent(p, entities.PipelineEventInputOpened, "", donut)
+
+	// closing the input disconnects the rejected publisher
+	if strings.Contains(strings.ToLower(inputURL), "srt://") && !isSRTCaller {
+		if err := srtStreamID.Check(donut.Recipe.Input.Options[entities.DonutSRTStreamID]); err != nil {
+			return err
+		}
+	}
 
-	if err := p.inputFormatContext.FindStreamInfo(nil); err != nil {
+	if err := c.findStreamInfo(p.inputFormatContext, donut.Recipe); err != nil {
 		return fmt.Errorf("ffmpeg/libav: finding stream info failed %w", err)
 	}
+	c.reportPipelineEvent(p, entities.PipelineEventStreamInfoFound, "", donut)
+
+	if c.c.TimestampDiscontinuity != entities.TimestampDiscontinuityIgnore &&
+		p.inputFormatContext.InputFormat().Flags().Has(astiav.IOFormatFlagTsDiscont) {
+		p.discontinuities = newDiscontinuityTracker(time.Duration(c.c.TimestampDiscontinuityThresholdMS) * time.Millisecond)
+	}
 
+	audioStreams := 0
 	for _, is := range p.inputFormatContext.Streams() {
 		if is.CodecParameters().MediaType() != astiav.MediaTypeAudio &&
 			is.CodecParameters().MediaType() != astiav.MediaTypeVideo {
 			c.l.Infof("skipping media type %s", is.CodecParameters().MediaType().String())
+			if is.CodecParameters().MediaType() == astiav.MediaTypeData {
+				p.data[is.Index()] = is
+			} else {
+				p.dropped[is.Index()] = true
+			}
+			continue
+		}
+		if is.CodecParameters().MediaType() == astiav.MediaTypeAudio {
+			selected := audioStreams == donut.Recipe.Audio.StreamIndex
+			audioStreams++
+			if donut.Recipe.Audio.Action == entities.DonutDrop || !selected {
+				c.l.Infof("dropping audio stream #%d", is.Index())
+				p.dropped[is.Index()] = true
+				continue
+			}
+		}
+		if is.CodecParameters().MediaType() == astiav.MediaTypeVideo && donut.Recipe.Video.Action == entities.DonutDrop {
+			c.l.Infof("dropping video stream #%d", is.Index())
+			p.dropped[is.Index()] = true
 			continue
 		}
 
 		s := &streamContext{inputStream: is}
+		if c.c.TimecodeReports && is.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+			if start := sourceTimecode(p.inputFormatContext, is); start != "" {
+				tracker, err := newTimecodeTracker(start, is.AvgFrameRate(), is.TimeBase())
+				if err != nil {
+					c.l.Warnf("ignoring the source timecode: %s", err.Error())
+				}
+				s.timecode = tracker
+			}
+		}
 
 		// Log the time base and other timing info
 		c.l.Infof("Stream #%d: type=%s codec=%s timebase=%v avg_frame_rate=%v r_frame_rate=%v",
@@ -245,29 +655,11 @@ func (c *LibAVFFmpegStreamer) prepareInput(p *libAVParams, closer *astikit.Close
 			is.AvgFrameRate().String(),
 			is.RFrameRate().String())
 
-		if s.decCodec = astiav.FindDecoder(is.CodecParameters().CodecID()); s.decCodec == nil {
-			return errors.New("ffmpeg/libav: codec is missing")
-		}
-
-		if s.decCodecContext = astiav.AllocCodecContext(s.decCodec); s.decCodecContext == nil {
-			return errors.New("ffmpeg/libav: codec context is nil")
-		}
-		closer.Add(s.decCodecContext.Free)
-
-		if err := is.CodecParameters().ToCodecContext(s.decCodecContext); err != nil {
-			return fmt.Errorf("ffmpeg/libav: updating codec context failed %w", err)
-		}
-
-		//FFMPEG_NEW
-		s.decCodecContext.SetTimeBase(s.inputStream.TimeBase())
-
-		if is.CodecParameters().MediaType() == astiav.MediaTypeVideo {
-			s.decCodecContext.SetFramerate(p.inputFormatContext.GuessFrameRate(is, nil))
-		}
-
-		if err := s.decCodecContext.Open(s.decCodec, nil); err != nil {
-			return fmt.Errorf("ffmpeg/libav: opening codec context failed %w", err)
+		if err := c.openDecoder(p, s, donut); err != nil {
+			return err
 		}
+		// the decoder is replaced after a discontinuity (Config.TimestampDiscontinuity)
+		closer.Add(func() { s.decCodecContext.Free() })
 
 		s.decFrame = astiav.AllocFrame()
 		closer.Add(s.decFrame.Free)
@@ -282,9 +674,97 @@ func (c *LibAVFFmpegStreamer) prepareInput(p *libAVParams, closer *astikit.Close
 			}
 		}
 	}
+
+	if donut.Recipe.Input.StartAt > 0 {
+		if err := c.seek(p, donut.Recipe.Input.StartAt); err != nil {
+			return fmt.Errorf("ffmpeg/libav: seeking input failed %w", err)
+		}
+	}
+	return nil
+}
+
+// openDecoder opens the decoder of the input stream, it's only kept when it opens.
+func (c *LibAVFFmpegStreamer) openDecoder(p *libAVParams, s *streamContext, donut *entities.DonutParameters) error {
+	is := s.inputStream
+	if s.decCodec = astiav.FindDecoder(is.CodecParameters().CodecID()); s.decCodec == nil {
+		return errors.New("ffmpeg/libav: codec is missing")
+	}
+
+	cc := astiav.AllocCodecContext(s.decCodec)
+	if cc == nil {
+		return errors.New("ffmpeg/libav: codec context is nil")
+	}
+
+	if err := is.CodecParameters().ToCodecContext(cc); err != nil {
+		cc.Free()
+		return fmt.Errorf("ffmpeg/libav: updating codec context failed %w", err)
+	}
+
+	//FFMPEG_NEW
+	cc.SetTimeBase(s.inputStream.TimeBase())
+
+	// the container (ex: mkv, mp4) might carry the aspect ratio instead of the bitstream
+	if is.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+		cc.SetSampleAspectRatio(p.inputFormatContext.GuessSampleAspectRatio(is, nil))
+	}
+
+	decoderOptions := donut.Recipe.Audio.DecoderCodecContextOptions
+	if is.CodecParameters().MediaType() == astiav.MediaTypeVideo {
+		frameRate := p.inputFormatContext.GuessFrameRate(is, nil)
+		if frameRate.Num() <= 0 || frameRate.Den() <= 0 {
+			s.unknownFrameRate = true
+			if fps := c.c.VideoFallbackFrameRate; fps > 0 {
+				frameRate = astiav.NewRational(fps, 1)
+				s.frameDurations = newFrameDurations(time.Second / time.Duration(fps))
+			}
+			c.l.Warnf("unknown frame rate for stream #%d, assuming %s fps until the timestamps tell", is.Index(), frameRate.String())
+		}
+		cc.SetFramerate(frameRate)
+		decoderOptions = donut.Recipe.Video.DecoderCodecContextOptions
+	}
+	for _, opt := range decoderOptions {
+		opt(cc)
+	}
+
+	if err := cc.Open(s.decCodec, nil); err != nil {
+		cc.Free()
+		return fmt.Errorf("ffmpeg/libav: opening codec context failed %w", err)
+	}
+	s.decCodecContext = cc
+	return nil
+}
+
+// seek moves the input to the key frames preceding the position, the decoders have no frame yet so
+// there's nothing to flush. The transcoded streams discard the decoded frames until the position.
+func (c *LibAVFFmpegStreamer) seek(p *libAVParams, startAt time.Duration) error {
+	ts := startAt.Microseconds()
+	if start := p.inputFormatContext.StartTime(); start != astiav.NoPtsValue {
+		ts += start
+	}
+	c.l.Infof("seeking input to %s", startAt)
+
+	if err := p.inputFormatContext.SeekFrame(-1, ts, astiav.NewSeekFlags(astiav.SeekFlagBackward)); err != nil {
+		return err
+	}
+	for _, s := range p.streams {
+		s.startPTS = astiav.RescaleQ(ts, astiav.TimeBaseQ, s.inputStream.TimeBase())
+		s.seeking = true
+	}
 	return nil
 }
 
+// beforeStart returns true for the frames (or bypassed audio packets) preceding the position sought to.
+func (s *streamContext) beforeStart(pts int64) bool {
+	if !s.seeking || pts == astiav.NoPtsValue {
+		return false
+	}
+	if pts < s.startPTS {
+		return true
+	}
+	s.seeking = false
+	return false
+}
+
 func (c *LibAVFFmpegStreamer) prepareOutput(p *libAVParams, closer *astikit.Closer, donut *entities.DonutParameters) error {
 	for _, is := range p.inputFormatContext.Streams() {
 		s, ok := p.streams[is.Index()]
@@ -294,87 +774,80 @@ func (c *LibAVFFmpegStreamer) prepareOutput(p *libAVParams, closer *astikit.Clos
 		}
 
 		isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
-		isVideoBypass := donut.Recipe.Video.Action == entities.DonutBypass
-		if isVideo && isVideoBypass {
+		if isVideo && !plannedStages(entities.VideoType, donut.Recipe).encoder {
 			c.l.Infof("bypass video for %+v", s.inputStream)
+			if err := c.addMuxerStream(donut, entities.VideoType, s.inputStream.CodecParameters(), s.decCodecContext.TimeBase()); err != nil {
+				return err
+			}
 			continue
 		}
 
 		isAudio := s.decCodecContext.MediaType() == astiav.MediaTypeAudio
-		isAudioBypass := donut.Recipe.Audio.Action == entities.DonutBypass
-		if isAudio && isAudioBypass {
+		if isAudio && !plannedStages(entities.AudioType, donut.Recipe).encoder {
 			c.l.Infof("bypass audio for %+v", s.inputStream)
+			if err := c.addMuxerStream(donut, entities.AudioType, s.inputStream.CodecParameters(), s.decCodecContext.TimeBase()); err != nil {
+				return err
+			}
 			continue
 		}
 
-		var codecID astiav.CodecID
+		var codec entities.Codec
 		if isAudio {
-			audioCodecID, err := c.m.FromStreamCodecToLibAVCodecID(donut.Recipe.Audio.Codec)
-			if err != nil {
-				return err
-			}
-			codecID = audioCodecID
+			codec = donut.Recipe.Audio.Codec
 		}
 		if isVideo {
-			videoCodecID, err := c.m.FromStreamCodecToLibAVCodecID(donut.Recipe.Video.Codec)
-			if err != nil {
-				return err
-			}
-			codecID = videoCodecID
+			codec = donut.Recipe.Video.Codec
+		}
+		codecID, err := c.m.FromStreamCodecToLibAVCodecID(codec)
+		if err != nil {
+			return err
 		}
 
 		if s.encCodec = astiav.FindEncoder(codecID); s.encCodec == nil {
-			// TODO: migrate error to entity
-			return fmt.Errorf("cannot find a libav encoder for %+v", codecID)
+			return entities.NewEncoderNotFoundError(codec)
 		}
 
-		if s.encCodecContext = astiav.AllocCodecContext(s.encCodec); s.encCodecContext == nil {
-			return errors.New("ffmpeg/libav: codec context is nil")
+		// the encoder might be reopened while streaming, see downgrade
+		closer.Add(func() {
+			if s.encCodecContext != nil {
+				s.encCodecContext.Free()
+			}
+		})
+		if err := c.openEncoder(s, donut); err != nil {
+			return err
 		}
-		closer.Add(s.encCodecContext.Free)
-
 		if isAudio {
-			if v := s.encCodec.ChannelLayouts(); len(v) > 0 {
-				s.encCodecContext.SetChannelLayout(v[0])
-			} else {
-				s.encCodecContext.SetChannelLayout(s.decCodecContext.ChannelLayout())
-			}
-			s.encCodecContext.SetChannels(s.decCodecContext.Channels())
-			s.encCodecContext.SetSampleRate(s.decCodecContext.SampleRate())
-			if v := s.encCodec.SampleFormats(); len(v) > 0 {
-				s.encCodecContext.SetSampleFormat(v[0])
-			} else {
-				s.encCodecContext.SetSampleFormat(s.decCodecContext.SampleFormat())
+			if err := c.prepareMuxerAudio(s, closer, donut); err != nil {
+				return err
 			}
-			s.encCodecContext.SetTimeBase(s.decCodecContext.TimeBase())
 		}
-
 		if isVideo {
-			if v := s.encCodec.PixelFormats(); len(v) > 0 {
-				s.encCodecContext.SetPixelFormat(v[0])
-			} else {
-				s.encCodecContext.SetPixelFormat(s.decCodecContext.PixelFormat())
-			}
-			s.encCodecContext.SetSampleAspectRatio(s.decCodecContext.SampleAspectRatio())
-			s.encCodecContext.SetTimeBase(s.decCodecContext.TimeBase())
-			s.encCodecContext.SetHeight(s.decCodecContext.Height())
-			s.encCodecContext.SetWidth(s.decCodecContext.Width())
-			// s.encCodecContext.SetFramerate(s.inputStream.AvgFrameRate())
-
-			// overriding with user provide config
-			if len(donut.Recipe.Video.CodecContextOptions) > 0 {
-				for _, opt := range donut.Recipe.Video.CodecContextOptions {
-					opt(s.encCodecContext)
-				}
+			if err := c.prepareMuxerVideo(s, closer, donut); err != nil {
+				return err
 			}
 		}
 
-		if s.decCodecContext.Flags().Has(astiav.CodecContextFlagGlobalHeader) {
-			s.encCodecContext.SetFlags(s.encCodecContext.Flags().Add(astiav.CodecContextFlagGlobalHeader))
+		if isVideo && c.c.EncodeBudgetPercent > 0 {
+			s.budget = newEncodeBudget(c.c.EncodeBudgetPercent, time.Duration(c.c.EncodeBudgetWindowMS)*time.Millisecond)
 		}
 
-		if err := s.encCodecContext.Open(s.encCodec, nil); err != nil {
-			return fmt.Errorf("opening encoder context failed: %w", err)
+		if len(muxersOf(donut.Sinks)) > 0 {
+			muxerEncoder := s.encCodecContext
+			if s.muxerEncoder != nil {
+				muxerEncoder = s.muxerEncoder.encCodecContext
+			}
+			encCodecParameters := astiav.AllocCodecParameters()
+			closer.Add(encCodecParameters.Free)
+			if err := encCodecParameters.FromCodecContext(muxerEncoder); err != nil {
+				return fmt.Errorf("ffmpeg/libav: getting encoder parameters failed %w", err)
+			}
+			mediaType := entities.VideoType
+			if isAudio {
+				mediaType = entities.AudioType
+			}
+			if err := c.addMuxerStream(donut, mediaType, encCodecParameters, muxerEncoder.TimeBase()); err != nil {
+				return err
+			}
 		}
 
 		// Log input and output time bases
@@ -396,108 +869,191 @@ func (c *LibAVFFmpegStreamer) prepareOutput(p *libAVParams, closer *astikit.Clos
 	return nil
 }
 
-func (c *LibAVFFmpegStreamer) prepareFilters(p *libAVParams, closer *astikit.Closer, donut *entities.DonutParameters) error {
-	for _, s := range p.streams {
+// openEncoder allocates and opens the stream encoder, replacing the current one (if any).
+func (c *LibAVFFmpegStreamer) openEncoder(s *streamContext, donut *entities.DonutParameters) error {
+	if s.encCodecContext != nil {
+		s.encCodecContext.Free()
+	}
+	if s.encCodecContext = astiav.AllocCodecContext(s.encCodec); s.encCodecContext == nil {
+		return errors.New("ffmpeg/libav: codec context is nil")
+	}
 
-		isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
-		isVideoBypass := donut.Recipe.Video.Action == entities.DonutBypass
-		if isVideo && isVideoBypass {
-			c.l.Infof("bypass video for %+v", s.inputStream)
-			continue
+	isAudio := s.decCodecContext.MediaType() == astiav.MediaTypeAudio
+	if isAudio {
+		if donut.Recipe.Audio.Mono {
+			// the filter downmixed the source
+			s.encCodecContext.SetChannelLayout(astiav.ChannelLayoutMono)
+			s.encCodecContext.SetChannels(1)
+		} else {
+			if v := s.encCodec.ChannelLayouts(); len(v) > 0 {
+				s.encCodecContext.SetChannelLayout(v[0])
+			} else {
+				s.encCodecContext.SetChannelLayout(s.decCodecContext.ChannelLayout())
+			}
+			s.encCodecContext.SetChannels(s.decCodecContext.Channels())
 		}
-
-		isAudio := s.decCodecContext.MediaType() == astiav.MediaTypeAudio
-		isAudioBypass := donut.Recipe.Audio.Action == entities.DonutBypass
-		if isAudio && isAudioBypass {
-			c.l.Infof("bypass audio for %+v", s.inputStream)
-			continue
+		s.encCodecContext.SetSampleRate(s.decCodecContext.SampleRate())
+		if v := s.encCodec.SampleFormats(); len(v) > 0 {
+			s.encCodecContext.SetSampleFormat(v[0])
+		} else {
+			s.encCodecContext.SetSampleFormat(s.decCodecContext.SampleFormat())
 		}
+		s.encCodecContext.SetTimeBase(s.decCodecContext.TimeBase())
 
-		var args astiav.FilterArgs
-		var buffersrc, buffersink *astiav.Filter
-		var content string
-		var err error
-
-		if s.filterGraph = astiav.AllocFilterGraph(); s.filterGraph == nil {
-			return errors.New("main: graph is nil")
+		// the sample rate must match the one produced by the resampler filter
+		for _, opt := range donut.Recipe.Audio.CodecContextOptions {
+			opt(s.encCodecContext)
 		}
-		closer.Add(s.filterGraph.Free)
+	}
 
-		outputs := astiav.AllocFilterInOut()
-		if outputs == nil {
-			return errors.New("main: outputs is nil")
+	isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
+	if isVideo {
+		if name := donut.Recipe.Video.PixelFormat; name != "" {
+			pixelFormat, err := entities.EncoderPixelFormat(s.encCodec, name)
+			if err != nil {
+				return err
+			}
+			s.encCodecContext.SetPixelFormat(pixelFormat)
+			s.outputPixelFormat = name
+		} else if v := s.encCodec.PixelFormats(); donut.Recipe.Video.PreserveColor && supportsPixelFormat(v, s.decCodecContext.PixelFormat()) {
+			// keeps the bit depth, ex: yuv420p10le
+			s.encCodecContext.SetPixelFormat(s.decCodecContext.PixelFormat())
+		} else if len(v) > 0 {
+			s.encCodecContext.SetPixelFormat(v[0])
+		} else {
+			s.encCodecContext.SetPixelFormat(s.decCodecContext.PixelFormat())
 		}
-		closer.Add(outputs.Free)
-
-		inputs := astiav.AllocFilterInOut()
-		if inputs == nil {
-			return errors.New("main: inputs is nil")
+		// browsers ignore the sample aspect ratio, anamorphic sources would be displayed stretched
+		sar := s.decCodecContext.SampleAspectRatio()
+		if c.c.VideoSquarePixels && s.outputWidth == 0 {
+			if width, height, ok := squarePixelsSize(s.decCodecContext.Width(), s.decCodecContext.Height(), sar.Num(), sar.Den()); ok {
+				c.l.Infof("scaling the anamorphic video (sar %s) to %dx%d square pixels", sar.String(), width, height)
+				s.outputWidth, s.outputHeight = width, height
+				s.squarePixels = true
+			}
+		}
+		if s.squarePixels {
+			sar = astiav.NewRational(1, 1)
+		}
+		s.encCodecContext.SetSampleAspectRatio(sar)
+		s.encCodecContext.SetTimeBase(s.decCodecContext.TimeBase())
+		width, height := s.decCodecContext.Width(), s.decCodecContext.Height()
+		if s.outputWidth > 0 {
+			width, height = s.outputWidth, s.outputHeight
+		}
+		// the requested resolution preset, after the square pixels keeping the display aspect ratio
+		if scaledWidth, scaledHeight, ok := scaledDownSize(width, height, donut.Recipe.Video.Height); ok {
+			c.l.Infof("scaling the video from %dx%d to %dx%d", width, height, scaledWidth, scaledHeight)
+			width, height = scaledWidth, scaledHeight
+			s.outputWidth, s.outputHeight = width, height
+		}
+		s.encCodecContext.SetHeight(height)
+		s.encCodecContext.SetWidth(width)
+		// s.encCodecContext.SetFramerate(s.inputStream.AvgFrameRate())
+
+		// doubling the interlaced sources deinterlaced a frame per field and decimating high frame rate sources,
+		// ex: 60fps -> 30fps, the fps filter then paces the frames at the output rate
+		if decFrameRate := s.decCodecContext.Framerate(); s.outputFrameRate.Num() == 0 {
+			if num, den, ok := encoderFrameRate(decFrameRate.Num(), decFrameRate.Den(), donut.Recipe.Video.Deinterlace,
+				interlaced(s.inputStream.CodecParameters()), donut.Recipe.Video.FrameRate); ok {
+				s.outputFrameRate = astiav.NewRational(num, den)
+				c.l.Infof("changing frame rate from %s to %s", decFrameRate.String(), s.outputFrameRate.String())
+			}
+		}
+		if s.outputFrameRate.Num() > 0 {
+			s.encCodecContext.SetFramerate(s.outputFrameRate)
 		}
-		closer.Add(inputs.Free)
 
-		if isAudio {
-			args = astiav.FilterArgs{
-				"channel_layout": s.decCodecContext.ChannelLayout().String(),
-				"sample_fmt":     s.decCodecContext.SampleFormat().Name(),
-				"sample_rate":    strconv.Itoa(s.decCodecContext.SampleRate()),
-				"time_base":      s.decCodecContext.TimeBase().String(),
-			}
-			buffersrc = astiav.FindFilterByName("abuffer")
-			buffersink = astiav.FindFilterByName("abuffersink")
-			if donut.Recipe.Audio.DonutStreamFilter != nil {
-				content = string(*donut.Recipe.Audio.DonutStreamFilter)
-			} else {
-				content = "anull" /* passthrough (dummy) filter for audio */
+		// the bit rate follows the resolution (ex: after downscaling), unless the recipe sets one
+		if c.c.VideoBitsPerPixel > 0 {
+			frameRate := s.outputFrameRate
+			if frameRate.Num() == 0 {
+				frameRate = s.decCodecContext.Framerate()
 			}
+			s.encCodecContext.SetBitRate(entities.RecommendedVideoBitRate(width, height, frameRate.Float64(), c.c.VideoBitsPerPixel, c.c.VideoMaxBitRate))
 		}
 
-		if isVideo {
-			args = astiav.FilterArgs{
-				"pix_fmt":      strconv.Itoa(int(s.decCodecContext.PixelFormat())),
-				"pixel_aspect": s.decCodecContext.SampleAspectRatio().String(),
-				"time_base":    s.decCodecContext.TimeBase().String(),
-				"video_size":   strconv.Itoa(s.decCodecContext.Width()) + "x" + strconv.Itoa(s.decCodecContext.Height()),
-			}
-			buffersrc = astiav.FindFilterByName("buffer")
-			buffersink = astiav.FindFilterByName("buffersink")
-			if donut.Recipe.Video.DonutStreamFilter != nil {
-				content = string(*donut.Recipe.Video.DonutStreamFilter)
-			} else {
-				content = "null" /* passthrough (dummy) filter for video */
+		// overriding with user provide config
+		if len(donut.Recipe.Video.CodecContextOptions) > 0 {
+			for _, opt := range donut.Recipe.Video.CodecContextOptions {
+				opt(s.encCodecContext)
 			}
 		}
+	}
 
-		if buffersrc == nil {
-			return errors.New("main: buffersrc is nil")
+	if s.bitRate > 0 {
+		s.encCodecContext.SetBitRate(s.bitRate)
+	}
+
+	if s.decCodecContext.Flags().Has(astiav.CodecContextFlagGlobalHeader) {
+		s.encCodecContext.SetFlags(s.encCodecContext.Flags().Add(astiav.CodecContextFlagGlobalHeader))
+	}
+
+	encoderOptions, err := c.defineEncoderOptions(s, donut)
+	if err != nil {
+		return err
+	}
+	privateOptions := donut.Recipe.Video.PrivateOptions
+	if isAudio {
+		privateOptions = donut.Recipe.Audio.PrivateOptions
+	}
+	for key, value := range privateOptions {
+		if encoderOptions == nil {
+			encoderOptions = &astiav.Dictionary{}
 		}
-		if buffersink == nil {
-			return errors.New("main: buffersink is nil")
+		// the user's x264-params complete the latency mode's ones rather than replacing them
+		if tuned := encoderOptions.Get(key, nil, 0); tuned != nil && key == "x264-params" {
+			value = mergeX264Params(tuned.Value(), value)
 		}
-
-		if s.buffersrcContext, err = s.filterGraph.NewFilterContext(buffersrc, "in", args); err != nil {
-			return fmt.Errorf("main: creating buffersrc context failed: %w", err)
+		if err := encoderOptions.Set(key, value, 0); err != nil {
+			return fmt.Errorf("setting the encoder option %s failed: %w", key, err)
 		}
-		if s.buffersinkContext, err = s.filterGraph.NewFilterContext(buffersink, "out", nil); err != nil {
-			return fmt.Errorf("main: creating buffersink context failed: %w", err)
+	}
+	if encoderOptions != nil {
+		defer encoderOptions.Free()
+	}
+
+	if err := s.encCodecContext.Open(s.encCodec, encoderOptions); err != nil {
+		return fmt.Errorf("opening encoder context failed: %w", err)
+	}
+	// the encoder consumes the options it knows, the remaining ones were ignored
+	for key := range privateOptions {
+		if encoderOptions.Get(key, nil, 0) != nil {
+			c.l.Warnf("the %s encoder ignored the private option %s", s.encCodec.Name(), key)
 		}
+	}
+	return nil
+}
 
-		outputs.SetName("in")
-		outputs.SetFilterContext(s.buffersrcContext)
-		outputs.SetPadIdx(0)
-		outputs.SetNext(nil)
+func (c *LibAVFFmpegStreamer) prepareFilters(p *libAVParams, closer *astikit.Closer, donut *entities.DonutParameters) error {
+	for _, s := range p.streams {
+		s := s
 
-		inputs.SetName("out")
-		inputs.SetFilterContext(s.buffersinkContext)
-		inputs.SetPadIdx(0)
-		inputs.SetNext(nil)
+		isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
+		if isVideo && !plannedStages(entities.VideoType, donut.Recipe).filterGraph {
+			c.l.Infof("bypass video for %+v", s.inputStream)
+			continue
+		}
+
+		isAudio := s.decCodecContext.MediaType() == astiav.MediaTypeAudio
+		if isAudio && !plannedStages(entities.AudioType, donut.Recipe).filterGraph {
+			c.l.Infof("bypass audio for %+v", s.inputStream)
+			continue
+		}
 
-		if err = s.filterGraph.Parse(content, inputs, outputs); err != nil {
-			return fmt.Errorf("main: parsing filter failed: %w", err)
+		var filter *entities.DonutStreamFilter
+		if isAudio {
+			filter = donut.Recipe.Audio.DonutStreamFilter
+		}
+		if isVideo {
+			filter = donut.Recipe.Video.DonutStreamFilter
 		}
 
-		if err = s.filterGraph.Configure(); err != nil {
-			return fmt.Errorf("main: configuring filter failed: %w", err)
+		if err := c.configureFilterGraph(s, filter); err != nil {
+			return err
 		}
+		// the filter graph might be replaced while streaming, see reconfigureFilter
+		closer.Add(func() { s.filterGraph.Free() })
 
 		s.filterFrame = astiav.AllocFrame()
 		closer.Add(s.filterFrame.Free)
@@ -508,6 +1064,207 @@ func (c *LibAVFFmpegStreamer) prepareFilters(p *libAVParams, closer *astikit.Clo
 	return nil
 }
 
+// configureFilterGraph builds the stream's filter graph, replacing the current one (if any).
+// A nil filter means passthrough.
+func (c *LibAVFFmpegStreamer) configureFilterGraph(s *streamContext, filter *entities.DonutStreamFilter) (err error) {
+	var args astiav.FilterArgs
+	var buffersrc, buffersink *astiav.Filter
+	var content string
+	var format audioFormat
+
+	isAudio := s.decCodecContext.MediaType() == astiav.MediaTypeAudio
+	if isAudio {
+		// the decoded frames might have changed their format, see followAudioFormat
+		format = s.audioFormat
+		if format == (audioFormat{}) {
+			format = audioFormat{
+				sampleRate:    s.decCodecContext.SampleRate(),
+				sampleFormat:  s.decCodecContext.SampleFormat().Name(),
+				channelLayout: s.decCodecContext.ChannelLayout().String(),
+			}
+		}
+		args = astiav.FilterArgs{
+			"channel_layout": format.channelLayout,
+			"sample_fmt":     format.sampleFormat,
+			"sample_rate":    strconv.Itoa(format.sampleRate),
+			"time_base":      s.decCodecContext.TimeBase().String(),
+		}
+		buffersrc = astiav.FindFilterByName("abuffer")
+		buffersink = astiav.FindFilterByName("abuffersink")
+		if filter != nil && *filter != "" {
+			content = string(*filter)
+		} else {
+			content = "anull" /* passthrough (dummy) filter for audio */
+		}
+		if frameSize := s.encCodecContext.FrameSize(); frameSize > 0 {
+			// the encoder expects frames of exactly frame size samples (ex: 2880 for 60ms at 48kHz),
+			// asetnsamples is the audio FIFO: it buffers the filtered samples and emits frame size chunks
+			content = fmt.Sprintf("%s,asetnsamples=n=%d", content, frameSize)
+		}
+	}
+
+	isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
+	if isVideo {
+		args = astiav.FilterArgs{
+			"pix_fmt":      strconv.Itoa(int(s.decCodecContext.PixelFormat())),
+			"pixel_aspect": s.decCodecContext.SampleAspectRatio().String(),
+			"time_base":    s.decCodecContext.TimeBase().String(),
+			"video_size":   strconv.Itoa(s.decCodecContext.Width()) + "x" + strconv.Itoa(s.decCodecContext.Height()),
+		}
+		buffersrc = astiav.FindFilterByName("buffer")
+		buffersink = astiav.FindFilterByName("buffersink")
+		if filter != nil && *filter != "" {
+			content = string(*filter)
+		} else {
+			content = "null" /* passthrough (dummy) filter for video */
+		}
+		// the range is explicit, the scaler would otherwise convert the full range samples (ex: yuvj420p) to the
+		// limited range while the encoder signals the full one. Overriding the range only fixes the metadata.
+		var scale []string
+		if s.outputWidth > 0 {
+			scale = append(scale, fmt.Sprintf("%d:%d", s.outputWidth, s.outputHeight))
+		}
+		if colorRange := scaleColorRange(s.colorRange); colorRange != "" {
+			scale = append(scale, "in_range="+colorRange, "out_range="+colorRange)
+		}
+		if len(scale) > 0 {
+			content = fmt.Sprintf("%s,scale=%s", content, strings.Join(scale, ":"))
+		}
+		if s.squarePixels {
+			content = fmt.Sprintf("%s,setsar=1", content)
+		}
+		if s.outputPixelFormat != "" {
+			content = fmt.Sprintf("%s,format=%s", content, s.outputPixelFormat)
+		}
+		if s.outputFrameRate.Num() > 0 {
+			// fps changes the time base to 1/fps, settb restores the one expected by the encoder
+			content = fmt.Sprintf("%s,fps=%s,settb=%s", content, s.outputFrameRate.String(), s.decCodecContext.TimeBase().String())
+		}
+	}
+
+	if buffersrc == nil {
+		return errors.New("main: buffersrc is nil")
+	}
+	if buffersink == nil {
+		return errors.New("main: buffersink is nil")
+	}
+
+	filterGraph := astiav.AllocFilterGraph()
+	if filterGraph == nil {
+		return errors.New("main: graph is nil")
+	}
+	defer func() {
+		if err != nil {
+			filterGraph.Free()
+		}
+	}()
+
+	outputs := astiav.AllocFilterInOut()
+	if outputs == nil {
+		return errors.New("main: outputs is nil")
+	}
+	defer outputs.Free()
+
+	inputs := astiav.AllocFilterInOut()
+	if inputs == nil {
+		return errors.New("main: inputs is nil")
+	}
+	defer inputs.Free()
+
+	buffersrcContext, err := filterGraph.NewFilterContext(buffersrc, "in", args)
+	if err != nil {
+		return fmt.Errorf("main: creating buffersrc context failed: %w", err)
+	}
+	buffersinkContext, err := filterGraph.NewFilterContext(buffersink, "out", nil)
+	if err != nil {
+		return fmt.Errorf("main: creating buffersink context failed: %w", err)
+	}
+
+	outputs.SetName("in")
+	outputs.SetFilterContext(buffersrcContext)
+	outputs.SetPadIdx(0)
+	outputs.SetNext(nil)
+
+	inputs.SetName("out")
+	inputs.SetFilterContext(buffersinkContext)
+	inputs.SetPadIdx(0)
+	inputs.SetNext(nil)
+
+	if err = filterGraph.Parse(content, inputs, outputs); err != nil {
+		return fmt.Errorf("main: parsing filter failed: %w", err)
+	}
+
+	if err = filterGraph.Configure(); err != nil {
+		return fmt.Errorf("main: configuring filter failed: %w", err)
+	}
+	if c.c.LogFilterGraphs {
+		controllers.NewDebugLogger(c.l, "filter_graph").Debugw("filter graph configured",
+			"stream", s.inputStream.Index(),
+			"filter", content,
+			"graph", filterGraph.String(),
+		)
+	}
+
+	if s.filterGraph != nil {
+		s.filterGraph.Free()
+	}
+	s.filterGraph = filterGraph
+	s.filter = filter
+	s.audioFormat = format
+	s.buffersrcContext = buffersrcContext
+	s.buffersinkContext = buffersinkContext
+	return nil
+}
+
+// reconfigureFilter swaps the filter of a transcoded stream between two frames, ex: toggling an overlay.
+// The frames buffered by the current graph are encoded first and the encoder is kept,
+// hence the new filter must not change the frame properties (ex: size) expected by the encoder.
+func (c *LibAVFFmpegStreamer) reconfigureFilter(p *libAVParams, donut *entities.DonutParameters, u entities.DonutFilterUpdate) error {
+	for _, s := range p.streams {
+		if s.filterGraph == nil || c.m.FromLibAVMediaTypeToEntityMediaType(s.decCodecContext.MediaType()) != u.MediaType {
+			continue
+		}
+
+		if err := c.filterAndEncode(p, nil, s, donut); err != nil {
+			return fmt.Errorf("draining filter failed: %w", err)
+		}
+		if err := c.configureFilterGraph(s, &u.Filter); err != nil {
+			return err
+		}
+		c.l.Infof("%s filter reconfigured to %q", u.MediaType, u.Filter)
+		return nil
+	}
+	return fmt.Errorf("%w: %s", entities.ErrMissingFilterGraph, u.MediaType)
+}
+
+// updateBitRate changes the target bit rate of a transcoded stream between two frames, encoders
+// reconfiguring on the fly (ex: libx264) follow it from the next frame on, within a GOP.
+func (c *LibAVFFmpegStreamer) updateBitRate(p *libAVParams, u entities.DonutBitRateUpdate) error {
+	if u.BitRate <= 0 {
+		return entities.ErrInvalidBitRate
+	}
+	for _, s := range p.streams {
+		if s.encCodecContext == nil || c.m.FromLibAVMediaTypeToEntityMediaType(s.decCodecContext.MediaType()) != u.MediaType {
+			continue
+		}
+
+		s.bitRate = u.BitRate
+		s.encCodecContext.SetBitRate(u.BitRate)
+		c.l.Infof("%s bit rate updated to %d bps", u.MediaType, u.BitRate)
+		return nil
+	}
+	return fmt.Errorf("%w: %s", entities.ErrMissingEncoder, u.MediaType)
+}
+
+// requestKeyFrame forces a key frame of the transcoded video, a bypassed one can't be given one on demand.
+func (c *LibAVFFmpegStreamer) requestKeyFrame(p *libAVParams) {
+	for _, s := range p.streams {
+		if s.encCodecContext != nil && s.decCodecContext.MediaType() == astiav.MediaTypeVideo {
+			s.keyFrameRequested = true
+		}
+	}
+}
+
 func (c *LibAVFFmpegStreamer) prepareBitStreamFilters(p *libAVParams, closer *astikit.Closer, donut *entities.DonutParameters) error {
 	for _, s := range p.streams {
 		isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
@@ -523,33 +1280,44 @@ func (c *LibAVFFmpegStreamer) prepareBitStreamFilters(p *libAVParams, closer *as
 			continue
 		}
 
-		if currentMedia.DonutBitStreamFilter == nil {
+		if len(currentMedia.DonutBitStreamFilters) == 0 {
 			c.l.Infof("no bit stream filter configured for %s", s.decCodecContext.String())
 			continue
 		}
 
-		bsf := astiav.FindBitStreamFilterByName(string(*currentMedia.DonutBitStreamFilter))
-		if bsf == nil {
-			return fmt.Errorf("can not find the filter %s", string(*currentMedia.DonutBitStreamFilter))
-		}
+		for _, name := range currentMedia.DonutBitStreamFilters {
+			bsf := astiav.FindBitStreamFilterByName(string(name))
+			if bsf == nil {
+				return fmt.Errorf("can not find the filter %s", string(name))
+			}
 
-		var err error
-		s.bsfContext, err = astiav.AllocBitStreamFilterContext(bsf)
-		if err != nil {
-			return fmt.Errorf("error while allocating bit stream context %w", err)
-		}
-		closer.Add(s.bsfContext.Free)
+			bsfContext, err := astiav.AllocBitStreamFilterContext(bsf)
+			if err != nil {
+				return fmt.Errorf("error while allocating bit stream context %w", err)
+			}
+			closer.Add(bsfContext.Free)
 
-		s.bsfContext.SetTimeBaseIn(s.inputStream.TimeBase())
-		if err := s.inputStream.CodecParameters().Copy(s.bsfContext.CodecParametersIn()); err != nil {
-			return fmt.Errorf("error while copying codec parameters %w", err)
-		}
+			// the first filter gets the input stream packets, the others the output of the previous one
+			if previous := len(s.bsfContexts); previous > 0 {
+				if err := chainBitStreamFilter(s.bsfContexts[previous-1], bsfContext); err != nil {
+					return fmt.Errorf("error while chaining %s %w", name, err)
+				}
+			} else {
+				bsfContext.SetTimeBaseIn(s.inputStream.TimeBase())
+				if err := s.inputStream.CodecParameters().Copy(bsfContext.CodecParametersIn()); err != nil {
+					return fmt.Errorf("error while copying codec parameters %w", err)
+				}
+			}
 
-		if err := s.bsfContext.Initialize(); err != nil {
-			return fmt.Errorf("error while initiating %w", err)
+			if err := bsfContext.Initialize(); err != nil {
+				return fmt.Errorf("error while initiating %s %w", name, err)
+			}
+			bsfPacket := astiav.AllocPacket()
+			closer.Add(bsfPacket.Free)
+
+			s.bsfContexts = append(s.bsfContexts, bsfContext)
+			s.bsfPackets = append(s.bsfPackets, bsfPacket)
 		}
-		s.bsfPacket = astiav.AllocPacket()
-		closer.Add(s.bsfPacket.Free)
 	}
 	return nil
 }
@@ -570,36 +1338,51 @@ func (c *LibAVFFmpegStreamer) processPacket(p *libAVParams, pkt *astiav.Packet,
 
 	byPass := currentMedia.Action == entities.DonutBypass
 	if isVideo && byPass {
-		if donut.OnVideoFrame != nil {
-			pkt.RescaleTs(s.inputStream.TimeBase(), s.decCodecContext.TimeBase())
-			if err := donut.OnVideoFrame(pkt.Data(), entities.MediaFrameContext{
-				PTS:      int(pkt.Pts()),
-				DTS:      int(pkt.Dts()),
-				Duration: c.defineVideoDuration(s, pkt),
-			}); err != nil {
-				return err
-			}
+		if c.c.ConcealCorruptFrames && c.conceal(s, pkt, currentMedia.Codec) {
+			return nil
 		}
-		return nil
+		latency, _ := s.readTimes.since(pkt.Pts(), time.Now())
+		if pkt.Flags().Has(astiav.PacketFlagKey) {
+			c.reportTimecode(s, pkt.Pts(), nil, donut)
+		}
+		pkt.RescaleTs(s.inputStream.TimeBase(), s.decCodecContext.TimeBase())
+		frameContext := entities.MediaFrameContext{
+			PTS:             int(pkt.Pts()),
+			DTS:             int(pkt.Dts()),
+			Duration:        c.defineVideoDuration(s, pkt),
+			KeyFrame:        pkt.Flags().Has(astiav.PacketFlagKey),
+			PipelineLatency: latency,
+			RTPTimestamp:    c.packetRTPTimestamp(s, pkt, s.decCodecContext.TimeBase(), currentMedia.Codec),
+		}
+		c.logStats(s, entities.VideoType, pkt.Size())
+		c.reportPipelineEvent(p, entities.PipelineEventStreaming, entities.VideoType, donut)
+		return writeToSinks(donut.Sinks, entities.VideoType, pkt.Data(), frameContext)
 	}
 	if isAudio && byPass {
-		if donut.OnAudioFrame != nil {
-			pkt.RescaleTs(s.inputStream.TimeBase(), s.decCodecContext.TimeBase())
-			if err := donut.OnAudioFrame(pkt.Data(), entities.MediaFrameContext{
-				PTS:      int(pkt.Pts()),
-				DTS:      int(pkt.Dts()),
-				Duration: c.defineAudioDuration(s, pkt),
-			}); err != nil {
-				return err
-			}
+		if s.beforeStart(pkt.Pts()) {
+			return nil
 		}
-		return nil
+		latency, _ := s.readTimes.since(pkt.Pts(), time.Now())
+		pkt.RescaleTs(s.inputStream.TimeBase(), s.decCodecContext.TimeBase())
+		frameContext := entities.MediaFrameContext{
+			PTS:             int(pkt.Pts()),
+			DTS:             int(pkt.Dts()),
+			Duration:        c.defineAudioDuration(s, pkt, s.decCodecContext.TimeBase()),
+			KeyFrame:        pkt.Flags().Has(astiav.PacketFlagKey),
+			PipelineLatency: latency,
+			RTPTimestamp:    c.packetRTPTimestamp(s, pkt, s.decCodecContext.TimeBase(), currentMedia.Codec),
+		}
+		c.logStats(s, entities.AudioType, pkt.Size())
+		c.reportPipelineEvent(p, entities.PipelineEventStreaming, entities.AudioType, donut)
+		return writeToSinks(donut.Sinks, entities.AudioType, pkt.Data(), frameContext)
 	}
 
 	// if isAudio {
 	// 	continue
 	// }
 
+	// the budget accounts the decoding too, the time of the packets yielding no frame adds up to the next one
+	started := time.Now()
 	if err := s.decCodecContext.SendPacket(pkt); err != nil {
 		return err
 	}
@@ -607,37 +1390,126 @@ func (c *LibAVFFmpegStreamer) processPacket(p *libAVParams, pkt *astiav.Packet,
 	for {
 		if err := s.decCodecContext.ReceiveFrame(s.decFrame); err != nil {
 			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				if s.budget != nil {
+					s.budget.track(time.Since(started), 0)
+				}
 				break
 			}
 			return err
 		}
+		if s.beforeStart(s.decFrame.Pts()) {
+			continue
+		}
+		c.reportPipelineEvent(p, entities.PipelineEventFirstFrameDecoded, c.m.FromLibAVMediaTypeToEntityMediaType(s.decCodecContext.MediaType()), donut)
+		if isVideo && s.decFrame.KeyFrame() {
+			if c.wantsPoster(s, donut) {
+				c.capturePoster(s, s.decFrame, donut)
+			}
+			var s12m []byte
+			if sd := s.decFrame.SideData(astiav.FrameSideDataTypeS12MTimecode); sd != nil {
+				s12m = sd.Data()
+			}
+			c.reportTimecode(s, s.decFrame.Pts(), s12m, donut)
+		}
 		if err := c.filterAndEncode(p, s.decFrame, s, donut); err != nil {
 			return err
 		}
+		if s.muxerEncoder != nil {
+			if err := c.encodeMuxerFrame(s.muxerEncoder, s.decFrame, donut); err != nil {
+				return err
+			}
+		}
+		if s.budget != nil && s.budget.track(time.Since(started), c.defineFrameInterval(s)) {
+			if err := c.downgrade(p, s, donut); err != nil {
+				return fmt.Errorf("downgrading quality failed: %w", err)
+			}
+		}
+		started = time.Now()
 	}
 	return nil
 }
 
-func (c *LibAVFFmpegStreamer) applyBitStreamFilter(p *libAVParams, pkt *astiav.Packet, s *streamContext, donut *entities.DonutParameters) error {
-	if err := s.bsfContext.SendPacket(pkt); err != nil && !errors.Is(err, astiav.ErrEagain) {
+// downgrade lowers the video quality of a stream falling behind real time, first halving
+// the resolution down to minBudgetHeight and then the frame rate down to minBudgetFrameRate.
+func (c *LibAVFFmpegStreamer) downgrade(p *libAVParams, s *streamContext, donut *entities.DonutParameters) error {
+	width, height := s.encCodecContext.Width(), s.encCodecContext.Height()
+	frameRate := s.outputFrameRate
+	if frameRate.Num() == 0 {
+		frameRate = s.decCodecContext.Framerate()
+	}
+
+	// the muxer can't follow a resolution change
+	canScale := len(muxersOf(donut.Sinks)) == 0 && height/2 >= minBudgetHeight
+	canDecimate := frameRate.Float64()/2 >= minBudgetFrameRate
+	if !canScale && !canDecimate {
+		c.l.Warnf("encoding is behind real time at %dx%d@%s, the quality can't be lowered any further", width, height, frameRate.String())
+		s.budget = nil
+		return nil
+	}
+
+	// the frames buffered by the current graph are encoded with the current settings
+	if err := c.filterAndEncode(p, nil, s, donut); err != nil {
+		return fmt.Errorf("draining filter failed: %w", err)
+	}
+
+	if canScale {
+		if err := c.encodeFrame(p, nil, s, donut); err != nil {
+			return fmt.Errorf("draining encoder failed: %w", err)
+		}
+		// encoders expect even dimensions
+		s.outputWidth, s.outputHeight = (width/2)&^1, (height/2)&^1
+		if err := c.openEncoder(s, donut); err != nil {
+			return err
+		}
+		c.l.Warnf("encoding is behind real time, downscaling from %dx%d to %dx%d", width, height, s.outputWidth, s.outputHeight)
+	} else {
+		s.outputFrameRate = astiav.NewRational(frameRate.Num(), frameRate.Den()*2)
+		c.l.Warnf("encoding is behind real time, decimating from %s to %s fps", frameRate.String(), s.outputFrameRate.String())
+	}
+
+	return c.configureFilterGraph(s, s.filter)
+}
+
+// applyBitStreamFilter sends the packet to the filter at index, its output feeds the next
+// filter of the chain and the last one's output is processed.
+func (c *LibAVFFmpegStreamer) applyBitStreamFilter(p *libAVParams, pkt *astiav.Packet, s *streamContext, index int, donut *entities.DonutParameters) error {
+	bsfContext, bsfPacket := s.bsfContexts[index], s.bsfPackets[index]
+	if err := bsfContext.SendPacket(pkt); err != nil && !errors.Is(err, astiav.ErrEagain) {
 		return fmt.Errorf("sending bit stream packet failed: %w", err)
 	}
 
 	for {
-		if err := s.bsfContext.ReceivePacket(s.bsfPacket); err != nil {
+		if err := bsfContext.ReceivePacket(bsfPacket); err != nil {
 			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
 				break
 			}
 			return fmt.Errorf("receiving bit stream packet failed: %w", err)
 		}
 
-		c.processPacket(p, s.bsfPacket, s, donut)
-		s.bsfPacket.Unref()
+		var err error
+		if index+1 < len(s.bsfContexts) {
+			err = c.applyBitStreamFilter(p, bsfPacket, s, index+1, donut)
+		} else {
+			err = c.processPacket(p, bsfPacket, s, donut)
+		}
+		bsfPacket.Unref()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (c *LibAVFFmpegStreamer) filterAndEncode(p *libAVParams, f *astiav.Frame, s *streamContext, donut *entities.DonutParameters) (err error) {
+	if s.buffersrcContext == nil || s.buffersinkContext == nil {
+		return fmt.Errorf("%w: stream %d", entities.ErrMissingFilterGraph, s.inputStream.Index())
+	}
+	if f != nil && s.decCodecContext.MediaType() == astiav.MediaTypeAudio {
+		if err = c.followAudioFormat(s, f, func() error { return c.filterAndEncode(p, nil, s, donut) }); err != nil {
+			return err
+		}
+		s.samples.filter(f.NbSamples(), f.SampleRate())
+	}
 	if err = s.buffersrcContext.BuffersrcAddFrame(f, astiav.NewBuffersrcFlags(astiav.BuffersrcFlagKeepRef)); err != nil {
 		return fmt.Errorf("adding frame failed: %w", err)
 	}
@@ -653,6 +1525,10 @@ func (c *LibAVFFmpegStreamer) filterAndEncode(p *libAVParams, f *astiav.Frame, s
 		}
 		// TODO: should we avoid setting the picture type for audio?
 		s.filterFrame.SetPictureType(astiav.PictureTypeNone)
+		if s.keyFrameRequested {
+			s.filterFrame.SetPictureType(astiav.PictureTypeI)
+			s.keyFrameRequested = false
+		}
 		if err = c.encodeFrame(p, s.filterFrame, s, donut); err != nil {
 			err = fmt.Errorf("main: encoding and writing frame failed: %w", err)
 			return
@@ -662,13 +1538,20 @@ func (c *LibAVFFmpegStreamer) filterAndEncode(p *libAVParams, f *astiav.Frame, s
 }
 
 func (c *LibAVFFmpegStreamer) encodeFrame(p *libAVParams, f *astiav.Frame, s *streamContext, donut *entities.DonutParameters) (err error) {
+	if s.encCodecContext == nil || s.encPkt == nil {
+		return fmt.Errorf("%w: stream %d", entities.ErrMissingEncoder, s.inputStream.Index())
+	}
 	s.encPkt.Unref()
 
-	// when converting from aac to opus using filters,
-	// the np samples are bigger than the frame size
-	// to fix the error "more samples than frame size"
-	if f != nil {
-		f.SetNbSamples(s.encCodecContext.FrameSize())
+	// the filter graph (asetnsamples) buffers the audio samples and emits frames of exactly the encoder
+	// frame size (ex: aac 1024 samples to opus 960), the last one is padded with silence.
+	// A frame of another size would be truncated or rejected by the encoder, the sample counter
+	// checks that no sample is dropped on the way.
+	if f != nil && s.decCodecContext.MediaType() == astiav.MediaTypeAudio {
+		if frameSize := s.encCodecContext.FrameSize(); frameSize > 0 && f.NbSamples() != frameSize {
+			return fmt.Errorf("audio frame of %d samples, the encoder expects %d", f.NbSamples(), frameSize)
+		}
+		s.samples.encode(f.NbSamples(), f.SampleRate())
 	}
 
 	if err = s.encCodecContext.SendFrame(f); err != nil {
@@ -684,56 +1567,79 @@ func (c *LibAVFFmpegStreamer) encodeFrame(p *libAVParams, f *astiav.Frame, s *st
 			return fmt.Errorf("receiving packet failed: %w", err)
 		}
 
+		// the encoder keeps the input pts, unless the filters changed the timestamps
+		latency, _ := s.readTimes.since(s.encPkt.Pts(), time.Now())
 		s.encPkt.RescaleTs(s.inputStream.TimeBase(), s.encCodecContext.TimeBase())
 
-		// Create RTP packet
-		rtpPacket := &rtp.Packet{
-			Header: rtp.Header{
-				Version:        2,
-				PayloadType:    96, // Adjust based on codec
-				SequenceNumber: 0,  // Will be set by WebRTC
-				Timestamp:      uint32(s.encPkt.Pts()),
-				SSRC:           0, // Will be set by WebRTC
-			},
-			Payload: s.encPkt.Data(),
+		// the muxers might get their own encoding, see encodeMuxerFrame
+		if s.muxerEncoder == nil {
+			if err := c.writeToMuxer(s, donut); err != nil {
+				return err
+			}
 		}
 
 		isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
+		mediaType, codec := entities.AudioType, donut.Recipe.Audio.Codec
 		if isVideo {
-			if donut.OnVideoFrame != nil {
-				rtpData, marshalErr := rtpPacket.Marshal()
-				if marshalErr != nil {
-					return fmt.Errorf("failed to marshal video RTP packet: %w", marshalErr)
-				}
-				if err := donut.OnVideoFrame(rtpData, entities.MediaFrameContext{
-					PTS:      int(s.encPkt.Pts()),
-					DTS:      int(s.encPkt.Dts()),
-					Duration: c.defineVideoDuration(s, s.encPkt),
-				}); err != nil {
-					return err
-				}
-			}
+			mediaType, codec = entities.VideoType, donut.Recipe.Video.Codec
+		}
+		c.reportPipelineEvent(p, entities.PipelineEventFirstFrameEncoded, mediaType, donut)
+		c.logStats(s, mediaType, s.encPkt.Size())
+
+		// the sinks packetize the encoded frame themselves (ex: the WebRTC tracks)
+		frameContext := entities.MediaFrameContext{
+			PTS:             int(s.encPkt.Pts()),
+			DTS:             int(s.encPkt.Dts()),
+			KeyFrame:        s.encPkt.Flags().Has(astiav.PacketFlagKey),
+			PipelineLatency: latency,
+			RTPTimestamp:    c.packetRTPTimestamp(s, s.encPkt, s.encCodecContext.TimeBase(), codec),
+		}
+		if isVideo {
+			frameContext.Duration = c.defineVideoDuration(s, s.encPkt)
+		} else {
+			frameContext.Duration = c.defineAudioDuration(s, s.encPkt, s.encCodecContext.TimeBase())
+		}
+		if err := writeToSinks(frameSinksOf(donut.Sinks), mediaType, s.encPkt.Data(), frameContext); err != nil {
+			return err
 		}
+		c.reportPipelineEvent(p, entities.PipelineEventStreaming, mediaType, donut)
+	}
 
-		isAudio := s.decCodecContext.MediaType() == astiav.MediaTypeAudio
-		if isAudio {
-			if donut.OnAudioFrame != nil {
-				rtpPacket.PayloadType = 111 // Opus
-				rtpData, marshalErr := rtpPacket.Marshal()
-				if marshalErr != nil {
-					return fmt.Errorf("failed to marshal audio RTP packet: %w", marshalErr)
-				}
-				if err := donut.OnAudioFrame(rtpData, entities.MediaFrameContext{
-					PTS:      int(s.encPkt.Pts()),
-					DTS:      int(s.encPkt.Dts()),
-					Duration: c.defineAudioDuration(s, s.encPkt),
-				}); err != nil {
-					return err
-				}
-			}
+	return nil
+}
+
+func (c *LibAVFFmpegStreamer) addMuxerStream(donut *entities.DonutParameters, mediaType entities.MediaType, codecParameters *astiav.CodecParameters, timeBase astiav.Rational) error {
+	for _, m := range muxersOf(donut.Sinks) {
+		if err := m.AddStream(mediaType, codecParameters, timeBase); err != nil {
+			return fmt.Errorf("adding %s stream to the muxer failed: %w", mediaType, err)
 		}
 	}
+	return nil
+}
 
+// writeToMuxer sends the encoded packet, before the RTP packetization, to the muxers.
+func (c *LibAVFFmpegStreamer) writeToMuxer(s *streamContext, donut *entities.DonutParameters) error {
+	frameContext := entities.MediaFrameContext{
+		PTS:      int(s.encPkt.Pts()),
+		DTS:      int(s.encPkt.Dts()),
+		KeyFrame: s.encPkt.Flags().Has(astiav.PacketFlagKey),
+	}
+	isVideo := s.decCodecContext.MediaType() == astiav.MediaTypeVideo
+	if isVideo {
+		frameContext.Duration = c.defineVideoDuration(s, s.encPkt)
+	} else {
+		frameContext.Duration = time.Duration(s.encPkt.Duration()) * time.Second * time.Duration(s.encCodecContext.TimeBase().Num()) / time.Duration(s.encCodecContext.TimeBase().Den())
+	}
+
+	for _, m := range muxersOf(donut.Sinks) {
+		write := m.WriteAudio
+		if isVideo {
+			write = m.WriteVideo
+		}
+		if err := write(s.encPkt.Data(), frameContext); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -748,6 +1654,22 @@ func (c *LibAVFFmpegStreamer) defineInputFormat(streamFormat string) (*astiav.In
 	return inputFormat, nil
 }
 
+func (c *LibAVFFmpegStreamer) defineInputIOContext(r io.Reader, closer *astikit.Closer) (*astiav.IOContext, error) {
+	ioContext, err := astiav.AllocIOContext(c.c.PipeReadBufferSizeBytes, func(b []byte) (int, error) {
+		n, err := r.Read(b)
+		if errors.Is(err, io.EOF) {
+			// libav only understands its own EOF
+			return n, astiav.ErrEof
+		}
+		return n, err
+	}, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg/libav: allocating io context failed %w", err)
+	}
+	closer.Add(ioContext.Free)
+	return ioContext, nil
+}
+
 func (c *LibAVFFmpegStreamer) defineInputOptions(p *entities.DonutParameters, closer *astikit.Closer) *astiav.Dictionary {
 	var dic *astiav.Dictionary
 	if len(p.Recipe.Input.Options) > 0 {
@@ -761,7 +1683,153 @@ func (c *LibAVFFmpegStreamer) defineInputOptions(p *entities.DonutParameters, cl
 	return dic
 }
 
-func (c *LibAVFFmpegStreamer) defineAudioDuration(s *streamContext, pkt *astiav.Packet) time.Duration {
+// defineEncoderOptions returns the encoder private options, nil when there's none, the caller frees them.
+func (c *LibAVFFmpegStreamer) defineEncoderOptions(s *streamContext, donut *entities.DonutParameters) (*astiav.Dictionary, error) {
+	if s.decCodecContext.MediaType() == astiav.MediaTypeAudio {
+		return c.defineAudioEncoderOptions(donut), nil
+	}
+
+	if s.decCodecContext.MediaType() != astiav.MediaTypeVideo {
+		return nil, nil
+	}
+
+	var options *astiav.Dictionary
+	set := func(key, value string) {
+		if options == nil {
+			options = &astiav.Dictionary{}
+		}
+		options.Set(key, value, 0)
+	}
+
+	// the engine checked the encoder exposes the layers (libvpx), a single layer needs no option
+	if mode := donut.Recipe.Video.ScalabilityMode; mode.TemporalLayers() > 1 {
+		layers := mode.TemporalLayers()
+		bitRate := s.encCodecContext.BitRate()
+		if bitRate <= 0 {
+			bitRate = defaultSVCBitRate
+			s.encCodecContext.SetBitRate(bitRate)
+		}
+
+		set("ts-parameters", temporalLayersParameters(layers, bitRate))
+		c.l.Infof("encoding %s with scalability mode %s", donut.Recipe.Video.Codec, mode)
+	}
+
+	s.colorRange = encoderColorRange(s.decCodecContext.ColorRange(), s.decCodecContext.ColorSpace(), donut.Recipe.Video.ColorRange)
+	c.defineVideoTuningOptions(s, donut, set)
+	if donut.Recipe.Video.PreserveColor {
+		c.l.Infof("encoding %s preserving the source color metadata", donut.Recipe.Video.Codec)
+	}
+	return options, nil
+}
+
+// defineVideoTuningOptions sets the options shared by the video encoders of a stream, the WebRTC one and the
+// muxers' one: the latency mode, the content type and the color metadata of s.colorRange.
+func (c *LibAVFFmpegStreamer) defineVideoTuningOptions(s *streamContext, donut *entities.DonutParameters, set func(key, value string)) {
+	c.defineLatencyModeOptions(s, donut, set)
+	c.defineContentTypeOptions(s, donut, set)
+
+	// the mastering display metadata travels as frame side data through the filters
+	for key, value := range encoderColorOptions(s.decCodecContext.ColorPrimaries(), s.decCodecContext.ColorTransferCharacteristic(),
+		s.decCodecContext.ColorSpace(), s.colorRange, donut.Recipe.Video.PreserveColor) {
+		set(key, value)
+	}
+}
+
+// defineLatencyModeOptions sets the keyframe interval of the latency mode for any encoder, and its preset,
+// B-frames and lookahead for the encoders known to accept them (see latencyModeOptions).
+func (c *LibAVFFmpegStreamer) defineLatencyModeOptions(s *streamContext, donut *entities.DonutParameters, set func(key, value string)) {
+	mode := donut.Recipe.Video.LatencyMode
+	if mode == "" {
+		return
+	}
+
+	frameRate := s.outputFrameRate
+	if frameRate.Num() == 0 {
+		frameRate = s.decCodecContext.Framerate()
+	}
+	options, ok := latencyModeOptions(s.encCodec.Name(), mode, frameRate.Float64())
+	for key, value := range options {
+		set(key, value)
+	}
+	if !ok {
+		c.l.Infof("there's no %s latency tuning for the %s encoder", mode, s.encCodec.Name())
+		return
+	}
+	c.l.Infow("encoding with a latency mode", "codec", donut.Recipe.Video.Codec, "mode", mode, "options", options)
+}
+
+// defineContentTypeOptions tunes the encoder for the content, the options are private
+// hence they're only set for the encoders known to accept them.
+func (c *LibAVFFmpegStreamer) defineContentTypeOptions(s *streamContext, donut *entities.DonutParameters, set func(key, value string)) {
+	contentType := donut.Recipe.Video.ContentType
+	if contentType == "" || contentType == entities.ContentTypeMotion {
+		return
+	}
+
+	switch s.encCodec.Name() {
+	case "libx264":
+		if contentType == entities.ContentTypeAnimation {
+			set("tune", "animation")
+			break
+		}
+		// sharp text over smooth motion: no psychovisual tuning and better I-frames (ipratio 2)
+		set("tune", "stillimage")
+		set("psy", "0")
+		set("i_qfactor", "0.5")
+	case "libvpx":
+		if contentType == entities.ContentTypeScreen {
+			set("screen-content-mode", "1")
+		}
+	case "libvpx-vp9":
+		if contentType == entities.ContentTypeScreen {
+			set("tune-content", "screen")
+		}
+	default:
+		c.l.Infof("there's no %s content tuning for the %s encoder", contentType, s.encCodec.Name())
+		return
+	}
+	c.l.Infof("encoding %s tuned for %s content", donut.Recipe.Video.Codec, contentType)
+}
+
+// findStreamInfo finds the streams like the prober does (see probers.FindStreamInfo), the
+// Config.FindStreamInfoMediaTypes the recipe drops aren't awaited.
+func (c *LibAVFFmpegStreamer) findStreamInfo(inputFormatContext *astiav.FormatContext, recipe entities.DonutRecipe) error {
+	var expected []entities.MediaType
+	for _, mediaType := range c.c.FindStreamInfoMediaTypes {
+		if mediaType == entities.AudioType && recipe.Audio.Action == entities.DonutDrop ||
+			mediaType == entities.VideoType && recipe.Video.Action == entities.DonutDrop {
+			continue
+		}
+		expected = append(expected, mediaType)
+	}
+	return probers.FindStreamInfo(c.c, c.l, c.m, inputFormatContext, expected)
+}
+
+func supportsPixelFormat(formats []astiav.PixelFormat, format astiav.PixelFormat) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// defineAudioEncoderOptions sets the opus frame duration, each encoded packet fills one RTP packet.
+func (c *LibAVFFmpegStreamer) defineAudioEncoderOptions(donut *entities.DonutParameters) *astiav.Dictionary {
+	ptime := donut.Recipe.Audio.PtimeMS
+	if ptime <= 0 || donut.Recipe.Audio.Codec != entities.Opus {
+		return nil
+	}
+
+	options := &astiav.Dictionary{}
+	options.Set("frame_duration", strconv.Itoa(ptime), 0)
+	c.l.Infof("encoding %s with ptime %dms", donut.Recipe.Audio.Codec, ptime)
+	return options
+}
+
+// defineAudioDuration returns the duration of an audio packet whose timestamps are in the time base, ex: the
+// decoder one for the bypassed packets (there's no encoder) or the encoder one for the transcoded packets.
+func (c *LibAVFFmpegStreamer) defineAudioDuration(s *streamContext, pkt *astiav.Packet, timeBase astiav.Rational) time.Duration {
 	audioDuration := time.Duration(0)
 	if s.inputStream.CodecParameters().MediaType() == astiav.MediaTypeAudio {
 
@@ -773,21 +1841,19 @@ func (c *LibAVFFmpegStreamer) defineAudioDuration(s *streamContext, pkt *astiav.
 		// 1s = dur * (sample/frameSize)
 		// ref https://developer.apple.com/documentation/coreaudiotypes/audiostreambasicdescription/1423257-mframesperpacket
 
-		// TODO: properly handle wraparound / roll over
-		// or explore av frame_size https://ffmpeg.org/doxygen/trunk/structAVCodecContext.html#aec57f0d859a6df8b479cd93ca3a44a33
-		// and libAV pts roll over
-		if float64(pkt.Dts())-c.lastAudioFrameDTS > 0 {
-			c.currentAudioFrameSize = float64(pkt.Dts()) - c.lastAudioFrameDTS
+		// the timestamps are tracked even when the packet tells its duration, the next one might not
+		dts := pkt.Dts()
+		audioDuration = s.frameDurations.next(dts, dts != astiav.NoPtsValue, timeBase.Num(), timeBase.Den())
+		// the demuxers and the encoders usually tell the duration of the packet
+		if pkt.Duration() > 0 {
+			audioDuration = time.Duration(float64(pkt.Duration()) * timeBase.Float64() * float64(time.Second))
 		}
-
-		c.lastAudioFrameDTS = float64(pkt.Dts())
-		sampleRate := float64(s.encCodecContext.SampleRate())
-		audioDuration = time.Duration((c.currentAudioFrameSize / sampleRate) * float64(time.Second))
 	}
 	return audioDuration
 }
 
-func (c *LibAVFFmpegStreamer) defineVideoDuration(s *streamContext, _ *astiav.Packet) time.Duration {
+// defineVideoDuration returns the duration of a video packet, its timestamps must be in the decoder time base.
+func (c *LibAVFFmpegStreamer) defineVideoDuration(s *streamContext, pkt *astiav.Packet) time.Duration {
 	videoDuration := time.Duration(0)
 	if s.inputStream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
 		// Video
@@ -797,12 +1863,40 @@ func (c *LibAVFFmpegStreamer) defineVideoDuration(s *streamContext, _ *astiav.Pa
 		// frameSize = 1
 		// 1s = dur * (sample/frameSize)
 
+		// the frame rate was capped, frames are evenly spaced at the output rate
+		if s.outputFrameRate.Num() > 0 {
+			return time.Duration(float64(s.outputFrameRate.Den()) / float64(s.outputFrameRate.Num()) * float64(time.Second))
+		}
+
+		if s.unknownFrameRate {
+			return c.defineVideoDurationFromTimestamps(s, pkt)
+		}
+
 		// we're assuming fixed video frame rate
-		videoDuration = time.Duration((float64(1) / float64(s.inputStream.AvgFrameRate().Num())) * float64(time.Second))
+		videoDuration = c.defineFrameInterval(s)
 	}
 	return videoDuration
 }
 
+// defineVideoDurationFromTimestamps derives the duration from the timestamps of the packet, see frameDurations.
+func (c *LibAVFFmpegStreamer) defineVideoDurationFromTimestamps(s *streamContext, pkt *astiav.Packet) time.Duration {
+	dts := pkt.Dts()
+	if dts == astiav.NoPtsValue {
+		dts = pkt.Pts()
+	}
+	timeBase := s.decCodecContext.TimeBase()
+	return s.frameDurations.next(dts, dts != astiav.NoPtsValue, timeBase.Num(), timeBase.Den())
+}
+
+// defineFrameInterval returns the media duration of a decoded video frame, 0 when the frame rate is unknown.
+func (c *LibAVFFmpegStreamer) defineFrameInterval(s *streamContext) time.Duration {
+	frameRate := s.decCodecContext.Framerate()
+	if frameRate.Num() == 0 {
+		return 0
+	}
+	return time.Duration(float64(frameRate.Den()) / float64(frameRate.Num()) * float64(time.Second))
+}
+
 // TODO: move this either to a mapper or make a PR for astiav
 func (*LibAVFFmpegStreamer) libAVLogToString(l astiav.LogLevel) string {
 	const _Ciconst_AV_LOG_DEBUG = 0x30
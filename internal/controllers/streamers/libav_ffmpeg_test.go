@@ -0,0 +1,157 @@
+package streamers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type recordingSink struct {
+	video, audio []entities.MediaFrameContext
+}
+
+func (s *recordingSink) WriteVideo(_ []byte, c entities.MediaFrameContext) error {
+	s.video = append(s.video, c)
+	return nil
+}
+
+func (s *recordingSink) WriteAudio(_ []byte, c entities.MediaFrameContext) error {
+	s.audio = append(s.audio, c)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+// newBypassedAudioStream returns an audio stream as prepareInput opens it, prepareOutput opens no encoder
+// for a bypassed stream.
+func newBypassedAudioStream(t *testing.T, codecID astiav.CodecID, sampleRate int, timeBase astiav.Rational) *streamContext {
+	fc := astiav.AllocFormatContext()
+	t.Cleanup(fc.Free)
+	is := fc.NewStream(nil)
+	is.CodecParameters().SetMediaType(astiav.MediaTypeAudio)
+	is.CodecParameters().SetCodecID(codecID)
+	is.CodecParameters().SetSampleRate(sampleRate)
+	is.SetTimeBase(timeBase)
+
+	decCodec := astiav.FindDecoder(codecID)
+	require.NotNil(t, decCodec)
+	cc := astiav.AllocCodecContext(decCodec)
+	t.Cleanup(cc.Free)
+	require.NoError(t, is.CodecParameters().ToCodecContext(cc))
+	cc.SetTimeBase(is.TimeBase())
+	return &streamContext{inputStream: is, decCodec: decCodec, decCodecContext: cc}
+}
+
+func newAudioPacket(t *testing.T, dts, duration int64) *astiav.Packet {
+	pkt := astiav.AllocPacket()
+	t.Cleanup(pkt.Free)
+	require.NoError(t, pkt.FromData([]byte{0xfc, 0xff, 0xfe}))
+	pkt.SetPts(dts)
+	pkt.SetDts(dts)
+	pkt.SetDuration(duration)
+	return pkt
+}
+
+func TestProcessPacketBypassesAudio(t *testing.T) {
+	c := &LibAVFFmpegStreamer{c: &entities.Config{}, l: zap.NewNop().Sugar()}
+	sink := &recordingSink{}
+	donut := &entities.DonutParameters{
+		Recipe: entities.DonutRecipe{
+			Audio: entities.DonutMediaTask{Action: entities.DonutBypass, Codec: entities.Opus},
+		},
+		Sinks: []entities.OutputSink{sink},
+	}
+	// 20ms Opus packets, the first one tells its duration, the second one doesn't
+	s := newBypassedAudioStream(t, astiav.CodecIDOpus, 48000, astiav.NewRational(1, 48000))
+	require.Nil(t, s.encCodecContext)
+
+	require.NoError(t, c.processPacket(&libAVParams{}, newAudioPacket(t, 0, 960), s, donut))
+	require.NoError(t, c.processPacket(&libAVParams{}, newAudioPacket(t, 960, 0), s, donut))
+
+	require.Len(t, sink.audio, 2)
+	assert.Equal(t, 20*time.Millisecond, sink.audio[0].Duration)
+	assert.Equal(t, 20*time.Millisecond, sink.audio[1].Duration)
+	assert.Equal(t, uint32(960), sink.audio[1].RTPTimestamp-sink.audio[0].RTPTimestamp)
+	assert.Empty(t, sink.video)
+}
+
+// TestProcessPacketBypassesFallbackAudio streams the source audio bypassed by the engine's audio fallback
+// (ex: no Opus encoder), the MPEG-TS packets don't tell their duration.
+func TestProcessPacketBypassesFallbackAudio(t *testing.T) {
+	c := &LibAVFFmpegStreamer{c: &entities.Config{}, l: zap.NewNop().Sugar()}
+	sink := &recordingSink{}
+	donut := &entities.DonutParameters{
+		Recipe: entities.DonutRecipe{
+			Video: entities.DonutMediaTask{Action: entities.DonutDrop},
+			Audio: entities.DonutMediaTask{Action: entities.DonutBypass, Codec: entities.Opus},
+		},
+		Sinks: []entities.OutputSink{sink},
+	}
+	s := newBypassedAudioStream(t, astiav.CodecIDOpus, 48000, astiav.NewRational(1, 90000))
+
+	for _, dts := range []int64{0, 1800, 3600} {
+		require.NoError(t, c.processPacket(&libAVParams{}, newAudioPacket(t, dts, 0), s, donut))
+	}
+
+	require.Len(t, sink.audio, 3)
+	for _, frame := range sink.audio[1:] {
+		assert.Equal(t, 20*time.Millisecond, frame.Duration)
+	}
+	assert.Equal(t, uint32(960), sink.audio[2].RTPTimestamp-sink.audio[1].RTPTimestamp)
+}
+
+// TestProcessPacketAudioDurationsPerStream interleaves the packets of two pipelines sharing the streamer.
+func TestProcessPacketAudioDurationsPerStream(t *testing.T) {
+	c := &LibAVFFmpegStreamer{c: &entities.Config{}, l: zap.NewNop().Sugar()}
+	opusSink, aacSink := &recordingSink{}, &recordingSink{}
+	opusDonut := &entities.DonutParameters{
+		Recipe: entities.DonutRecipe{Audio: entities.DonutMediaTask{Action: entities.DonutBypass, Codec: entities.Opus}},
+		Sinks:  []entities.OutputSink{opusSink},
+	}
+	aacDonut := &entities.DonutParameters{
+		Recipe: entities.DonutRecipe{Audio: entities.DonutMediaTask{Action: entities.DonutBypass, Codec: entities.AAC}},
+		Sinks:  []entities.OutputSink{aacSink},
+	}
+	// 20ms Opus packets at 48kHz, 23ms AAC packets in the FLV time base
+	opus := newBypassedAudioStream(t, astiav.CodecIDOpus, 48000, astiav.NewRational(1, 48000))
+	aac := newBypassedAudioStream(t, astiav.CodecIDAac, 44100, astiav.NewRational(1, 1000))
+
+	for i := int64(0); i < 3; i++ {
+		require.NoError(t, c.processPacket(&libAVParams{}, newAudioPacket(t, i*960, 0), opus, opusDonut))
+		require.NoError(t, c.processPacket(&libAVParams{}, newAudioPacket(t, i*23, 0), aac, aacDonut))
+	}
+
+	require.Len(t, opusSink.audio, 3)
+	require.Len(t, aacSink.audio, 3)
+	for i := 1; i < 3; i++ {
+		assert.Equal(t, 20*time.Millisecond, opusSink.audio[i].Duration)
+		assert.Equal(t, 23*time.Millisecond, aacSink.audio[i].Duration)
+	}
+}
+
+// TestProcessPacketAudioTimestampsRollover crosses the 33 bits MPEG-TS timestamps rollover.
+func TestProcessPacketAudioTimestampsRollover(t *testing.T) {
+	c := &LibAVFFmpegStreamer{c: &entities.Config{}, l: zap.NewNop().Sugar()}
+	sink := &recordingSink{}
+	donut := &entities.DonutParameters{
+		Recipe: entities.DonutRecipe{Audio: entities.DonutMediaTask{Action: entities.DonutBypass, Codec: entities.Opus}},
+		Sinks:  []entities.OutputSink{sink},
+	}
+	s := newBypassedAudioStream(t, astiav.CodecIDOpus, 48000, astiav.NewRational(1, 90000))
+
+	for _, dts := range []int64{1<<33 - 3600, 1<<33 - 1800, 0, 1800} {
+		require.NoError(t, c.processPacket(&libAVParams{}, newAudioPacket(t, dts, 0), s, donut))
+	}
+
+	require.Len(t, sink.audio, 4)
+	for _, frame := range sink.audio[1:] {
+		assert.Equal(t, 20*time.Millisecond, frame.Duration)
+	}
+}
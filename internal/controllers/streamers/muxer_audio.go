@@ -0,0 +1,76 @@
+package streamers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/asticode/go-astiav"
+	"github.com/asticode/go-astikit"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// muxerAudioFilter converts the output of base (nil means passthrough) to the format expected by the
+// muxer encoder, the WebRTC encoder might accept another sample format (ex: s16 for Opus, fltp for AAC).
+func muxerAudioFilter(base *entities.DonutStreamFilter, sampleFormat string, sampleRate int, channelLayout string) *entities.DonutStreamFilter {
+	filter := entities.DonutStreamFilter(fmt.Sprintf("aformat=sample_fmts=%s:sample_rates=%d:channel_layouts=%s", sampleFormat, sampleRate, channelLayout))
+	if base != nil && *base != "" {
+		filter = entities.DonutStreamFilter(fmt.Sprintf("%s,%s", *base, filter))
+	}
+	return &filter
+}
+
+// prepareMuxerAudio opens the second audio encoder of the muxers, when they need another codec than
+// the WebRTC one. It follows the channels, sample rate and bit rate of the opened WebRTC encoder.
+func (c *LibAVFFmpegStreamer) prepareMuxerAudio(s *streamContext, closer *astikit.Closer, donut *entities.DonutParameters) error {
+	codec, ok := muxerCodec(donut.Recipe.Audio)
+	if !ok || len(muxersOf(donut.Sinks)) == 0 {
+		return nil
+	}
+	codecID, err := c.m.FromStreamCodecToLibAVCodecID(codec)
+	if err != nil {
+		return err
+	}
+
+	m := &streamContext{
+		inputStream:     s.inputStream,
+		decCodecContext: s.decCodecContext,
+	}
+	if m.encCodec = astiav.FindEncoder(codecID); m.encCodec == nil {
+		return entities.NewEncoderNotFoundError(codec)
+	}
+	if m.encCodecContext = astiav.AllocCodecContext(m.encCodec); m.encCodecContext == nil {
+		return errors.New("ffmpeg/libav: codec context is nil")
+	}
+	closer.Add(m.encCodecContext.Free)
+
+	sampleFormat := s.encCodecContext.SampleFormat()
+	if v := m.encCodec.SampleFormats(); len(v) > 0 {
+		sampleFormat = v[0]
+	}
+	m.encCodecContext.SetSampleFormat(sampleFormat)
+	m.encCodecContext.SetChannelLayout(s.encCodecContext.ChannelLayout())
+	m.encCodecContext.SetChannels(s.encCodecContext.Channels())
+	m.encCodecContext.SetSampleRate(s.encCodecContext.SampleRate())
+	m.encCodecContext.SetBitRate(s.encCodecContext.BitRate())
+	m.encCodecContext.SetTimeBase(s.encCodecContext.TimeBase())
+	// the muxers (ex: mp4 or flv) expect the codec configuration in the stream header
+	m.encCodecContext.SetFlags(m.encCodecContext.Flags().Add(astiav.CodecContextFlagGlobalHeader))
+	if err := m.encCodecContext.Open(m.encCodec, nil); err != nil {
+		return fmt.Errorf("opening the %s muxer encoder failed: %w", codec, err)
+	}
+
+	filter := muxerAudioFilter(donut.Recipe.Audio.DonutStreamFilter, sampleFormat.Name(), m.encCodecContext.SampleRate(), m.encCodecContext.ChannelLayout().String())
+	if err := c.configureFilterGraph(m, filter); err != nil {
+		return err
+	}
+	closer.Add(func() { m.filterGraph.Free() })
+
+	m.filterFrame = astiav.AllocFrame()
+	closer.Add(m.filterFrame.Free)
+	m.encPkt = astiav.AllocPacket()
+	closer.Add(m.encPkt.Free)
+
+	c.l.Infof("encoding the audio to %s for the muxers", codec)
+	s.muxerEncoder = m
+	return nil
+}
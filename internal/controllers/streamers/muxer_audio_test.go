@@ -0,0 +1,16 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxerAudioFilter(t *testing.T) {
+	assert.Equal(t, "aformat=sample_fmts=fltp:sample_rates=48000:channel_layouts=stereo",
+		string(*muxerAudioFilter(nil, "fltp", 48000, "stereo")))
+	base := entities.AudioResamplerFilter(48000)
+	assert.Equal(t, "aresample=48000,aformat=sample_fmts=fltp:sample_rates=48000:channel_layouts=mono",
+		string(*muxerAudioFilter(base, "fltp", 48000, "mono")))
+}
@@ -0,0 +1,74 @@
+package streamers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// muxerCodec returns the codec the muxers need besides the WebRTC one (ex: AAC for HLS or H264 for
+// an mp4 recording of VP9), ok is false when they get the packets sent to the viewers.
+func muxerCodec(task entities.DonutMediaTask) (codec entities.Codec, ok bool) {
+	if task.Action != entities.DonutTranscode || task.MuxerCodec == "" || task.MuxerCodec == task.Codec {
+		return "", false
+	}
+	return task.MuxerCodec, true
+}
+
+// encodeMuxerFrame filters and encodes a decoded frame for the muxers, a nil frame drains the filter
+// graph and the encoder. The frame is kept intact for the WebRTC encoder.
+func (c *LibAVFFmpegStreamer) encodeMuxerFrame(m *streamContext, f *astiav.Frame, donut *entities.DonutParameters) error {
+	if f != nil && m.decCodecContext.MediaType() == astiav.MediaTypeAudio {
+		if err := c.followAudioFormat(m, f, func() error { return c.filterMuxerFrame(m, nil, donut) }); err != nil {
+			return err
+		}
+	}
+	if err := c.filterMuxerFrame(m, f, donut); err != nil {
+		return err
+	}
+	if f == nil {
+		return c.sendMuxerFrame(m, nil, donut)
+	}
+	return nil
+}
+
+// filterMuxerFrame sends the filtered frames to the muxer encoder, a nil frame drains the filter graph.
+func (c *LibAVFFmpegStreamer) filterMuxerFrame(m *streamContext, f *astiav.Frame, donut *entities.DonutParameters) error {
+	if err := m.buffersrcContext.BuffersrcAddFrame(f, astiav.NewBuffersrcFlags(astiav.BuffersrcFlagKeepRef)); err != nil {
+		return fmt.Errorf("adding muxer frame failed: %w", err)
+	}
+	for {
+		m.filterFrame.Unref()
+		if err := m.buffersinkContext.BuffersinkGetFrame(m.filterFrame, astiav.NewBuffersinkFlags()); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				break
+			}
+			return fmt.Errorf("getting muxer frame failed: %w", err)
+		}
+		if err := c.sendMuxerFrame(m, m.filterFrame, donut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *LibAVFFmpegStreamer) sendMuxerFrame(m *streamContext, f *astiav.Frame, donut *entities.DonutParameters) error {
+	if err := m.encCodecContext.SendFrame(f); err != nil {
+		return fmt.Errorf("sending muxer frame failed: %w", err)
+	}
+	for {
+		m.encPkt.Unref()
+		if err := m.encCodecContext.ReceivePacket(m.encPkt); err != nil {
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				return nil
+			}
+			return fmt.Errorf("receiving muxer packet failed: %w", err)
+		}
+		m.encPkt.RescaleTs(m.inputStream.TimeBase(), m.encCodecContext.TimeBase())
+		if err := c.writeToMuxer(m, donut); err != nil {
+			return err
+		}
+	}
+}
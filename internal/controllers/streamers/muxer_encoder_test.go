@@ -0,0 +1,37 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxerCodec(t *testing.T) {
+	tests := []struct {
+		name   string
+		task   entities.DonutMediaTask
+		want   entities.Codec
+		wantOK bool
+	}{
+		{"opus for webrtc, aac for the muxers", entities.DonutMediaTask{Action: entities.DonutTranscode, Codec: entities.Opus, MuxerCodec: entities.AAC}, entities.AAC, true},
+		{"no muxer codec", entities.DonutMediaTask{Action: entities.DonutTranscode, Codec: entities.Opus}, "", false},
+		{"same codec", entities.DonutMediaTask{Action: entities.DonutTranscode, Codec: entities.Opus, MuxerCodec: entities.Opus}, "", false},
+		{"bypassed", entities.DonutMediaTask{Action: entities.DonutBypass, Codec: entities.AAC, MuxerCodec: entities.AAC}, "", false},
+		{"vp9 for webrtc, h264 for the recording", entities.DonutMediaTask{Action: entities.DonutTranscode, Codec: entities.VP9, MuxerCodec: entities.H264}, entities.H264, true},
+	}
+	for _, tt := range tests {
+		codec, ok := muxerCodec(tt.task)
+		assert.Equal(t, tt.want, codec, tt.name)
+		assert.Equal(t, tt.wantOK, ok, tt.name)
+	}
+}
+
+func TestMuxerVideoPixelFormat(t *testing.T) {
+	supported := []astiav.PixelFormat{astiav.PixelFormatYuv420P, astiav.PixelFormatYuv420P10Le}
+	// the WebRTC pixel format is kept when supported, or without a supported list
+	assert.Equal(t, astiav.PixelFormatYuv420P10Le, muxerVideoPixelFormat(supported, astiav.PixelFormatYuv420P10Le))
+	assert.Equal(t, astiav.PixelFormatYuv420P, muxerVideoPixelFormat(supported, astiav.PixelFormatNv12))
+	assert.Equal(t, astiav.PixelFormatNv12, muxerVideoPixelFormat(nil, astiav.PixelFormatNv12))
+}
@@ -0,0 +1,90 @@
+package streamers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/asticode/go-astiav"
+	"github.com/asticode/go-astikit"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// muxerVideoPixelFormat keeps the pixel format of the WebRTC encoder when the muxer encoder supports it,
+// its first supported one otherwise (ex: libx264 doesn't take the nv12 of some hardware encoders).
+func muxerVideoPixelFormat(supported []astiav.PixelFormat, current astiav.PixelFormat) astiav.PixelFormat {
+	if len(supported) == 0 || supportsPixelFormat(supported, current) {
+		return current
+	}
+	return supported[0]
+}
+
+// prepareMuxerVideo opens the second video encoder of the muxers, when they need another codec than
+// the WebRTC one (ex: an mp4 recording in H264 of a VP9 stream). The frames are decoded once, it follows
+// the size, frame rate, bit rate, keyframe interval and tuning options of the opened WebRTC encoder.
+func (c *LibAVFFmpegStreamer) prepareMuxerVideo(s *streamContext, closer *astikit.Closer, donut *entities.DonutParameters) error {
+	codec, ok := muxerCodec(donut.Recipe.Video)
+	if !ok || len(muxersOf(donut.Sinks)) == 0 {
+		return nil
+	}
+	codecID, err := c.m.FromStreamCodecToLibAVCodecID(codec)
+	if err != nil {
+		return err
+	}
+
+	m := &streamContext{
+		inputStream:      s.inputStream,
+		decCodecContext:  s.decCodecContext,
+		outputWidth:      s.outputWidth,
+		outputHeight:     s.outputHeight,
+		outputFrameRate:  s.outputFrameRate,
+		squarePixels:     s.squarePixels,
+		colorRange:       s.colorRange,
+		unknownFrameRate: s.unknownFrameRate,
+		frameDurations:   newFrameDurations(s.frameDurations.duration),
+	}
+	if m.encCodec = astiav.FindEncoder(codecID); m.encCodec == nil {
+		return entities.NewEncoderNotFoundError(codec)
+	}
+	if m.encCodecContext = astiav.AllocCodecContext(m.encCodec); m.encCodecContext == nil {
+		return errors.New("ffmpeg/libav: codec context is nil")
+	}
+	closer.Add(m.encCodecContext.Free)
+
+	pixelFormat := muxerVideoPixelFormat(m.encCodec.PixelFormats(), s.encCodecContext.PixelFormat())
+	m.encCodecContext.SetPixelFormat(pixelFormat)
+	m.outputPixelFormat = pixelFormat.Name()
+	m.encCodecContext.SetWidth(s.encCodecContext.Width())
+	m.encCodecContext.SetHeight(s.encCodecContext.Height())
+	m.encCodecContext.SetSampleAspectRatio(s.encCodecContext.SampleAspectRatio())
+	m.encCodecContext.SetTimeBase(s.encCodecContext.TimeBase())
+	if frameRate := s.encCodecContext.Framerate(); frameRate.Num() > 0 {
+		m.encCodecContext.SetFramerate(frameRate)
+	}
+	m.encCodecContext.SetBitRate(s.encCodecContext.BitRate())
+	m.encCodecContext.SetGopSize(s.encCodecContext.GopSize())
+	// the muxers (ex: mp4 or flv) expect the codec configuration in the stream header
+	m.encCodecContext.SetFlags(m.encCodecContext.Flags().Add(astiav.CodecContextFlagGlobalHeader))
+	// the same tuning as the WebRTC encoder (ex: the latency mode's preset, keyframe interval and B-frames),
+	// the muxers mustn't add latency the WebRTC output doesn't have
+	options := &astiav.Dictionary{}
+	defer options.Free()
+	c.defineVideoTuningOptions(m, donut, func(key, value string) { options.Set(key, value, 0) })
+	if err := m.encCodecContext.Open(m.encCodec, options); err != nil {
+		return fmt.Errorf("opening the %s muxer encoder failed: %w", codec, err)
+	}
+
+	// the same filters as the WebRTC encoder (ex: deinterlacing or the watermark), then its size and rate
+	if err := c.configureFilterGraph(m, donut.Recipe.Video.DonutStreamFilter); err != nil {
+		return err
+	}
+	closer.Add(func() { m.filterGraph.Free() })
+
+	m.filterFrame = astiav.AllocFrame()
+	closer.Add(m.filterFrame.Free)
+	m.encPkt = astiav.AllocPacket()
+	closer.Add(m.encPkt.Free)
+
+	c.l.Infof("encoding the video to %s for the muxers", codec)
+	s.muxerEncoder = m
+	return nil
+}
@@ -0,0 +1,55 @@
+package streamers
+
+import (
+	"fmt"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// bypassed tells whether the recipe writes the packets of a media untouched. A bypassed stream has
+// neither a filter graph nor an encoder, any other stream has both (see pipelineStages.validate).
+func bypassed(mediaType entities.MediaType, recipe entities.DonutRecipe) bool {
+	switch mediaType {
+	case entities.VideoType:
+		return recipe.Video.Action == entities.DonutBypass
+	case entities.AudioType:
+		return recipe.Audio.Action == entities.DonutBypass
+	}
+	return false
+}
+
+// pipelineStages are the stages set up for a stream, prepareOutput opens the encoder and prepareFilters
+// builds the filter graph, both skip the bypassed streams.
+type pipelineStages struct {
+	decoder     bool
+	filterGraph bool
+	encoder     bool
+}
+
+// plannedStages returns the stages set up for a media of the recipe, prepareOutput and prepareFilters
+// follow them. Every stream is decoded, ex: the poster of a bypassed video.
+func plannedStages(mediaType entities.MediaType, recipe entities.DonutRecipe) pipelineStages {
+	transcoded := !bypassed(mediaType, recipe)
+	return pipelineStages{decoder: true, filterGraph: transcoded, encoder: transcoded}
+}
+
+// validate checks the stream is either fully transcoded (decoder, filter graph and encoder) or bypassed
+// (neither filter graph nor encoder), a half set up stream would panic once a frame reaches it.
+func (p pipelineStages) validate(mediaType entities.MediaType, bypass bool) error {
+	if bypass {
+		if p.filterGraph || p.encoder {
+			return fmt.Errorf("%w: the bypassed %s has a filter graph or an encoder", entities.ErrInconsistentStream, mediaType)
+		}
+		return nil
+	}
+	if !p.decoder {
+		return fmt.Errorf("%w: the transcoded %s has no decoder", entities.ErrInconsistentStream, mediaType)
+	}
+	if !p.filterGraph {
+		return fmt.Errorf("%w: %s", entities.ErrMissingFilterGraph, mediaType)
+	}
+	if !p.encoder {
+		return fmt.Errorf("%w: %s", entities.ErrMissingEncoder, mediaType)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package streamers
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// pipelineEventsTotal counts the events reached by the pipelines, keyed by event (and media type, ex:
+// first_frame_decoded.video), pipelineEventsElapsedMS sums the time they took to reach them since their start.
+// They're served with the other expvar metrics, see GET /debug/vars.
+var (
+	pipelineEventsTotal     = expvar.NewMap("donut_pipeline_events_total")
+	pipelineEventsElapsedMS = expvar.NewMap("donut_pipeline_events_elapsed_ms_total")
+)
+
+func countPipelineEvent(e *entities.PipelineEvent) {
+	key := string(e.Name)
+	if e.MediaType != "" {
+		key += "." + string(e.MediaType)
+	}
+	pipelineEventsTotal.Add(key, 1)
+	pipelineEventsElapsedMS.Add(key, e.ElapsedMS)
+}
+
+// pipelineEvents reports each lifecycle event of the pipeline once (Config.PipelineEvents),
+// ex: input_opened, first_frame_decoded then streaming.
+type pipelineEvents struct {
+	started  time.Time
+	reported map[entities.PipelineEventName]bool
+}
+
+func newPipelineEvents(started time.Time) *pipelineEvents {
+	return &pipelineEvents{started: started, reported: map[entities.PipelineEventName]bool{}}
+}
+
+// next returns the event happening at now, ok is false when it was already reported.
+func (e *pipelineEvents) next(name entities.PipelineEventName, mediaType entities.MediaType, now time.Time) (event *entities.PipelineEvent, ok bool) {
+	if e.reported[name] {
+		return nil, false
+	}
+	e.reported[name] = true
+	return &entities.PipelineEvent{
+		Name:      name,
+		MediaType: mediaType,
+		TimeMS:    now.UnixMilli(),
+		ElapsedMS: now.Sub(e.started).Milliseconds(),
+	}, true
+}
+
+// reportPipelineEvent counts and sends the event the first time it happens, mediaType is empty for the input events.
+func (c *LibAVFFmpegStreamer) reportPipelineEvent(p *libAVParams, name entities.PipelineEventName, mediaType entities.MediaType, donut *entities.DonutParameters) {
+	if !c.c.PipelineEvents {
+		return
+	}
+	event, ok := p.events.next(name, mediaType, time.Now())
+	if !ok {
+		return
+	}
+	c.l.Infow("pipeline event", "event", event.Name, "media_type", event.MediaType, "elapsed_ms", event.ElapsedMS)
+	countPipelineEvent(event)
+	if donut.OnPipelineEvent == nil {
+		return
+	}
+	if err := donut.OnPipelineEvent(event); err != nil {
+		c.l.Warnf("reporting the pipeline event %s failed: %s", event.Name, err.Error())
+	}
+}
@@ -0,0 +1,50 @@
+package streamers
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineEvents(t *testing.T) {
+	started := time.UnixMilli(1_700_000_000_000)
+	e := newPipelineEvents(started)
+
+	event, ok := e.next(entities.PipelineEventInputOpened, "", started.Add(250*time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, entities.PipelineEventInputOpened, event.Name)
+	assert.Equal(t, int64(250), event.ElapsedMS)
+	assert.Equal(t, int64(1_700_000_000_250), event.TimeMS)
+
+	// the event is reported once
+	_, ok = e.next(entities.PipelineEventInputOpened, "", started.Add(time.Second))
+	assert.False(t, ok)
+
+	event, ok = e.next(entities.PipelineEventFirstFrameDecoded, entities.VideoType, started.Add(time.Second))
+	require.True(t, ok)
+	assert.Equal(t, entities.VideoType, event.MediaType)
+	assert.Equal(t, int64(1000), event.ElapsedMS)
+}
+
+func TestCountPipelineEvent(t *testing.T) {
+	counted := func(m *expvar.Map, key string) int64 {
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	total := counted(pipelineEventsTotal, "first_frame_decoded.video")
+	elapsed := counted(pipelineEventsElapsedMS, "first_frame_decoded.video")
+
+	countPipelineEvent(&entities.PipelineEvent{Name: entities.PipelineEventFirstFrameDecoded, MediaType: entities.VideoType, ElapsedMS: 400})
+	countPipelineEvent(&entities.PipelineEvent{Name: entities.PipelineEventFirstFrameDecoded, MediaType: entities.VideoType, ElapsedMS: 600})
+	countPipelineEvent(&entities.PipelineEvent{Name: entities.PipelineEventInputOpened, ElapsedMS: 100})
+
+	assert.Equal(t, total+2, counted(pipelineEventsTotal, "first_frame_decoded.video"))
+	assert.Equal(t, elapsed+1000, counted(pipelineEventsElapsedMS, "first_frame_decoded.video"))
+	assert.NotZero(t, counted(pipelineEventsTotal, "input_opened"))
+}
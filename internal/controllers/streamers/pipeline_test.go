@@ -0,0 +1,72 @@
+package streamers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineStagesMixedRecipes(t *testing.T) {
+	transcoded := pipelineStages{decoder: true, filterGraph: true, encoder: true}
+	bypassedStages := pipelineStages{decoder: true}
+
+	tests := []struct {
+		name         string
+		recipe       entities.DonutRecipe
+		video, audio pipelineStages
+	}{
+		{"video bypass, audio transcode", entities.DonutRecipe{
+			Video: entities.DonutMediaTask{Action: entities.DonutBypass},
+			Audio: entities.DonutMediaTask{Action: entities.DonutTranscode},
+		}, bypassedStages, transcoded},
+		{"video transcode, audio bypass", entities.DonutRecipe{
+			Video: entities.DonutMediaTask{Action: entities.DonutTranscode},
+			Audio: entities.DonutMediaTask{Action: entities.DonutBypass},
+		}, transcoded, bypassedStages},
+		{"both transcode", entities.DonutRecipe{
+			Video: entities.DonutMediaTask{Action: entities.DonutTranscode},
+			Audio: entities.DonutMediaTask{Action: entities.DonutTranscode},
+		}, transcoded, transcoded},
+		{"both bypass", entities.DonutRecipe{
+			Video: entities.DonutMediaTask{Action: entities.DonutBypass},
+			Audio: entities.DonutMediaTask{Action: entities.DonutBypass},
+		}, bypassedStages, bypassedStages},
+	}
+	for _, tt := range tests {
+		video := plannedStages(entities.VideoType, tt.recipe)
+		audio := plannedStages(entities.AudioType, tt.recipe)
+		assert.Equal(t, tt.video, video, tt.name)
+		assert.Equal(t, tt.audio, audio, tt.name)
+		// the planned stages pass the check done once the streams are set up
+		assert.NoError(t, video.validate(entities.VideoType, bypassed(entities.VideoType, tt.recipe)), tt.name)
+		assert.NoError(t, audio.validate(entities.AudioType, bypassed(entities.AudioType, tt.recipe)), tt.name)
+	}
+}
+
+func TestPipelineStagesInconsistent(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages pipelineStages
+		bypass bool
+		want   error
+	}{
+		{"filter graph without encoder", pipelineStages{decoder: true, filterGraph: true}, false, entities.ErrMissingEncoder},
+		{"encoder without filter graph", pipelineStages{decoder: true, encoder: true}, false, entities.ErrMissingFilterGraph},
+		{"transcode without decoder", pipelineStages{filterGraph: true, encoder: true}, false, entities.ErrInconsistentStream},
+		{"bypass with filter graph", pipelineStages{decoder: true, filterGraph: true}, true, entities.ErrInconsistentStream},
+		{"bypass with encoder", pipelineStages{decoder: true, encoder: true}, true, entities.ErrInconsistentStream},
+	}
+	for _, tt := range tests {
+		assert.ErrorIs(t, tt.stages.validate(entities.VideoType, tt.bypass), tt.want, tt.name)
+	}
+}
+
+func TestBypassedIgnoresOtherMediaTypes(t *testing.T) {
+	recipe := entities.DonutRecipe{
+		Video: entities.DonutMediaTask{Action: entities.DonutBypass},
+		Audio: entities.DonutMediaTask{Action: entities.DonutBypass},
+	}
+	// only audio and video are bypassed
+	assert.False(t, bypassed(entities.MediaType("data"), recipe))
+}
@@ -0,0 +1,77 @@
+package streamers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/asticode/go-astiav"
+)
+
+// posterQuality keeps the poster small enough for a single data channel message.
+const posterQuality = 70
+
+// posterMaxPackets bounds the bypassed packets decoded while waiting for the poster, decoders
+// with a reordering delay only output the key frame after a few more packets.
+const posterMaxPackets = 30
+
+// posterState tracks the capture of the first decoded key frame (Config.PosterFrames).
+type posterState struct {
+	// started is set once a key frame was sent to the decoder (bypass only)
+	started bool
+	packets int
+	done    bool
+}
+
+// encodePoster encodes the frame as a JPEG no wider than maxWidth (0 keeps its size).
+func encodePoster(f *astiav.Frame, maxWidth int) ([]byte, error) {
+	img, err := f.Data().GuessImageFormat()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Data().ToImage(img); err != nil {
+		return nil, err
+	}
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		img = downscaleYCbCr(ycbcr, posterScale(ycbcr.Rect.Dx(), maxWidth))
+	}
+
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: posterQuality}); err != nil {
+		return nil, fmt.Errorf("encoding the poster failed: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// posterScale returns the integer factor bringing the width within maxWidth, 1 when it fits.
+func posterScale(width, maxWidth int) int {
+	if maxWidth <= 0 || width <= maxWidth {
+		return 1
+	}
+	return (width + maxWidth - 1) / maxWidth
+}
+
+// downscaleYCbCr shrinks the picture by the factor, the luma is averaged and the chroma sampled.
+func downscaleYCbCr(src *image.YCbCr, factor int) *image.YCbCr {
+	if factor <= 1 {
+		return src
+	}
+	width, height := src.Rect.Dx()/factor, src.Rect.Dy()/factor
+	dst := image.NewYCbCr(image.Rect(0, 0, width, height), src.SubsampleRatio)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := src.Rect.Min.X+x*factor, src.Rect.Min.Y+y*factor
+			sum := 0
+			for dy := 0; dy < factor; dy++ {
+				for dx := 0; dx < factor; dx++ {
+					sum += int(src.Y[src.YOffset(sx+dx, sy+dy)])
+				}
+			}
+			dst.Y[dst.YOffset(x, y)] = uint8(sum / (factor * factor))
+			dst.Cb[dst.COffset(x, y)] = src.Cb[src.COffset(sx, sy)]
+			dst.Cr[dst.COffset(x, y)] = src.Cr[src.COffset(sx, sy)]
+		}
+	}
+	return dst
+}
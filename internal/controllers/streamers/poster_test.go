@@ -0,0 +1,45 @@
+package streamers
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPosterScale(t *testing.T) {
+	tests := []struct {
+		width, maxWidth, want int
+	}{
+		{1920, 480, 4},
+		{1280, 480, 3},
+		{480, 480, 1},
+		{320, 480, 1},
+		{1920, 0, 1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, posterScale(tt.width, tt.maxWidth), "posterScale(%d, %d)", tt.width, tt.maxWidth)
+	}
+}
+
+func TestDownscaleYCbCr(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 8, 4), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = uint8(i % 8 * 10)
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = 100, 200
+	}
+
+	dst := downscaleYCbCr(src, 2)
+
+	require.Equal(t, 4, dst.Rect.Dx())
+	require.Equal(t, 2, dst.Rect.Dy())
+	// the luma of each 2x2 block is averaged, ex: (0+10+0+10)/4
+	for x, want := range []uint8{5, 25, 45, 65} {
+		assert.Equal(t, want, dst.Y[dst.YOffset(x, 1)], "Y(%d, 1)", x)
+	}
+	assert.Equal(t, uint8(100), dst.Cb[dst.COffset(3, 1)])
+	assert.Equal(t, uint8(200), dst.Cr[dst.COffset(3, 1)])
+}
@@ -0,0 +1,107 @@
+package streamers
+
+import (
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// maxPrebuffer caps the prebuffer, anything longer is just added latency.
+const maxPrebuffer = time.Second
+
+// maxPrebufferedFrames bounds the memory when the frames carry no duration.
+const maxPrebufferedFrames = 300
+
+type prebufferedFrame struct {
+	write func(data []byte, c entities.MediaFrameContext) error
+	data  []byte
+	c     entities.MediaFrameContext
+}
+
+// prebuffer holds the first frames until any media type spans the target duration,
+// then writes them at once. It gives the client's jitter buffer a head start,
+// smoothing the first second of playback while the pipeline warms up.
+type prebuffer struct {
+	target   time.Duration
+	buffered map[entities.MediaType]time.Duration
+	frames   []prebufferedFrame
+	released bool
+}
+
+func newPrebuffer(target time.Duration) *prebuffer {
+	if target > maxPrebuffer {
+		target = maxPrebuffer
+	}
+	return &prebuffer{
+		target:   target,
+		buffered: map[entities.MediaType]time.Duration{},
+	}
+}
+
+// wrap returns a copy of the parameters whose sinks go through the prebuffer, but the muxers.
+func (b *prebuffer) wrap(donut *entities.DonutParameters) *entities.DonutParameters {
+	wrapped := *donut
+	wrapped.Sinks = nil
+	for _, sink := range donut.Sinks {
+		if _, ok := sink.(entities.DonutMuxer); !ok {
+			sink = &prebufferedSink{
+				video: b.writer(entities.VideoType, sink.WriteVideo),
+				audio: b.writer(entities.AudioType, sink.WriteAudio),
+				sink:  sink,
+			}
+		}
+		wrapped.Sinks = append(wrapped.Sinks, sink)
+	}
+	return &wrapped
+}
+
+// prebufferedSink holds the frames of a sink until the prebuffer is released.
+type prebufferedSink struct {
+	video func(data []byte, c entities.MediaFrameContext) error
+	audio func(data []byte, c entities.MediaFrameContext) error
+	sink  entities.OutputSink
+}
+
+func (s *prebufferedSink) WriteVideo(data []byte, c entities.MediaFrameContext) error {
+	return s.video(data, c)
+}
+
+func (s *prebufferedSink) WriteAudio(data []byte, c entities.MediaFrameContext) error {
+	return s.audio(data, c)
+}
+
+func (s *prebufferedSink) Close() error {
+	return s.sink.Close()
+}
+
+func (b *prebuffer) writer(mediaType entities.MediaType, write func(data []byte, c entities.MediaFrameContext) error) func(data []byte, c entities.MediaFrameContext) error {
+	return func(data []byte, c entities.MediaFrameContext) error {
+		if b.released {
+			return write(data, c)
+		}
+
+		b.frames = append(b.frames, prebufferedFrame{write: write, data: data, c: c})
+		b.buffered[mediaType] += c.Duration
+		if b.buffered[mediaType] >= b.target || len(b.frames) >= maxPrebufferedFrames {
+			return b.release()
+		}
+		return nil
+	}
+}
+
+// release writes the buffered frames in arrival order, the following frames are written straight away.
+func (b *prebuffer) release() error {
+	if b.released {
+		return nil
+	}
+	b.released = true
+
+	frames := b.frames
+	b.frames = nil
+	for _, f := range frames {
+		if err := f.write(f.data, f.c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
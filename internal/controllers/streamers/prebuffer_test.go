@@ -0,0 +1,152 @@
+package streamers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// orderedSink records the writes of both media types in arrival order, ex: "video 1".
+type orderedSink struct {
+	writes []string
+	closed bool
+}
+
+func (s *orderedSink) WriteVideo(data []byte, _ entities.MediaFrameContext) error {
+	s.writes = append(s.writes, fmt.Sprintf("video %s", data))
+	return nil
+}
+
+func (s *orderedSink) WriteAudio(data []byte, _ entities.MediaFrameContext) error {
+	s.writes = append(s.writes, fmt.Sprintf("audio %s", data))
+	return nil
+}
+
+func (s *orderedSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+type orderedMuxer struct {
+	orderedSink
+}
+
+func (m *orderedMuxer) AddStream(entities.MediaType, *astiav.CodecParameters, astiav.Rational) error {
+	return nil
+}
+
+// newPrebufferedSink returns the sink the prebuffer wraps around the recorder.
+func newPrebufferedSink(t *testing.T, b *prebuffer) (entities.OutputSink, *orderedSink) {
+	recorder := &orderedSink{}
+	wrapped := b.wrap(&entities.DonutParameters{Sinks: []entities.OutputSink{recorder}})
+	require.Len(t, wrapped.Sinks, 1)
+	return wrapped.Sinks[0], recorder
+}
+
+func writeFrame(t *testing.T, sink entities.OutputSink, mediaType entities.MediaType, n int, duration time.Duration) {
+	data := []byte(fmt.Sprint(n))
+	c := entities.MediaFrameContext{Duration: duration}
+	if mediaType == entities.VideoType {
+		require.NoError(t, sink.WriteVideo(data, c))
+	} else {
+		require.NoError(t, sink.WriteAudio(data, c))
+	}
+}
+
+func TestPrebufferReleasesAtTheTarget(t *testing.T) {
+	sink, recorder := newPrebufferedSink(t, newPrebuffer(100*time.Millisecond))
+
+	for i := 1; i <= 3; i++ {
+		writeFrame(t, sink, entities.VideoType, i, 33*time.Millisecond)
+	}
+	assert.Empty(t, recorder.writes, "99ms are buffered")
+
+	writeFrame(t, sink, entities.VideoType, 4, 33*time.Millisecond)
+	assert.Equal(t, []string{"video 1", "video 2", "video 3", "video 4"}, recorder.writes)
+
+	// the following frames are written straight away
+	writeFrame(t, sink, entities.VideoType, 5, 33*time.Millisecond)
+	assert.Equal(t, "video 5", recorder.writes[len(recorder.writes)-1])
+}
+
+func TestPrebufferReleasesOnAnyMediaType(t *testing.T) {
+	sink, recorder := newPrebufferedSink(t, newPrebuffer(100*time.Millisecond))
+
+	writeFrame(t, sink, entities.VideoType, 1, 33*time.Millisecond)
+	for i := 1; i <= 4; i++ {
+		writeFrame(t, sink, entities.AudioType, i, 20*time.Millisecond)
+	}
+	writeFrame(t, sink, entities.VideoType, 2, 33*time.Millisecond)
+	assert.Empty(t, recorder.writes, "neither the video (66ms) nor the audio (80ms) reached the target")
+
+	writeFrame(t, sink, entities.AudioType, 5, 20*time.Millisecond)
+	assert.Equal(t, []string{
+		"video 1", "audio 1", "audio 2", "audio 3", "audio 4", "video 2", "audio 5",
+	}, recorder.writes, "the frames are released in arrival order")
+}
+
+func TestPrebufferCapsTheTarget(t *testing.T) {
+	b := newPrebuffer(5 * time.Second)
+	assert.Equal(t, maxPrebuffer, b.target)
+
+	sink, recorder := newPrebufferedSink(t, b)
+	for i := 1; i <= 30; i++ {
+		writeFrame(t, sink, entities.VideoType, i, 33*time.Millisecond)
+	}
+	assert.Empty(t, recorder.writes, "990ms are buffered")
+
+	writeFrame(t, sink, entities.VideoType, 31, 33*time.Millisecond)
+	assert.Len(t, recorder.writes, 31)
+}
+
+func TestPrebufferBoundsTheFrames(t *testing.T) {
+	sink, recorder := newPrebufferedSink(t, newPrebuffer(maxPrebuffer))
+
+	// the frames carry no duration
+	for i := 1; i < maxPrebufferedFrames; i++ {
+		writeFrame(t, sink, entities.VideoType, i, 0)
+	}
+	assert.Empty(t, recorder.writes)
+
+	writeFrame(t, sink, entities.VideoType, maxPrebufferedFrames, 0)
+	require.Len(t, recorder.writes, maxPrebufferedFrames)
+	assert.Equal(t, "video 1", recorder.writes[0])
+}
+
+func TestPrebufferRelease(t *testing.T) {
+	b := newPrebuffer(maxPrebuffer)
+	sink, recorder := newPrebufferedSink(t, b)
+
+	// a stream shorter than the prebuffer
+	writeFrame(t, sink, entities.VideoType, 1, 33*time.Millisecond)
+	writeFrame(t, sink, entities.AudioType, 1, 20*time.Millisecond)
+	require.NoError(t, b.release())
+	assert.Equal(t, []string{"video 1", "audio 1"}, recorder.writes)
+
+	require.NoError(t, b.release())
+	assert.Len(t, recorder.writes, 2)
+}
+
+func TestPrebufferPassesTheMuxersThrough(t *testing.T) {
+	muxer, recorder := &orderedMuxer{}, &orderedSink{}
+	wrapped := newPrebuffer(100 * time.Millisecond).wrap(&entities.DonutParameters{
+		Sinks: []entities.OutputSink{muxer, recorder},
+	})
+	require.Len(t, wrapped.Sinks, 2)
+	assert.Same(t, muxer, wrapped.Sinks[0])
+	assert.NotSame(t, recorder, wrapped.Sinks[1])
+
+	for _, sink := range wrapped.Sinks {
+		writeFrame(t, sink, entities.VideoType, 1, 33*time.Millisecond)
+	}
+	assert.Equal(t, []string{"video 1"}, muxer.writes, "the recording isn't delayed")
+	assert.Empty(t, recorder.writes)
+
+	require.NoError(t, wrapped.Sinks[1].Close())
+	assert.True(t, recorder.closed)
+}
@@ -0,0 +1,58 @@
+package streamers
+
+import (
+	"math"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+)
+
+// rtpTimestamp rescales a pts expressed in timeBase to the RTP clock rate of the codec,
+// ex: 90kHz for video and 48kHz for Opus. The result wraps around as RTP timestamps do.
+func rtpTimestamp(pts int64, timeBase astiav.Rational, clockRate uint32) uint32 {
+	return uint32(astiav.RescaleQ(pts, timeBase, astiav.NewRational(1, int(clockRate))))
+}
+
+// rtpClock keeps the RTP timestamps of a stream continuous, they wrap around at 2^32 (every ~13h at 90kHz,
+// ~24h at 48kHz) and the receivers compute the deltas modulo 2^32. Some receivers glitch at the wrap though,
+// with a reset window the timestamps are rebased to 0 on a key frame before it, where the receiver can resync.
+type rtpClock struct {
+	// offset is added to the rescaled pts, modulo 2^32
+	offset uint32
+}
+
+// timestamp returns the RTP timestamp of a packet, resetWindow is the number of ticks before the wrap
+// from which a key frame rebases the timestamps to 0, 0 lets them wrap. The frames following a key frame
+// in decoding order must not be displayed before it (no open GOP), they'd be timestamped before the reset.
+func (c *rtpClock) timestamp(pts int64, timeBase astiav.Rational, clockRate uint32, keyFrame bool, resetWindow uint32) uint32 {
+	ts := rtpTimestamp(pts, timeBase, clockRate) + c.offset
+	if keyFrame && resetWindow > 0 && ts > math.MaxUint32-resetWindow {
+		c.offset -= ts
+		return 0
+	}
+	return ts
+}
+
+// rtpResetWindow converts the reset window to clock rate ticks, bounded to a quarter of the timestamp range
+// so that a reset never happens right after the previous one.
+func rtpResetWindow(seconds int, clockRate uint32) uint32 {
+	if seconds <= 0 {
+		return 0
+	}
+	ticks := uint64(seconds) * uint64(clockRate)
+	if ticks > math.MaxUint32/4 {
+		return math.MaxUint32 / 4
+	}
+	return uint32(ticks)
+}
+
+// packetRTPTimestamp returns the RTP timestamp of a packet whose timestamps are in timeBase, its dts when it has
+// no pts. The stream's clock keeps them continuous, see rtpClock.
+func (c *LibAVFFmpegStreamer) packetRTPTimestamp(s *streamContext, pkt *astiav.Packet, timeBase astiav.Rational, codec entities.Codec) uint32 {
+	pts := pkt.Pts()
+	if pts == astiav.NoPtsValue {
+		pts = pkt.Dts()
+	}
+	clockRate := codec.RTPClockRate()
+	return s.rtp.timestamp(pts, timeBase, clockRate, pkt.Flags().Has(astiav.PacketFlagKey), rtpResetWindow(c.c.RTPTimestampResetWindowS, clockRate))
+}
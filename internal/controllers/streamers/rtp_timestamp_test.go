@@ -0,0 +1,80 @@
+package streamers
+
+import (
+	"math"
+	"testing"
+
+	"github.com/asticode/go-astiav"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRTPTimestamp_Video(t *testing.T) {
+	clockRate := entities.H264.RTPClockRate()
+	frameTimeBase := astiav.NewRational(1, 30)
+
+	var timestamps []uint32
+	for pts := int64(0); pts < 4; pts++ {
+		timestamps = append(timestamps, rtpTimestamp(pts, frameTimeBase, clockRate))
+	}
+
+	assert.Equal(t, uint32(90000), clockRate)
+	// 30fps advances 3000 ticks per frame at 90kHz
+	assert.Equal(t, []uint32{0, 3000, 6000, 9000}, timestamps)
+	assert.Equal(t, uint32(90000), rtpTimestamp(1000, astiav.NewRational(1, 1000), clockRate))
+}
+
+func TestRTPTimestamp_Audio(t *testing.T) {
+	clockRate := entities.Opus.RTPClockRate()
+	millisecondTimeBase := astiav.NewRational(1, 1000)
+
+	var timestamps []uint32
+	for pts := int64(0); pts < 60; pts += 20 {
+		timestamps = append(timestamps, rtpTimestamp(pts, millisecondTimeBase, clockRate))
+	}
+
+	assert.Equal(t, uint32(48000), clockRate)
+	// 20ms Opus frames advance 960 ticks at 48kHz
+	assert.Equal(t, []uint32{0, 960, 1920}, timestamps)
+	// the clock rate doesn't depend on the sample rate
+	assert.Equal(t, uint32(48000), rtpTimestamp(16000, astiav.NewRational(1, 16000), clockRate))
+}
+
+func TestRTPClock_Wrap(t *testing.T) {
+	clockRate := entities.H264.RTPClockRate()
+	tickTimeBase := astiav.NewRational(1, int(clockRate))
+	clock := rtpClock{}
+
+	// 30fps crossing 2^32 ticks, about 13h15m into the session
+	var timestamps []uint32
+	for pts := int64(math.MaxUint32 - 6000 + 1); pts < math.MaxUint32+6000; pts += 3000 {
+		timestamps = append(timestamps, clock.timestamp(pts, tickTimeBase, clockRate, false, 0))
+	}
+
+	assert.Equal(t, []uint32{math.MaxUint32 - 5999, math.MaxUint32 - 2999, 0, 3000}, timestamps)
+	for i := 1; i < len(timestamps); i++ {
+		// the receivers compute the deltas modulo 2^32
+		assert.Equal(t, uint32(3000), timestamps[i]-timestamps[i-1])
+	}
+}
+
+func TestRTPClock_Reset(t *testing.T) {
+	clockRate := entities.H264.RTPClockRate()
+	tickTimeBase := astiav.NewRational(1, int(clockRate))
+	window := rtpResetWindow(1, clockRate)
+	clock := rtpClock{}
+
+	start := int64(math.MaxUint32 - 2*90000)
+	assert.Equal(t, uint32(start), clock.timestamp(start, tickTimeBase, clockRate, true, window), "outside the window")
+	assert.Equal(t, uint32(start+3000*30), clock.timestamp(start+3000*30, tickTimeBase, clockRate, false, window), "not a key frame")
+	assert.Equal(t, uint32(0), clock.timestamp(start+3000*31, tickTimeBase, clockRate, true, window))
+	// the following frames are continuous from the reset, past the wrap
+	assert.Equal(t, uint32(3000), clock.timestamp(start+3000*32, tickTimeBase, clockRate, false, window))
+	assert.Equal(t, uint32(3000*60), clock.timestamp(start+3000*91, tickTimeBase, clockRate, true, window))
+}
+
+func TestRTPResetWindow(t *testing.T) {
+	assert.Equal(t, uint32(0), rtpResetWindow(0, 90000))
+	assert.Equal(t, uint32(48000*60), rtpResetWindow(60, 48000))
+	assert.Equal(t, uint32(math.MaxUint32/4), rtpResetWindow(24*3600, 90000))
+}
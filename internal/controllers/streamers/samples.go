@@ -0,0 +1,34 @@
+package streamers
+
+import "time"
+
+// sampleCounter accounts the audio samples entering the filters and the ones reaching the encoder,
+// once resampled (ex: 44.1kHz AAC to 48kHz Opus) both durations match unless samples were dropped.
+type sampleCounter struct {
+	filtered     int64
+	filteredRate int
+	encoded      int64
+	encodedRate  int
+}
+
+func (c *sampleCounter) filter(samples, sampleRate int) {
+	c.filtered += int64(samples)
+	c.filteredRate = sampleRate
+}
+
+func (c *sampleCounter) encode(samples, sampleRate int) {
+	c.encoded += int64(samples)
+	c.encodedRate = sampleRate
+}
+
+// missing is the audio duration that didn't reach the encoder, it's negative when padded (ex: the last frame).
+func (c *sampleCounter) missing() time.Duration {
+	return samplesDuration(c.filtered, c.filteredRate) - samplesDuration(c.encoded, c.encodedRate)
+}
+
+func samplesDuration(samples int64, sampleRate int) time.Duration {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(samples) * time.Second / time.Duration(sampleRate)
+}
@@ -0,0 +1,32 @@
+package streamers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleCounter_Resampled(t *testing.T) {
+	c := &sampleCounter{}
+
+	// one second of 44.1kHz AAC (1024 samples per frame) resampled to 48kHz Opus (960 samples per frame)
+	for i := 0; i < 44100/1024; i++ {
+		c.filter(1024, 44100)
+	}
+	c.filter(44100%1024, 44100)
+	for i := 0; i < 48000/960; i++ {
+		c.encode(960, 48000)
+	}
+
+	assert.Equal(t, time.Duration(0), c.missing())
+}
+
+func TestSampleCounter_Dropped(t *testing.T) {
+	c := &sampleCounter{}
+
+	c.filter(1024, 48000)
+	c.encode(960, 48000)
+
+	assert.Equal(t, 64*time.Second/48000, c.missing())
+}
@@ -0,0 +1,39 @@
+package streamers
+
+import "github.com/flavioribeiro/donut/internal/entities"
+
+// muxersOf returns the sinks fed with the encoded packets, they need the streams before the first frame.
+func muxersOf(sinks []entities.OutputSink) []entities.DonutMuxer {
+	var result []entities.DonutMuxer
+	for _, sink := range sinks {
+		if m, ok := sink.(entities.DonutMuxer); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// frameSinksOf returns the sinks fed with the frames ready for WebRTC, that's every sink but the muxers.
+func frameSinksOf(sinks []entities.OutputSink) []entities.OutputSink {
+	var result []entities.OutputSink
+	for _, sink := range sinks {
+		if _, ok := sink.(entities.DonutMuxer); !ok {
+			result = append(result, sink)
+		}
+	}
+	return result
+}
+
+// writeToSinks fans the frame out, it stops at the first sink failing.
+func writeToSinks(sinks []entities.OutputSink, mediaType entities.MediaType, data []byte, c entities.MediaFrameContext) error {
+	for _, sink := range sinks {
+		write := sink.WriteAudio
+		if mediaType == entities.VideoType {
+			write = sink.WriteVideo
+		}
+		if err := write(data, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
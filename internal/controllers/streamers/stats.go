@@ -0,0 +1,30 @@
+package streamers
+
+import "time"
+
+// streamStats accounts the frames written for a stream, reporting its throughput and frame rate
+// once per interval (Config.StreamStatsIntervalMS).
+type streamStats struct {
+	start  time.Time
+	frames int
+	bytes  int
+}
+
+// add accounts a written frame, once the interval elapsed it returns the bit rate (bits per second)
+// and the frame rate measured since the last report and starts a new window.
+func (s *streamStats) add(size int, now time.Time, interval time.Duration) (bitRate float64, frameRate float64, ok bool) {
+	if s.start.IsZero() {
+		s.start = now
+	}
+	s.frames++
+	s.bytes += size
+
+	elapsed := now.Sub(s.start)
+	if interval <= 0 || elapsed < interval {
+		return 0, 0, false
+	}
+	bitRate = float64(s.bytes*8) / elapsed.Seconds()
+	frameRate = float64(s.frames) / elapsed.Seconds()
+	*s = streamStats{start: now}
+	return bitRate, frameRate, true
+}
@@ -0,0 +1,39 @@
+package streamers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamStatsReportsOncePerInterval(t *testing.T) {
+	var s streamStats
+	start := time.Unix(0, 0)
+	interval := time.Second
+
+	// 30 frames of 1250 bytes, ~33ms apart: the last one completes the window
+	for i := 0; i < 30; i++ {
+		_, _, ok := s.add(1250, start.Add(time.Duration(i)*time.Second/30), interval)
+		require.False(t, ok, "frame %d reported before the interval elapsed", i)
+	}
+	bitRate, frameRate, ok := s.add(1250, start.Add(time.Second), interval)
+	require.True(t, ok)
+	assert.Equal(t, float64(31*1250*8), bitRate)
+	assert.Equal(t, float64(31), frameRate)
+
+	// the next window starts at the report
+	_, _, ok = s.add(1250, start.Add(1500*time.Millisecond), interval)
+	assert.False(t, ok)
+}
+
+func TestStreamStatsDisabled(t *testing.T) {
+	var s streamStats
+	start := time.Unix(0, 0)
+	// there's no report when the interval is 0
+	for i := 0; i < 10; i++ {
+		_, _, ok := s.add(100, start.Add(time.Duration(i)*time.Second), 0)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,112 @@
+package streamers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/asticode/go-astiav"
+)
+
+// timecodeTracker derives the SMPTE timecode of the video frames from the start timecode found in the
+// source metadata (ex: "01:00:00:00") and the frames elapsed since the first tracked one.
+type timecodeTracker struct {
+	frameRate astiav.Rational
+	timeBase  astiav.Rational
+	// fps is the nominal frame rate, ex: 30 for 29.97
+	fps int
+	// dropFrames are the frame numbers skipped every minute but every tenth, 0 unless drop-frame
+	dropFrames  int
+	startFrames int
+	startPTS    int64
+	started     bool
+}
+
+func newTimecodeTracker(start string, frameRate, timeBase astiav.Rational) (*timecodeTracker, error) {
+	fps := int(math.Round(frameRate.Float64()))
+	if fps <= 0 {
+		return nil, fmt.Errorf("timecode %s: unknown frame rate", start)
+	}
+
+	var hh, mm, ss, ff int
+	var separator byte
+	if _, err := fmt.Sscanf(start, "%d:%d:%d%c%d", &hh, &mm, &ss, &separator, &ff); err != nil {
+		return nil, fmt.Errorf("timecode %s: %w", start, err)
+	}
+
+	t := &timecodeTracker{frameRate: frameRate, timeBase: timeBase, fps: fps}
+	// drop-frame timecodes (ex: 29.97 or 59.94fps) separate the frames with ; or .
+	if separator == ';' || separator == '.' {
+		t.dropFrames = fps / 15
+	}
+	minutes := hh*60 + mm
+	t.startFrames = (minutes*60+ss)*fps + ff - t.dropFrames*(minutes-minutes/10)
+	return t, nil
+}
+
+// at returns the timecode of the frame presented at pts (expressed in the tracker time base).
+func (t *timecodeTracker) at(pts int64) string {
+	if !t.started {
+		t.startPTS, t.started = pts, true
+	}
+	elapsed := math.Round(float64(pts-t.startPTS) * t.timeBase.Float64() * t.frameRate.Float64())
+	return t.format(t.startFrames + int(elapsed))
+}
+
+func (t *timecodeTracker) format(frames int) string {
+	separator := ":"
+	if t.dropFrames > 0 {
+		separator = ";"
+		framesPer10Minutes := t.fps*600 - t.dropFrames*9
+		framesPerMinute := t.fps*60 - t.dropFrames
+		tens, remainder := frames/framesPer10Minutes, frames%framesPer10Minutes
+		frames += t.dropFrames * 9 * tens
+		if remainder >= t.dropFrames {
+			frames += t.dropFrames * ((remainder - t.dropFrames) / framesPerMinute)
+		}
+	}
+
+	ff := frames % t.fps
+	seconds := frames / t.fps
+	// the timecode wraps around every 24 hours
+	return fmt.Sprintf("%02d:%02d:%02d%s%02d", seconds/3600%24, seconds/60%60, seconds%60, separator, ff)
+}
+
+// s12mTimecode decodes the first timecode of the S12M side data (a count followed by
+// SMPTE 12M packed timecodes), it returns false when there's none.
+func s12mTimecode(data []byte) (string, bool) {
+	if len(data) < 8 || binary.LittleEndian.Uint32(data[0:4]) == 0 {
+		return "", false
+	}
+	tc := binary.LittleEndian.Uint32(data[4:8])
+
+	separator := ":"
+	if tc&(1<<30) != 0 {
+		separator = ";"
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%02d",
+		bcdToInt(tc&0x3f),
+		bcdToInt(tc>>8&0x7f),
+		bcdToInt(tc>>16&0x7f),
+		separator,
+		bcdToInt(tc>>24&0x3f),
+	), true
+}
+
+func bcdToInt(bcd uint32) uint32 {
+	return (bcd>>4)*10 + bcd&0xf
+}
+
+// sourceTimecode returns the start timecode of the stream, or of the container when the stream has none.
+func sourceTimecode(inputFormatContext *astiav.FormatContext, is *astiav.Stream) string {
+	for _, metadata := range []*astiav.Dictionary{is.Metadata(), inputFormatContext.Metadata()} {
+		if metadata == nil {
+			continue
+		}
+		if e := metadata.Get("timecode", nil, 0); e != nil {
+			return strings.TrimSpace(e.Value())
+		}
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package streamers
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/asticode/go-astiav"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimecodeTracker_NonDropFrame(t *testing.T) {
+	tracker, err := newTimecodeTracker("01:00:00:00", astiav.NewRational(25, 1), astiav.NewRational(1, 90000))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "01:00:00:00", tracker.at(900000))
+	// 3600 ticks per frame at 25fps
+	assert.Equal(t, "01:00:00:01", tracker.at(903600))
+	assert.Equal(t, "01:00:01:00", tracker.at(990000))
+}
+
+func TestTimecodeTracker_DropFrame(t *testing.T) {
+	tracker, err := newTimecodeTracker("00:00:59;29", astiav.NewRational(30000, 1001), astiav.NewRational(1, 30000))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "00:00:59;29", tracker.at(0))
+	// frames 00 and 01 are skipped at the start of every minute
+	assert.Equal(t, "00:01:00;02", tracker.at(1001))
+	assert.Equal(t, "00:10:00;00", tracker.format(17982))
+}
+
+func TestS12MTimecode(t *testing.T) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data[0:4], 1)
+	// 10:20:30:15, each field is BCD
+	binary.LittleEndian.PutUint32(data[4:8], 0x10|0x20<<8|0x30<<16|0x15<<24)
+
+	timecode, ok := s12mTimecode(data)
+
+	assert.True(t, ok)
+	assert.Equal(t, "10:20:30:15", timecode)
+}
@@ -4,19 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"net"
+	"time"
 
 	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/flavioribeiro/donut/internal/mapper"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"go.uber.org/zap"
 )
 
+// endSessionTimeout bounds the wait for the last message to be sent before closing the session.
+const endSessionTimeout = time.Second
+
 type WebRTCController struct {
-	c   *entities.Config
-	l   *zap.SugaredLogger
-	api *webrtc.API
-	m   *mapper.Mapper
+	c        *entities.Config
+	l        *zap.SugaredLogger
+	api      *webrtc.API
+	m        *mapper.Mapper
+	rewriter SDPRewriter
+	dscp     *DSCPMarker
+	// pending holds the metadata sent before the data channels open
+	pending *dataChannelQueue
 }
 
 func NewWebRTCController(
@@ -24,36 +31,49 @@ func NewWebRTCController(
 	l *zap.SugaredLogger,
 	api *webrtc.API,
 	m *mapper.Mapper,
+	rewriter SDPRewriter,
+	dscp *DSCPMarker,
 ) *WebRTCController {
 	return &WebRTCController{
-		c:   c,
-		l:   l,
-		api: api,
-		m:   m,
+		c:        c,
+		l:        l,
+		api:      api,
+		m:        m,
+		rewriter: rewriter,
+		dscp:     dscp,
+		pending:  newDataChannelQueue(l),
 	}
 }
 
 func (c *WebRTCController) Setup(cancel context.CancelFunc, donutRecipe *entities.DonutRecipe, params entities.RequestParams) (*entities.WebRTCSetupResponse, error) {
 	response := &entities.WebRTCSetupResponse{}
-	peer, err := c.CreatePeerConnection(cancel)
+	// there's no session resource, the offer's ICE ufrag correlates the logs of a viewer
+	l := c.l.With("stream_id", params.StreamID, "ice_ufrag", iceUfrag(params.Offer.SDP))
+	peer, err := c.CreatePeerConnection(cancel, l)
 	if err != nil {
 		return nil, err
 	}
 	response.Connection = peer
 
-	var videoTrack *webrtc.TrackLocalStaticSample
-	videoTrack, err = c.CreateTrack(peer, donutRecipe.Video.Codec, string(entities.VideoType), params.StreamID)
-	if err != nil {
-		return nil, err
+	// pion answers the offer's m-lines in their order, whatever the order the tracks are added in.
+	// The session has no video track when the client didn't offer it.
+	if donutRecipe.Video.Action != entities.DonutDrop {
+		var sender *webrtc.RTPSender
+		if response.Video, sender, err = c.CreateTrack(peer, donutRecipe.Video.Codec, string(entities.VideoType), params.StreamID); err != nil {
+			return nil, err
+		}
+		// the viewer's key frame requests (ex: after a loss) force one when the video is transcoded
+		response.KeyFrameRequests = make(chan struct{}, 1)
+		go ForwardKeyFrameRequests(sender, response.KeyFrameRequests)
 	}
-	response.Video = videoTrack
-
-	var audioTrack *webrtc.TrackLocalStaticSample
-	audioTrack, err = c.CreateTrack(peer, donutRecipe.Audio.Codec, string(entities.AudioType), params.StreamID)
-	if err != nil {
-		return nil, err
+	// the session has no audio track when the client can't play any
+	if donutRecipe.Audio.Action != entities.DonutDrop {
+		if response.Audio, _, err = c.CreateTrack(peer, donutRecipe.Audio.Codec, string(entities.AudioType), params.StreamID); err != nil {
+			return nil, err
+		}
 	}
-	response.Audio = audioTrack
+
+	c.dscp.TrackPeer(peer)
 
 	metadataSender, err := c.CreateDataChannel(peer, entities.MetadataChannelID)
 	if err != nil {
@@ -65,7 +85,7 @@ func (c *WebRTCController) Setup(cancel context.CancelFunc, donutRecipe *entitie
 		return nil, err
 	}
 
-	localDescription, err := c.GatheringWebRTC(peer)
+	localDescription, err := c.GatheringWebRTC(peer, l, donutRecipe, PreferredICEAddressFamily(c.c, &params))
 	if err != nil {
 		return nil, err
 	}
@@ -74,26 +94,35 @@ func (c *WebRTCController) Setup(cancel context.CancelFunc, donutRecipe *entitie
 	return response, nil
 }
 
-func (c *WebRTCController) CreatePeerConnection(cancel context.CancelFunc) (*webrtc.PeerConnection, error) {
-	c.l.Infow("trying to set up web rtc conn")
+// CreatePeerConnection creates the viewer's peer connection, l is the logger of its session.
+func (c *WebRTCController) CreatePeerConnection(cancel context.CancelFunc, l *zap.SugaredLogger) (*webrtc.PeerConnection, error) {
+	l.Infow("trying to set up web rtc conn")
 
-	peerConnectionConfiguration := webrtc.Configuration{}
-	if !c.c.EnableICEMux {
-		peerConnectionConfiguration.ICEServers = []webrtc.ICEServer{
-			{
-				URLs: c.c.StunServers,
-			},
-		}
+	peerConnectionConfiguration, err := PeerConnectionConfiguration(c.c, !c.c.EnableICEMux)
+	if err != nil {
+		return nil, err
 	}
 
 	peerConnection, err := c.api.NewPeerConnection(peerConnectionConfiguration)
 	if err != nil {
-		c.l.Errorw("error while creating a new peer connection",
+		l.Errorw("error while creating a new peer connection",
 			"error", err,
 		)
 		return nil, err
 	}
 
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		l.Infow("OnICECandidate",
+			"protocol", candidate.Protocol.String(),
+			"address", candidate.Address,
+			"port", candidate.Port,
+			"type", candidate.Typ.String(),
+		)
+	})
+
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		finished := connectionState == webrtc.ICEConnectionStateClosed ||
 			connectionState == webrtc.ICEConnectionStateDisconnected ||
@@ -101,13 +130,13 @@ func (c *WebRTCController) CreatePeerConnection(cancel context.CancelFunc) (*web
 			connectionState == webrtc.ICEConnectionStateFailed
 
 		if finished {
-			c.l.Infow("Canceling webrtc",
+			l.Infow("Canceling webrtc",
 				"status", connectionState.String(),
 			)
 			cancel()
 		}
 
-		c.l.Infow("OnICEConnectionStateChange",
+		l.Infow("OnICEConnectionStateChange",
 			"status", connectionState.String(),
 		)
 	})
@@ -115,17 +144,19 @@ func (c *WebRTCController) CreatePeerConnection(cancel context.CancelFunc) (*web
 	return peerConnection, nil
 }
 
-func (c *WebRTCController) CreateTrack(peer *webrtc.PeerConnection, codec entities.Codec, id string, streamId string) (*webrtc.TrackLocalStaticSample, error) {
+// CreateTrack adds a track fed with RTP packets, see RTPWriter. Its sender receives the viewer's RTCP.
+func (c *WebRTCController) CreateTrack(peer *webrtc.PeerConnection, codec entities.Codec, id string, streamId string) (*webrtc.TrackLocalStaticRTP, *webrtc.RTPSender, error) {
 	codecCapability := c.m.FromTrackToRTPCodecCapability(codec)
-	webRTCtrack, err := webrtc.NewTrackLocalStaticSample(codecCapability, id, streamId)
+	webRTCtrack, err := webrtc.NewTrackLocalStaticRTP(codecCapability, id, streamId)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if _, err := peer.AddTrack(webRTCtrack); err != nil {
-		return nil, err
+	sender, err := peer.AddTrack(webRTCtrack)
+	if err != nil {
+		return nil, nil, err
 	}
-	return webRTCtrack, nil
+	return webRTCtrack, sender, nil
 }
 
 func (c *WebRTCController) CreateDataChannel(peer *webrtc.PeerConnection, channelID string) (*webrtc.DataChannel, error) {
@@ -144,8 +175,10 @@ func (c *WebRTCController) SetRemoteDescription(peer *webrtc.PeerConnection, des
 	return nil
 }
 
-func (c *WebRTCController) GatheringWebRTC(peer *webrtc.PeerConnection) (*webrtc.SessionDescription, error) {
-	c.l.Infow("Gathering WebRTC Candidates")
+// GatheringWebRTC answers the offer once the candidates are gathered, the recipe tells what the answer advertises
+// (see LocalDescriptionSDP).
+func (c *WebRTCController) GatheringWebRTC(peer *webrtc.PeerConnection, l *zap.SugaredLogger, recipe *entities.DonutRecipe, preferredFamily string) (*webrtc.SessionDescription, error) {
+	l.Infow("Gathering WebRTC Candidates")
 	gatherComplete := webrtc.GatheringCompletePromise(peer)
 	answer, err := peer.CreateAnswer(nil)
 	if err != nil {
@@ -155,16 +188,29 @@ func (c *WebRTCController) GatheringWebRTC(peer *webrtc.PeerConnection) (*webrtc
 	}
 
 	<-gatherComplete
-	c.l.Infow("Gathering WebRTC Candidates Complete")
+	l.Infow("Gathering WebRTC Candidates Complete")
+	LogNegotiatedMedia(l, "signaling", negotiatedMedia(peer))
 
-	return peer.LocalDescription(), nil
+	localDescription := *peer.LocalDescription()
+	if localDescription.SDP, err = LocalDescriptionSDP(c.c, c.rewriter, peer.RemoteDescription().SDP, localDescription.SDP, recipe, preferredFamily); err != nil {
+		return nil, err
+	}
+	return &localDescription, nil
 }
 
-func (c *WebRTCController) SendMediaSample(mediaTrack *webrtc.TrackLocalStaticSample, data []byte, mediaCtx entities.MediaFrameContext) error {
-	if err := mediaTrack.WriteSample(media.Sample{Data: data, Duration: mediaCtx.Duration}); err != nil {
-		return err
+// negotiatedMedia returns the codec selected for each transceiver, see LogNegotiatedMedia.
+func negotiatedMedia(peer *webrtc.PeerConnection) []NegotiatedMedia {
+	var media []NegotiatedMedia
+	for _, t := range peer.GetTransceivers() {
+		m := NegotiatedMedia{Kind: t.Kind().String(), Mid: t.Mid()}
+		if t.Sender() != nil {
+			if codecs := t.Sender().GetParameters().Codecs; len(codecs) > 0 {
+				m.MimeType, m.ClockRate, m.PayloadType = codecs[0].MimeType, codecs[0].ClockRate, uint8(codecs[0].PayloadType)
+			}
+		}
+		media = append(media, m)
 	}
-	return nil
+	return media
 }
 
 func (c *WebRTCController) SendMetadata(metaTrack *webrtc.DataChannel, st *entities.Stream) error {
@@ -180,21 +226,255 @@ func (c *WebRTCController) SendMetadata(metaTrack *webrtc.DataChannel, st *entit
 	return nil
 }
 
-func NewWebRTCSettingsEngine(c *entities.Config, tcpListener net.Listener, udpListener net.PacketConn) webrtc.SettingEngine {
+func (c *WebRTCController) SendCue(metaTrack *webrtc.DataChannel, cue *entities.Cue) error {
+	msg, err := c.m.FromCueToEntityMessage(cue)
+	if err != nil {
+		return err
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return metaTrack.SendText(string(msgBytes))
+}
+
+func (c *WebRTCController) SendTimecode(metaTrack *webrtc.DataChannel, tc *entities.TimecodeInfo) error {
+	msg, err := c.m.FromTimecodeToEntityMessage(tc)
+	if err != nil {
+		return err
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return metaTrack.SendText(string(msgBytes))
+}
+
+// SendWarnings sends the recipe warnings (ex: the audio is unavailable) once the data channel is open.
+func (c *WebRTCController) SendWarnings(metaTrack *webrtc.DataChannel, warnings []string) error {
+	for _, warning := range warnings {
+		msgBytes, err := json.Marshal(c.m.FromWarningToEntityMessage(warning))
+		if err != nil {
+			return err
+		}
+		if err := c.pending.send(metaTrack, string(msgBytes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendPoster sends the poster once the data channel is open, it might not be yet since the stream starts
+// along with the connection. It's queued along with the other early messages (ex: the warnings), none of them
+// replaces the channel's OnOpen handler.
+func (c *WebRTCController) SendPoster(metaTrack *webrtc.DataChannel, jpeg []byte) error {
+	msgBytes, err := json.Marshal(c.m.FromPosterToEntityMessage(jpeg))
+	if err != nil {
+		return err
+	}
+	return c.pending.send(metaTrack, string(msgBytes))
+}
+
+// SendPipelineEvent sends a lifecycle event of the pipeline once the data channel is open, the first
+// ones (ex: input_opened) usually happen before.
+func (c *WebRTCController) SendPipelineEvent(metaTrack *webrtc.DataChannel, e *entities.PipelineEvent) error {
+	msg, err := c.m.FromPipelineEventToEntityMessage(e)
+	if err != nil {
+		return err
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.pending.send(metaTrack, string(msgBytes))
+}
+
+// EndSession tells the client the stream is over, either ended (err is nil) or failed, and closes the
+// session once the message leaves the data channel (or after endSessionTimeout).
+func (c *WebRTCController) EndSession(session *entities.WebRTCSetupResponse, cancel context.CancelFunc, cause error) {
+	msg := c.m.FromStreamEndToEntityMessage()
+	if cause != nil {
+		msg = c.m.FromStreamErrorToEntityMessage(cause)
+	}
+	cancel()
+	defer session.Connection.Close()
+
+	if session.Data.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		c.l.Errorw("error while marshaling the end of stream", "error", err)
+		return
+	}
+	if err := session.Data.SendText(string(msgBytes)); err != nil {
+		c.l.Errorw("error while sending the end of stream", "error", err)
+		return
+	}
+
+	deadline := time.Now().Add(endSessionTimeout)
+	for session.Data.BufferedAmount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// KeepAlive periodically sends a keepalive message over the data channel until the context is done.
+func (c *WebRTCController) KeepAlive(ctx context.Context, metaTrack *webrtc.DataChannel) {
+	if c.c.DataChannelKeepaliveIntervalMS <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(c.c.DataChannelKeepaliveIntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// the client might not have opened the channel yet
+			if metaTrack.ReadyState() != webrtc.DataChannelStateOpen {
+				continue
+			}
+			msgBytes, err := json.Marshal(entities.Message{
+				Type:    entities.MessageTypeKeepalive,
+				Message: now.UTC().Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				c.l.Errorw("error while marshaling keepalive", "error", err)
+				return
+			}
+			if err := metaTrack.SendText(string(msgBytes)); err != nil {
+				c.l.Errorw("error while sending keepalive", "error", err)
+			}
+		}
+	}
+}
+
+// ReportClock periodically sends the server clock and the pipeline latency over the data channel,
+// the client measures the end-to-end latency with them. It returns once the context is done.
+func (c *WebRTCController) ReportClock(ctx context.Context, metaTrack *webrtc.DataChannel, pipelineLatency func() time.Duration) {
+	if c.c.ClockReportIntervalMS <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(c.c.ClockReportIntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			msg, err := c.m.FromClockToEntityMessage(now, pipelineLatency())
+			if err != nil {
+				c.l.Errorw("error while marshaling the clock", "error", err)
+				return
+			}
+			if err := sendIfOpen(metaTrack, msg); err != nil {
+				c.l.Errorw("error while sending the clock", "error", err)
+			}
+		}
+	}
+}
+
+// ExpireSession tears the session down once it reaches Config.MaxSessionDurationMS, warning the client
+// over the data channel beforehand. It returns earlier when the context is done.
+func (c *WebRTCController) ExpireSession(ctx context.Context, session *entities.WebRTCSetupResponse, cancel context.CancelFunc) {
+	if c.c.MaxSessionDurationMS <= 0 {
+		return
+	}
+	maxDuration := time.Duration(c.c.MaxSessionDurationMS) * time.Millisecond
+	warning := time.Duration(c.c.SessionTeardownWarningMS) * time.Millisecond
+	if warning <= 0 || warning >= maxDuration {
+		warning = 0
+	}
+
+	if warning > 0 {
+		if !waitFor(ctx, maxDuration-warning) {
+			return
+		}
+		if err := sendIfOpen(session.Data, c.m.FromSessionExpiryToEntityMessage(warning)); err != nil {
+			c.l.Errorw("error while sending teardown warning", "error", err)
+		}
+	}
+
+	if !waitFor(ctx, warning) {
+		return
+	}
+	c.l.Infow("session reached its maximum duration", "duration", maxDuration)
+	cancel()
+	session.Connection.Close()
+}
+
+// sendIfOpen sends the message over the data channel, it's dropped when the channel isn't open.
+func sendIfOpen(dc *webrtc.DataChannel, msg entities.Message) error {
+	if dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return dc.SendText(string(msgBytes))
+}
+
+// waitFor returns false when the context is done before d elapses.
+func waitFor(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func NewWebRTCSettingsEngine(c *entities.Config, tcpMux ICETCPMux, udpMux ICEUDPMux) (webrtc.SettingEngine, error) {
 	settingEngine := webrtc.SettingEngine{}
 
+	networkTypes, err := WebRTCNetworkTypes(c)
+	if err != nil {
+		return settingEngine, err
+	}
+	settingEngine.SetNetworkTypes(networkTypes)
+	// failing at startup rather than on every peer connection
+	if err := CheckICETransportPolicy(c); err != nil {
+		return settingEngine, err
+	}
+	if c.EnableICEMux {
+		for _, raw := range c.ICEMuxCandidateTypes {
+			if _, err := webrtc.NewICECandidateType(raw); err != nil {
+				return settingEngine, err
+			}
+		}
+	}
+	// the external IPs replace the addresses of the host candidates, in mux mode they're the only UDP
+	// candidates: the UDP host candidates are all gathered on the UDPICEPort mux.
 	settingEngine.SetNAT1To1IPs(c.ICEExternalIPsDNAT, webrtc.ICECandidateTypeHost)
-	settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, c.ICEReadBufferSize))
-	settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+	settingEngine.SetICETCPMux(tcpMux)
+	settingEngine.SetICEUDPMux(udpMux)
 
-	return settingEngine
+	return settingEngine, nil
 }
 
-func NewWebRTCMediaEngine() (*webrtc.MediaEngine, error) {
+// WebRTCVideoCodecs are the video codecs NewWebRTCMediaEngine registers (pion's default ones).
+var WebRTCVideoCodecs = []entities.Codec{entities.VP8, entities.VP9, entities.H264}
+
+func NewWebRTCMediaEngine(c *entities.Config) (*webrtc.MediaEngine, error) {
 	mediaEngine := &webrtc.MediaEngine{}
 	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
 		return nil, err
 	}
+	for _, uri := range c.RTPHeaderExtensionURIs {
+		for _, codecType := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+			if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, codecType); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return mediaEngine, nil
 }
 
@@ -216,7 +496,7 @@ func NewTCPICEServer(c *entities.Config) (net.Listener, error) {
 	return tcpListener, nil
 }
 
-func NewUDPICEServer(c *entities.Config) (net.PacketConn, error) {
+func NewUDPICEServer(c *entities.Config, dscp *DSCPMarker) (net.PacketConn, error) {
 	udpListener, err := net.ListenUDP("udp", &net.UDPAddr{
 		IP:   net.IP{0, 0, 0, 0},
 		Port: c.UDPICEPort,
@@ -224,5 +504,8 @@ func NewUDPICEServer(c *entities.Config) (net.PacketConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if dscp.Enabled() {
+		return &dscpPacketConn{UDPConn: udpListener, s: dscp.NewSocket()}, nil
+	}
 	return udpListener, nil
 }
@@ -3,6 +3,10 @@ package entities
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,16 +21,159 @@ const (
 
 type WebRTCSetupResponse struct {
 	Connection *pionv3.PeerConnection
-	Video      *pionv3.TrackLocalStaticSample
-	Audio      *pionv3.TrackLocalStaticSample
+	Video      *pionv3.TrackLocalStaticRTP
+	Audio      *pionv3.TrackLocalStaticRTP
 	Data       *pionv3.DataChannel
 	LocalSDP   *pionv3.SessionDescription
+	// KeyFrameRequests receives the viewer's key frame requests (PLI or FIR), it's nil without video.
+	KeyFrameRequests chan struct{}
 }
 
 type RequestParams struct {
 	StreamURL string
 	StreamID  string
 	Offer     pionv3.SessionDescription
+
+	// SRTReadBufferSizeBytes overrides Config.SRTReadBufferSizeBytes for this request.
+	SRTReadBufferSizeBytes int
+	// SRTReadStrategy overrides Config.SRTReadStrategy for this request.
+	SRTReadStrategy DonutReadStrategy
+
+	// SRTResourceName, SRTUser and SRTMode build the streamid following the SRT access control
+	// syntax (#!::r=resource,m=request,u=user), StreamID is the resource name when it's empty.
+	// ref https://github.com/Haivision/srt/blob/master/docs/features/access-control.md
+	SRTResourceName string
+	SRTUser         string
+	SRTMode         SRTMode
+
+	// AudioSampleRate overrides Config.AudioSampleRate for this request, ex: 16000 for voice.
+	AudioSampleRate int
+	// AudioLoudnessLUFS overrides Config.AudioLoudnessLUFS for this request, ex: -16.
+	AudioLoudnessLUFS float64
+	// AudioMono forces mono audio for this request (Config.AudioMono), ex: voice or commentary.
+	AudioMono bool
+	// FastProbe probes the source just enough to identify its codecs for this request (Config.FastProbe).
+	FastProbe bool
+	// AudioStreamIndex selects the source audio stream, ex: 2 is the third one. It defaults to the first.
+	AudioStreamIndex int
+	// ContentType overrides Config.VideoContentType for this request, ex: screen for slides.
+	ContentType ContentType
+	// LatencyMode overrides Config.VideoLatencyMode for this request, ex: quality for a lecture.
+	LatencyMode LatencyMode
+	// Deinterlace overrides Config.VideoDeinterlace for this request, ex: send_field for interlaced sports.
+	Deinterlace DeinterlaceMode
+	// Resolution scales the video down to a preset height, ex: 480p for a mobile viewer. Empty means auto.
+	Resolution ResolutionPreset
+	// RelayURL overrides Config.RelayURL for this request, ex: rtmp://a.rtmp.youtube.com/live2/key.
+	RelayURL string
+	// RecordingFormat overrides Config.RecordingFormat for this request.
+	RecordingFormat RecordingFormat
+	// StartAtMS starts a seekable input (a VOD manifest) at the given position, ex: 90000 for 00:01:30.
+	StartAtMS int64
+	// ICEPreferredAddressFamily overrides Config.ICEPreferredAddressFamily for this request, ex: ipv6.
+	ICEPreferredAddressFamily string
+	// Publish is set for the publishers (WHIP), the jwt mode requires a token with the publish claim.
+	// The clients can't set it.
+	Publish bool `json:"-"`
+	// VideoCodecs are the video codecs the handler's media engine registers, the engine only bypasses a
+	// source whose codec is among them. Empty doesn't restrict the codecs. The clients can't set it.
+	VideoCodecs []Codec `json:"-"`
+}
+
+// OpusSampleRates are the sample rates accepted by the Opus encoder,
+// the RTP clock rate stays 48kHz regardless of the one used to encode.
+var OpusSampleRates = []int{8000, 12000, 16000, 24000, 48000}
+
+func IsOpusSampleRate(sampleRate int) bool {
+	for _, r := range OpusSampleRates {
+		if r == sampleRate {
+			return true
+		}
+	}
+	return false
+}
+
+// OpusPtimesMS are the packet durations (a=ptime) produced by the Opus encoder, longer packets
+// bundle more audio per RTP packet reducing the overhead at the cost of latency.
+var OpusPtimesMS = []int{10, 20, 40, 60}
+
+func IsOpusPtime(ptime int) bool {
+	for _, p := range OpusPtimesMS {
+		if p == ptime {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateAudioPtime returns the ptime, lowered to the longest supported one within
+// the maxptime of the offer's audio section (if any).
+func NegotiateAudioPtime(ptime int, offer string) int {
+	maxPtime := audioAttribute(offer, "maxptime")
+	if maxPtime <= 0 || ptime <= maxPtime {
+		return ptime
+	}
+
+	negotiated := OpusPtimesMS[0]
+	for _, p := range OpusPtimesMS {
+		if p <= maxPtime {
+			negotiated = p
+		}
+	}
+	return negotiated
+}
+
+// audioAttribute returns the numeric value of an attribute of the audio section, 0 when it's absent.
+func audioAttribute(sdp, name string) int {
+	prefix := "a=" + name + ":"
+	inAudio := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			inAudio = strings.HasPrefix(line, "m=audio")
+			continue
+		}
+		if inAudio && strings.HasPrefix(line, prefix) {
+			if v, err := strconv.Atoi(strings.TrimPrefix(line, prefix)); err == nil {
+				return v
+			}
+		}
+	}
+	return 0
+}
+
+type SRTMode string
+
+var SRTModeRequest SRTMode = "request"
+var SRTModePublish SRTMode = "publish"
+var SRTModeBidirectional SRTMode = "bidirectional"
+
+func (m SRTMode) Valid() bool {
+	return m == SRTModeRequest || m == SRTModePublish || m == SRTModeBidirectional
+}
+
+// SRTAccessControlStreamID builds the streamid using the access control syntax,
+// it returns StreamID untouched when no access control parameter is set or it's already formatted.
+func (p *RequestParams) SRTAccessControlStreamID() string {
+	if strings.HasPrefix(p.StreamID, SRTAccessControlPrefix) ||
+		(p.SRTResourceName == "" && p.SRTUser == "" && p.SRTMode == "") {
+		return p.StreamID
+	}
+
+	resource := p.SRTResourceName
+	if resource == "" {
+		resource = p.StreamID
+	}
+	mode := p.SRTMode
+	if mode == "" {
+		mode = SRTModeRequest
+	}
+
+	streamID := fmt.Sprintf("%sr=%s,m=%s", SRTAccessControlPrefix, resource, mode)
+	if p.SRTUser != "" {
+		streamID += ",u=" + p.SRTUser
+	}
+	return streamID
 }
 
 func (p *RequestParams) Valid() error {
@@ -43,11 +190,72 @@ func (p *RequestParams) Valid() error {
 	}
 	isRTMP := strings.Contains(strings.ToLower(p.StreamURL), "rtmp")
 	isSRT := strings.Contains(strings.ToLower(p.StreamURL), "srt")
+	isPipe := IsPipeURL(p.StreamURL)
+	isManifest := IsManifestURL(p.StreamURL)
 
-	if !(isRTMP || isSRT) {
+	if !(isRTMP || isSRT || isPipe || isManifest) {
 		return ErrUnsupportedStreamURL
 	}
 
+	if p.SRTReadBufferSizeBytes != 0 && !IsSRTPayloadSize(p.SRTReadBufferSizeBytes) {
+		return ErrInvalidSRTReadBufferSize
+	}
+
+	if p.SRTReadStrategy != "" && !p.SRTReadStrategy.Valid() {
+		return ErrInvalidReadStrategy
+	}
+
+	if p.SRTMode != "" && !p.SRTMode.Valid() {
+		return ErrInvalidSRTMode
+	}
+
+	if p.AudioSampleRate != 0 && !IsOpusSampleRate(p.AudioSampleRate) {
+		return ErrInvalidAudioSampleRate
+	}
+
+	if p.AudioLoudnessLUFS != 0 && !IsLoudnessTarget(p.AudioLoudnessLUFS) {
+		return ErrInvalidLoudnessTarget
+	}
+
+	if p.AudioStreamIndex < 0 {
+		return ErrInvalidAudioStreamIndex
+	}
+
+	if p.ContentType != "" && !p.ContentType.Valid() {
+		return ErrInvalidContentType
+	}
+
+	if p.LatencyMode != "" && !p.LatencyMode.Valid() {
+		return ErrInvalidLatencyMode
+	}
+
+	if p.Deinterlace != "" && !p.Deinterlace.Valid() {
+		return ErrInvalidDeinterlaceMode
+	}
+
+	if p.Resolution != "" && !p.Resolution.Valid() {
+		return ErrInvalidResolution
+	}
+
+	if p.RelayURL != "" && !IsRelayURL(p.RelayURL) {
+		return ErrInvalidRelayURL
+	}
+
+	if p.RecordingFormat != "" && !p.RecordingFormat.Valid() {
+		return ErrInvalidRecordingFormat
+	}
+
+	if p.ICEPreferredAddressFamily != "" && !IsICEAddressFamily(p.ICEPreferredAddressFamily) {
+		return ErrInvalidICEAddressFamily
+	}
+
+	if p.StartAtMS < 0 {
+		return ErrInvalidStartAt
+	}
+	if p.StartAtMS > 0 && !isManifest {
+		return ErrUnseekableInput
+	}
+
 	return nil
 }
 
@@ -71,13 +279,128 @@ func (p *RequestParamsV4) Valid() error {
 	}
 	isRTMP := strings.Contains(strings.ToLower(p.StreamURL), "rtmp")
 	isSRT := strings.Contains(strings.ToLower(p.StreamURL), "srt")
+	isPipe := IsPipeURL(p.StreamURL)
+	isManifest := IsManifestURL(p.StreamURL)
 
-	if !(isRTMP || isSRT) {
+	if !(isRTMP || isSRT || isPipe || isManifest) {
 		return ErrUnsupportedStreamURL
 	}
 
 	return nil
 }
+
+// IsPipeURL returns true when the url points to a pipe (ex: pipe:0 for stdin).
+func IsPipeURL(url string) bool {
+	return strings.HasPrefix(strings.ToLower(url), "pipe:")
+}
+
+// IsSRTCallerURL returns true when the SRT url asks donut to connect to a remote listener (mode=caller),
+// otherwise donut listens on the url's port.
+func IsSRTCallerURL(url string) bool {
+	lower := strings.ToLower(url)
+	if !strings.HasPrefix(lower, "srt://") {
+		return false
+	}
+	_, query, _ := strings.Cut(lower, "?")
+	for _, param := range strings.Split(query, "&") {
+		if param == "mode=caller" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsICEAddressFamily returns true for the candidate address families, either ipv4 or ipv6.
+func IsICEAddressFamily(family string) bool {
+	family = strings.ToLower(family)
+	return family == "ipv4" || family == "ipv6"
+}
+
+// IsRelayURL returns true when the url is a supported re-publish destination (RTMP or SRT).
+func IsRelayURL(url string) bool {
+	lower := strings.ToLower(url)
+	return IsFLVRelayURL(url) || strings.HasPrefix(lower, "srt://")
+}
+
+// IsFLVRelayURL returns true for the RTMP destinations, they're muxed as FLV which can't carry Opus.
+func IsFLVRelayURL(url string) bool {
+	lower := strings.ToLower(url)
+	return strings.HasPrefix(lower, "rtmp://") || strings.HasPrefix(lower, "rtmps://")
+}
+
+// RelayURLOf returns the relay destination of a request, the configured one unless the request overrides it.
+func RelayURLOf(c *Config, p *RequestParams) string {
+	if p.RelayURL != "" {
+		return p.RelayURL
+	}
+	return c.RelayURL
+}
+
+// IsAllowedRelayURL returns true when the url has the scheme and host of one of the allowed destinations
+// and starts with its path, ex: rtmp://a.rtmp.youtube.com/live2/key for rtmp://a.rtmp.youtube.com/live2.
+func IsAllowedRelayURL(allowed []string, relayURL string) bool {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return false
+	}
+	// ex: rtmp://host/live2/../other
+	relayPath := path.Clean("/" + u.Path)
+	for _, raw := range allowed {
+		a, err := url.Parse(raw)
+		if err != nil || a.Host == "" {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, a.Scheme) || !strings.EqualFold(u.Host, a.Host) {
+			continue
+		}
+		if allowedPath := path.Clean("/" + a.Path); relayPath == allowedPath || strings.HasPrefix(relayPath, strings.TrimSuffix(allowedPath, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactURL hides the secrets of a network url for the logs: the user info, the query (ex: an SRT passphrase)
+// and the last path segment (ex: an RTMP stream key). A file path is returned as is.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		if strings.Contains(raw, "://") {
+			return "[redacted]"
+		}
+		return raw
+	}
+	redacted := u.Scheme + "://" + u.Host
+	if i := strings.LastIndex(u.Path, "/"); i > 0 {
+		redacted += u.Path[:i]
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+		redacted += "/[redacted]"
+	}
+	return redacted
+}
+
+// IsManifestURL returns true when the url points to an HLS (.m3u8) or DASH (.mpd) manifest over http(s).
+func IsManifestURL(url string) bool {
+	return ManifestFormat(url) != ""
+}
+
+// ManifestFormat returns the libav demuxer for a manifest url, empty when it isn't one.
+func ManifestFormat(url string) DonutInputFormat {
+	lower := strings.ToLower(url)
+	if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+		return ""
+	}
+	path, _, _ := strings.Cut(lower, "?")
+	if strings.HasSuffix(path, ".m3u8") {
+		return DonutHLSFormat
+	}
+	if strings.HasSuffix(path, ".mpd") {
+		return DonutDASHFormat
+	}
+	return ""
+}
+
 func (p *RequestParams) String() string {
 	if p == nil {
 		return ""
@@ -88,7 +411,17 @@ func (p *RequestParams) String() string {
 type MessageType string
 
 const (
-	MessageTypeMetadata MessageType = "metadata"
+	MessageTypeMetadata  MessageType = "metadata"
+	MessageTypeKeepalive MessageType = "keepalive"
+	MessageTypeTeardown  MessageType = "teardown"
+	MessageTypeClock     MessageType = "clock"
+	MessageTypeCue       MessageType = "cue"
+	MessageTypeTimecode  MessageType = "timecode"
+	MessageTypeEnded     MessageType = "ended"
+	MessageTypeError     MessageType = "error"
+	MessageTypePoster    MessageType = "poster"
+	MessageTypeWarning   MessageType = "warning"
+	MessageTypePipeline  MessageType = "pipeline"
 )
 
 type Message struct {
@@ -96,6 +429,23 @@ type Message struct {
 	Message string
 }
 
+// ClockInfo is carried by the clock messages, the client compares ServerTimeMS with its own
+// (synchronized) clock to estimate the end-to-end latency.
+type ClockInfo struct {
+	// ServerTimeMS is the server wall clock, in unix milliseconds
+	ServerTimeMS int64
+	// PipelineLatencyMS is the average time spent by a video frame inside donut
+	PipelineLatencyMS int64
+}
+
+// TimecodeInfo is carried by the timecode messages, it's the source SMPTE timecode of a video key frame.
+type TimecodeInfo struct {
+	// Timecode is HH:MM:SS:FF, the frames are separated by ; for drop-frame timecodes (ex: 29.97fps)
+	Timecode string
+	// PTSMS is the presentation time of the frame, in milliseconds
+	PTSMS int64
+}
+
 type Codec string
 type MediaType string
 
@@ -110,6 +460,15 @@ const (
 	Opus         Codec = "opus"
 )
 
+// RTPClockRate returns the RTP timestamp clock rate, Opus always uses 48kHz whatever the
+// sample rate (RFC 7587) and video codecs use 90kHz.
+func (c Codec) RTPClockRate() uint32 {
+	if c == Opus {
+		return 48000
+	}
+	return 90000
+}
+
 const (
 	UnknownType MediaType = "unknownMediaType"
 	VideoType   MediaType = "video"
@@ -121,6 +480,110 @@ type Stream struct {
 	Type  MediaType
 	Id    uint16
 	Index uint16
+	// HDR is true when the video transfer characteristic is PQ (HDR10) or HLG
+	HDR bool
+	// ColorPrimaries, ColorTransfer and ColorSpace describe the video colors (ex: BT.2020, PQ and BT.2020 NCL),
+	// they're empty when the source doesn't signal them.
+	ColorPrimaries string `json:",omitempty"`
+	ColorTransfer  string `json:",omitempty"`
+	ColorSpace     string `json:",omitempty"`
+	// ParameterSets are the H264 SPS and PPS read from the extradata, empty when they're only in-band
+	ParameterSets [][]byte `json:"-"`
+	// SampleRate and Channels describe the audio, they're 0 when the source doesn't signal them.
+	SampleRate int `json:",omitempty"`
+	Channels   int `json:",omitempty"`
+	// Width and Height are the video size, they're 0 when the source doesn't signal it.
+	Width  int `json:",omitempty"`
+	Height int `json:",omitempty"`
+}
+
+// ColorDescription summarizes the video colors as primaries / transfer, ex: "BT.2020 / PQ" for HDR10.
+// It's empty when neither is signaled.
+func (s Stream) ColorDescription() string {
+	if s.ColorPrimaries == "" && s.ColorTransfer == "" {
+		return ""
+	}
+	primaries, transfer := s.ColorPrimaries, s.ColorTransfer
+	if primaries == "" {
+		primaries = "unknown"
+	}
+	if transfer == "" {
+		transfer = "unknown"
+	}
+	return primaries + " / " + transfer
+}
+
+// SessionInfo describes a running session, it's returned by the /session/{id} endpoint.
+type SessionInfo struct {
+	ID               string
+	StreamKey        string
+	Recipe           RecipeInfo
+	NegotiatedCodecs []string
+	Uptime           string
+	// Viewers are the sessions sharing the stream's pipeline, it's encoded once for all of them
+	Viewers int `json:",omitempty"`
+	// VideoBitRate and AudioBitRate are the bits per second currently sent
+	VideoBitRate int64
+	AudioBitRate int64
+	// PipelineLatencyMS is the average time spent by a video frame inside donut (read to write)
+	PipelineLatencyMS int64
+	// KeyFrameRequests are the key frame requests (PLI or FIR) of the stream's viewers so far,
+	// ViewersAwaitingKeyFrame the viewers still waiting for one.
+	KeyFrameRequests        int64 `json:",omitempty"`
+	ViewersAwaitingKeyFrame int   `json:",omitempty"`
+	// Source are the streams of the upstream as probed, ex: the HDR color metadata of the video
+	Source []Stream `json:",omitempty"`
+	// Pipeline are the lifecycle events of the stream so far (Config.PipelineEvents)
+	Pipeline []PipelineEvent `json:",omitempty"`
+}
+
+// PipelineEventName is a step of the pipeline lifecycle, each one is reported once per stream.
+type PipelineEventName string
+
+var PipelineEventInputOpened PipelineEventName = "input_opened"
+var PipelineEventStreamInfoFound PipelineEventName = "stream_info_found"
+var PipelineEventFirstFrameDecoded PipelineEventName = "first_frame_decoded"
+var PipelineEventFirstFrameEncoded PipelineEventName = "first_frame_encoded"
+
+// PipelineEventStreaming is the first media sent to the outputs, bypassed or transcoded.
+var PipelineEventStreaming PipelineEventName = "streaming"
+
+// PipelineEvent is a step of the pipeline lifecycle, ex: input_opened then first_frame_decoded and streaming.
+type PipelineEvent struct {
+	Name PipelineEventName
+	// MediaType is the media reaching the step first, empty for the input steps
+	MediaType MediaType `json:",omitempty"`
+	// TimeMS is the unix time of the event and ElapsedMS the time since the stream started
+	TimeMS    int64
+	ElapsedMS int64
+}
+
+// RecipeInfo is the serializable part of a DonutRecipe.
+type RecipeInfo struct {
+	InputURL    string
+	InputFormat DonutInputFormat
+	Video       MediaTaskInfo
+	Audio       MediaTaskInfo
+}
+
+// MediaTaskInfo is the serializable part of a DonutMediaTask.
+type MediaTaskInfo struct {
+	Action           DonutMediaTaskAction
+	Codec            Codec
+	FrameRate        int               `json:",omitempty"`
+	PtimeMS          int               `json:",omitempty"`
+	StreamIndex      int               `json:",omitempty"`
+	ScalabilityMode  ScalabilityMode   `json:",omitempty"`
+	ContentType      ContentType       `json:",omitempty"`
+	LatencyMode      LatencyMode       `json:",omitempty"`
+	Deinterlace      DeinterlaceMode   `json:",omitempty"`
+	Height           int               `json:",omitempty"`
+	PreserveColor    bool              `json:",omitempty"`
+	ColorRange       ColorRange        `json:",omitempty"`
+	PixelFormat      string            `json:",omitempty"`
+	PrivateOptions   map[string]string `json:",omitempty"`
+	Filter           string            `json:",omitempty"`
+	BitStreamFilters []string          `json:",omitempty"`
 }
 
 type MediaFrameContext struct {
@@ -130,9 +593,17 @@ type MediaFrameContext struct {
 	PTS int
 	// Media frame duration
 	Duration time.Duration
+	// KeyFrame is true when the frame can be decoded independently
+	KeyFrame bool
+	// PipelineLatency is the time since the source packet was read (decode, filter and encode), 0 when unknown
+	PipelineLatency time.Duration
+	// RTPTimestamp is the PTS at the codec's RTP clock rate, continuous across the 32-bit wrap
+	RTPTimestamp uint32
 }
 
 type StreamInfo struct {
+	// Format is the container format confirmed by the prober, ex: mpegts
+	Format  DonutInputFormat
 	Streams []Stream
 }
 
@@ -146,6 +617,34 @@ func (s *StreamInfo) VideoStreams() []Stream {
 	return result
 }
 
+// Has tells whether the streams include the media type (ex: the client offered an audio m-line),
+// streams without advertised ones are assumed to have both.
+func (s *StreamInfo) Has(mediaType MediaType) bool {
+	if s == nil || len(s.Streams) == 0 {
+		return true
+	}
+	for _, st := range s.Streams {
+		if st.Type == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Plays tells whether the (client) streams include the codec,
+// a client without advertised streams is assumed to accept anything.
+func (s *StreamInfo) Plays(mediaType MediaType, codec Codec) bool {
+	if s == nil || len(s.Streams) == 0 {
+		return true
+	}
+	for _, st := range s.Streams {
+		if st.Type == mediaType && st.Codec == codec {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *StreamInfo) AudioStreams() []Stream {
 	var result []Stream
 	for _, s := range s.Streams {
@@ -162,17 +661,73 @@ type Cue struct {
 	Text      string
 }
 
+// RTPHeaderExtensions maps a negotiated RTP header extension URI to its id.
+type RTPHeaderExtensions map[string]uint8
+
 type DonutParameters struct {
 	Cancel context.CancelFunc
 	Ctx    context.Context
 
 	Recipe DonutRecipe
 
-	OnClose      func()
-	OnError      func(err error)
-	OnStream     func(st *Stream) error
-	OnVideoFrame func(data []byte, c MediaFrameContext) error
-	OnAudioFrame func(data []byte, c MediaFrameContext) error
+	// Sinks receive the media, the streamer fans every frame out to them (ex: the WebRTC tracks and a recording).
+	// The muxers among them receive the encoded media (before RTP packetization). Closing them is up to the caller.
+	Sinks []OutputSink
+
+	// FilterUpdates replaces the filter of a transcoded media while streaming, it might be nil.
+	FilterUpdates <-chan DonutFilterUpdate
+	// BitRateUpdates changes the target bit rate of a transcoded media while streaming, it might be nil.
+	BitRateUpdates <-chan DonutBitRateUpdate
+	// KeyFrameRequests forces a key frame of the transcoded video, ex: a viewer joining, it might be nil.
+	KeyFrameRequests <-chan struct{}
+
+	OnClose func()
+	// OnEnd is called once a finite source (ex: a VOD manifest) ends cleanly, after flushing the buffered frames.
+	// OnError is called instead when streaming fails, they might be nil.
+	OnEnd    func()
+	OnError  func(err error)
+	OnStream func(st *Stream) error
+	// OnCue receives the packets of the data streams (ex: SCTE-35) when Config.DataStreamCues is enabled, it might be nil.
+	OnCue func(cue *Cue) error
+	// OnTimecode receives the source timecode of the video key frames when Config.TimecodeReports is enabled, it might be nil.
+	OnTimecode func(tc *TimecodeInfo) error
+	// OnPoster receives the first decoded video key frame as a JPEG when Config.PosterFrames is enabled, it might be nil.
+	OnPoster func(jpeg []byte) error
+	// OnPipelineEvent receives the lifecycle events of the pipeline when Config.PipelineEvents is enabled, it might be nil.
+	OnPipelineEvent func(e *PipelineEvent) error
+}
+
+// DonutFilterUpdate replaces the filter of a transcoded media while streaming, ex: toggling an overlay.
+type DonutFilterUpdate struct {
+	MediaType MediaType
+	// Filter is the new filter description, empty means passthrough
+	Filter DonutStreamFilter
+	// Done optionally receives the outcome of the update, it must be buffered
+	Done chan error
+}
+
+// DonutBitRateUpdate changes the target bit rate of a transcoded media while streaming,
+// ex: an operator or an external ABR controller lowering the quality.
+type DonutBitRateUpdate struct {
+	MediaType MediaType
+	// BitRate is the new target in bits per second
+	BitRate int64
+	// Done optionally receives the outcome of the update, it must be buffered
+	Done chan error
+}
+
+// OutputSink receives the media of a session, ex: the WebRTC tracks, a recording or a relay.
+type OutputSink interface {
+	WriteVideo(data []byte, c MediaFrameContext) error
+	WriteAudio(data []byte, c MediaFrameContext) error
+	Close() error
+}
+
+// DonutMuxer is a sink interleaving encoded audio and video into a single output (ex: an mp4 file).
+type DonutMuxer interface {
+	OutputSink
+	// AddStream registers a stream, it must be called before writing any frame.
+	AddStream(mediaType MediaType, codecParameters *astiav.CodecParameters, timeBase astiav.Rational) error
 }
 
 type DonutMediaTaskAction string
@@ -180,9 +735,13 @@ type DonutMediaTaskAction string
 var DonutTranscode DonutMediaTaskAction = "transcode"
 var DonutBypass DonutMediaTaskAction = "bypass"
 
+// DonutDrop discards the media, ex: the client plays none of the audio codecs donut can send.
+var DonutDrop DonutMediaTaskAction = "drop"
+
 type DonutBitStreamFilter string
 
 var DonutH264AnnexB DonutBitStreamFilter = "h264_mp4toannexb"
+var DonutH265AnnexB DonutBitStreamFilter = "hevc_mp4toannexb"
 
 type DonutStreamFilter string
 
@@ -191,6 +750,89 @@ func AudioResamplerFilter(sampleRate int) *DonutStreamFilter {
 	return &filter
 }
 
+// MonoFilter downmixes the output of base (nil means passthrough) to a single channel, the conversion
+// between the source layout and mono (ex: 5.1) is left to the resampler negotiated by aformat.
+func MonoFilter(base *DonutStreamFilter) *DonutStreamFilter {
+	filter := DonutStreamFilter("aformat=channel_layouts=mono")
+	if base != nil && *base != "" {
+		filter = DonutStreamFilter(fmt.Sprintf("%s,%s", *base, filter))
+	}
+	return &filter
+}
+
+// MinLoudnessLUFS and MaxLoudnessLUFS bound the integrated loudness targets accepted by loudnorm.
+const (
+	MinLoudnessLUFS = -70
+	MaxLoudnessLUFS = -5
+)
+
+func IsLoudnessTarget(lufs float64) bool {
+	return lufs >= MinLoudnessLUFS && lufs <= MaxLoudnessLUFS
+}
+
+// LoudnormFilter normalizes the loudness (EBU R128) to the integrated target before base (nil means passthrough),
+// loudnorm outputs 192kHz so it must precede the resampler.
+// ref https://ffmpeg.org/ffmpeg-filters.html#loudnorm
+func LoudnormFilter(lufs float64, base *DonutStreamFilter) *DonutStreamFilter {
+	filter := DonutStreamFilter(fmt.Sprintf("loudnorm=I=%g:TP=-1.5:LRA=11", lufs))
+	if base != nil && *base != "" {
+		filter = DonutStreamFilter(fmt.Sprintf("%s,%s", filter, *base))
+	}
+	return &filter
+}
+
+// DonutOverlay is a static image (ex: a PNG logo with alpha) drawn over the video.
+type DonutOverlay struct {
+	ImagePath string
+	// X and Y follow the overlay filter syntax, ex: X="W-w-10" Y="10" for the top right corner
+	X string
+	Y string
+	// Opacity ranges from 0 (transparent) to 1 (opaque)
+	Opacity float64
+}
+
+// DeinterlaceFilter deinterlaces the output of base (nil means passthrough) with the deinterlacer (bwdif or yadif),
+// the progressive frames go through untouched.
+// ref https://ffmpeg.org/ffmpeg-filters.html#bwdif
+func DeinterlaceFilter(base *DonutStreamFilter, deinterlacer string, mode DeinterlaceMode) *DonutStreamFilter {
+	filter := DonutStreamFilter(fmt.Sprintf("%s=mode=%s:parity=auto:deint=interlaced", deinterlacer, mode))
+	if base != nil && *base != "" {
+		filter = DonutStreamFilter(fmt.Sprintf("%s,%s", *base, filter))
+	}
+	return &filter
+}
+
+// OverlayFilter draws the overlay on top of the output of base (nil means passthrough).
+// ref https://ffmpeg.org/ffmpeg-filters.html#overlay-1
+func OverlayFilter(base *DonutStreamFilter, o DonutOverlay) *DonutStreamFilter {
+	content := "null"
+	if base != nil && *base != "" {
+		content = string(*base)
+	}
+	filter := DonutStreamFilter(fmt.Sprintf(
+		"%s[base];movie=%s,format=rgba,colorchannelmixer=aa=%.2f[logo];[base][logo]overlay=%s:%s",
+		content, escapeFilterValue(o.ImagePath), o.Opacity, o.X, o.Y,
+	))
+	return &filter
+}
+
+// escapeFilterValue escapes a filter option value (ex: a path containing ':'),
+// it's escaped twice since both the option and the filter graph parsers unescape it.
+// ref https://ffmpeg.org/ffmpeg-filters.html#Notes-on-filtergraph-escaping
+func escapeFilterValue(v string) string {
+	escape := func(v, special string) string {
+		var b strings.Builder
+		for _, r := range v {
+			if strings.ContainsRune(special, r) {
+				b.WriteRune('\\')
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+	return escape(escape(v, `\':`), `\'[],;`)
+}
+
 // TODO: split entities per domain or files avoiding name collision.
 
 // DonutMediaTask is a transformation template to apply over a media.
@@ -203,14 +845,290 @@ type DonutMediaTask struct {
 	// If no value is provided ffmpeg will use defaults.
 	// For instance, if one does not provide bit rate, it'll fallback to 64000 bps (opus)
 	CodecContextOptions []LibAVOptionsCodecContext
+	// PtimeMS is the audio duration carried by each RTP packet (transcode only), ex: 60 bundles three
+	// 20ms Opus frames per packet. 0 keeps the encoder default.
+	PtimeMS int
+	// FrameRate caps the output frames per second dropping frames before encoding (transcode only),
+	// 0 keeps the source frame rate.
+	FrameRate int
+	// ScalabilityMode enables SVC layers (transcode only), ex: L1T3 (1 spatial, 3 temporal layers)
+	// letting the browser drop layers under congestion. Empty disables it.
+	ScalabilityMode ScalabilityMode
+	// ContentType tunes the encoder for the content (transcode only), empty means motion.
+	ContentType ContentType
+	// LatencyMode sets the encoder preset, keyframe interval, B-frames and lookahead (transcode only),
+	// empty keeps the encoder defaults.
+	LatencyMode LatencyMode
+	// Deinterlace is set when the DonutStreamFilter deinterlaces the video (transcode only), send_field
+	// doubles the output frame rate of the interlaced sources. Empty means the video isn't deinterlaced.
+	Deinterlace DeinterlaceMode
+	// Height scales the video down to this height (transcode only), the width keeps the display aspect ratio.
+	// Shorter sources aren't upscaled, 0 keeps the source resolution.
+	Height int
+	// PixelFormat forces the encoder pixel format (transcode only), ex: yuv420p for encoders listing
+	// another one first. It must be supported by the encoder, empty picks the encoder's first one.
+	PixelFormat string
+	// PreserveColor keeps the source color metadata (primaries, transfer and matrix) and bit depth,
+	// when the encoder supports it, instead of converting HDR sources to SDR (transcode only).
+	PreserveColor bool
+	// ColorRange overrides the color range of the encoder (transcode only), ex: a full range source tagged
+	// as limited. The samples aren't converted, empty or auto signals the source range.
+	ColorRange ColorRange
+	// DecoderCodecContextOptions is a list of options applied on the decoder codec context before opening it.
+	DecoderCodecContextOptions []LibAVOptionsCodecContext
+	// PrivateOptions are the encoder specific options (transcode only), set on its private data when it's opened,
+	// ex: crf=23 and preset=slow for libx264. They override the ones donut derives (ex: the content type tune).
+	PrivateOptions map[string]string
+	// ParameterSets are the H264 SPS and PPS of the source (bypass only), advertised as sprop-parameter-sets
+	// in the answer. Empty leaves the fmtp untouched.
+	ParameterSets [][]byte
+	// Mono forces a single output channel (transcode audio only), the filter must downmix the source
+	// (ex: MonoFilter). Otherwise the source channels are kept.
+	Mono bool
+	// MuxerCodec encodes the media a second time, from the same decoded frames, for the muxers (transcode
+	// only), ex: AAC for HLS while the WebRTC viewers get Opus, or an H264 recording of the VP9 sent to them.
+	// Empty feeds them the Codec packets.
+	MuxerCodec Codec
+	// StreamIndex selects the source stream among the ones of the task media type (audio only),
+	// ex: 2 is the third audio stream. The other streams are skipped.
+	StreamIndex int
 
-	// DonutBitStreamFilter is the bitstream filter
-	DonutBitStreamFilter *DonutBitStreamFilter
+	// DonutBitStreamFilters are the bitstream filters, applied in sequence (ex: h264_mp4toannexb then dump_extra)
+	DonutBitStreamFilters []DonutBitStreamFilter
 
 	// DonutStreamFilter is a regular filter
 	DonutStreamFilter *DonutStreamFilter
 }
 
+// ScalabilityMode follows the W3C WebRTC-SVC notation.
+// ref https://www.w3.org/TR/webrtc-svc/#scalabilitymodes*
+type ScalabilityMode string
+
+var ScalabilityModeL1T1 ScalabilityMode = "L1T1"
+var ScalabilityModeL1T2 ScalabilityMode = "L1T2"
+var ScalabilityModeL1T3 ScalabilityMode = "L1T3"
+
+// TemporalLayers returns the number of temporal layers, 0 when the mode isn't supported.
+func (m ScalabilityMode) TemporalLayers() int {
+	switch m {
+	case ScalabilityModeL1T1:
+		return 1
+	case ScalabilityModeL1T2:
+		return 2
+	case ScalabilityModeL1T3:
+		return 3
+	}
+	return 0
+}
+
+// ContentType hints the encoder about the video content, screen captures and slides
+// need sharp text and static frames rather than smooth motion.
+type ContentType string
+
+var ContentTypeMotion ContentType = "motion"
+var ContentTypeScreen ContentType = "screen"
+var ContentTypeAnimation ContentType = "animation"
+
+func (t ContentType) Valid() bool {
+	return t == ContentTypeMotion || t == ContentTypeScreen || t == ContentTypeAnimation
+}
+
+// LatencyMode trades the encoding latency for the compression efficiency, realtime disables
+// B-frames and lookahead while quality enables them.
+type LatencyMode string
+
+var LatencyModeRealtime LatencyMode = "realtime"
+var LatencyModeBalanced LatencyMode = "balanced"
+var LatencyModeQuality LatencyMode = "quality"
+
+func (m LatencyMode) Valid() bool {
+	return m == LatencyModeRealtime || m == LatencyModeBalanced || m == LatencyModeQuality
+}
+
+// DeinterlaceMode selects the frames output by the deinterlacer, send_field outputs a frame per field
+// doubling the frame rate (ex: 1080i50 to 1080p50) for a smoother motion.
+type DeinterlaceMode string
+
+var DeinterlaceModeFrame DeinterlaceMode = "send_frame"
+var DeinterlaceModeField DeinterlaceMode = "send_field"
+
+func (m DeinterlaceMode) Valid() bool {
+	return m == DeinterlaceModeFrame || m == DeinterlaceModeField
+}
+
+// ResolutionPreset is the output resolution requested by a client, auto keeps the source one.
+type ResolutionPreset string
+
+var ResolutionAuto ResolutionPreset = "auto"
+var Resolution1080p ResolutionPreset = "1080p"
+var Resolution720p ResolutionPreset = "720p"
+var Resolution480p ResolutionPreset = "480p"
+var Resolution360p ResolutionPreset = "360p"
+
+func (r ResolutionPreset) Valid() bool {
+	return r == ResolutionAuto || r.Height() > 0
+}
+
+// Height returns the output height of the preset, 0 for auto (or an unknown preset).
+func (r ResolutionPreset) Height() int {
+	switch r {
+	case Resolution1080p:
+		return 1080
+	case Resolution720p:
+		return 720
+	case Resolution480p:
+		return 480
+	case Resolution360p:
+		return 360
+	}
+	return 0
+}
+
+// IsDeinterlacer returns true for the supported deinterlace filters, either bwdif or yadif.
+func IsDeinterlacer(name string) bool {
+	return name == "bwdif" || name == "yadif"
+}
+
+// AuthMode selects the built-in Authorizer.
+type AuthMode string
+
+var AuthModeNone AuthMode = "none"
+var AuthModeToken AuthMode = "token"
+var AuthModeJWT AuthMode = "jwt"
+
+// SRTStreamIDMismatch is what an SRT listener does when the publisher's streamid isn't the expected one.
+type SRTStreamIDMismatch string
+
+// SRTStreamIDMismatchReject closes the connection, failing with ErrSRTStreamIDMismatch.
+var SRTStreamIDMismatchReject SRTStreamIDMismatch = "reject"
+
+// SRTStreamIDMismatchWarn logs the mismatch and keeps the publisher.
+var SRTStreamIDMismatchWarn SRTStreamIDMismatch = "warn"
+
+// SRTStreamIDMismatchIgnore accepts any publisher, as libav does.
+var SRTStreamIDMismatchIgnore SRTStreamIDMismatch = "ignore"
+
+func (m SRTStreamIDMismatch) Valid() bool {
+	return m == SRTStreamIDMismatchReject || m == SRTStreamIDMismatchWarn || m == SRTStreamIDMismatchIgnore
+}
+
+// ICETransportPolicy selects the candidates gathered by the peer connections.
+type ICETransportPolicy string
+
+var ICETransportPolicyAll ICETransportPolicy = "all"
+var ICETransportPolicyRelay ICETransportPolicy = "relay"
+
+func (p ICETransportPolicy) Valid() bool {
+	return p == ICETransportPolicyAll || p == ICETransportPolicyRelay
+}
+
+// AudioFormatChange is what the transcoded audio does when the decoded frames change their sample rate,
+// sample format or channel layout mid-stream, ex: an MPEG-TS source switching from 44.1kHz to 48kHz.
+type AudioFormatChange string
+
+// AudioFormatChangeReconfigure rebuilds the filter graph for the new format, the encoder keeps its output.
+var AudioFormatChangeReconfigure AudioFormatChange = "reconfigure"
+
+// AudioFormatChangeFail stops the stream with ErrAudioFormatChanged.
+var AudioFormatChangeFail AudioFormatChange = "fail"
+
+func (m AudioFormatChange) Valid() bool {
+	return m == AudioFormatChangeReconfigure || m == AudioFormatChangeFail
+}
+
+// TimestampDiscontinuity is what the streamer does when the source timestamps jump, ex: an MPEG-TS
+// discontinuity after a splice or an encoder restart.
+type TimestampDiscontinuity string
+
+// TimestampDiscontinuityReset rebases the timestamps and restarts the decoders of the transcoded streams,
+// the frames after the jump don't reference the ones before it.
+var TimestampDiscontinuityReset TimestampDiscontinuity = "reset"
+
+// TimestampDiscontinuityRebase shifts the timestamps after the jump to follow the previous ones.
+var TimestampDiscontinuityRebase TimestampDiscontinuity = "rebase"
+
+// TimestampDiscontinuityIgnore keeps the source timestamps, as libav reads them.
+var TimestampDiscontinuityIgnore TimestampDiscontinuity = "ignore"
+
+func (m TimestampDiscontinuity) Valid() bool {
+	return m == TimestampDiscontinuityReset || m == TimestampDiscontinuityRebase || m == TimestampDiscontinuityIgnore
+}
+
+// OfferMissingMedia is what the signaling does when the client offer has no m-line for a media
+// the source provides, ex: an audio-only offer of a stream with video.
+type OfferMissingMedia string
+
+// OfferMissingMediaOmit answers with the offered media only, the other one isn't streamed to the client.
+var OfferMissingMediaOmit OfferMissingMedia = "omit"
+
+// OfferMissingMediaReject fails the signaling, the client must offer every media of the source.
+var OfferMissingMediaReject OfferMissingMedia = "reject"
+
+func (m OfferMissingMedia) Valid() bool {
+	return m == OfferMissingMediaOmit || m == OfferMissingMediaReject
+}
+
+// ColorRange is the video color range signaled by the encoder (transcode only), a wrong one displays
+// the video washed out or with crushed blacks.
+type ColorRange string
+
+// ColorRangeAuto signals the source range.
+var ColorRangeAuto ColorRange = "auto"
+
+// ColorRangeTV is the limited range (16-235), the one of most video sources.
+var ColorRangeTV ColorRange = "tv"
+
+// ColorRangeFull is the full range (0-255), ex: MJPEG cameras or screen captures.
+var ColorRangeFull ColorRange = "full"
+
+func (r ColorRange) Valid() bool {
+	return r == ColorRangeAuto || r == ColorRangeTV || r == ColorRangeFull
+}
+
+// RecordingFormat is the container of the recordings, mkv and mpegts stay playable
+// when donut is killed before writing the trailer, unlike mp4.
+type RecordingFormat string
+
+var RecordingFormatMP4 RecordingFormat = "mp4"
+var RecordingFormatMKV RecordingFormat = "mkv"
+var RecordingFormatMpegTS RecordingFormat = "mpegts"
+
+func (f RecordingFormat) Valid() bool {
+	return f == RecordingFormatMP4 || f == RecordingFormatMKV || f == RecordingFormatMpegTS
+}
+
+// Extension returns the file extension, without the dot.
+func (f RecordingFormat) Extension() string {
+	if f == RecordingFormatMpegTS {
+		return "ts"
+	}
+	return string(f)
+}
+
+// MuxerName returns the libav muxer name.
+func (f RecordingFormat) MuxerName() string {
+	if f == RecordingFormatMKV {
+		return "matroska"
+	}
+	return string(f)
+}
+
+// defaultFrameRate is assumed when the source doesn't declare its frame rate.
+const defaultFrameRate = 30
+
+// RecommendedVideoBitRate scales the bit rate with the resolution and frame rate spending bitsPerPixel
+// on each pixel, ex: 0.09 gives ~620kbps for 640x360@30. It's capped by maxBitRate, 0 means no cap.
+func RecommendedVideoBitRate(width, height int, frameRate, bitsPerPixel float64, maxBitRate int64) int64 {
+	if frameRate <= 0 {
+		frameRate = defaultFrameRate
+	}
+	bitRate := int64(float64(width*height) * frameRate * bitsPerPixel)
+	if maxBitRate > 0 && bitRate > maxBitRate {
+		return maxBitRate
+	}
+	return bitRate
+}
+
 type DonutInputOptionKey string
 
 func (d DonutInputOptionKey) String() string {
@@ -220,9 +1138,47 @@ func (d DonutInputOptionKey) String() string {
 var DonutSRTStreamID DonutInputOptionKey = "srt_streamid"
 var DonutSRTsmoother DonutInputOptionKey = "smoother"
 var DonutSRTTranstype DonutInputOptionKey = "transtype"
+var DonutSRTPayloadSize DonutInputOptionKey = "payload_size"
+var DonutSRTListenTimeout DonutInputOptionKey = "listen_timeout"
 
 var DonutRTMPLive DonutInputOptionKey = "rtmp_live"
 
+var DonutHLSLiveStartIndex DonutInputOptionKey = "live_start_index"
+var DonutHTTPPersistent DonutInputOptionKey = "http_persistent"
+
+var DonutProbeSize DonutInputOptionKey = "probesize"
+var DonutAnalyzeDuration DonutInputOptionKey = "analyzeduration"
+var DonutFPSProbeSize DonutInputOptionKey = "fpsprobesize"
+
+// SRTAccessControlPrefix starts a streamid following the SRT access control syntax.
+const SRTAccessControlPrefix = "#!::"
+
+// MpegTSPacketSize is the size of a single MPEG-TS unit.
+const MpegTSPacketSize = 188
+
+// SRTMaxPayloadSize is the largest payload of an SRT live packet, libsrt refuses larger ones.
+const SRTMaxPayloadSize = 1456
+
+// IsSRTPayloadSize tells whether the size fits whole MPEG-TS units in an SRT packet, ex: 1316 (188*7).
+func IsSRTPayloadSize(size int) bool {
+	return size > 0 && size%MpegTSPacketSize == 0 && size <= SRTMaxPayloadSize
+}
+
+// DonutReadStrategy defines how the input is read.
+type DonutReadStrategy string
+
+// DonutReadBlocking blocks (inside libav) until there is data.
+var DonutReadBlocking DonutReadStrategy = "blocking"
+
+// DonutReadPolling opens the input in non-blocking mode and polls it every Config.SRTPollIntervalMS, waiting in
+// Go instead of in a cgo call, so many idle sessions don't pin one OS thread each. Each session still has its
+// reading goroutine: libav's SRT protocol doesn't expose its socket, a single srt_epoll can't serve them all.
+var DonutReadPolling DonutReadStrategy = "polling"
+
+func (d DonutReadStrategy) Valid() bool {
+	return d == DonutReadBlocking || d == DonutReadPolling
+}
+
 type DonutInputFormat string
 
 func (d DonutInputFormat) String() string {
@@ -231,17 +1187,48 @@ func (d DonutInputFormat) String() string {
 
 var DonutMpegTSFormat DonutInputFormat = "mpegts"
 var DonutFLVFormat DonutInputFormat = "flv"
+var DonutHLSFormat DonutInputFormat = "hls"
+var DonutDASHFormat DonutInputFormat = "dash"
+
+// DonutLavfiFormat reads a libavfilter graph as input, ex: the fallback test pattern.
+var DonutLavfiFormat DonutInputFormat = "lavfi"
 
 type DonutAppetizer struct {
 	URL     string
 	Format  DonutInputFormat
 	Options map[DonutInputOptionKey]string
+	// Reader is the media source for pipe inputs, it's read through a custom libav IO context.
+	Reader io.Reader
+	// ReadStrategy defines how the input is read, empty means blocking.
+	ReadStrategy DonutReadStrategy
+	// StartAt seeks the input before reading, zero starts at the beginning.
+	StartAt time.Duration
 }
 
 type DonutRecipe struct {
 	Input DonutAppetizer
 	Video DonutMediaTask
 	Audio DonutMediaTask
+	// Warnings tell the client what the recipe degraded, ex: the audio dropped for lack of an encoder.
+	Warnings []string
+}
+
+// DonutRecipeRule defines the default video task for sources matching a container format and video codec.
+type DonutRecipeRule struct {
+	// Format is the source container, empty matches any format.
+	Format DonutInputFormat
+	// Codec is the source video codec, empty matches any codec.
+	Codec Codec
+	// Action is the action applied to the matching source.
+	Action DonutMediaTaskAction
+	// TargetCodec is the output codec when transcoding.
+	TargetCodec Codec
+}
+
+func (r *DonutRecipeRule) Match(format DonutInputFormat, codec Codec) bool {
+	matchFormat := r.Format == "" || r.Format == format
+	matchCodec := r.Codec == "" || r.Codec == codec
+	return matchFormat && matchCodec
 }
 
 type LibAVOptionsCodecContext func(c *astiav.CodecContext)
@@ -276,6 +1263,22 @@ func SetGopSize(gopSize int) LibAVOptionsCodecContext {
 	}
 }
 
+// SetLowDelay makes the codec output frames as soon as possible, ex: no frame reordering delay.
+func SetLowDelay() LibAVOptionsCodecContext {
+	return func(c *astiav.CodecContext) {
+		c.SetFlags(c.Flags().Add(astiav.CodecContextFlagLowDelay))
+	}
+}
+
+// SetThreadCount sets the number of threads, 0 lets ffmpeg decide.
+// Slice threading is used since frame threading adds one frame of delay per thread.
+func SetThreadCount(threadCount int) LibAVOptionsCodecContext {
+	return func(c *astiav.CodecContext) {
+		c.SetThreadCount(threadCount)
+		c.SetThreadType(astiav.ThreadTypeSlice)
+	}
+}
+
 // SetSampleFormat sets sample format,
 // CAUTION it only contains partial list of fmt
 // TODO: move it to mappers
@@ -294,6 +1297,25 @@ func SetSampleFormat(fmt string) LibAVOptionsCodecContext {
 	}
 }
 
+// EncoderPixelFormat looks the pixel format up by name (ex: yuv420p) and checks the encoder supports it,
+// an encoder not listing its pixel formats is assumed to accept it.
+func EncoderPixelFormat(encoder *astiav.Codec, name string) (astiav.PixelFormat, error) {
+	pixelFormat := astiav.FindPixelFormatByName(name)
+	if pixelFormat == astiav.PixelFormatNone {
+		return pixelFormat, fmt.Errorf("%w %s", ErrUnsupportedPixelFormat, name)
+	}
+	supported := encoder.PixelFormats()
+	for _, f := range supported {
+		if f == pixelFormat {
+			return pixelFormat, nil
+		}
+	}
+	if len(supported) > 0 {
+		return pixelFormat, fmt.Errorf("%w %s for %s", ErrUnsupportedPixelFormat, name, encoder.Name())
+	}
+	return pixelFormat, nil
+}
+
 // TODO: implement proper matching
 // DonutTransformRecipe
 //  AudioTask: {Action: Transcode, From: AAC, To: Opus}
@@ -303,6 +1325,11 @@ type Config struct {
 	HTTPPort       int32  `required:"true" default:"8080"`
 	HTTPHost       string `required:"true" default:"0.0.0.0"`
 	PproffHTTPPort int32  `required:"true" default:"6060"`
+	// HTTP server timeouts, they protect the signaling endpoints against stalled (slowloris-style) clients.
+	// The write timeout must be longer than the ICE gathering, which happens before writing the answer.
+	HTTPReadHeaderTimeoutMS int `required:"true" default:"5000"`
+	HTTPWriteTimeoutMS      int `required:"true" default:"30000"`
+	HTTPIdleTimeoutMS       int `required:"true" default:"60000"`
 
 	TCPICEPort         int      `required:"true" default:"8081"`
 	UDPICEPort         int      `required:"true" default:"8094"`
@@ -310,15 +1337,277 @@ type Config struct {
 	ICEExternalIPsDNAT []string `required:"true" default:"127.0.0.1"`
 	EnableICEMux       bool     `require:"true" default:"false"`
 	StunServers        []string `required:"true" default:"stun:stun.l.google.com:19302,stun:stun1.l.google.com:19302,stun:stun2.l.google.com:19302,stun:stun4.l.google.com:19302"`
+	// TURNServers relay the media of the viewers unreachable otherwise, ex: turn:turn.example.com:3478?transport=udp.
+	// TURNUsername and TURNCredential authenticate donut to them (long-term credentials).
+	TURNServers    []string `default:""`
+	TURNUsername   string   `default:""`
+	TURNCredential string   `default:""`
+	// ICETransportPolicy is either all or relay, relay gathers only the TURN candidates (it requires TURNServers):
+	// the viewers never learn the server addresses.
+	ICETransportPolicy ICETransportPolicy `default:"all"`
+	// DSCPAudio and DSCPVideo mark the outgoing media packets for the managed networks prioritizing them,
+	// ex: EF for audio and AF41 for video. Only the ICE-UDP packets are marked, on linux, empty disables it.
+	DSCPAudio string `default:""`
+	DSCPVideo string `default:""`
+	// RTPTimestampResetWindowS rebases the RTP timestamps of a stream to 0 on the first key frame this many seconds
+	// before they wrap around at 2^32 (every ~13h at 90kHz), for the receivers glitching at the wrap. 0 lets them wrap.
+	RTPTimestampResetWindowS int `default:"0"`
+	// BypassMaxKeyFrameWaitMS reports the viewers of a bypassed video waiting longer than this for a key frame
+	// they requested (PLI or FIR), donut can't produce one: the source key frame interval is too long. 0 disables it.
+	BypassMaxKeyFrameWaitMS int `default:"5000"`
+	// ICEMuxCandidateTypes are the candidate types advertised when EnableICEMux is set, the UDP ones are
+	// restricted to the UDPICEPort mux (host candidates on ICEExternalIPsDNAT), so a single UDP port is exposed.
+	ICEMuxCandidateTypes []string `default:"host"`
+	// ICENetworkTypes are the networks gathering candidates, the tcp ones (ICE-TCP on TCPICEPort)
+	// reach viewers behind UDP-blocking firewalls.
+	ICENetworkTypes []string `default:"udp4,udp6,tcp4,tcp6"`
+	// ICECandidateTypes and ICEAddressFamilies filter the candidates placed in the answers,
+	// ex: ICECandidateTypes="relay" for a relay-only (TURN) deployment or ICEAddressFamilies="ipv4" excluding IPv6.
+	ICECandidateTypes  []string `default:"host,srflx,prflx,relay"`
+	ICEAddressFamilies []string `default:"ipv4,ipv6"`
+	// ICEPreferredAddressFamily places the candidates of a family (ipv4 or ipv6) first in the answers of
+	// dual-stack deployments, empty keeps the gathering order.
+	ICEPreferredAddressFamily string `default:""`
+	// OfferMissingMedia is either omit or reject, for the offers without a video or an audio m-line.
+	// The answer only has the tracks of the media both offered by the client and provided by the source.
+	OfferMissingMedia OfferMissingMedia `default:"omit"`
+	// DataChannelKeepaliveIntervalMS is how often a keepalive message is sent over the metadata
+	// data channel, keeping NATs/proxies open and signaling liveness to the client. 0 disables it.
+	DataChannelKeepaliveIntervalMS int `default:"5000"`
+	// ClockReportIntervalMS is how often the server clock and the pipeline latency are sent over the
+	// metadata data channel, letting the client measure the end-to-end latency. 0 disables it.
+	ClockReportIntervalMS int `default:"0"`
+	// DataStreamCues forwards the packets of the source data streams (ex: SCTE-35, KLV) as cues over the
+	// metadata data channel, the payload is base64 encoded. Otherwise they're discarded.
+	DataStreamCues bool `default:"false"`
+	// TimecodeReports sends the source SMPTE timecode of every video key frame over the metadata data channel,
+	// read from the decoded frames (S12M) or derived from the start timecode of the source metadata.
+	TimecodeReports bool `default:"false"`
+	// PosterFrames captures the first decoded video key frame as a JPEG (no wider than PosterMaxWidth), it's sent
+	// over the metadata data channel and served by GET /session/{id}/poster, showing a poster while connecting.
+	PosterFrames   bool `default:"false"`
+	PosterMaxWidth int  `default:"480"`
+	// PipelineEvents reports the lifecycle of every stream (input_opened, stream_info_found, first_frame_decoded,
+	// first_frame_encoded then streaming) over the metadata data channel and in the sessions, with timestamps.
+	// They're counted in the metrics served by GET /debug/vars.
+	PipelineEvents bool `default:"false"`
+	// MaxSessionDurationMS tears a session down (stopping its stream and closing the peer) once it's reached,
+	// reclaiming the resources of forgotten tabs. The client is warned SessionTeardownWarningMS before. 0 disables it.
+	MaxSessionDurationMS     int `default:"0"`
+	SessionTeardownWarningMS int `default:"10000"`
+	// SessionIdleTimeoutMS tears a WHEP session down once no RTCP feedback (receiver reports, NACKs, PLIs) was
+	// received from the viewer for this long, ex: a peer gone without closing the connection. 0 disables it.
+	SessionIdleTimeoutMS int `default:"0"`
+	// RTPHeaderExtensionURIs are the RTP header extensions offered for both audio and video,
+	// by default abs-send-time and transport-wide-cc, both required for browser's bandwidth estimation.
+	RTPHeaderExtensionURIs []string `default:"http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time,http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"`
+	// VideoRTCPFeedback and AudioRTCPFeedback are the RTCP feedback advertised per codec (WHEP/WHIP),
+	// ex: "nack", "nack pli", "ccm fir", "goog-remb", "transport-cc".
+	VideoRTCPFeedback []string `default:"nack,nack pli,ccm fir,goog-remb,transport-cc"`
+	AudioRTCPFeedback []string `default:"transport-cc"`
+	// WHIPMaxVideoBitRate caps the video a WHIP publisher sends (bps), it's advertised in the answer (b=AS)
+	// and enforced through REMB feedback. 0 disables it.
+	WHIPMaxVideoBitRate int64 `default:"0"`
 
 	SRTConnectionLatencyMS int32 `required:"true" default:"300"`
 	// MPEG-TS consists of single units of 188 bytes. Multiplying 188*7 we get 1316,
 	// which is the maximum product of 188 that is less than MTU 1500 (188*8=1504)
 	// ref https://github.com/Haivision/srt/blob/master/docs/features/live-streaming.md#transmitting-mpeg-ts-binary-protocol-over-srt
 	SRTReadBufferSizeBytes int `required:"true" default:"1316"`
+	// SRTReadStrategy is either blocking or polling, see DonutReadStrategy.
+	SRTReadStrategy DonutReadStrategy `required:"true" default:"blocking"`
+	// SRTConnectTimeoutMS bounds how long a caller (srt://host:port?mode=caller) waits for the remote
+	// listener to accept the connection, failing with ErrSRTConnectTimeout instead of hanging.
+	SRTConnectTimeoutMS int `default:"3000"`
+	// SRTStreamIDMismatch is either reject, warn or ignore, it applies when a publisher connects to a listener
+	// with another streamid than the requested one. A publisher sending no streamid can't be verified, it's
+	// handled as a mismatch: the default only warns, plain publishers (ex: ffmpeg -f mpegts srt://host:port)
+	// send none.
+	SRTStreamIDMismatch SRTStreamIDMismatch `default:"warn"`
+	// SRTPollIntervalMS is how long the polling strategy waits when there's no data available, it must be
+	// greater than zero.
+	SRTPollIntervalMS int `required:"true" default:"5"`
+	// ConcealCorruptFrames drops bypassed H264/H265 frames damaged by packet loss (ex: on a lossy SRT link)
+	// and the following ones up to the next keyframe, trading garbled frames for a brief freeze.
+	ConcealCorruptFrames bool `default:"false"`
 
 	ProbingSize int `required:"true" default:"120"`
 
+	// VideoBitsPerPixel derives the default video bit rate from the output resolution and frame rate,
+	// see RecommendedVideoBitRate, when the recipe doesn't set one. 0 keeps the encoder default.
+	VideoBitsPerPixel float64 `default:"0.09"`
+	// VideoMaxBitRate caps the derived video bit rate (bps), 0 means no cap.
+	VideoMaxBitRate int64 `default:"4000000"`
+
+	// VideoScalabilityMode enables SVC temporal layers for VP9 transcoding, either L1T1, L1T2 or L1T3.
+	// AV1 is only given a single layer (L1T1), its libav encoders don't expose the layers. Empty disables it.
+	// The RTP payload descriptor doesn't carry the temporal layer IDs (pion's VP9 payloader has no L bit), so
+	// the viewers decode every layer and a forwarding SFU can't drop some under congestion.
+	VideoScalabilityMode ScalabilityMode `default:""`
+
+	// WatermarkPath is an image (ex: PNG with alpha) drawn over the transcoded video, empty disables it.
+	// WatermarkX and WatermarkY follow the overlay filter syntax, the default is the top right corner.
+	WatermarkPath    string  `default:""`
+	WatermarkX       string  `default:"W-w-10"`
+	WatermarkY       string  `default:"10"`
+	WatermarkOpacity float64 `default:"1"`
+
+	// AudioSampleRate is the sample rate the audio is resampled to before encoding, one of OpusSampleRates.
+	AudioSampleRate int `default:"48000"`
+	// AudioPtimeMS is the audio packet duration, one of OpusPtimesMS. It's lowered when the client's
+	// offer carries a shorter a=maxptime.
+	AudioPtimeMS int `default:"20"`
+	// AudioFormatChange is either reconfigure or fail, it applies when the decoded audio changes its sample rate,
+	// sample format or channel layout mid-stream. Reconfigure resamples the new format to the same output.
+	AudioFormatChange AudioFormatChange `default:"reconfigure"`
+	// AudioLoudnessLUFS normalizes the transcoded audio to this integrated loudness (EBU R128), keeping the volume
+	// consistent across sources, ex: -23 for broadcast or -16 for streaming. 0 disables it.
+	AudioLoudnessLUFS float64 `default:"0"`
+	// AudioMono downmixes the transcoded audio to mono, halving the Opus bit rate, ex: voice or commentary.
+	AudioMono bool `default:"false"`
+	// AudioOpusPassthrough forwards an Opus source already at the target sample rate and channels instead of
+	// transcoding it, unless its loudness is normalized or the muxers need another codec.
+	AudioOpusPassthrough bool `default:"true"`
+
+	// VideoContentType tunes the video encoder, either motion, screen (slides, screen share) or animation.
+	VideoContentType ContentType `default:"motion"`
+	// VideoLatencyMode tunes the video encoder, either realtime, balanced or quality. Empty keeps the
+	// encoder defaults.
+	VideoLatencyMode LatencyMode `default:""`
+	// VideoDeinterlace deinterlaces the transcoded video, either send_frame (same frame rate) or send_field
+	// (a frame per field, ex: 1080i50 to 1080p50). Empty disables it, progressive frames are never altered.
+	VideoDeinterlace DeinterlaceMode `default:""`
+	// VideoDeinterlacer is the deinterlace filter, either bwdif or yadif.
+	VideoDeinterlacer string `default:"bwdif"`
+
+	// HDRPassthrough bypasses HDR sources whose codec (ex: h265, av1) the client supports, instead of
+	// transcoding them through the recipe rules, and keeps the color metadata when transcoding is unavoidable.
+	HDRPassthrough bool `default:"true"`
+
+	// VideoFallbackFrameRate paces the video of sources with an unknown frame rate (ex: some SRT sources) until
+	// the duration is derived from the timestamps of consecutive packets.
+	VideoFallbackFrameRate int `default:"30"`
+	// VideoMaxFrameRate caps the transcoded video frame rate (ex: 60fps sources served at 30fps), 0 disables it.
+	VideoMaxFrameRate int `default:"0"`
+	// VideoSquarePixels scales the transcoded anamorphic sources (non-square pixels, ex: DVDs) to square pixels
+	// keeping their display aspect ratio, browsers ignore the sample aspect ratio of the WebRTC streams.
+	VideoSquarePixels bool `default:"true"`
+	// VideoPixelFormat forces the pixel format of the transcoded video, ex: yuv420p. Empty lets the encoder pick.
+	VideoPixelFormat string `default:""`
+	// VideoColorRange is either auto, tv or full, the color range signaled for the transcoded video. auto keeps
+	// the source one, tv or full fix the sources tagged with a wrong range.
+	VideoColorRange ColorRange `default:"auto"`
+	// VideoEncoderPrivateOptions are the video encoder specific options, ex: "crf:23,preset:slow" for libx264.
+	// The encoders ignore (with a warning) the options they don't know.
+	VideoEncoderPrivateOptions map[string]string `default:""`
+
+	// DecoderLowDelay opens the video decoder in low-delay mode, reducing the decoding latency.
+	DecoderLowDelay bool `default:"true"`
+	// DecoderThreads is the video decoder thread count, 0 lets ffmpeg decide.
+	DecoderThreads int `default:"0"`
+
+	// LogSDP logs the SDP offers and answers at debug level, on the "sdp" logger: the other logs keep their
+	// level. They're verbose and expose client addresses.
+	LogSDP bool `default:"false"`
+	// LogFilterGraphs logs, at debug level on the "filter_graph" logger, the filter graph of each transcoded stream
+	// once it's configured, showing how the filter string was parsed and the formats negotiated between the filters.
+	LogFilterGraphs bool `default:"false"`
+	// StreamStatsIntervalMS logs the throughput and frame rate of each stream at this interval
+	// (ex: "stream #0 video: 2.3 Mbps, 29.97 fps"), 0 disables it.
+	StreamStatsIntervalMS int `default:"0"`
+
+	// AuthMode checks the signaling requests along with the session endpoints (/session/, /whep/{id}) and the
+	// HLS stream, either none, token (a static bearer token) or jwt (HS256). The token is read from the
+	// Authorization header or the token query parameter. A session endpoint is authorized against the stream of
+	// the session, a JWT publishing (WHIP) must have the publish claim.
+	AuthMode AuthMode `default:"none"`
+	// AuthToken is the bearer token expected by the token mode.
+	AuthToken string `default:""`
+	// AuthJWTSecret is the HS256 secret verifying the tokens of the jwt mode.
+	AuthJWTSecret string `default:""`
+
+	// RecordingDir enables recording every session into this directory, empty disables it.
+	RecordingDir string `default:""`
+	// RecordingFormat is the container of the recordings, either mp4, mkv or mpegts.
+	RecordingFormat RecordingFormat `default:"mp4"`
+	// RelayURL re-publishes every stream, as served over WebRTC (bypassed or transcoded), to an
+	// RTMP (flv) or SRT (mpegts) destination. Empty disables it.
+	RelayURL string `default:""`
+	// RelayAllowedURLs are the destinations a request's RelayURL may re-publish to, a request url must have
+	// the scheme and host of one of them and start with its path, ex: rtmp://a.rtmp.youtube.com/live2.
+	// Empty rejects the request relays, only RelayURL is used.
+	RelayAllowedURLs []string `default:""`
+	// MuxerAudioCodec encodes the transcoded audio a second time for the recording and the relay, ex: aac
+	// for RTMP. Empty sends them the WebRTC audio (Opus), or AAC to an RTMP relay since FLV can't carry Opus.
+	MuxerAudioCodec Codec `default:""`
+	// MuxerVideoCodec encodes the transcoded video a second time, from the same decoded frames, for the
+	// recording and the relay, ex: h264 for an mp4 recording of VP9. Empty sends them the WebRTC video.
+	MuxerVideoCodec Codec `default:""`
+	// HLSDir publishes every WHEP stream as HLS into <HLSDir>/<stream id>/index.m3u8, served under /hls/.
+	// Its audio is encoded to AAC alongside the Opus sent to the viewers. Empty disables it.
+	HLSDir string `default:""`
+	// HLSSegmentMS is the target duration of the HLS segments.
+	HLSSegmentMS int `default:"2000"`
+	// MuxerReorderWindowMS bounds how long packets are buffered to interleave audio and video.
+	MuxerReorderWindowMS int `required:"true" default:"500"`
+
+	// RecipeRules are evaluated in order against the source, the first match defines the video task.
+	// Each rule follows the syntax [format/]codec=action[:codec], where * matches any codec,
+	// ex: "mpegts/h265=transcode:h264,h264=bypass".
+	RecipeRules []string `default:"h265=transcode:h264,h264=bypass"`
+	// H264SpropParameterSets advertises the SPS and PPS of bypassed H264 sources in the answer's fmtp,
+	// letting browsers initialize the decoder before the first key frame.
+	H264SpropParameterSets bool `default:"false"`
+	// BypassBitStreamFilters are appended to the bit stream filters of a bypassed video, ex: "dump_extra".
+	BypassBitStreamFilters []string `default:""`
+
+	// EncodeBudgetPercent is the share of real time a transcoded video stream may spend decoding, filtering and encoding,
+	// when it's exceeded for consecutive windows of EncodeBudgetWindowMS the resolution (then the frame rate)
+	// is lowered instead of accumulating latency. 0 disables it.
+	EncodeBudgetPercent  int `default:"0"`
+	EncodeBudgetWindowMS int `default:"2000"`
+
+	// HLSLiveStartIndex is the segment where a live HLS input starts, negative values count from the
+	// end of the playlist, ex: -3 starts three segments behind the live edge.
+	HLSLiveStartIndex int `default:"-3"`
+
+	// FallbackTestPattern serves color bars and a tone while the source is unavailable instead of
+	// failing the request, switching to the live media once the source comes up.
+	FallbackTestPattern bool `default:"false"`
+	// FallbackRetryMS is the interval between attempts to reach the source while the pattern is served.
+	FallbackRetryMS int `default:"2000"`
+	// FallbackProbeTimeoutMS bounds how long an SRT listener waits for the encoder before falling back.
+	FallbackProbeTimeoutMS int `default:"3000"`
+
+	// PrebufferMS accumulates the initial frames before writing them to the WebRTC tracks,
+	// smoothing the startup. It's capped to one second, 0 disables it.
+	PrebufferMS int `default:"0"`
+
+	// FindStreamInfoAttempts re-runs FindStreamInfo until the FindStreamInfoMediaTypes show up, slow-starting
+	// sources (ex: an MPEG-TS without PMT yet) might report only some of their streams at first.
+	FindStreamInfoAttempts int `default:"3"`
+	// FindStreamInfoIntervalMS is the wait between FindStreamInfo attempts.
+	FindStreamInfoIntervalMS int `default:"500"`
+	// FindStreamInfoMediaTypes are the media types expected from the sources, ex: "video,audio".
+	FindStreamInfoMediaTypes []MediaType `default:"video,audio"`
+	// ProbeSizeBytes and ProbeAnalyzeDurationMS bound how much of the source FindStreamInfo reads (libav's probesize
+	// and analyzeduration), 0 keeps the libav defaults (5MB and 5s) or the FastProbe ones.
+	ProbeSizeBytes         int `default:"0"`
+	ProbeAnalyzeDurationMS int `default:"0"`
+	// FastProbe reads just enough of the source to identify its codecs (64KB or 500ms, without probing the frame
+	// rate), cutting the signaling latency of known-good sources. The stream details (ex: the frame rate or a late
+	// audio stream) might be missing, the streamer then learns them from the packets.
+	FastProbe bool `default:"false"`
+
+	// TimestampDiscontinuity is either reset, rebase or ignore, it applies to the inputs whose timestamps
+	// might jump (ex: mpegts) when the DTS of a stream moves by more than TimestampDiscontinuityThresholdMS.
+	TimestampDiscontinuity TimestampDiscontinuity `default:"reset"`
+	// TimestampDiscontinuityThresholdMS is the DTS jump treated as a discontinuity, as ffmpeg's dts_delta_threshold.
+	TimestampDiscontinuityThresholdMS int `default:"10000"`
+
+	// PipeReadBufferSizeBytes is the libav IO buffer size used when reading from pipes (stdin).
+	PipeReadBufferSizeBytes int `required:"true" default:"32768"`
+
 	// Add the following fields to fix the compilation error
 	DefaultStreamURL string `required:"true" default:"srt://localhost:40053"`
 	DefaultStreamID  string `required:"true" default:"stream-id"`
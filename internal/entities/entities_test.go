@@ -0,0 +1,28 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestParamsValidSRTReadBufferSize(t *testing.T) {
+	for size, want := range map[int]error{
+		0:    nil,
+		188:  nil,
+		1316: nil,
+		1504: ErrInvalidSRTReadBufferSize,
+		1000: ErrInvalidSRTReadBufferSize,
+		-188: ErrInvalidSRTReadBufferSize,
+	} {
+		p := &RequestParams{StreamURL: "srt://0.0.0.0:40052", StreamID: "stream-id", SRTReadBufferSizeBytes: size}
+
+		err := p.Valid()
+
+		if want == nil {
+			assert.NoError(t, err, size)
+		} else {
+			assert.ErrorIs(t, err, want, size)
+		}
+	}
+}
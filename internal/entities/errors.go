@@ -7,24 +7,81 @@ import (
 
 var ErrHTTPGetOnly = errors.New("you must use http GET verb")
 var ErrHTTPPostOnly = errors.New("you must use http POST verb")
+var ErrHTTPMethodNotAllowed = errors.New("http verb not allowed")
 var ErrMissingParamsOffer = errors.New("ParamsOffer must not be nil")
 
 var ErrMissingStreamURL = errors.New("stream URL must not be nil")
 var ErrMissingStreamID = errors.New("stream ID must not be nil")
 var ErrUnsupportedStreamURL = errors.New("unsupported stream")
+var ErrInvalidSRTReadBufferSize = errors.New("SRT read buffer size must be a multiple of 188 (MPEG-TS packet size) up to 1456 (SRT payload size)")
+var ErrInvalidSRTPollInterval = errors.New("SRTPollIntervalMS must be greater than zero")
+var ErrInvalidReadStrategy = errors.New("read strategy must be either blocking or polling")
 
 var ErrMissingSRTHost = errors.New("SRTHost must not be nil")
 var ErrMissingSRTPort = errors.New("SRTPort must be valid")
 var ErrMissingSRTStreamID = errors.New("SRTStreamID must not be empty")
+var ErrInvalidAudioStreamIndex = errors.New("invalid audio stream index, the source doesn't have such audio stream")
+var ErrInvalidAudioSampleRate = errors.New("invalid audio sample rate, opus accepts 8000, 12000, 16000, 24000 or 48000")
+var ErrInvalidLoudnessTarget = errors.New("invalid audio loudness, loudnorm accepts targets from -70 to -5 LUFS")
+var ErrInvalidAudioPtime = errors.New("invalid audio ptime, opus accepts 10, 20, 40 or 60 ms")
+var ErrInvalidAudioFormatChange = errors.New("AudioFormatChange must be either reconfigure or fail")
+var ErrAudioFormatChanged = errors.New("the source audio changed its format mid-stream")
+var ErrInvalidTimestampDiscontinuity = errors.New("TimestampDiscontinuity must be either reset, rebase or ignore")
+var ErrInvalidOfferMissingMedia = errors.New("OfferMissingMedia must be either omit or reject")
+var ErrMissingOfferedMedia = errors.New("the offer misses a media of the stream")
+var ErrInvalidContentType = errors.New("ContentType must be either motion, screen or animation")
+var ErrInvalidLatencyMode = errors.New("LatencyMode must be either realtime, balanced or quality")
+var ErrInvalidDeinterlaceMode = errors.New("Deinterlace must be either send_frame or send_field")
+var ErrInvalidResolution = errors.New("Resolution must be either auto, 1080p, 720p, 480p or 360p")
+var ErrInvalidColorRange = errors.New("VideoColorRange must be either auto, tv or full")
+var ErrInvalidDeinterlacer = errors.New("VideoDeinterlacer must be either bwdif or yadif")
+var ErrSRTConnectTimeout = errors.New("timed out connecting to the SRT listener")
+var ErrSRTStreamIDMismatch = errors.New("the SRT publisher connected with another streamid")
+var ErrSourceConnectionRefused = errors.New("the source refused the connection, nothing listens on its address")
+var ErrSourceUnreachable = errors.New("the source host is unreachable")
+var ErrSourceRejected = errors.New("the source rejected the connection, check its credentials (ex: SRT passphrase or streamid)")
+var ErrSourceNotFound = errors.New("the source was not found")
+var ErrSourceTimeout = errors.New("timed out connecting to the source")
+var ErrInvalidSRTStreamIDMismatch = errors.New("SRTStreamIDMismatch must be either reject, warn or ignore")
+var ErrInvalidBitRate = errors.New("BitRate must be greater than zero")
+var ErrInvalidRequestBody = errors.New("the request body must be valid JSON")
+var ErrInvalidICETransportPolicy = errors.New("ICETransportPolicy must be either all or relay")
+var ErrRelayWithoutTURNServers = errors.New("the relay ICETransportPolicy requires TURNServers")
+var ErrRelayWithoutMuxRelayCandidates = errors.New("the relay ICETransportPolicy requires the relay ICEMuxCandidateTypes along with EnableICEMux")
+var ErrInvalidDSCP = errors.New("invalid DSCP, it must be a per-hop behavior (ex: EF, AF41, CS5) or a value from 0 to 63")
+var ErrDSCPUnsupported = errors.New("marking the packets with a DSCP is only supported on linux")
+var ErrUnauthorized = errors.New("unauthorized")
+var ErrInvalidAuthMode = errors.New("AuthMode must be either none, token or jwt")
+var ErrInvalidRecordingFormat = errors.New("RecordingFormat must be either mp4, mkv or mpegts")
+var ErrInvalidICEAddressFamily = errors.New("ICEPreferredAddressFamily must be either ipv4 or ipv6")
+var ErrInvalidRelayURL = errors.New("RelayURL must be either rtmp(s):// or srt://")
+var ErrRelayURLNotAllowed = errors.New("RelayURL must be one of the RelayAllowedURLs destinations")
+var ErrRelayAudioCodec = errors.New("an RTMP relay can't carry Opus, the audio must be transcoded (ex: MuxerAudioCodec aac)")
+var ErrInvalidSRTMode = errors.New("SRTMode must be either request, publish or bidirectional")
+var ErrInvalidStartAt = errors.New("StartAtMS must not be negative")
+var ErrInvalidFallbackRetry = errors.New("FallbackRetryMS and FallbackProbeTimeoutMS must be greater than zero")
+var ErrUnseekableInput = errors.New("only VOD manifests (HLS or DASH) can start at a given position")
 
 var ErrMissingWebRTCSetup = errors.New("WebRTCController.SetupPeerConnection must be called first")
 var ErrMissingRemoteOffer = errors.New("nil offer, in order to connect one must pass a valid offer")
 var ErrMissingRequestParams = errors.New("RequestParams must not be nil")
+var ErrMissingSession = errors.New("there is no such session")
+var ErrStreamStopped = errors.New("the stream has stopped")
+var ErrStreamShared = errors.New("the stream is shared with other viewers, only a single viewer can change it")
+var ErrMissingPoster = errors.New("there is no poster yet")
+var ErrMissingICECredentials = errors.New("ice-ufrag and ice-pwd must not be empty")
 
 var ErrMissingProcess = errors.New("there is no process running")
 var ErrMissingProber = errors.New("there is no prober")
 var ErrMissingStreamer = errors.New("there is no streamer")
 var ErrMissingCompatibleStreams = errors.New("there is no compatible streams")
+var ErrTrackNotNegotiated = errors.New("the client didn't accept the codec of a track")
+var ErrMissingRTPPayloader = errors.New("there is no RTP payloader for the codec")
+var ErrMissingTransportSequence = errors.New("there is no transport sequence for the header extension")
+var ErrInvalidRecipeRule = errors.New("invalid recipe rule")
+var ErrMissingEncoder = errors.New("there is no encoder, the media is either bypassed or absent")
+var ErrMissingFilterGraph = errors.New("there is no filter graph, the media is either bypassed or absent")
+var ErrInconsistentStream = errors.New("the stream is neither fully transcoded nor bypassed")
 
 // FFmpeg/LibAV
 var ErrFFMpegLibAV = errors.New("ffmpeg/libav error")
@@ -32,3 +89,59 @@ var ErrFFmpegLibAVNotFound = fmt.Errorf("%w input not found", ErrFFMpegLibAV)
 var ErrFFmpegLibAVFormatContextIsNil = fmt.Errorf("%w format context is nil", ErrFFMpegLibAV)
 var ErrFFmpegLibAVFormatContextOpenInputFailed = fmt.Errorf("%w format context open input has failed", ErrFFMpegLibAV)
 var ErrFFmpegLibAVFindStreamInfo = fmt.Errorf("%w could not find stream info", ErrFFMpegLibAV)
+var ErrUnsupportedScalabilityMode = fmt.Errorf("%w unsupported scalability mode", ErrFFMpegLibAV)
+var ErrUnsupportedPixelFormat = fmt.Errorf("%w unsupported pixel format", ErrFFMpegLibAV)
+var ErrEncoderNotFound = fmt.Errorf("%w encoder not found", ErrFFMpegLibAV)
+var ErrFFmpegLibAVMissingComponents = fmt.Errorf("%w missing components", ErrFFMpegLibAV)
+
+// encoderBuildHints tells which ffmpeg build flag provides the encoder for a codec
+var encoderBuildHints = map[Codec]string{
+	H264: "requires --enable-gpl --enable-libx264",
+	H265: "requires --enable-gpl --enable-libx265",
+	VP8:  "requires --enable-libvpx",
+	VP9:  "requires --enable-libvpx",
+	AV1:  "requires --enable-libaom or --enable-libsvtav1",
+	Opus: "requires --enable-libopus",
+}
+
+// EncoderNotFoundError is returned when the linked ffmpeg lacks the encoder for a codec,
+// it matches ErrEncoderNotFound.
+type EncoderNotFoundError struct {
+	Codec Codec
+	// Hint suggests how to build ffmpeg with the encoder
+	Hint string
+}
+
+func NewEncoderNotFoundError(codec Codec) *EncoderNotFoundError {
+	return &EncoderNotFoundError{Codec: codec, Hint: encoderBuildHints[codec]}
+}
+
+func (e *EncoderNotFoundError) Error() string {
+	if e.Hint == "" {
+		return fmt.Sprintf("%s for %s", ErrEncoderNotFound, e.Codec)
+	}
+	return fmt.Sprintf("%s for %s (%s)", ErrEncoderNotFound, e.Codec, e.Hint)
+}
+
+func (e *EncoderNotFoundError) Unwrap() error {
+	return ErrEncoderNotFound
+}
+
+// SourceOpenError tells why a source failed to open, it matches both its Cause (ex: ErrSourceRejected)
+// and the libav error.
+type SourceOpenError struct {
+	Cause error
+	Err   error
+}
+
+func (e *SourceOpenError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Cause, e.Err)
+}
+
+func (e *SourceOpenError) Is(target error) bool {
+	return errors.Is(e.Cause, target)
+}
+
+func (e *SourceOpenError) Unwrap() error {
+	return e.Err
+}
@@ -113,3 +113,73 @@ func (n *NAL) parseSEI() error {
 
 	return nil
 }
+
+// H264ParameterSets returns the SPS and PPS NAL units (without start codes) of an H264 extradata,
+// either avcC (ex: mp4, flv) or Annex B (ex: mpegts), nil when it carries none.
+// ref ISO/IEC 14496-15 5.3.3.1 (AVCDecoderConfigurationRecord)
+func H264ParameterSets(extradata []byte) [][]byte {
+	if len(extradata) > 0 && extradata[0] == 1 {
+		return avcCParameterSets(extradata)
+	}
+
+	var sets [][]byte
+	for _, nal := range splitAnnexB(extradata) {
+		if len(nal) == 0 {
+			continue
+		}
+		if t := NALUnitType(nal[0] & 0x1f); t == SequenceParameterSet || t == PictureParameterSet {
+			sets = append(sets, nal)
+		}
+	}
+	return sets
+}
+
+func avcCParameterSets(extradata []byte) [][]byte {
+	var sets [][]byte
+	// version, profile, compatibility, level and length size precede the SPS count
+	offset := 5
+	for _, mask := range []byte{0x1f, 0xff} {
+		if offset >= len(extradata) {
+			return sets
+		}
+		count := int(extradata[offset] & mask)
+		offset++
+		for i := 0; i < count; i++ {
+			if offset+2 > len(extradata) {
+				return sets
+			}
+			size := int(extradata[offset])<<8 | int(extradata[offset+1])
+			offset += 2
+			if offset+size > len(extradata) {
+				return sets
+			}
+			sets = append(sets, extradata[offset:offset+size])
+			offset += size
+		}
+	}
+	return sets
+}
+
+// splitAnnexB splits a byte stream on its start codes (00 00 01 or 00 00 00 01).
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start <= len(data) {
+		nals = append(nals, data[start:])
+	}
+	return nals
+}
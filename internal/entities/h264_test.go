@@ -0,0 +1,28 @@
+package entities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func TestH264ParameterSets_AVCC(t *testing.T) {
+	avcC := []byte{0x01, 0x42, 0xc0, 0x1f, 0xff,
+		0xe1, 0x00, 0x04, 0x67, 0x42, 0xc0, 0x1f,
+		0x01, 0x00, 0x04, 0x68, 0xce, 0x3c, 0x80}
+
+	assert.Equal(t, [][]byte{testSPS, testPPS}, H264ParameterSets(avcC))
+}
+
+func TestH264ParameterSets_AnnexB(t *testing.T) {
+	annexB := []byte{0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0xc0, 0x1f,
+		0x00, 0x00, 0x01, 0x68, 0xce, 0x3c, 0x80,
+		0x00, 0x00, 0x01, 0x06, 0x05}
+
+	assert.Equal(t, [][]byte{testSPS, testPPS}, H264ParameterSets(annexB))
+}
@@ -1,8 +1,16 @@
 package mapper
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/asticode/go-astiav"
 	"github.com/flavioribeiro/donut/internal/entities"
@@ -10,6 +18,24 @@ import (
 	"go.uber.org/zap"
 )
 
+// NormalizeSRTListenerURL returns the address an SRT listener binds to: every interface (0.0.0.0, or :: for
+// an IPv6 host) on the url's port, without the userinfo and the query params, ex: srt://user@host:40052?mode=listener
+// becomes srt://0.0.0.0:40052. Callers, other schemes and urls without a port are returned untouched.
+func NormalizeSRTListenerURL(rawURL string) string {
+	if !strings.HasPrefix(strings.ToLower(rawURL), "srt://") || entities.IsSRTCallerURL(rawURL) {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Port() == "" {
+		return rawURL
+	}
+	host := "0.0.0.0"
+	if strings.Contains(u.Hostname(), ":") {
+		host = "::"
+	}
+	return "srt://" + net.JoinHostPort(host, u.Port())
+}
+
 // TODO: split mapper by subject (either by files alone or new modules)
 type Mapper struct {
 	l *zap.SugaredLogger
@@ -29,6 +55,14 @@ func (m *Mapper) FromTrackToRTPCodecCapability(codec entities.Codec) webrtc.RTPC
 		response.MimeType = webrtc.MimeTypeH265
 	} else if codec == entities.Opus {
 		response.MimeType = webrtc.MimeTypeOpus
+	} else if codec == entities.VP8 {
+		response.MimeType = webrtc.MimeTypeVP8
+	} else if codec == entities.VP9 {
+		// temporal layers (SVC) don't require a distinct profile
+		response.MimeType = webrtc.MimeTypeVP9
+		response.SDPFmtpLine = "profile-id=0"
+	} else if codec == entities.AV1 {
+		response.MimeType = webrtc.MimeTypeAV1
 	} else {
 		m.l.Info("[[[[TODO: mapper not implemented]]]] for ", codec)
 	}
@@ -113,6 +147,46 @@ func (m *Mapper) FromWebRTCSessionDescriptionToStreamInfo(desc webrtc.SessionDes
 	return result, nil
 }
 
+func (m *Mapper) FromSessionDescriptionToRTPHeaderExtensions(desc webrtc.SessionDescription) (map[entities.MediaType]entities.RTPHeaderExtensions, error) {
+	sdpDesc, err := desc.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+	result := map[entities.MediaType]entities.RTPHeaderExtensions{}
+
+	for _, desc := range sdpDesc.MediaDescriptions {
+		var mediaType entities.MediaType
+		if desc.MediaName.Media == "video" {
+			mediaType = entities.VideoType
+		} else if desc.MediaName.Media == "audio" {
+			mediaType = entities.AudioType
+		} else {
+			continue
+		}
+
+		extensions := entities.RTPHeaderExtensions{}
+		for _, a := range desc.Attributes {
+			if a.Key != "extmap" {
+				continue
+			}
+			// Samples:
+			// Key:extmap Value: 3 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time
+			// Key:extmap Value: 5/sendrecv http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01
+			fields := strings.Fields(a.Value)
+			if len(fields) < 2 {
+				continue
+			}
+			id, err := strconv.ParseUint(strings.Split(fields[0], "/")[0], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extmap %s: %w", a.Value, err)
+			}
+			extensions[fields[1]] = uint8(id)
+		}
+		result[mediaType] = extensions
+	}
+	return result, nil
+}
+
 func (m *Mapper) FromStreamInfoToEntityMessages(si *entities.StreamInfo) []entities.Message {
 	var result []entities.Message
 
@@ -130,17 +204,161 @@ func (m *Mapper) FromStreamToEntityMessage(st entities.Stream) entities.Message
 	}
 }
 
-func (m *Mapper) FromLibAVStreamToEntityStream(libavStream *astiav.Stream) entities.Stream {
-	st := entities.Stream{}
+func (m *Mapper) FromSessionExpiryToEntityMessage(remaining time.Duration) entities.Message {
+	return entities.Message{
+		Type:    entities.MessageTypeTeardown,
+		Message: fmt.Sprintf("the session ends in %s", remaining),
+	}
+}
 
-	if libavStream.CodecParameters().MediaType() == astiav.MediaTypeAudio {
-		st.Type = entities.AudioType
-	} else if libavStream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
-		st.Type = entities.VideoType
-	} else {
-		m.l.Info("[[[[TODO: mapper not implemented]]]] for ", libavStream.CodecParameters().MediaType())
-		st.Type = entities.UnknownType
+func (m *Mapper) FromStreamEndToEntityMessage() entities.Message {
+	return entities.Message{
+		Type:    entities.MessageTypeEnded,
+		Message: "the stream has ended",
 	}
+}
+
+func (m *Mapper) FromStreamErrorToEntityMessage(err error) entities.Message {
+	return entities.Message{
+		Type:    entities.MessageTypeError,
+		Message: fmt.Sprintf("the stream has failed: %s", err.Error()),
+	}
+}
+
+func (m *Mapper) FromWarningToEntityMessage(warning string) entities.Message {
+	return entities.Message{
+		Type:    entities.MessageTypeWarning,
+		Message: warning,
+	}
+}
+
+func (m *Mapper) FromPipelineEventToEntityMessage(e *entities.PipelineEvent) (entities.Message, error) {
+	event, err := json.Marshal(e)
+	if err != nil {
+		return entities.Message{}, err
+	}
+	return entities.Message{
+		Type:    entities.MessageTypePipeline,
+		Message: string(event),
+	}, nil
+}
+
+func (m *Mapper) FromCueToEntityMessage(cue *entities.Cue) (entities.Message, error) {
+	c, err := json.Marshal(cue)
+	if err != nil {
+		return entities.Message{}, err
+	}
+	return entities.Message{
+		Type:    entities.MessageTypeCue,
+		Message: string(c),
+	}, nil
+}
+
+func (m *Mapper) FromPosterToEntityMessage(jpeg []byte) entities.Message {
+	return entities.Message{
+		Type:    entities.MessageTypePoster,
+		Message: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(jpeg),
+	}
+}
+
+func (m *Mapper) FromTimecodeToEntityMessage(tc *entities.TimecodeInfo) (entities.Message, error) {
+	info, err := json.Marshal(tc)
+	if err != nil {
+		return entities.Message{}, err
+	}
+	return entities.Message{
+		Type:    entities.MessageTypeTimecode,
+		Message: string(info),
+	}, nil
+}
+
+func (m *Mapper) FromClockToEntityMessage(now time.Time, pipelineLatency time.Duration) (entities.Message, error) {
+	info, err := json.Marshal(entities.ClockInfo{
+		ServerTimeMS:      now.UnixMilli(),
+		PipelineLatencyMS: pipelineLatency.Milliseconds(),
+	})
+	if err != nil {
+		return entities.Message{}, err
+	}
+	return entities.Message{
+		Type:    entities.MessageTypeClock,
+		Message: string(info),
+	}, nil
+}
+
+func (m *Mapper) FromDonutRecipeToRecipeInfo(r entities.DonutRecipe) entities.RecipeInfo {
+	return entities.RecipeInfo{
+		InputURL:    r.Input.URL,
+		InputFormat: r.Input.Format,
+		Video:       m.FromDonutMediaTaskToMediaTaskInfo(r.Video),
+		Audio:       m.FromDonutMediaTaskToMediaTaskInfo(r.Audio),
+	}
+}
+
+func (m *Mapper) FromDonutMediaTaskToMediaTaskInfo(t entities.DonutMediaTask) entities.MediaTaskInfo {
+	info := entities.MediaTaskInfo{
+		Action:          t.Action,
+		Codec:           t.Codec,
+		FrameRate:       t.FrameRate,
+		PtimeMS:         t.PtimeMS,
+		StreamIndex:     t.StreamIndex,
+		ScalabilityMode: t.ScalabilityMode,
+		ContentType:     t.ContentType,
+		LatencyMode:     t.LatencyMode,
+		Deinterlace:     t.Deinterlace,
+		Height:          t.Height,
+		PreserveColor:   t.PreserveColor,
+		ColorRange:      t.ColorRange,
+		PixelFormat:     t.PixelFormat,
+		PrivateOptions:  t.PrivateOptions,
+	}
+	if t.DonutStreamFilter != nil {
+		info.Filter = string(*t.DonutStreamFilter)
+	}
+	for _, bsf := range t.DonutBitStreamFilters {
+		info.BitStreamFilters = append(info.BitStreamFilters, string(bsf))
+	}
+	return info
+}
+
+// FromLibAVOpenInputErrorToSourceError tells why libav failed to open the source, the error is returned
+// untouched when the cause is unknown. libav's libsrt returns the OS errno of a failed connection, or
+// AVERROR_UNKNOWN when there's none: it's how a listener rejecting the caller (SRT_ECONNREJ, ex: a wrong
+// passphrase or streamid) is reported, a listener that isn't running yields ECONNREFUSED.
+func (m *Mapper) FromLibAVOpenInputErrorToSourceError(err error, isSRT bool) error {
+	var cause error
+	switch {
+	case errors.Is(err, astiav.Error(-int(syscall.ECONNREFUSED))):
+		cause = entities.ErrSourceConnectionRefused
+	case errors.Is(err, astiav.Error(-int(syscall.EHOSTUNREACH))), errors.Is(err, astiav.Error(-int(syscall.ENETUNREACH))):
+		cause = entities.ErrSourceUnreachable
+	case errors.Is(err, astiav.ErrHttpUnauthorized), errors.Is(err, astiav.ErrHttpForbidden),
+		errors.Is(err, astiav.ErrEperm), errors.Is(err, astiav.Error(-int(syscall.EACCES))),
+		isSRT && errors.Is(err, astiav.ErrUnknown):
+		cause = entities.ErrSourceRejected
+	case errors.Is(err, astiav.ErrHttpNotFound), errors.Is(err, astiav.Error(-int(syscall.ENOENT))):
+		cause = entities.ErrSourceNotFound
+	case errors.Is(err, astiav.ErrEtimedout):
+		cause = entities.ErrSourceTimeout
+	default:
+		return err
+	}
+	return &entities.SourceOpenError{Cause: cause, Err: err}
+}
+
+func (m *Mapper) FromLibAVMediaTypeToEntityMediaType(mediaType astiav.MediaType) entities.MediaType {
+	if mediaType == astiav.MediaTypeAudio {
+		return entities.AudioType
+	} else if mediaType == astiav.MediaTypeVideo {
+		return entities.VideoType
+	}
+	m.l.Info("[[[[TODO: mapper not implemented]]]] for ", mediaType)
+	return entities.UnknownType
+}
+
+func (m *Mapper) FromLibAVStreamToEntityStream(libavStream *astiav.Stream) entities.Stream {
+	st := entities.Stream{}
+	st.Type = m.FromLibAVMediaTypeToEntityMediaType(libavStream.CodecParameters().MediaType())
 
 	// https://github.com/FFmpeg/FFmpeg/blob/master/libavcodec/codec_desc.c#L34
 	if libavStream.CodecParameters().CodecID().Name() == "h264" {
@@ -164,12 +382,93 @@ func (m *Mapper) FromLibAVStreamToEntityStream(libavStream *astiav.Stream) entit
 		st.Codec = entities.UnknownCodec
 	}
 
+	if st.Codec == entities.H264 {
+		st.ParameterSets = entities.H264ParameterSets(libavStream.CodecParameters().ExtraData())
+	}
+
 	st.Id = uint16(libavStream.ID())
 	st.Index = uint16(libavStream.Index())
 
+	transfer := libavStream.CodecParameters().ColorTransferCharacteristic()
+	st.HDR = st.Type == entities.VideoType &&
+		(transfer == astiav.ColorTransferCharacteristicSmpte2084 || transfer == astiav.ColorTransferCharacteristicAribStdB67)
+
+	if st.Type == entities.VideoType {
+		st.ColorPrimaries = m.FromLibAVColorPrimariesToString(libavStream.CodecParameters().ColorPrimaries())
+		st.ColorTransfer = m.FromLibAVColorTransferToString(transfer)
+		st.ColorSpace = m.FromLibAVColorSpaceToString(libavStream.CodecParameters().ColorSpace())
+		st.Width = libavStream.CodecParameters().Width()
+		st.Height = libavStream.CodecParameters().Height()
+	}
+	if st.Type == entities.AudioType {
+		st.SampleRate = libavStream.CodecParameters().SampleRate()
+		st.Channels = libavStream.CodecParameters().Channels()
+	}
+
 	return st
 }
 
+// FromLibAVColorPrimariesToString names the common color primaries, empty when they're unspecified.
+func (m *Mapper) FromLibAVColorPrimariesToString(p astiav.ColorPrimaries) string {
+	switch p {
+	case astiav.ColorPrimariesBt709:
+		return "BT.709"
+	case astiav.ColorPrimariesBt2020:
+		return "BT.2020"
+	case astiav.ColorPrimariesBt470Bg, astiav.ColorPrimariesSmpte170M:
+		return "BT.601"
+	case astiav.ColorPrimariesSmpte431:
+		return "DCI-P3"
+	case astiav.ColorPrimariesSmpte432:
+		return "Display P3"
+	case astiav.ColorPrimariesUnspecified, astiav.ColorPrimariesReserved0, astiav.ColorPrimariesReserved:
+		return ""
+	}
+	return fmt.Sprintf("primaries %d", p)
+}
+
+// FromLibAVColorTransferToString names the common transfer characteristics, empty when it's unspecified.
+func (m *Mapper) FromLibAVColorTransferToString(t astiav.ColorTransferCharacteristic) string {
+	switch t {
+	case astiav.ColorTransferCharacteristicSmpte2084:
+		return "PQ"
+	case astiav.ColorTransferCharacteristicAribStdB67:
+		return "HLG"
+	case astiav.ColorTransferCharacteristicBt709, astiav.ColorTransferCharacteristicBt202010, astiav.ColorTransferCharacteristicBt202012:
+		return "BT.709"
+	case astiav.ColorTransferCharacteristicSmpte170M:
+		return "BT.601"
+	case astiav.ColorTransferCharacteristicIec6196621:
+		return "sRGB"
+	case astiav.ColorTransferCharacteristicLinear:
+		return "linear"
+	case astiav.ColorTransferCharacteristicUnspecified, astiav.ColorTransferCharacteristicReserved0, astiav.ColorTransferCharacteristicReserved:
+		return ""
+	}
+	return fmt.Sprintf("transfer %d", t)
+}
+
+// FromLibAVColorSpaceToString names the common color spaces (matrix coefficients), empty when it's unspecified.
+func (m *Mapper) FromLibAVColorSpaceToString(s astiav.ColorSpace) string {
+	switch s {
+	case astiav.ColorSpaceBt709:
+		return "BT.709"
+	case astiav.ColorSpaceBt2020Ncl:
+		return "BT.2020 NCL"
+	case astiav.ColorSpaceBt2020Cl:
+		return "BT.2020 CL"
+	case astiav.ColorSpaceBt470Bg, astiav.ColorSpaceSmpte170M:
+		return "BT.601"
+	case astiav.ColorSpaceIctcp:
+		return "ICtCp"
+	case astiav.ColorSpaceRgb:
+		return "RGB"
+	case astiav.ColorSpaceUnspecified, astiav.ColorSpaceReserved:
+		return ""
+	}
+	return fmt.Sprintf("colorspace %d", s)
+}
+
 func (m *Mapper) FromStreamCodecToLibAVCodecID(codec entities.Codec) (astiav.CodecID, error) {
 	if codec == entities.H264 {
 		return astiav.CodecIDH264, nil
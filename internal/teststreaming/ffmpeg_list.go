@@ -19,6 +19,7 @@ var ffmpeg_input = `
 `
 
 // OUTPUT PORTS: the output port must be different for each ffmpeg case so it might run in parallel
+// ffmpeg listens on the output port, donut pulls from it in caller mode
 var outputPort = 45678
 
 var FFMPEG_LIVE_SRT_MPEG_TS_H264_AAC = testFFmpeg{
@@ -31,7 +32,7 @@ var FFMPEG_LIVE_SRT_MPEG_TS_H264_AAC = testFFmpeg{
 		{Index: 0, Id: uint16(256), Codec: entities.H264, Type: entities.VideoType},
 		{Index: 1, Id: uint16(257), Codec: entities.AAC, Type: entities.AudioType},
 	},
-	output: entities.RequestParams{StreamURL: fmt.Sprintf("srt://127.0.0.1:%d", outputPort+0), StreamID: "stream-id"},
+	output: entities.RequestParams{StreamURL: fmt.Sprintf("srt://127.0.0.1:%d?mode=caller", outputPort+0), StreamID: "stream-id"},
 }
 
 // ref https://x265.readthedocs.io/en/stable/cli.html#executable-options
@@ -45,5 +46,5 @@ var FFMPEG_LIVE_SRT_MPEG_TS_H265_AAC = testFFmpeg{
 		{Index: 0, Id: uint16(256), Codec: entities.H265, Type: entities.VideoType},
 		{Index: 1, Id: uint16(257), Codec: entities.AAC, Type: entities.AudioType},
 	},
-	output: entities.RequestParams{StreamURL: fmt.Sprintf("srt://127.0.0.1:%d", outputPort+1), StreamID: "stream-id"},
+	output: entities.RequestParams{StreamURL: fmt.Sprintf("srt://127.0.0.1:%d?mode=caller", outputPort+1), StreamID: "stream-id"},
 }
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	whepSessionPrefix = "/whep/"
+	sessionPrefix     = "/session/"
+)
+
+// statusRecorder keeps the status code written by the handler, it's 200 when nothing is written explicitly.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// accessLog records one structured line per request, the session id is taken from the
+// WHEP or session resource, either requested (ex: PATCH/DELETE) or created (Location header).
+func accessLog(l *zap.SugaredLogger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		l.Infow("access",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", time.Since(started),
+			"remoteAddr", r.RemoteAddr,
+			"sessionID", sessionIDFor(r, recorder.Header()),
+		)
+	})
+}
+
+func sessionIDFor(r *http.Request, header http.Header) string {
+	for _, prefix := range []string{whepSessionPrefix, sessionPrefix} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+			return id
+		}
+	}
+	if location := header.Get("Location"); strings.HasPrefix(location, whepSessionPrefix) {
+		return strings.TrimPrefix(location, whepSessionPrefix)
+	}
+	return ""
+}
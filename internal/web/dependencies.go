@@ -33,25 +33,37 @@ func Dependencies(enableICEMux bool) fx.Option {
 		// Track Manager for WebRTC
 		fx.Provide(handlers.NewTrackManager),
 
+		// Session Manager for WHEP viewers
+		fx.Provide(handlers.NewSessionManager),
+		fx.Provide(handlers.NewSharedStreamRegistry),
+
 		// HTTP handlers
 		fx.Provide(handlers.NewSignalingHandler),
 		fx.Provide(handlers.NewIndexHandler),
 		fx.Provide(handlers.NewWHEPHandler),
 		fx.Provide(handlers.NewWHIPHandler),
+		fx.Provide(handlers.NewSessionHandler),
 
 		// ICE mux servers
 		fx.Provide(controllers.NewTCPICEServer),
 		fx.Provide(controllers.NewUDPICEServer),
+		fx.Provide(controllers.NewDSCPMarker),
+		fx.Provide(controllers.NewICETCPMux),
+		fx.Provide(controllers.NewICEUDPMux),
 
 		// Controllers
 		fx.Provide(controllers.NewWebRTCController),
 		fx.Provide(controllers.NewWebRTCSettingsEngine),
 		fx.Provide(controllers.NewWebRTCMediaEngine),
 		fx.Provide(controllers.NewWebRTCAPI),
+		fx.Provide(controllers.NewSDPRewriter),
+		fx.Provide(controllers.NewAuthorizer),
+		fx.Provide(controllers.NewSRTStreamIDs),
 		fx.Provide(streamers.NewLibAVFFmpegStreamer),
 		fx.Provide(probers.NewLibAVFFmpeg),
 
 		fx.Provide(engine.NewDonutEngineController),
+		fx.Invoke(engine.RegisterSelfCheck),
 
 		// Mappers
 		fx.Provide(mapper.NewMapper),
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// bitrateWindow is the period the bit rate is averaged over.
+const bitrateWindow = time.Second
+
+// bitrateMeter measures the bit rate of the written frames over bitrateWindow.
+type bitrateMeter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	bytes       int64
+	bitrate     int64
+}
+
+func (m *bitrateMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+	m.bytes += int64(n)
+	if elapsed := now.Sub(m.windowStart); elapsed >= bitrateWindow {
+		m.bitrate = m.bytes * 8 * int64(time.Second) / int64(elapsed)
+		m.bytes = 0
+		m.windowStart = now
+	}
+}
+
+// Bitrate returns the bits per second of the last window, 0 once the frames stop.
+func (m *bitrateMeter) Bitrate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.windowStart) > 2*bitrateWindow {
+		return 0
+	}
+	return m.bitrate
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/pion/transport/v3"
+	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/webrtc/v4"
+)
+
+// dscpNet marks the packets of the UDP sockets the pion v4 ICE agents listen on outside the shared UDP mux
+// (ex: the srflx candidates), the mux socket is marked by controllers.NewUDPICEServer.
+type dscpNet struct {
+	transport.Net
+	dscp *controllers.DSCPMarker
+}
+
+func newDSCPNet(dscp *controllers.DSCPMarker) (*dscpNet, error) {
+	n, err := stdnet.NewNet()
+	if err != nil {
+		return nil, err
+	}
+	return &dscpNet{Net: n, dscp: dscp}, nil
+}
+
+func (n *dscpNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &dscpUDPConn{UDPConn: conn, s: n.dscp.NewSocket()}, nil
+}
+
+type dscpUDPConn struct {
+	transport.UDPConn
+	s *controllers.DSCPSocket
+}
+
+func (c *dscpUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.s.WriteTo(c.UDPConn, b, addr)
+}
+
+// trackDSCP marks the packets of the peer's senders, the returned func stops it once the peer is closed.
+func trackDSCP(dscp *controllers.DSCPMarker, senders ...*webrtc.RTPSender) (untrack func()) {
+	var video, audio []uint32
+	for _, sender := range senders {
+		if sender == nil || sender.Track() == nil {
+			continue
+		}
+		for _, e := range sender.GetParameters().Encodings {
+			if sender.Track().Kind() == webrtc.RTPCodecTypeAudio {
+				audio = append(audio, uint32(e.SSRC))
+			} else {
+				video = append(video, uint32(e.SSRC))
+			}
+		}
+	}
+	return dscp.TrackSSRCs(video, audio)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// keyFrameRequests tracks the key frame requests (PLI or FIR) of the viewers. A bypassed video can't
+// produce a key frame on demand, the viewers (ex: late joiners or after a loss) wait for the source's next one.
+type keyFrameRequests struct {
+	mu    sync.Mutex
+	total int64
+	// waiting are the viewers since their first request not followed by a key frame
+	waiting map[string]time.Time
+	// warned is set once the current wait was reported
+	warned bool
+}
+
+// request records a viewer's request, it returns how long the oldest waiting viewer has been waiting and
+// whether it's the first time the wait exceeds maxWait (0 never reports it).
+func (k *keyFrameRequests) request(sessionID string, now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.total++
+	if k.waiting == nil {
+		k.waiting = map[string]time.Time{}
+	}
+	if _, ok := k.waiting[sessionID]; !ok {
+		k.waiting[sessionID] = now
+	}
+	wait := k.longestWait(now)
+	if maxWait <= 0 || wait <= maxWait || k.warned {
+		return wait, false
+	}
+	k.warned = true
+	return wait, true
+}
+
+// keyFrame releases the waiting viewers, it returns how many were waiting and the longest wait.
+func (k *keyFrameRequests) keyFrame(now time.Time) (int, time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	waiting, wait := len(k.waiting), k.longestWait(now)
+	k.waiting = nil
+	k.warned = false
+	return waiting, wait
+}
+
+// leave forgets a viewer, it's no longer waiting.
+func (k *keyFrameRequests) leave(sessionID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.waiting, sessionID)
+}
+
+// Stats returns the requests so far and the viewers currently waiting for a key frame.
+func (k *keyFrameRequests) Stats() (total int64, waiting int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.total, len(k.waiting)
+}
+
+func (k *keyFrameRequests) longestWait(now time.Time) time.Duration {
+	var wait time.Duration
+	for _, since := range k.waiting {
+		if d := now.Sub(since); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyFrameRequests(t *testing.T) {
+	k := &keyFrameRequests{}
+	start := time.Now()
+	maxWait := 2 * time.Second
+
+	wait, exceeded := k.request("a", start, maxWait)
+	assert.Zero(t, wait)
+	assert.False(t, exceeded)
+	// the wait is the oldest viewer's one
+	wait, exceeded = k.request("b", start.Add(time.Second), maxWait)
+	assert.Equal(t, time.Second, wait)
+	assert.False(t, exceeded)
+
+	// the exceeded wait is reported once
+	wait, exceeded = k.request("a", start.Add(3*time.Second), maxWait)
+	assert.Equal(t, 3*time.Second, wait)
+	assert.True(t, exceeded)
+	_, exceeded = k.request("b", start.Add(4*time.Second), maxWait)
+	assert.False(t, exceeded)
+
+	total, waiting := k.Stats()
+	assert.Equal(t, int64(4), total)
+	assert.Equal(t, 2, waiting)
+
+	// a viewer leaving isn't waiting anymore
+	k.leave("b")
+	_, waiting = k.Stats()
+	assert.Equal(t, 1, waiting)
+
+	// the key frame releases the waiting viewers, the next long wait is reported again
+	waiting, wait = k.keyFrame(start.Add(5 * time.Second))
+	assert.Equal(t, 1, waiting)
+	assert.Equal(t, 5*time.Second, wait)
+	total, waiting = k.Stats()
+	assert.Equal(t, int64(4), total)
+	assert.Zero(t, waiting)
+
+	k.request("c", start.Add(6*time.Second), maxWait)
+	_, exceeded = k.request("c", start.Add(9*time.Second), maxWait)
+	assert.True(t, exceeded)
+
+	// a zero maximum wait never reports it
+	unreported := &keyFrameRequests{}
+	unreported.request("a", start, 0)
+	_, exceeded = unreported.request("a", start.Add(time.Minute), 0)
+	assert.False(t, exceeded)
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// latencySmoothing is the weight of a new sample in the moving average.
+const latencySmoothing = 0.1
+
+// latencyMeter averages the pipeline latency of the written frames.
+type latencyMeter struct {
+	mu      sync.Mutex
+	latency time.Duration
+}
+
+func (m *latencyMeter) add(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.latency == 0 {
+		m.latency = d
+		return
+	}
+	m.latency += time.Duration(latencySmoothing * float64(d-m.latency))
+}
+
+// Latency returns the average latency, 0 while it's unknown.
+func (m *latencyMeter) Latency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latency
+}
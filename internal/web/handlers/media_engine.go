@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// newPeerConnectionConfiguration is controllers.PeerConnectionConfiguration for the pion v4 peer connections.
+func newPeerConnectionConfiguration(c *entities.Config) (webrtc.Configuration, error) {
+	configuration := webrtc.Configuration{}
+	v3, err := controllers.PeerConnectionConfiguration(c, !c.EnableICEMux)
+	if err != nil {
+		return configuration, err
+	}
+	configuration.ICETransportPolicy = webrtc.NewICETransportPolicy(v3.ICETransportPolicy.String())
+	for _, server := range v3.ICEServers {
+		configuration.ICEServers = append(configuration.ICEServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return configuration, nil
+}
+
+// whipVideoCodecs are the codecs a publisher may send, the ingest relays H264 only (see tracks.go).
+var whipVideoCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 96},
+}
+
+// whepVideoCodecs are the codecs the engine may stream to a viewer, their fmtp match the tracks' ones
+// (mapper.FromTrackToRTPCodecCapability).
+var whepVideoCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}, PayloadType: 96},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 97},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}, PayloadType: 98},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000}, PayloadType: 99},
+}
+
+// videoCodecsOf returns the entities codecs of the registered ones.
+func videoCodecsOf(params []webrtc.RTPCodecParameters) []entities.Codec {
+	mimeTypes := map[string]entities.Codec{
+		webrtc.MimeTypeH264: entities.H264,
+		webrtc.MimeTypeVP8:  entities.VP8,
+		webrtc.MimeTypeVP9:  entities.VP9,
+		webrtc.MimeTypeAV1:  entities.AV1,
+	}
+	var result []entities.Codec
+	for _, p := range params {
+		if codec, ok := mimeTypes[p.MimeType]; ok {
+			result = append(result, codec)
+		}
+	}
+	return result
+}
+
+// newAPI creates a pion API supporting the video codecs and Opus with the configured RTCP feedback,
+// along with the interceptors required to honor it (nack, transport-cc and RTCP reports).
+// The ICE candidates are served by the muxes shared with the signaling API, the UDP packets are marked by dscp.
+func newAPI(c *entities.Config, videoCodecs []webrtc.RTPCodecParameters, tcpMux controllers.ICETCPMux, udpMux controllers.ICEUDPMux, dscp *controllers.DSCPMarker, factories ...interceptor.Factory) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	videoFeedback := rtcpFeedbackFrom(c.VideoRTCPFeedback)
+	audioFeedback := rtcpFeedbackFrom(c.AudioRTCPFeedback)
+
+	for _, codec := range videoCodecs {
+		codec.RTCPFeedback = videoFeedback
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("failed to register video codec %s: %w", codec.MimeType, err)
+		}
+	}
+
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeOpus,
+			ClockRate:    48000,
+			Channels:     2,
+			SDPFmtpLine:  "minptime=10;useinbandfec=1",
+			RTCPFeedback: audioFeedback,
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register audio codec: %w", err)
+	}
+
+	i := &interceptor.Registry{}
+	for _, f := range factories {
+		i.Add(f)
+	}
+
+	// webrtc.RegisterDefaultInterceptors is not used since it forces its own feedback for every codec
+	if hasRTCPFeedback(videoFeedback, webrtc.TypeRTCPFBNACK) || hasRTCPFeedback(audioFeedback, webrtc.TypeRTCPFBNACK) {
+		generator, err := nack.NewGeneratorInterceptor()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create nack generator: %w", err)
+		}
+		responder, err := nack.NewResponderInterceptor()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create nack responder: %w", err)
+		}
+		i.Add(generator)
+		i.Add(responder)
+	}
+
+	for codecType, feedback := range map[webrtc.RTPCodecType][]webrtc.RTCPFeedback{
+		webrtc.RTPCodecTypeVideo: videoFeedback,
+		webrtc.RTPCodecTypeAudio: audioFeedback,
+	} {
+		if !hasRTCPFeedback(feedback, webrtc.TypeRTCPFBTransportCC) {
+			continue
+		}
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, codecType); err != nil {
+			return nil, fmt.Errorf("failed to register transport-cc extension: %w", err)
+		}
+	}
+	if hasRTCPFeedback(videoFeedback, webrtc.TypeRTCPFBTransportCC) || hasRTCPFeedback(audioFeedback, webrtc.TypeRTCPFBTransportCC) {
+		generator, err := twcc.NewSenderInterceptor()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create twcc interceptor: %w", err)
+		}
+		i.Add(generator)
+	}
+
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return nil, fmt.Errorf("failed to register RTCP reports: %w", err)
+	}
+
+	s := webrtc.SettingEngine{}
+	v3NetworkTypes, err := controllers.WebRTCNetworkTypes(c)
+	if err != nil {
+		return nil, err
+	}
+	var networkTypes []webrtc.NetworkType
+	for _, v3NetworkType := range v3NetworkTypes {
+		networkType, err := webrtc.NewNetworkType(v3NetworkType.String())
+		if err != nil {
+			return nil, err
+		}
+		networkTypes = append(networkTypes, networkType)
+	}
+	s.SetNetworkTypes(networkTypes)
+	s.SetICETCPMux(tcpMux)
+	s.SetICEUDPMux(udpMux)
+	if dscp.Enabled() {
+		n, err := newDSCPNet(dscp)
+		if err != nil {
+			return nil, err
+		}
+		s.SetNet(n)
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s)), nil
+}
+
+// rtcpFeedbackFrom maps feedback such as "nack", "nack pli" or "transport-cc" to pion's RTCPFeedback.
+func rtcpFeedbackFrom(feedbacks []string) []webrtc.RTCPFeedback {
+	var result []webrtc.RTCPFeedback
+	for _, f := range feedbacks {
+		fields := strings.Fields(f)
+		if len(fields) == 0 {
+			continue
+		}
+		result = append(result, webrtc.RTCPFeedback{
+			Type:      fields[0],
+			Parameter: strings.Join(fields[1:], " "),
+		})
+	}
+	return result
+}
+
+func hasRTCPFeedback(feedbacks []webrtc.RTCPFeedback, feedbackType string) bool {
+	for _, f := range feedbacks {
+		if f.Type == feedbackType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// offerOnly creates a browser-like offer receiving the codec only.
+func offerOnly(t *testing.T, codec webrtc.RTPCodecParameters) webrtc.SessionDescription {
+	m := &webrtc.MediaEngine{}
+	require.NoError(t, m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo))
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+	return offer
+}
+
+func TestNewAPINegotiatesWHEPVideoCodecs(t *testing.T) {
+	c := &entities.Config{VideoRTCPFeedback: []string{"nack", "nack pli"}}
+
+	for _, tt := range []struct {
+		codec entities.Codec
+		offer webrtc.RTPCodecParameters
+	}{
+		{entities.H264, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}, PayloadType: 102}},
+		{entities.VP8, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96}},
+		{entities.VP9, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}, PayloadType: 98}},
+		{entities.AV1, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000}, PayloadType: 45}},
+	} {
+		t.Run(string(tt.codec), func(t *testing.T) {
+			api, err := newAPI(c, whepVideoCodecs, nil, nil, &controllers.DSCPMarker{})
+			require.NoError(t, err)
+			pc, err := api.NewPeerConnection(webrtc.Configuration{})
+			require.NoError(t, err)
+			defer pc.Close()
+
+			track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: tt.offer.MimeType, SDPFmtpLine: tt.offer.SDPFmtpLine}, "video", "donut")
+			require.NoError(t, err)
+			sender, err := pc.AddTrack(track)
+			require.NoError(t, err)
+			require.NoError(t, pc.SetRemoteDescription(offerOnly(t, tt.offer)))
+			_, err = pc.CreateAnswer(nil)
+			require.NoError(t, err)
+
+			codecs := sender.GetParameters().Codecs
+			require.Len(t, codecs, 1)
+			assert.Equal(t, tt.offer.MimeType, codecs[0].MimeType)
+			assert.Equal(t, tt.offer.PayloadType, codecs[0].PayloadType)
+			assert.True(t, hasRTCPFeedback(codecs[0].RTCPFeedback, webrtc.TypeRTCPFBNACK))
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// negotiatedCodecs returns the codec selected for each transceiver, ex: video/H264.
+func negotiatedCodecs(peerConnection *webrtc.PeerConnection) []string {
+	var codecs []string
+	for _, t := range peerConnection.GetTransceivers() {
+		if t.Sender() == nil {
+			continue
+		}
+		if params := t.Sender().GetParameters().Codecs; len(params) > 0 {
+			codecs = append(codecs, params[0].MimeType)
+		}
+	}
+	return codecs
+}
+
+// codecTrack is a local track with a fixed codec, ex: webrtc.TrackLocalStaticRTP.
+type codecTrack interface {
+	Codec() webrtc.RTPCodecCapability
+}
+
+// verifyNegotiatedTracks fails when a track is missing from the answer or the client didn't accept its codec,
+// otherwise the samples written to it go nowhere (ex: a black screen).
+func verifyNegotiatedTracks(peerConnection *webrtc.PeerConnection) error {
+	for _, t := range peerConnection.GetTransceivers() {
+		if t.Sender() == nil || t.Sender().Track() == nil {
+			continue
+		}
+		track, ok := t.Sender().Track().(codecTrack)
+		if !ok {
+			continue
+		}
+		mimeType := track.Codec().MimeType
+		if t.Mid() == "" {
+			return fmt.Errorf("%w: %s has no media section in the offer", entities.ErrTrackNotNegotiated, mimeType)
+		}
+
+		accepted := false
+		for _, codec := range t.Sender().GetParameters().Codecs {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return fmt.Errorf("%w: %s(mid=%s) %s", entities.ErrTrackNotNegotiated, t.Kind(), t.Mid(), mimeType)
+		}
+	}
+	return nil
+}
+
+// logSDP logs a session description when Config.LogSDP is enabled, ex: kind "offer". The "sdp" logger
+// writes it at debug level, the application's level is kept.
+func logSDP(c *entities.Config, l *zap.SugaredLogger, endpoint, kind, sdp string) {
+	if !c.LogSDP {
+		return
+	}
+	controllers.NewDebugLogger(l, "sdp").Debugw("sdp", "endpoint", endpoint, "kind", kind, "sdp", sdp)
+}
+
+// negotiatedMedia returns the codec selected for each transceiver, sent (WHEP) or received (WHIP),
+// see controllers.LogNegotiatedMedia.
+func negotiatedMedia(peerConnection *webrtc.PeerConnection) []controllers.NegotiatedMedia {
+	var media []controllers.NegotiatedMedia
+	for _, t := range peerConnection.GetTransceivers() {
+		var codecs []webrtc.RTPCodecParameters
+		if t.Sender() != nil {
+			codecs = t.Sender().GetParameters().Codecs
+		} else if t.Receiver() != nil {
+			codecs = t.Receiver().GetParameters().Codecs
+		}
+
+		m := controllers.NegotiatedMedia{Kind: t.Kind().String(), Mid: t.Mid()}
+		if len(codecs) > 0 {
+			m.MimeType, m.ClockRate, m.PayloadType = codecs[0].MimeType, codecs[0].ClockRate, uint8(codecs[0].PayloadType)
+		}
+		media = append(media, m)
+	}
+	return media
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/controllers/muxers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"go.uber.org/zap"
+)
+
+// recordingFormatFor returns the container of the request's recording.
+func recordingFormatFor(c *entities.Config, params *entities.RequestParams) (entities.RecordingFormat, error) {
+	format := c.RecordingFormat
+	if params.RecordingFormat != "" {
+		format = params.RecordingFormat
+	}
+	if !format.Valid() {
+		return "", fmt.Errorf("%w: %s", entities.ErrInvalidRecordingFormat, format)
+	}
+	return format, nil
+}
+
+// recordingPathFor returns the recording file of a stream, empty when recording is disabled.
+func recordingPathFor(c *entities.Config, streamID string, format entities.RecordingFormat, now time.Time) string {
+	if c.RecordingDir == "" {
+		return ""
+	}
+	return filepath.Join(c.RecordingDir, fmt.Sprintf("%s-%d.%s", pathName(streamID), now.Unix(), format.Extension()))
+}
+
+// hlsDirFor returns the HLS directory of a stream, empty when HLS is disabled, it's served under /hls/ as well.
+func hlsDirFor(c *entities.Config, streamID string) string {
+	if c.HLSDir == "" {
+		return ""
+	}
+	return filepath.Join(c.HLSDir, pathName(streamID))
+}
+
+// pathName reduces the stream id to letters, digits, '-' and '_' so that it can't escape the
+// directory it's joined to (ex: ../../etc).
+func pathName(streamID string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, streamID)
+}
+
+// newOutputs opens the outputs fed with the encoded packets besides WebRTC: the recording, when
+// recordingPath isn't empty, the HLS stream, when hlsDir isn't empty, and the relay (ex: an RTMP ingest).
+// It returns nil when there's none.
+func newOutputs(c *entities.Config, l *zap.SugaredLogger, params *entities.RequestParams, recordingPath string, recordingFormat entities.RecordingFormat, hlsDir string) (entities.DonutMuxer, error) {
+	reorderWindow := time.Duration(c.MuxerReorderWindowMS) * time.Millisecond
+
+	var outputs []entities.DonutMuxer
+	closeOutputs := func() {
+		for _, o := range outputs {
+			o.Close()
+		}
+	}
+
+	if recordingPath != "" {
+		recorder, err := muxers.NewLibAVFFmpegMuxer(l, recordingPath, recordingFormat.MuxerName(), reorderWindow)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, recorder)
+	}
+
+	if hlsDir != "" {
+		hls, err := muxers.NewHLSMuxer(l, hlsDir, time.Duration(c.HLSSegmentMS)*time.Millisecond, reorderWindow)
+		if err != nil {
+			closeOutputs()
+			return nil, err
+		}
+		l.Infow("publishing the stream as HLS", "dir", hlsDir)
+		outputs = append(outputs, hls)
+	}
+
+	if relayURL := entities.RelayURLOf(c, params); relayURL != "" {
+		relay, err := muxers.NewLibAVFFmpegMuxer(l, relayURL, "", reorderWindow)
+		if err != nil {
+			closeOutputs()
+			return nil, err
+		}
+		l.Infow("relaying the stream", "url", entities.RedactURL(relayURL))
+		outputs = append(outputs, relay)
+	}
+
+	if len(outputs) == 0 {
+		return nil, nil
+	}
+	return muxers.NewMultiMuxer(l, outputs...), nil
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordingPathFor(t *testing.T) {
+	c := &entities.Config{RecordingDir: "/recordings"}
+	now := time.Unix(1700000000, 0)
+
+	assert.Equal(t, "/recordings/live-1700000000.mp4", recordingPathFor(c, "live", entities.RecordingFormatMP4, now))
+	// the stream id can't escape the recordings directory
+	assert.Equal(t, "/recordings/______etc_passwd-1700000000.mp4", recordingPathFor(c, "../../etc/passwd", entities.RecordingFormatMP4, now))
+	assert.Empty(t, recordingPathFor(&entities.Config{}, "live", entities.RecordingFormatMP4, now))
+}
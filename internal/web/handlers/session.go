@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"go.uber.org/zap"
+)
+
+// SessionHandler exposes the state of the running WHEP sessions (GET /session/{id}), their poster
+// (GET /session/{id}/poster) and controls them (POST /session/{id}/bitrate and POST /session/{id}/filter).
+// The viewers asking for the same media share a pipeline (see SharedStreamKey), a session only controls it
+// while it's its single viewer, otherwise it fails with 409 (entities.ErrStreamShared).
+type SessionHandler struct {
+	c        *entities.Config
+	l        *zap.SugaredLogger
+	mapper   *mapper.Mapper
+	sessions *SessionManager
+}
+
+func NewSessionHandler(
+	c *entities.Config,
+	log *zap.SugaredLogger,
+	mapper *mapper.Mapper,
+	sessions *SessionManager,
+) *SessionHandler {
+	return &SessionHandler{
+		c:        c,
+		l:        log,
+		mapper:   mapper,
+		sessions: sessions,
+	}
+}
+
+func (h *SessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	isBitRate := strings.HasSuffix(r.URL.Path, "/bitrate")
+	isPoster := strings.HasSuffix(r.URL.Path, "/poster")
+	isFilter := strings.HasSuffix(r.URL.Path, "/filter")
+	id := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(r.URL.Path, "/bitrate"), "/poster"), "/filter")
+	session, err := h.sessionFor(id)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case isBitRate && r.Method == http.MethodPost:
+		return h.updateBitRate(w, r, session)
+	case isFilter && r.Method == http.MethodPost:
+		return h.updateFilter(w, r, session)
+	case isPoster && r.Method == http.MethodGet:
+		return h.poster(w, session)
+	case !isBitRate && !isPoster && !isFilter && r.Method == http.MethodGet:
+		return h.describe(w, session)
+	}
+	return entities.ErrHTTPMethodNotAllowed
+}
+
+// bitRateRequest is the body of POST /session/{id}/bitrate, the media type defaults to video
+type bitRateRequest struct {
+	MediaType entities.MediaType
+	BitRate   int64
+}
+
+func (h *SessionHandler) updateBitRate(w http.ResponseWriter, r *http.Request, session *Session) error {
+	req := bitRateRequest{MediaType: entities.VideoType}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("%w: %s", entities.ErrInvalidRequestBody, err)
+	}
+	if req.BitRate <= 0 {
+		return entities.ErrInvalidBitRate
+	}
+
+	if err := session.UpdateBitRate(r.Context(), req.MediaType, req.BitRate); err != nil {
+		return err
+	}
+	h.l.Infow("session bit rate updated", "id", session.ID, "mediaType", req.MediaType, "bitRate", req.BitRate)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// filterRequest is the body of POST /session/{id}/filter, the media type defaults to video.
+// An empty filter removes the current one.
+type filterRequest struct {
+	MediaType entities.MediaType
+	Filter    entities.DonutStreamFilter
+}
+
+func (h *SessionHandler) updateFilter(w http.ResponseWriter, r *http.Request, session *Session) error {
+	req := filterRequest{MediaType: entities.VideoType}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return fmt.Errorf("%w: %s", entities.ErrInvalidRequestBody, err)
+	}
+
+	if err := session.UpdateFilter(r.Context(), req.MediaType, req.Filter); err != nil {
+		return err
+	}
+	h.l.Infow("session filter updated", "id", session.ID, "mediaType", req.MediaType, "filter", req.Filter)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// poster serves the first video key frame, the viewer shows it while the connection is set up.
+func (h *SessionHandler) poster(w http.ResponseWriter, session *Session) error {
+	if session.Stream == nil {
+		return entities.ErrMissingPoster
+	}
+	poster := session.Stream.Poster()
+	if poster == nil {
+		return entities.ErrMissingPoster
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(poster)
+	return err
+}
+
+func (h *SessionHandler) describe(w http.ResponseWriter, session *Session) error {
+	info := entities.SessionInfo{
+		ID:               session.ID,
+		NegotiatedCodecs: negotiatedCodecs(session.PeerConnection),
+		Uptime:           time.Since(session.CreatedAt).Round(time.Second).String(),
+	}
+	if stream := session.Stream; stream != nil {
+		info.StreamKey = stream.Key
+		info.Viewers = stream.Viewers()
+		info.Recipe = h.mapper.FromDonutRecipeToRecipeInfo(stream.Recipe)
+		info.VideoBitRate, info.AudioBitRate = stream.Bitrates()
+		info.PipelineLatencyMS = stream.PipelineLatency().Milliseconds()
+		info.KeyFrameRequests, info.ViewersAwaitingKeyFrame = stream.KeyFrameRequests()
+		info.Pipeline = stream.PipelineEvents()
+		if stream.Source != nil {
+			info.Source = stream.Source.Streams
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	return json.NewEncoder(w).Encode(info)
+}
+
+func (h *SessionHandler) sessionFor(path string) (*Session, error) {
+	id := strings.TrimPrefix(path, "/session/")
+	if id == "" || id == path {
+		return nil, entities.ErrMissingSession
+	}
+
+	session, ok := h.sessions.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", entities.ErrMissingSession, id)
+	}
+	return session, nil
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSessionHandlerUpdateFilter(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	sessions := NewSessionManager(&entities.Config{}, l, mapper.NewMapper(l))
+	stream := newTestSharedStream(t, "key", func() {})
+	sessions.sessions["abc"] = &Session{ID: "abc", Stream: stream}
+	h := NewSessionHandler(&entities.Config{}, l, mapper.NewMapper(l), sessions)
+
+	// the pipeline applies the update
+	updates := make(chan entities.DonutFilterUpdate, 1)
+	go func() {
+		u := <-stream.FilterUpdates
+		updates <- u
+		u.Done <- nil
+	}()
+
+	w := httptest.NewRecorder()
+	body := strings.NewReader(`{"Filter": "drawtext=text=live"}`)
+	require.NoError(t, h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/session/abc/filter", body)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	u := <-updates
+	assert.Equal(t, entities.VideoType, u.MediaType)
+	assert.Equal(t, entities.DonutStreamFilter("drawtext=text=live"), u.Filter)
+
+	err := h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/session/abc/filter", nil))
+	assert.ErrorIs(t, err, entities.ErrHTTPMethodNotAllowed)
+}
+
+// TestSessionHandlerSharedStream keeps a viewer from changing the media of the other viewers of its stream.
+func TestSessionHandlerSharedStream(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	sessions := NewSessionManager(&entities.Config{}, l, mapper.NewMapper(l))
+	stream := newTestSharedStream(t, "key", func() {})
+	for _, id := range []string{"abc", "def"} {
+		require.True(t, stream.join())
+		require.NoError(t, stream.AddViewer(id, &Viewer{}))
+		sessions.sessions[id] = &Session{ID: id, Stream: stream}
+	}
+	h := NewSessionHandler(&entities.Config{}, l, mapper.NewMapper(l), sessions)
+
+	for target, body := range map[string]string{
+		"/session/abc/bitrate": `{"BitRate": 1000000}`,
+		"/session/abc/filter":  `{"Filter": "drawtext=text=live"}`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		assert.ErrorIs(t, h.ServeHTTP(httptest.NewRecorder(), r), entities.ErrStreamShared, target)
+	}
+
+	// the last viewer controls the stream, the pipeline applies the update
+	stream.RemoveViewer("def")
+	go func() {
+		u := <-stream.BitRateUpdates
+		u.Done <- nil
+	}()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/session/abc/bitrate", strings.NewReader(`{"BitRate": 1000000}`))
+	require.NoError(t, h.ServeHTTP(w, r))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestSessionHandlerUpdateBitRateInvalidBody(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	sessions := NewSessionManager(&entities.Config{}, l, mapper.NewMapper(l))
+	sessions.sessions["abc"] = &Session{ID: "abc", Stream: newTestSharedStream(t, "key", func() {})}
+	h := NewSessionHandler(&entities.Config{}, l, mapper.NewMapper(l), sessions)
+
+	for body, want := range map[string]error{
+		`{"BitRate": `:     entities.ErrInvalidRequestBody,
+		`{"BitRate": "1"}`: entities.ErrInvalidRequestBody,
+		`{"BitRate": 0}`:   entities.ErrInvalidBitRate,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/session/abc/bitrate", strings.NewReader(body))
+		assert.ErrorIs(t, h.ServeHTTP(httptest.NewRecorder(), r), want, body)
+	}
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// endSessionTimeout bounds the wait for the last messages to be sent before closing a session.
+const endSessionTimeout = time.Second
+
+// Session is a WHEP viewer, it lives alongside its media pipeline
+// and is addressed by the resource URL returned in the Location header.
+type Session struct {
+	ID             string
+	PeerConnection *webrtc.PeerConnection
+	Cancel         context.CancelFunc
+	CreatedAt      time.Time
+
+	// Stream is the pipeline the session is watching
+	Stream *SharedStream
+	// Params is the request starting the session, its endpoints are authorized against it (ex: the stream_id
+	// claim of a JWT must match its stream)
+	Params entities.RequestParams
+
+	mu sync.Mutex
+	// dataChannel is opened by the client, if any, see SetDataChannel
+	dataChannel *webrtc.DataChannel
+	// timers tear the session down after its maximum duration or once it's idle
+	timers []*time.Timer
+	// stopped is set once the session is removed, the timers mustn't be re-armed then
+	stopped bool
+	// lastActivity is when the viewer last sent feedback, see Touch
+	lastActivity time.Time
+}
+
+// Touch records the viewer's activity (ex: an RTCP receiver report), keeping the session from being idle.
+func (s *Session) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+}
+
+// SetDataChannel keeps the channel opened by the client, it's used to notify it.
+func (s *Session) SetDataChannel(dc *webrtc.DataChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataChannel = dc
+}
+
+// Notify sends the message over the client's data channel, it's a no-op when there's none open.
+func (s *Session) Notify(msg entities.Message) error {
+	s.mu.Lock()
+	dc := s.dataChannel
+	s.mu.Unlock()
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return dc.SendText(string(msgBytes))
+}
+
+// flush waits until the messages sent to the client left the data channel, or the timeout elapses.
+func (s *Session) flush(timeout time.Duration) {
+	s.mu.Lock()
+	dc := s.dataChannel
+	s.mu.Unlock()
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for dc.BufferedAmount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *Session) stopTimers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.timers {
+		t.Stop()
+	}
+	s.timers = nil
+	s.stopped = true
+}
+
+// controlsStream fails unless the session is the only viewer of its stream, the viewers share the encoders:
+// changing the pipeline would change the media of all of them.
+func (s *Session) controlsStream() error {
+	if s.Stream == nil {
+		return entities.ErrStreamStopped
+	}
+	if viewers := s.Stream.Viewers(); viewers > 1 {
+		return fmt.Errorf("%w: %d viewers", entities.ErrStreamShared, viewers)
+	}
+	return nil
+}
+
+// UpdateFilter swaps the filter of a transcoded media while streaming (ex: toggling an overlay),
+// it waits until the pipeline applies it. Only the single viewer of a stream can change it.
+func (s *Session) UpdateFilter(ctx context.Context, mediaType entities.MediaType, filter entities.DonutStreamFilter) error {
+	if err := s.controlsStream(); err != nil {
+		return err
+	}
+	u := entities.DonutFilterUpdate{
+		MediaType: mediaType,
+		Filter:    filter,
+		Done:      make(chan error, 1),
+	}
+
+	select {
+	case s.Stream.FilterUpdates <- u:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-u.Done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// UpdateBitRate changes the target bit rate of a transcoded media while streaming,
+// it waits until the pipeline applies it. Only the single viewer of a stream can change it.
+func (s *Session) UpdateBitRate(ctx context.Context, mediaType entities.MediaType, bitRate int64) error {
+	if err := s.controlsStream(); err != nil {
+		return err
+	}
+	u := entities.DonutBitRateUpdate{
+		MediaType: mediaType,
+		BitRate:   bitRate,
+		Done:      make(chan error, 1),
+	}
+
+	select {
+	case s.Stream.BitRateUpdates <- u:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-u.Done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SessionManager keeps track of the active sessions.
+type SessionManager struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	c        *entities.Config
+	l        *zap.SugaredLogger
+	m        *mapper.Mapper
+
+	clockReports sync.Once
+}
+
+// NewSessionManager creates an empty SessionManager
+func NewSessionManager(c *entities.Config, l *zap.SugaredLogger, m *mapper.Mapper) *SessionManager {
+	return &SessionManager{
+		sessions: map[string]*Session{},
+		c:        c,
+		l:        l,
+		m:        m,
+	}
+}
+
+// Add registers the session, assigning its id (unless it's set) and creation time
+func (m *SessionManager) Add(s *Session) error {
+	// the caller might have set it to correlate the logs of the session from its creation
+	if s.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		s.ID = id
+	}
+	id := s.ID
+	s.CreatedAt = time.Now()
+
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+
+	m.l.Infow("session added", "id", id)
+	m.scheduleExpiry(s)
+	m.watchIdle(s)
+	if m.c.ClockReportIntervalMS > 0 {
+		m.clockReports.Do(func() { go m.reportClocks() })
+	}
+	return nil
+}
+
+// reportClocks periodically sends the server clock and the pipeline latency to every session,
+// the client measures the end-to-end latency with them.
+func (m *SessionManager) reportClocks() {
+	ticker := time.NewTicker(time.Duration(m.c.ClockReportIntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		m.mu.RLock()
+		sessions := make([]*Session, 0, len(m.sessions))
+		for _, s := range m.sessions {
+			sessions = append(sessions, s)
+		}
+		m.mu.RUnlock()
+
+		for _, s := range sessions {
+			var latency time.Duration
+			if s.Stream != nil {
+				latency = s.Stream.PipelineLatency()
+			}
+			msg, err := m.m.FromClockToEntityMessage(now, latency)
+			if err != nil {
+				m.l.Errorw("error while marshaling the clock", "error", err)
+				return
+			}
+			if err := s.Notify(msg); err != nil {
+				m.l.Warnw("failed to send the clock", "id", s.ID, "error", err)
+			}
+		}
+	}
+}
+
+// scheduleExpiry tears the session down once it reaches Config.MaxSessionDurationMS,
+// warning the client beforehand.
+func (m *SessionManager) scheduleExpiry(s *Session) {
+	if m.c.MaxSessionDurationMS <= 0 {
+		return
+	}
+	maxDuration := time.Duration(m.c.MaxSessionDurationMS) * time.Millisecond
+	warning := time.Duration(m.c.SessionTeardownWarningMS) * time.Millisecond
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if warning > 0 && warning < maxDuration {
+		s.timers = append(s.timers, time.AfterFunc(maxDuration-warning, func() {
+			if err := s.Notify(m.m.FromSessionExpiryToEntityMessage(warning)); err != nil {
+				m.l.Warnw("failed to warn about the session teardown", "id", s.ID, "error", err)
+			}
+		}))
+	}
+	s.timers = append(s.timers, time.AfterFunc(maxDuration, func() {
+		m.l.Infow("session reached its maximum duration", "id", s.ID, "duration", maxDuration)
+		m.teardown(s)
+	}))
+}
+
+// teardown leaves the stream, closes the peer connection and forgets the session.
+func (m *SessionManager) teardown(s *Session) {
+	if s.Cancel != nil {
+		s.Cancel()
+	}
+	s.PeerConnection.Close()
+	m.Remove(s.ID)
+}
+
+// watchIdle tears the session down once the viewer sent no feedback for Config.SessionIdleTimeoutMS,
+// the connection might look alive while the peer is gone (ex: a crashed browser).
+func (m *SessionManager) watchIdle(s *Session) {
+	if m.c.SessionIdleTimeoutMS <= 0 {
+		return
+	}
+	timeout := time.Duration(m.c.SessionIdleTimeoutMS) * time.Millisecond
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the connection setup counts as activity, the feedback only starts once it's connected
+	s.lastActivity = s.CreatedAt
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		idle := time.Since(s.lastActivity)
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		m.l.Infow("session is idle", "id", s.ID, "idle", idle.Round(time.Millisecond))
+		m.teardown(s)
+	})
+	s.timers = append(s.timers, timer)
+}
+
+// Get returns the session for the id, if any
+func (m *SessionManager) Get(id string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// SessionOf returns the session addressed by one of its endpoints, ex: /session/{id}/bitrate or /whep/{id}.
+func (m *SessionManager) SessionOf(path string) (*Session, error) {
+	id := path
+	for _, prefix := range []string{"/session/", "/whep/"} {
+		id = strings.TrimPrefix(id, prefix)
+	}
+	id, _, _ = strings.Cut(id, "/")
+	if id == "" || id == path {
+		return nil, entities.ErrMissingSession
+	}
+
+	session, ok := m.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", entities.ErrMissingSession, id)
+	}
+	return session, nil
+}
+
+// Remove forgets the session, it's safe to call it multiple times
+func (m *SessionManager) Remove(id string) {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+
+	if ok {
+		s.stopTimers()
+		m.l.Infow("session removed", "id", id)
+	}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
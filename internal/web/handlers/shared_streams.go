@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/zap"
+)
+
+// Viewer receives the frames of a shared stream through the peer connection its tracks were added to.
+type Viewer struct {
+	// Close is called when the stream ends
+	Close func()
+	// Notify sends a message to the viewer (ex: a cue or the end of the stream), it might be nil
+	Notify func(msg entities.Message) error
+}
+
+// SharedStream runs a single media pipeline and fans its frames out to the viewers,
+// viewers join and leave without touching the upstream or probing it again.
+// The viewers share its tracks, each frame is encoded and packetized once then sent to every peer
+// connection the tracks are bound to (pion rewrites the SSRC and payload type of each one).
+type SharedStream struct {
+	Key    string
+	Recipe entities.DonutRecipe
+	// Source is the upstream as probed, nil when it's unknown
+	Source *entities.StreamInfo
+	// FilterUpdates feeds the media pipeline, it's shared by all the viewers: it's only fed while there's a
+	// single one (see Session.UpdateFilter)
+	FilterUpdates chan entities.DonutFilterUpdate
+	// BitRateUpdates feeds the media pipeline, it's shared by all the viewers: it's only fed while there's a
+	// single one (see Session.UpdateBitRate)
+	BitRateUpdates chan entities.DonutBitRateUpdate
+	// KeyFrames feeds the media pipeline with key frame requests, the pending one covers those made meanwhile
+	KeyFrames chan struct{}
+	// MaxKeyFrameWait is how long the viewers of a bypassed video may wait for a key frame they requested
+	// before it's reported (Config.BypassMaxKeyFrameWaitMS), 0 never reports it.
+	MaxKeyFrameWait time.Duration
+
+	// video and audio are added to the peer connection of each viewer, audio is nil when it's dropped
+	video *webrtc.TrackLocalStaticRTP
+	audio *webrtc.TrackLocalStaticRTP
+	// videoWriter and audioWriter packetize the frames into the tracks, without header extensions: those
+	// depend on the peer connection, its interceptors add them (ex: transport-cc, see newAPI)
+	videoWriter *controllers.RTPWriter
+	audioWriter *controllers.RTPWriter
+
+	mu      sync.RWMutex
+	viewers map[string]*Viewer
+	// joining are the viewers given the stream by the registry, not yet added nor released
+	joining int
+	stopped bool
+	cancel  func()
+	l       *zap.SugaredLogger
+
+	videoBitrate bitrateMeter
+	audioBitrate bitrateMeter
+	videoLatency latencyMeter
+	keyFrames    keyFrameRequests
+	// poster is the first video key frame (JPEG), nil until it's captured
+	poster []byte
+	// pipeline are the lifecycle events of the pipeline so far (Config.PipelineEvents)
+	pipeline []entities.PipelineEvent
+}
+
+// NewSharedStream creates the tracks of the recipe codecs, streamID groups them (msid) in the viewers' answers.
+func NewSharedStream(l *zap.SugaredLogger, m *mapper.Mapper, key string, streamID string, recipe entities.DonutRecipe, cancel func()) (*SharedStream, error) {
+	var video, audio *webrtc.TrackLocalStaticRTP
+	var videoWriter, audioWriter *controllers.RTPWriter
+	var err error
+	if recipe.Video.Action != entities.DonutDrop {
+		video, err = webrtc.NewTrackLocalStaticRTP(trackCapability(m, recipe.Video.Codec), string(entities.VideoType), streamID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create video track: %w", err)
+		}
+		if videoWriter, err = controllers.NewRTPWriter(video, recipe.Video.Codec, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	if recipe.Audio.Action != entities.DonutDrop {
+		audio, err = webrtc.NewTrackLocalStaticRTP(trackCapability(m, recipe.Audio.Codec), string(entities.AudioType), streamID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create audio track: %w", err)
+		}
+		if audioWriter, err = controllers.NewRTPWriter(audio, recipe.Audio.Codec, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SharedStream{
+		Key:            key,
+		Recipe:         recipe,
+		FilterUpdates:  make(chan entities.DonutFilterUpdate),
+		BitRateUpdates: make(chan entities.DonutBitRateUpdate),
+		KeyFrames:      make(chan struct{}, 1),
+		video:          video,
+		audio:          audio,
+		videoWriter:    videoWriter,
+		audioWriter:    audioWriter,
+		viewers:        map[string]*Viewer{},
+		cancel:         cancel,
+		l:              l,
+	}, nil
+}
+
+// trackCapability returns the capability of a track of the codec, the mapper's one is a pion v3 one.
+func trackCapability(m *mapper.Mapper, codec entities.Codec) webrtc.RTPCodecCapability {
+	capability := m.FromTrackToRTPCodecCapability(codec)
+	return webrtc.RTPCodecCapability{MimeType: capability.MimeType, SDPFmtpLine: capability.SDPFmtpLine}
+}
+
+// VideoTrack returns the video track shared by the viewers, nil when the video is dropped
+func (s *SharedStream) VideoTrack() *webrtc.TrackLocalStaticRTP {
+	return s.video
+}
+
+// AudioTrack returns the audio track shared by the viewers, nil when the audio is dropped
+func (s *SharedStream) AudioTrack() *webrtc.TrackLocalStaticRTP {
+	return s.audio
+}
+
+// Viewers returns how many viewers are watching the stream
+func (s *SharedStream) Viewers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.viewers)
+}
+
+// join reserves the stream for a viewer about to be added, it fails once the stream has stopped.
+func (s *SharedStream) join() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	s.joining++
+	return true
+}
+
+// AddViewer attaches the viewer's tracks to the running pipeline, the viewer joined it through the registry.
+// A transcoded video is given a key frame, the viewer doesn't wait for the next one.
+func (s *SharedStream) AddViewer(sessionID string, v *Viewer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return entities.ErrStreamStopped
+	}
+	s.joining--
+	s.viewers[sessionID] = v
+	s.l.Infow("viewer added", "stream", s.Key, "session", sessionID, "viewers", len(s.viewers))
+	if s.Recipe.Video.Action == entities.DonutTranscode {
+		s.requestKeyFrame()
+	}
+	return nil
+}
+
+// Release gives up joining the stream (ex: the viewer's session failed before AddViewer),
+// the pipeline stops when there's no viewer left.
+func (s *SharedStream) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.joining--
+	s.stopIfIdle()
+}
+
+// RemoveViewer detaches the viewer, the pipeline stops along with the last viewer.
+// It's safe to call it multiple times.
+func (s *SharedStream) RemoveViewer(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.viewers[sessionID]; !ok {
+		return
+	}
+	delete(s.viewers, sessionID)
+	s.keyFrames.leave(sessionID)
+	s.l.Infow("viewer removed", "stream", s.Key, "session", sessionID, "viewers", len(s.viewers))
+	s.stopIfIdle()
+}
+
+// stopIfIdle stops the pipeline when no viewer watches it nor is about to, s.mu must be held.
+func (s *SharedStream) stopIfIdle() {
+	if len(s.viewers) == 0 && s.joining == 0 && !s.stopped {
+		s.stopped = true
+		s.cancel()
+	}
+}
+
+// requestKeyFrame asks the pipeline for a key frame without blocking, a pending request covers this one.
+func (s *SharedStream) requestKeyFrame() {
+	select {
+	case s.KeyFrames <- struct{}{}:
+	default:
+	}
+}
+
+// Stopped tells whether the pipeline is gone, or going, hence it can't accept viewers
+func (s *SharedStream) Stopped() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stopped
+}
+
+// Close is called once the pipeline ends, closing the remaining viewers
+func (s *SharedStream) Close() error {
+	s.mu.Lock()
+	s.stopped = true
+	viewers := s.viewers
+	s.viewers = map[string]*Viewer{}
+	s.mu.Unlock()
+
+	for _, v := range viewers {
+		if v.Close != nil {
+			v.Close()
+		}
+	}
+	return nil
+}
+
+// Notify sends the message to every viewer, the viewers failing to get it are only logged.
+func (s *SharedStream) Notify(msg entities.Message) {
+	s.mu.RLock()
+	viewers := make(map[string]*Viewer, len(s.viewers))
+	for id, v := range s.viewers {
+		viewers[id] = v
+	}
+	s.mu.RUnlock()
+
+	for id, v := range viewers {
+		if v.Notify == nil {
+			continue
+		}
+		if err := v.Notify(msg); err != nil {
+			s.l.Warnw("failed to notify the viewer", "stream", s.Key, "session", id, "type", msg.Type, "error", err)
+		}
+	}
+}
+
+// Bitrates returns the current video and audio bits per second written to the viewers
+func (s *SharedStream) Bitrates() (video, audio int64) {
+	return s.videoBitrate.Bitrate(), s.audioBitrate.Bitrate()
+}
+
+// SetPoster keeps the poster served to the viewers while they connect
+func (s *SharedStream) SetPoster(jpeg []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.poster = jpeg
+}
+
+// Poster returns the first video key frame (JPEG), nil until it's captured
+func (s *SharedStream) Poster() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.poster
+}
+
+// AddPipelineEvent records a lifecycle event of the pipeline, reported in the sessions of the viewers
+func (s *SharedStream) AddPipelineEvent(e entities.PipelineEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipeline = append(s.pipeline, e)
+}
+
+// PipelineEvents returns the lifecycle events of the pipeline so far, ex: input_opened then streaming
+func (s *SharedStream) PipelineEvents() []entities.PipelineEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]entities.PipelineEvent(nil), s.pipeline...)
+}
+
+// PipelineLatency returns the average time a video frame spends in the pipeline
+func (s *SharedStream) PipelineLatency() time.Duration {
+	return s.videoLatency.Latency()
+}
+
+// RequestKeyFrame records a viewer's key frame request (PLI or FIR), the pipeline is asked for one when the video
+// is transcoded. A bypassed video can't be given a key frame on demand, a viewer waiting longer than MaxKeyFrameWait
+// is reported once per key frame: the source key frame interval is too long for the viewers joining or recovering
+// from a loss.
+func (s *SharedStream) RequestKeyFrame(sessionID string) {
+	if s.Recipe.Video.Action == entities.DonutTranscode {
+		s.requestKeyFrame()
+	}
+	wait, exceeded := s.keyFrames.request(sessionID, time.Now(), s.MaxKeyFrameWait)
+	if !exceeded || s.Recipe.Video.Action != entities.DonutBypass {
+		return
+	}
+	_, waiting := s.keyFrames.Stats()
+	s.l.Warnw("viewers are waiting for an upstream key frame, shorten the source key frame interval or transcode it",
+		"stream", s.Key, "waiting", waiting, "wait", wait)
+}
+
+// KeyFrameRequests returns the key frame requests of the viewers so far and how many are waiting for one.
+func (s *SharedStream) KeyFrameRequests() (total int64, waiting int) {
+	return s.keyFrames.Stats()
+}
+
+func (s *SharedStream) WriteVideo(data []byte, c entities.MediaFrameContext) error {
+	s.videoBitrate.add(len(data))
+	s.videoLatency.add(c.PipelineLatency)
+	if c.KeyFrame {
+		if waiting, wait := s.keyFrames.keyFrame(time.Now()); waiting > 0 {
+			s.l.Infow("key frame sent to the waiting viewers", "stream", s.Key, "waiting", waiting, "wait", wait)
+		}
+	}
+	s.write(s.video, s.videoWriter, data, c)
+	return nil
+}
+
+func (s *SharedStream) WriteAudio(data []byte, c entities.MediaFrameContext) error {
+	s.audioBitrate.add(len(data))
+	s.write(s.audio, s.audioWriter, data, c)
+	return nil
+}
+
+// write doesn't fail, a single broken viewer must not stop the pipeline for the others. The track
+// writes the packets to all its peer connections even when some of them fail.
+func (s *SharedStream) write(track *webrtc.TrackLocalStaticRTP, writer *controllers.RTPWriter, data []byte, c entities.MediaFrameContext) {
+	if track == nil {
+		return
+	}
+	if err := writer.Write(data, c); err != nil {
+		s.l.Warnw("failed to write frame", "stream", s.Key, "track", track.ID(), "error", err)
+	}
+}
+
+// SharedStreamKey identifies the pipeline of a request, the viewers share it only when they ask for the same
+// media, ex: viewers asking for distinct resolutions get distinct pipelines. The outputs (ex: the relay) are
+// the ones of the viewer starting it.
+func SharedStreamKey(params *entities.RequestParams) string {
+	v := url.Values{}
+	set := func(key string, value string, zero bool) {
+		if !zero {
+			v.Set(key, value)
+		}
+	}
+	set("resolution", string(params.Resolution), params.Resolution == "")
+	set("latency_mode", string(params.LatencyMode), params.LatencyMode == "")
+	set("deinterlace", string(params.Deinterlace), params.Deinterlace == "")
+	set("content_type", string(params.ContentType), params.ContentType == "")
+	set("audio_sample_rate", strconv.Itoa(params.AudioSampleRate), params.AudioSampleRate == 0)
+	set("audio_loudness", strconv.FormatFloat(params.AudioLoudnessLUFS, 'f', -1, 64), params.AudioLoudnessLUFS == 0)
+	set("audio_mono", strconv.FormatBool(params.AudioMono), !params.AudioMono)
+	set("audio_stream", strconv.Itoa(params.AudioStreamIndex), params.AudioStreamIndex == 0)
+	set("start_at", strconv.FormatInt(params.StartAtMS, 10), params.StartAtMS == 0)
+
+	key := params.StreamURL + "/" + params.StreamID
+	if len(v) > 0 {
+		key += "?" + v.Encode()
+	}
+	return key
+}
+
+// SharedStreamRegistry indexes the running shared streams by their key (see SharedStreamKey).
+type SharedStreamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*SharedStream
+	// creating are the streams being started, the viewers of the same key wait for them
+	creating map[string]*sharedStreamCreation
+}
+
+type sharedStreamCreation struct {
+	done chan struct{}
+	err  error
+}
+
+func NewSharedStreamRegistry() *SharedStreamRegistry {
+	return &SharedStreamRegistry{
+		streams:  map[string]*SharedStream{},
+		creating: map[string]*sharedStreamCreation{},
+	}
+}
+
+// GetOrCreate returns the running stream for the key, starting it with create otherwise. The viewer joins it,
+// it must be either added (SharedStream.AddViewer) or released (SharedStream.Release).
+// Two viewers joining at once don't probe the upstream twice, the second one waits for the first one's stream.
+// The registry isn't locked while probing, the other streams are started meanwhile. A stream whose pipeline
+// stopped before being registered (ex: the upstream ended right away) fails with entities.ErrStreamStopped.
+func (r *SharedStreamRegistry) GetOrCreate(key string, create func() (*SharedStream, error)) (*SharedStream, error) {
+	for {
+		r.mu.Lock()
+		if s, ok := r.streams[key]; ok && s.join() {
+			r.mu.Unlock()
+			return s, nil
+		}
+		if creation, ok := r.creating[key]; ok {
+			r.mu.Unlock()
+			<-creation.done
+			if creation.err != nil {
+				return nil, creation.err
+			}
+			// the stream might have stopped since, it's started again
+			continue
+		}
+		creation := &sharedStreamCreation{done: make(chan struct{})}
+		r.creating[key] = creation
+		r.mu.Unlock()
+
+		s, err := create()
+
+		r.mu.Lock()
+		delete(r.creating, key)
+		if err == nil {
+			if s.join() {
+				r.streams[key] = s
+			} else {
+				s, err = nil, entities.ErrStreamStopped
+			}
+		}
+		r.mu.Unlock()
+		creation.err = err
+		close(creation.done)
+		return s, err
+	}
+}
+
+// Remove forgets the stream, unless it was already replaced by a newer one
+func (r *SharedStreamRegistry) Remove(s *SharedStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.streams[s.Key] == s {
+		delete(r.streams, s.Key)
+	}
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestSharedStream(t *testing.T, key string, cancel func()) *SharedStream {
+	l := zap.NewNop().Sugar()
+	recipe := entities.DonutRecipe{
+		Video: entities.DonutMediaTask{Action: entities.DonutTranscode, Codec: entities.H264},
+		Audio: entities.DonutMediaTask{Action: entities.DonutDrop},
+	}
+	s, err := NewSharedStream(l, mapper.NewMapper(l), key, "live", recipe, cancel)
+	require.NoError(t, err)
+	return s
+}
+
+func TestSharedStreamRegistryRelease(t *testing.T) {
+	r := NewSharedStreamRegistry()
+	stopped := 0
+	create := func() (*SharedStream, error) {
+		return newTestSharedStream(t, "key", func() { stopped++ }), nil
+	}
+
+	first, err := r.GetOrCreate("key", create)
+	require.NoError(t, err)
+	second, err := r.GetOrCreate("key", create)
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+
+	// a viewer failing before being added doesn't stop the stream of the other one
+	require.NoError(t, first.AddViewer("a", &Viewer{}))
+	second.Release()
+	assert.Equal(t, 0, stopped)
+	// the added viewer is given a key frame
+	assert.Len(t, first.KeyFrames, 1)
+
+	first.RemoveViewer("a")
+	assert.Equal(t, 1, stopped)
+
+	// the stream of a single viewer failing before being added stops
+	third, err := r.GetOrCreate("key", create)
+	require.NoError(t, err)
+	assert.NotSame(t, first, third)
+	third.Release()
+	assert.Equal(t, 2, stopped)
+	assert.True(t, third.Stopped())
+}
+
+func TestSharedStreamRegistryCreateError(t *testing.T) {
+	r := NewSharedStreamRegistry()
+	_, err := r.GetOrCreate("key", func() (*SharedStream, error) {
+		return nil, errors.New("probing failed")
+	})
+	assert.EqualError(t, err, "probing failed")
+}
+
+func TestSharedStreamRegistryCreateStopped(t *testing.T) {
+	r := NewSharedStreamRegistry()
+	// the pipeline ended before the stream was registered
+	s, err := r.GetOrCreate("key", func() (*SharedStream, error) {
+		s := newTestSharedStream(t, "key", func() {})
+		require.NoError(t, s.Close())
+		return s, nil
+	})
+	assert.ErrorIs(t, err, entities.ErrStreamStopped)
+	assert.Nil(t, s)
+
+	// the stopped stream isn't registered, the next viewer starts a new one
+	s, err = r.GetOrCreate("key", func() (*SharedStream, error) {
+		return newTestSharedStream(t, "key", func() {}), nil
+	})
+	require.NoError(t, err)
+	assert.False(t, s.Stopped())
+}
+
+func TestSharedStreamKey(t *testing.T) {
+	params := entities.RequestParams{StreamURL: "srt://host:40052", StreamID: "live"}
+	assert.Equal(t, "srt://host:40052/live", SharedStreamKey(&params))
+
+	mobile := params
+	mobile.Resolution = entities.Resolution720p
+	assert.Equal(t, "srt://host:40052/live?resolution=720p", SharedStreamKey(&mobile))
+	assert.NotEqual(t, SharedStreamKey(&params), SharedStreamKey(&mobile))
+}
+
+func TestSharedStreamRequestKeyFrame(t *testing.T) {
+	s := newTestSharedStream(t, "key", func() {})
+
+	// the transcoded video is given a key frame, a pending request covers the next ones
+	s.RequestKeyFrame("a")
+	s.RequestKeyFrame("b")
+	assert.Len(t, s.KeyFrames, 1)
+	total, waiting := s.KeyFrameRequests()
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, 2, waiting)
+
+	// a bypassed one can't be, the requests are only tracked
+	<-s.KeyFrames
+	s.Recipe.Video.Action = entities.DonutBypass
+	s.RequestKeyFrame("a")
+	assert.Empty(t, s.KeyFrames)
+}
+
+func TestSharedStreamNotify(t *testing.T) {
+	s := newTestSharedStream(t, "key", func() {})
+	var got []entities.Message
+	notify := func(msg entities.Message) error {
+		got = append(got, msg)
+		return nil
+	}
+	for id, v := range map[string]*Viewer{
+		"a": {Notify: notify},
+		"b": {Notify: notify},
+		"c": {},
+		"d": {Notify: func(entities.Message) error { return errors.New("closed") }},
+	} {
+		require.True(t, s.join())
+		require.NoError(t, s.AddViewer(id, v))
+	}
+
+	// every viewer gets the cue, a failing one doesn't keep the others from it
+	cue, err := mapper.NewMapper(zap.NewNop().Sugar()).FromCueToEntityMessage(&entities.Cue{})
+	require.NoError(t, err)
+	s.Notify(cue)
+	assert.Equal(t, []entities.Message{cue, cue}, got)
+}
+
+// viewerTrackContext binds a shared track like the peer connection of a viewer, with its own SSRC and payload type.
+type viewerTrackContext struct {
+	id      string
+	ssrc    webrtc.SSRC
+	codec   webrtc.RTPCodecParameters
+	mu      sync.Mutex
+	headers []rtp.Header
+}
+
+func (c *viewerTrackContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{c.codec}
+}
+func (c *viewerTrackContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c *viewerTrackContext) SSRC() webrtc.SSRC                                      { return c.ssrc }
+func (c *viewerTrackContext) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (c *viewerTrackContext) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c *viewerTrackContext) WriteStream() webrtc.TrackLocalWriter                   { return c }
+func (c *viewerTrackContext) ID() string                                             { return c.id }
+func (c *viewerTrackContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+func (c *viewerTrackContext) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = append(c.headers, *header)
+	return len(payload), nil
+}
+
+func (c *viewerTrackContext) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// TestSharedStreamFanOut runs a single pipeline for the viewers joining at once, each frame is encoded once
+// and reaches every viewer with the SSRC and payload type negotiated with it.
+func TestSharedStreamFanOut(t *testing.T) {
+	const viewers = 3
+	r := NewSharedStreamRegistry()
+	var started atomic.Int32
+	create := func() (*SharedStream, error) {
+		started.Add(1)
+		// probing takes a while, the other viewers join meanwhile
+		time.Sleep(10 * time.Millisecond)
+		return newTestSharedStream(t, "key", func() {}), nil
+	}
+
+	streams := make([]*SharedStream, viewers)
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := r.GetOrCreate("key", create)
+			assert.NoError(t, err)
+			streams[i] = s
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), started.Load())
+
+	s := streams[0]
+	contexts := make([]*viewerTrackContext, viewers)
+	for i := range contexts {
+		require.Same(t, s, streams[i])
+		contexts[i] = &viewerTrackContext{
+			id:    fmt.Sprintf("viewer-%d", i),
+			ssrc:  webrtc.SSRC(1000 + i),
+			codec: webrtc.RTPCodecParameters{RTPCodecCapability: s.VideoTrack().Codec(), PayloadType: webrtc.PayloadType(96 + i)},
+		}
+		_, err := s.VideoTrack().Bind(contexts[i])
+		require.NoError(t, err)
+		require.NoError(t, s.AddViewer(contexts[i].id, &Viewer{}))
+	}
+	assert.Equal(t, viewers, s.Viewers())
+
+	// an encoded access unit (SPS, PPS and IDR), written once by the pipeline
+	frame := []byte{0x00, 0x00, 0x00, 0x01, 0x67, 0x42, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x01, 0x68, 0xce, 0x3c, 0x80,
+		0x00, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84, 0x00}
+	require.NoError(t, s.WriteVideo(frame, entities.MediaFrameContext{KeyFrame: true, RTPTimestamp: 3000}))
+
+	for i, c := range contexts {
+		require.NotEmpty(t, c.headers, c.id)
+		require.Len(t, c.headers, len(contexts[0].headers), c.id)
+		for j, h := range c.headers {
+			assert.Equal(t, uint32(1000+i), h.SSRC, c.id)
+			assert.Equal(t, uint8(96+i), h.PayloadType, c.id)
+			assert.Equal(t, uint32(3000), h.Timestamp, c.id)
+			// the packets are the same for every viewer, only rewritten
+			assert.Equal(t, contexts[0].headers[j].SequenceNumber, h.SequenceNumber, c.id)
+		}
+	}
+}
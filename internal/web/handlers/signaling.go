@@ -3,7 +3,9 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/flavioribeiro/donut/internal/controllers"
 	"github.com/flavioribeiro/donut/internal/controllers/engine"
@@ -18,6 +20,7 @@ type SignalingHandler struct {
 	webRTCController *controllers.WebRTCController
 	mapper           *mapper.Mapper
 	donut            *engine.DonutEngineController
+	authorizer       controllers.Authorizer
 }
 
 func NewSignalingHandler(
@@ -26,6 +29,7 @@ func NewSignalingHandler(
 	webRTCController *controllers.WebRTCController,
 	mapper *mapper.Mapper,
 	donut *engine.DonutEngineController,
+	authorizer controllers.Authorizer,
 ) *SignalingHandler {
 	return &SignalingHandler{
 		c:                c,
@@ -33,6 +37,7 @@ func NewSignalingHandler(
 		webRTCController: webRTCController,
 		mapper:           mapper,
 		donut:            donut,
+		authorizer:       authorizer,
 	}
 }
 
@@ -41,6 +46,9 @@ func (h *SignalingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) err
 	if err != nil {
 		return err
 	}
+	if err := h.authorizer.Authorize(r, params); err != nil {
+		return err
+	}
 	h.l.Infof("RequestParams %s", params.String())
 
 	donutEngine, err := h.donut.EngineFor(&params)
@@ -77,30 +85,85 @@ func (h *SignalingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 	h.l.Infof("WebRTCResponse %#v", webRTCResponse)
+	logSDP(h.c, h.l, "signaling", "offer", params.Offer.SDP)
+	logSDP(h.c, h.l, "signaling", "answer", webRTCResponse.LocalSDP.SDP)
 
-	go donutEngine.Serve(&entities.DonutParameters{
-		Cancel: cancel,
-		Ctx:    ctx,
+	if len(donutRecipe.Warnings) > 0 {
+		if err := h.webRTCController.SendWarnings(webRTCResponse.Data, donutRecipe.Warnings); err != nil {
+			cancel()
+			return err
+		}
+	}
+	go h.webRTCController.KeepAlive(ctx, webRTCResponse.Data)
+	go h.webRTCController.ExpireSession(ctx, webRTCResponse, cancel)
+	latency := &latencyMeter{}
+	go h.webRTCController.ReportClock(ctx, webRTCResponse.Data, latency.Latency)
 
-		Recipe: *donutRecipe,
+	rtpHeaderExtensions, err := h.mapper.FromSessionDescriptionToRTPHeaderExtensions(*webRTCResponse.LocalSDP)
+	if err != nil {
+		cancel()
+		return err
+	}
 
-		OnClose: func() {
-			cancel()
-			webRTCResponse.Connection.Close()
-		},
-		OnError: func(err error) {
-			h.l.Errorw("error while streaming", "error", err)
-		},
-		OnStream: func(st *entities.Stream) error {
-			return h.webRTCController.SendMetadata(webRTCResponse.Data, st)
-		},
-		OnVideoFrame: func(data []byte, c entities.MediaFrameContext) error {
-			return h.webRTCController.SendMediaSample(webRTCResponse.Video, data, c)
-		},
-		OnAudioFrame: func(data []byte, c entities.MediaFrameContext) error {
-			return h.webRTCController.SendMediaSample(webRTCResponse.Audio, data, c)
-		},
-	})
+	sink, err := newWebRTCSink(webRTCResponse, donutRecipe, rtpHeaderExtensions, latency)
+	if err != nil {
+		cancel()
+		return err
+	}
+	recordingFormat, err := recordingFormatFor(h.c, &params)
+	if err != nil {
+		cancel()
+		return err
+	}
+	recordingPath := recordingPathFor(h.c, params.StreamID, recordingFormat, time.Now())
+	muxer, err := newOutputs(h.c, h.l, &params, recordingPath, recordingFormat, "")
+	if err != nil {
+		cancel()
+		return err
+	}
+	sinks := sinksFor(sink, muxer)
+
+	go func() {
+		donutEngine.Serve(&entities.DonutParameters{
+			Cancel: cancel,
+			Ctx:    ctx,
+
+			Recipe: *donutRecipe,
+
+			Sinks: sinks,
+
+			KeyFrameRequests: webRTCResponse.KeyFrameRequests,
+
+			OnClose: func() {
+				cancel()
+				webRTCResponse.Connection.Close()
+			},
+			OnEnd: func() {
+				h.l.Infow("stream ended", "stream_id", params.StreamID)
+				h.webRTCController.EndSession(webRTCResponse, cancel, nil)
+			},
+			OnError: func(err error) {
+				h.l.Errorw("error while streaming", "error", err)
+				h.webRTCController.EndSession(webRTCResponse, cancel, err)
+			},
+			OnStream: func(st *entities.Stream) error {
+				return h.webRTCController.SendMetadata(webRTCResponse.Data, st)
+			},
+			OnCue: func(cue *entities.Cue) error {
+				return h.webRTCController.SendCue(webRTCResponse.Data, cue)
+			},
+			OnTimecode: func(tc *entities.TimecodeInfo) error {
+				return h.webRTCController.SendTimecode(webRTCResponse.Data, tc)
+			},
+			OnPoster: func(jpeg []byte) error {
+				return h.webRTCController.SendPoster(webRTCResponse.Data, jpeg)
+			},
+			OnPipelineEvent: func(e *entities.PipelineEvent) error {
+				return h.webRTCController.SendPipelineEvent(webRTCResponse.Data, e)
+			},
+		})
+		closeSinks(h.l, sinks)
+	}()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -122,11 +185,16 @@ func (h *SignalingHandler) createAndValidateParams(r *http.Request) (entities.Re
 
 	params := entities.RequestParams{}
 	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
-		return entities.RequestParams{}, err
+		return entities.RequestParams{}, fmt.Errorf("%w: %s", entities.ErrInvalidRequestBody, err)
 	}
+	params.VideoCodecs = controllers.WebRTCVideoCodecs
 	if err := params.Valid(); err != nil {
 		return entities.RequestParams{}, err
 	}
+	// the server dials the relay, a request can only pick one of the configured destinations
+	if params.RelayURL != "" && !entities.IsAllowedRelayURL(h.c.RelayAllowedURLs, params.RelayURL) {
+		return entities.RequestParams{}, entities.ErrRelayURLNotAllowed
+	}
 
 	return params, nil
 }
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"go.uber.org/zap"
+)
+
+// webRTCSink packetizes the media into the tracks of a signaling session.
+type webRTCSink struct {
+	// video and audio are nil when the session has no such track
+	video   *controllers.RTPWriter
+	audio   *controllers.RTPWriter
+	latency *latencyMeter
+}
+
+// newWebRTCSink packetizes the media with the header extensions negotiated per media type,
+// the tracks share the transport-cc sequence of their peer connection.
+func newWebRTCSink(response *entities.WebRTCSetupResponse, recipe *entities.DonutRecipe,
+	extensions map[entities.MediaType]entities.RTPHeaderExtensions, latency *latencyMeter) (*webRTCSink, error) {
+	sink := &webRTCSink{latency: latency}
+	sequence := &controllers.TransportSequence{}
+	var err error
+	if response.Video != nil {
+		if sink.video, err = controllers.NewRTPWriter(response.Video, recipe.Video.Codec, extensions[entities.VideoType], sequence); err != nil {
+			return nil, err
+		}
+	}
+	if response.Audio != nil {
+		if sink.audio, err = controllers.NewRTPWriter(response.Audio, recipe.Audio.Codec, extensions[entities.AudioType], sequence); err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+func (s *webRTCSink) WriteVideo(data []byte, c entities.MediaFrameContext) error {
+	s.latency.add(c.PipelineLatency)
+	if s.video == nil {
+		return nil
+	}
+	return s.video.Write(data, c)
+}
+
+func (s *webRTCSink) WriteAudio(data []byte, c entities.MediaFrameContext) error {
+	if s.audio == nil {
+		return nil
+	}
+	return s.audio.Write(data, c)
+}
+
+// Close does nothing, the peer connection is closed along with the session.
+func (s *webRTCSink) Close() error {
+	return nil
+}
+
+// sinksFor returns the sinks of a session, the muxer (ex: a recording) is optional.
+func sinksFor(sink entities.OutputSink, muxer entities.DonutMuxer) []entities.OutputSink {
+	sinks := []entities.OutputSink{sink}
+	if muxer != nil {
+		sinks = append(sinks, muxer)
+	}
+	return sinks
+}
+
+// closeSinks closes every sink once the stream is over, a failing one doesn't prevent closing the others.
+func closeSinks(l *zap.SugaredLogger, sinks []entities.OutputSink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			l.Errorw("error while closing the outputs", "error", err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"fmt"
 
+	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 )
@@ -15,14 +16,15 @@ type TrackManager struct {
 }
 
 // NewTrackManager creates a new TrackManager instance with shared video and audio tracks
-func NewTrackManager(logger *zap.SugaredLogger) (*TrackManager, error) {
+func NewTrackManager(c *entities.Config, logger *zap.SugaredLogger) (*TrackManager, error) {
 	// Create a video track for H264
 	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
 		webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeH264,
-			ClockRate:   90000,
-			Channels:    0,
-			SDPFmtpLine: "",
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			Channels:     0,
+			SDPFmtpLine:  "",
+			RTCPFeedback: rtcpFeedbackFrom(c.VideoRTCPFeedback),
 		},
 		"video",
 		"",
@@ -34,10 +36,11 @@ func NewTrackManager(logger *zap.SugaredLogger) (*TrackManager, error) {
 	// Create an audio track for Opus
 	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
 		webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeOpus,
-			ClockRate:   48000,
-			Channels:    2,
-			SDPFmtpLine: "minptime=10;useinbandfec=1",
+			MimeType:     webrtc.MimeTypeOpus,
+			ClockRate:    48000,
+			Channels:     2,
+			SDPFmtpLine:  "minptime=10;useinbandfec=1",
+			RTCPFeedback: rtcpFeedbackFrom(c.AudioRTCPFeedback),
 		},
 		"audio",
 		"",
@@ -6,24 +6,18 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/flavioribeiro/donut/internal/controllers"
 	"github.com/flavioribeiro/donut/internal/controllers/engine"
 	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/pion/rtcp"
 	webrtc3 "github.com/pion/webrtc/v3"
 	webrtc "github.com/pion/webrtc/v4" // or
-	"github.com/pion/webrtc/v4/pkg/media"
 	"go.uber.org/zap"
 )
 
-var peerConnectionConfiguration = webrtc.Configuration{
-	ICEServers: []webrtc.ICEServer{
-		{
-			URLs: []string{"stun:stun.l.google.com:19302"},
-		},
-	},
-}
-
 type WHEPHandler struct {
 	c          *entities.Config
 	l          *zap.SugaredLogger
@@ -31,6 +25,13 @@ type WHEPHandler struct {
 	donut      *engine.DonutEngineController
 	videoTrack *webrtc.TrackLocalStaticRTP
 	audioTrack *webrtc.TrackLocalStaticRTP
+	sessions   *SessionManager
+	streams    *SharedStreamRegistry
+	rewriter   controllers.SDPRewriter
+	authorizer controllers.Authorizer
+	tcpMux     controllers.ICETCPMux
+	udpMux     controllers.ICEUDPMux
+	dscp       *controllers.DSCPMarker
 }
 
 func NewWHEPHandler(
@@ -39,6 +40,13 @@ func NewWHEPHandler(
 	mapper *mapper.Mapper,
 	donut *engine.DonutEngineController,
 	tm *TrackManager,
+	sessions *SessionManager,
+	streams *SharedStreamRegistry,
+	rewriter controllers.SDPRewriter,
+	authorizer controllers.Authorizer,
+	tcpMux controllers.ICETCPMux,
+	udpMux controllers.ICEUDPMux,
+	dscp *controllers.DSCPMarker,
 ) *WHEPHandler {
 	return &WHEPHandler{
 		c:          c,
@@ -47,19 +55,77 @@ func NewWHEPHandler(
 		donut:      donut,
 		videoTrack: tm.GetVideoTrack(),
 		audioTrack: tm.GetAudioTrack(),
+		sessions:   sessions,
+		streams:    streams,
+		rewriter:   rewriter,
+		authorizer: authorizer,
+		tcpMux:     tcpMux,
+		udpMux:     udpMux,
+		dscp:       dscp,
 	}
 }
 
 func (h *WHEPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPatch:
+		return h.patchSession(w, r)
+	case http.MethodDelete:
+		return h.deleteSession(w, r)
+	case http.MethodPost:
+		return h.createSession(w, r)
+	}
+	return entities.ErrHTTPMethodNotAllowed
+}
+
+func (h *WHEPHandler) createSession(w http.ResponseWriter, r *http.Request) error {
 	// Read and log the offer details
 	offer, err := io.ReadAll(r.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read request body: %w", err)
 	}
-	h.l.Infof("Received WHEP Offer SDP:\n%s\n", string(offer))
+	logSDP(h.c, h.l, "whep", "offer", string(offer))
+
+	params, err := h.createAndValidateParams(r, offer)
+	if err != nil {
+		return err
+	}
+	if err := h.authorizer.Authorize(r, params); err != nil {
+		return err
+	}
+
+	// viewers of a running stream join its pipeline, it's only probed and started for the first one
+	stream, err := h.streams.GetOrCreate(SharedStreamKey(&params), func() (*SharedStream, error) {
+		return h.startStream(&params)
+	})
+	if err != nil {
+		return err
+	}
+	// until the viewer is added, a failing session must not leave the pipeline running without viewers
+	added := false
+	defer func() {
+		if !added {
+			stream.Release()
+		}
+	}()
+
+	// the session id is known upfront, correlating every ICE event of the viewer
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	l := h.l.With("session", id)
+
+	api, err := newAPI(h.c, whepVideoCodecs, h.tcpMux, h.udpMux, h.dscp)
+	if err != nil {
+		return err
+	}
 
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfiguration)
+	configuration, err := newPeerConnectionConfiguration(h.c)
+	if err != nil {
+		return err
+	}
+	peerConnection, err := api.NewPeerConnection(configuration)
 	if err != nil {
 		return fmt.Errorf("failed to create peer connection: %w", err)
 	}
@@ -69,142 +135,260 @@ func (h *WHEPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 		if candidate == nil {
 			return
 		}
-		h.l.Infof("Server ICE candidate (WHEP): Protocol: %s, Address: %s, Port: %d",
+		l.Infof("Server ICE candidate (WHEP): Protocol: %s, Address: %s, Port: %d",
 			candidate.Protocol,
 			candidate.Address,
 			candidate.Port)
 	})
 
-	// Log when ICE connection state changes
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		h.l.Infof("ICE Connection State has changed (WHEP): %s", connectionState.String())
+	session := &Session{
+		ID:             id,
+		PeerConnection: peerConnection,
+		Stream:         stream,
+		Params:         params,
+	}
+
+	// the tracks of the stream are shared, the frames are packetized once for all the viewers.
+	// A viewer without an m-line for a media, or unable to play it, joins without its track.
+	var videoTrack, audioTrack *webrtc.TrackLocalStaticRTP
+	playsVideo, err := h.plays(&params, stream, entities.VideoType, stream.Recipe.Video)
+	if err != nil {
+		return err
+	}
+	if playsVideo {
+		videoTrack = stream.VideoTrack()
+	}
+	playsAudio, err := h.plays(&params, stream, entities.AudioType, stream.Recipe.Audio)
+	if err != nil {
+		return err
+	}
+	if playsAudio {
+		audioTrack = stream.AudioTrack()
+	}
+	if videoTrack == nil && audioTrack == nil {
+		return fmt.Errorf("the viewer plays none of the stream media: %w", entities.ErrMissingCompatibleStreams)
+	}
+	// a viewer not bundling its media is answered a single media section, the video one (see
+	// controllers.LocalDescriptionSDP)
+	if videoTrack != nil && !controllers.BundlesMedia(string(offer)) {
+		audioTrack = nil
+	}
+
+	// Add tracks to peer connection, pion answers them in the offer's m-lines order
+	var rtpSender, audioRtpSender *webrtc.RTPSender
+	if videoTrack != nil {
+		if rtpSender, err = peerConnection.AddTrack(videoTrack); err != nil {
+			return fmt.Errorf("failed to add video track: %w", err)
+		}
+	}
+	if audioTrack != nil {
+		if audioRtpSender, err = peerConnection.AddTrack(audioTrack); err != nil {
+			return fmt.Errorf("failed to add audio track: %w", err)
+		}
+	}
+
+	if audioRtpSender != nil {
+		go func() {
+			rtcpBuf := make([]byte, 1500)
+			for {
+				if _, _, rtcpErr := audioRtpSender.Read(rtcpBuf); rtcpErr != nil {
+					l.Errorf("Failed to read audio RTCP: %v", rtcpErr)
+					return
+				}
+				session.Touch()
+			}
+		}()
+	}
+
+	// Handle RTCP packets, the key frame requests are tracked by the stream
+	if rtpSender != nil {
+		go func() {
+			for {
+				packets, _, rtcpErr := rtpSender.ReadRTCP()
+				if rtcpErr != nil {
+					l.Errorf("Failed to read video RTCP: %v", rtcpErr)
+					return
+				}
+				session.Touch()
+				for _, packet := range packets {
+					switch packet.(type) {
+					case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+						stream.RequestKeyFrame(session.ID)
+					}
+				}
+			}
+		}()
+	}
+
+	// Add this to the ServeHTTP function after creating the peer connection
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		l.Infof("Got track: %s (%s)", track.ID(), track.Kind())
 	})
 
-	params, err := h.createAndValidateParams(r)
+	// leaving the stream, it stops along with its last viewer
+	session.Cancel = func() {
+		stream.RemoveViewer(session.ID)
+	}
+	// the client's data channel, if any, receives the session notifications (ex: teardown) and,
+	// once open, the recipe warnings (ex: the audio is unavailable)
+	peerConnection.OnDataChannel(func(dc *webrtc.DataChannel) {
+		session.SetDataChannel(dc)
+		dc.OnOpen(func() {
+			for _, warning := range stream.Recipe.Warnings {
+				if err := session.Notify(h.mapper.FromWarningToEntityMessage(warning)); err != nil {
+					l.Warnw("failed to send the warning", "error", err)
+				}
+			}
+		})
+	})
+	if err := h.sessions.Add(session); err != nil {
+		return err
+	}
 
-	donutEngine, err := h.donut.EngineFor(&params)
-	if err != nil {
+	if err := stream.AddViewer(session.ID, &Viewer{
+		Close: func() {
+			// the end of the stream reaches the viewer before its connection is closed
+			session.flush(endSessionTimeout)
+			peerConnection.Close()
+		},
+		Notify: session.Notify,
+	}); err != nil {
+		h.sessions.Remove(session.ID)
 		return err
 	}
+	added = true
+
+	untrackDSCP := trackDSCP(h.dscp, rtpSender, audioRtpSender)
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		l.Infof("Connection state changed: %s", state.String())
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			untrackDSCP()
+		}
+		if state == webrtc.PeerConnectionStateClosed {
+			session.Cancel()
+			h.sessions.Remove(session.ID)
+		}
+	})
+
+	if err := h.writeAnswer(w, l, peerConnection, offer, "/whep/"+session.ID, &stream.Recipe); err != nil {
+		session.Cancel()
+		h.sessions.Remove(session.ID)
+		return err
+	}
+	return nil
+}
+
+// startStream probes the upstream and starts its media pipeline, fanning the frames out to the viewers.
+func (h *WHEPHandler) startStream(params *entities.RequestParams) (*SharedStream, error) {
+	donutEngine, err := h.donut.EngineFor(params)
+	if err != nil {
+		return nil, err
+	}
 	h.l.Infof("DonutEngine %#v", donutEngine)
 
 	// server side media info
 	serverStreamInfo, err := donutEngine.ServerIngredients()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	h.l.Infof("ServerIngredients %#v", serverStreamInfo)
 
-	// client side media support
+	// client side media support, the first viewer's offer picks the codecs. The media it didn't offer are kept
+	// for the next viewers, each one only gets the tracks of its own offer (see plays)
 	clientStreamInfo, err := donutEngine.ClientIngredients()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	clientStreamInfo = withUnofferedMedia(clientStreamInfo)
 	h.l.Infof("ClientIngredients %#v", clientStreamInfo)
 
 	donutRecipe, err := donutEngine.RecipeFor(serverStreamInfo, clientStreamInfo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	h.l.Infof("DonutRecipe %#v", donutRecipe)
 
-	// We can't defer calling cancel here because it'll live alongside the stream.
-	ctx, cancel := context.WithCancel(context.Background())
-
-	// Create video and audio tracks for this connection
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: "video/h264"},
-		"video",
-		"pion-rtsp",
-	)
-	if err != nil {
-		return fmt.Errorf("failed to create video track: %w", err)
-	}
-	audioTrack, err := webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: "audio/opus"},
-		"audio",
-		"pion-rtsp",
-	)
-	if err != nil {
-		return fmt.Errorf("failed to create audio track: %w", err)
+	hlsDir := hlsDirFor(h.c, params.StreamID)
+	if hlsDir != "" && donutRecipe.Audio.Action == entities.DonutTranscode {
+		// the viewers keep getting Opus
+		donutRecipe.Audio.MuxerCodec = entities.AAC
 	}
 
-	// Add tracks to peer connection
-	rtpSender, err := peerConnection.AddTrack(videoTrack)
+	// We can't defer calling cancel here because it'll live alongside the stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := NewSharedStream(h.l, h.mapper, SharedStreamKey(params), params.StreamID, *donutRecipe, cancel)
 	if err != nil {
-		return fmt.Errorf("failed to add video track: %w", err)
+		cancel()
+		return nil, err
 	}
-	audioRtpSender, err := peerConnection.AddTrack(audioTrack)
+	muxer, err := newOutputs(h.c, h.l, params, "", "", hlsDir)
 	if err != nil {
-		return fmt.Errorf("failed to add audio track: %w", err)
+		cancel()
+		return nil, err
 	}
+	stream.Source = serverStreamInfo
+	stream.MaxKeyFrameWait = time.Duration(h.c.BypassMaxKeyFrameWaitMS) * time.Millisecond
+	sinks := sinksFor(stream, muxer)
 
-	go donutEngine.Serve(&entities.DonutParameters{
-		Cancel: cancel,
-		Ctx:    ctx,
-		Recipe: *donutRecipe,
-		OnClose: func() {
-			cancel()
-			peerConnection.Close()
-		},
-		OnError: func(err error) {
-			h.l.Errorw("error while streaming", "error", err)
-		},
-		OnVideoFrame: func(data []byte, c entities.MediaFrameContext) error {
-			if err := videoTrack.WriteSample(media.Sample{
-				Data:     data,
-				Duration: c.Duration,
-			}); err != nil {
-				return fmt.Errorf("failed to write video: %w", err)
-			}
-			return nil
-		},
-		OnAudioFrame: func(data []byte, c entities.MediaFrameContext) error {
-			if err := audioTrack.WriteSample(media.Sample{
-				Data:     data,
-				Duration: c.Duration,
-			}); err != nil {
-				return fmt.Errorf("failed to write audio: %w", err)
-			}
-			return nil
-		},
-	})
-
-	// Handle RTCP packets
 	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-				h.l.Errorf("Failed to read video RTCP: %v", rtcpErr)
-				return
-			}
-		}
+		donutEngine.Serve(&entities.DonutParameters{
+			Cancel: cancel,
+			Ctx:    ctx,
+			Recipe: *donutRecipe,
+
+			FilterUpdates:    stream.FilterUpdates,
+			BitRateUpdates:   stream.BitRateUpdates,
+			KeyFrameRequests: stream.KeyFrames,
+
+			Sinks: sinks,
+
+			OnClose: func() {
+				cancel()
+			},
+			OnEnd: func() {
+				h.l.Infow("stream ended", "stream_id", params.StreamID)
+				stream.Notify(h.mapper.FromStreamEndToEntityMessage())
+			},
+			OnError: func(err error) {
+				h.l.Errorw("error while streaming", "error", err)
+				stream.Notify(h.mapper.FromStreamErrorToEntityMessage(err))
+			},
+			OnCue: func(cue *entities.Cue) error {
+				msg, err := h.mapper.FromCueToEntityMessage(cue)
+				if err != nil {
+					return err
+				}
+				stream.Notify(msg)
+				return nil
+			},
+			OnTimecode: func(tc *entities.TimecodeInfo) error {
+				msg, err := h.mapper.FromTimecodeToEntityMessage(tc)
+				if err != nil {
+					return err
+				}
+				stream.Notify(msg)
+				return nil
+			},
+			OnPoster: func(jpeg []byte) error {
+				stream.SetPoster(jpeg)
+				return nil
+			},
+			OnPipelineEvent: func(e *entities.PipelineEvent) error {
+				stream.AddPipelineEvent(*e)
+				return nil
+			},
+		})
+		cancel()
+		h.streams.Remove(stream)
+		// closes the remaining viewers along with the outputs
+		closeSinks(h.l, sinks)
 	}()
 
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := audioRtpSender.Read(rtcpBuf); rtcpErr != nil {
-				h.l.Errorf("Failed to read audio RTCP: %v", rtcpErr)
-				return
-			}
-		}
-	}()
-
-	// Add this to the ServeHTTP function after creating the peer connection
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		h.l.Infof("Got track: %s (%s)", track.ID(), track.Kind())
-	})
-
-	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		h.l.Infof("Connection state changed: %s", state.String())
-	})
-
-	h.writeAnswer(w, peerConnection, offer)
-	return nil
+	return stream, nil
 }
 
-func (h *WHEPHandler) writeAnswer(w http.ResponseWriter, peerConnection *webrtc.PeerConnection, offer []byte) error {
+// writeAnswer answers the offer, l is the logger of the session and the recipe is the one of the stream.
+func (h *WHEPHandler) writeAnswer(w http.ResponseWriter, l *zap.SugaredLogger, peerConnection *webrtc.PeerConnection, offer []byte, location string, recipe *entities.DonutRecipe) error {
 	// Validate SDP offer
 	sdpOffer := string(offer)
 	if sdpOffer == "" || !strings.Contains(sdpOffer, "ice-ufrag") {
@@ -213,11 +397,11 @@ func (h *WHEPHandler) writeAnswer(w http.ResponseWriter, peerConnection *webrtc.
 
 	// Set the handler for ICE connection state
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		h.l.Infof("ICE Connection State has changed: %s", connectionState.String())
+		l.Infof("ICE Connection State has changed (WHEP): %s", connectionState.String())
 
 		if connectionState == webrtc.ICEConnectionStateFailed {
 			if err := peerConnection.Close(); err != nil {
-				h.l.Errorf("Failed to close peer connection: %v", err)
+				l.Errorf("Failed to close peer connection: %v", err)
 			}
 		}
 	})
@@ -244,13 +428,29 @@ func (h *WHEPHandler) writeAnswer(w http.ResponseWriter, peerConnection *webrtc.
 
 	// Block until ICE Gathering is complete, disabling trickle ICE
 	<-gatherComplete
+	l.Infow("ICE credentials",
+		"remote_ufrag", parseSDPFragment(sdpOffer).ufrag,
+		"local_ufrag", parseSDPFragment(peerConnection.LocalDescription().SDP).ufrag,
+	)
+	controllers.LogNegotiatedMedia(l, "whep", negotiatedMedia(peerConnection))
+	if err := verifyNegotiatedTracks(peerConnection); err != nil {
+		l.Errorw("the viewer didn't accept a track", "error", err)
+		return err
+	}
+
+	answerSDP, err := controllers.LocalDescriptionSDP(h.c, h.rewriter, sdpOffer, peerConnection.LocalDescription().SDP, recipe, h.c.ICEPreferredAddressFamily)
+	if err != nil {
+		return err
+	}
+
+	logSDP(h.c, l, "whep", "answer", answerSDP)
 
 	// WHEP expects a Location header and a HTTP Status Code of 201
-	w.Header().Add("Location", "/whep")
+	w.Header().Add("Location", location)
 	w.WriteHeader(http.StatusCreated)
 
 	// Write Answer with Candidates as HTTP Response
-	_, err = fmt.Fprint(w, peerConnection.LocalDescription().SDP)
+	_, err = fmt.Fprint(w, answerSDP)
 	if err != nil {
 		return fmt.Errorf("failed to write response: %w", err)
 	}
@@ -258,27 +458,74 @@ func (h *WHEPHandler) writeAnswer(w http.ResponseWriter, peerConnection *webrtc.
 	return nil
 }
 
-func (h *WHEPHandler) createAndValidateParams(r *http.Request) (entities.RequestParams, error) {
+// plays tells whether the viewer's offer has an m-line for the media of the stream and plays its codec,
+// a media missing from the offer fails the session in the reject mode (Config.OfferMissingMedia).
+func (h *WHEPHandler) plays(params *entities.RequestParams, stream *SharedStream, mediaType entities.MediaType, task entities.DonutMediaTask) (bool, error) {
+	if task.Action == entities.DonutDrop {
+		return false, nil
+	}
+	client, err := h.mapper.FromWebRTCSessionDescriptionToStreamInfo(params.Offer)
+	if err != nil {
+		h.l.Warnw("failed to parse the offer, assuming it plays the media", "media_type", mediaType, "error", err)
+		return true, nil
+	}
+	offered, err := engine.OfferedMedia(stream.Source, client, mediaType, h.c.OfferMissingMedia)
+	if err != nil {
+		return false, err
+	}
+	if !offered {
+		h.l.Infow("the viewer didn't offer the media, joining without it", "media_type", mediaType)
+		return false, nil
+	}
+	if !client.Plays(mediaType, task.Codec) {
+		h.l.Warnw("the viewer doesn't play the media, joining without it", "media_type", mediaType, "codec", task.Codec)
+		return false, nil
+	}
+	return true, nil
+}
+
+// unofferedCodecs are assumed for the media missing from the offer of a shared stream's first viewer,
+// every WebRTC browser plays them.
+var unofferedCodecs = map[entities.MediaType][]entities.Codec{
+	entities.VideoType: {entities.H264, entities.VP8},
+	entities.AudioType: {entities.Opus},
+}
+
+// withUnofferedMedia adds the unofferedCodecs of the media missing from the client streams, the recipe of a
+// shared stream then keeps them for the next viewers.
+func withUnofferedMedia(client *entities.StreamInfo) *entities.StreamInfo {
+	result := &entities.StreamInfo{}
+	if client != nil {
+		result.Format = client.Format
+		result.Streams = append(result.Streams, client.Streams...)
+	}
+	for _, mediaType := range []entities.MediaType{entities.VideoType, entities.AudioType} {
+		if client.Has(mediaType) {
+			continue
+		}
+		for _, codec := range unofferedCodecs[mediaType] {
+			result.Streams = append(result.Streams, entities.Stream{Type: mediaType, Codec: codec})
+		}
+	}
+	return result
+}
+
+func (h *WHEPHandler) createAndValidateParams(r *http.Request, offer []byte) (entities.RequestParams, error) {
 	if r.Method != http.MethodPost {
 		return entities.RequestParams{}, entities.ErrHTTPPostOnly
 	}
 
 	// For WHEP, we'll use the configured default stream URL and ID
 	params := entities.RequestParams{
-		StreamURL: h.c.DefaultStreamURL,
-		StreamID:  h.c.DefaultStreamID,
+		StreamURL:   h.c.DefaultStreamURL,
+		StreamID:    h.c.DefaultStreamID,
+		VideoCodecs: videoCodecsOf(whepVideoCodecs),
 	}
 
-	// Read the SDP offer from the request body
-	offerBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		return entities.RequestParams{}, fmt.Errorf("failed to read offer: %w", err)
-	}
-
-	// Parse the SDP offer using v4
+	// The request body was already read, the offer is parsed using v3
 	params.Offer = webrtc3.SessionDescription{
 		Type: webrtc3.SDPTypeOffer,
-		SDP:  string(offerBytes),
+		SDP:  string(offer),
 	}
 
 	if err := params.Valid(); err != nil {
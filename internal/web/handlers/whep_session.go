@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/pion/webrtc/v4"
+)
+
+const sdpFragmentContentType = "application/trickle-ice-sdpfrag"
+
+// patchSession handles trickle ICE and ICE restarts for an existing WHEP session (RFC 9725).
+// When the fragment carries new ICE credentials (ex: the viewer switched from wifi to cellular)
+// the transport is renegotiated while the media pipeline keeps running.
+func (h *WHEPHandler) patchSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := h.sessionFor(r)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	fragment := parseSDPFragment(string(body))
+	if fragment.ufrag == "" || fragment.pwd == "" {
+		return entities.ErrMissingICECredentials
+	}
+
+	l := h.l.With("session", session.ID)
+	peerConnection := session.PeerConnection
+	remote := peerConnection.RemoteDescription()
+	if remote == nil {
+		return entities.ErrMissingRemoteOffer
+	}
+
+	if fragment.ufrag == parseSDPFragment(remote.SDP).ufrag {
+		l.Infow("adding remote ICE candidates", "count", len(fragment.candidates))
+		for _, candidate := range fragment.candidates {
+			if err := peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+				return fmt.Errorf("failed to add ICE candidate: %w", err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	l.Infow("restarting ICE", "remote_ufrag", fragment.ufrag)
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  withICECredentials(remote.SDP, fragment.ufrag, fragment.pwd),
+	}); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	// the restart resets the gathering state, so the promise must be created after it
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	<-gatherComplete
+
+	for _, candidate := range fragment.candidates {
+		if err := peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: candidate}); err != nil {
+			return fmt.Errorf("failed to add ICE candidate: %w", err)
+		}
+	}
+
+	answerSDP, err := controllers.LocalDescriptionSDP(h.c, h.rewriter, peerConnection.RemoteDescription().SDP, peerConnection.LocalDescription().SDP, &session.Stream.Recipe, h.c.ICEPreferredAddressFamily)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", sdpFragmentContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err = fmt.Fprint(w, toSDPFragment(answerSDP)); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// deleteSession tears down the WHEP session and its media pipeline
+func (h *WHEPHandler) deleteSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := h.sessionFor(r)
+	if err != nil {
+		return err
+	}
+
+	session.Cancel()
+	if err := session.PeerConnection.Close(); err != nil {
+		h.l.Errorw("Failed to close peer connection", "session", session.ID, "error", err)
+	}
+	h.sessions.Remove(session.ID)
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *WHEPHandler) sessionFor(r *http.Request) (*Session, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/whep/")
+	if id == "" || id == r.URL.Path {
+		return nil, entities.ErrMissingSession
+	}
+
+	session, ok := h.sessions.Get(id)
+	if !ok {
+		return nil, fmt.Errorf("%w %s", entities.ErrMissingSession, id)
+	}
+	return session, nil
+}
+
+type sdpFragment struct {
+	ufrag string
+	pwd   string
+	// candidates without the "a=" prefix
+	candidates []string
+}
+
+func sdpLines(sdp string) []string {
+	lines := strings.Split(sdp, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	return lines
+}
+
+func parseSDPFragment(sdp string) sdpFragment {
+	fragment := sdpFragment{}
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:") && fragment.ufrag == "":
+			fragment.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:") && fragment.pwd == "":
+			fragment.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			fragment.candidates = append(fragment.candidates, strings.TrimPrefix(line, "a="))
+		}
+	}
+	return fragment
+}
+
+// withICECredentials rewrites the offer with the new credentials, dropping the stale candidates
+func withICECredentials(sdp, ufrag, pwd string) string {
+	var result []string
+	for _, line := range sdpLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + pwd
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\r\n")
+}
+
+// toSDPFragment extracts the ICE attributes of a session description (RFC 8840)
+func toSDPFragment(sdp string) string {
+	fragment := parseSDPFragment(sdp)
+	lines := []string{
+		"a=ice-ufrag:" + fragment.ufrag,
+		"a=ice-pwd:" + fragment.pwd,
+	}
+	for _, line := range sdpLines(sdp) {
+		if strings.HasPrefix(line, "m=") || strings.HasPrefix(line, "a=mid:") ||
+			strings.HasPrefix(line, "a=candidate:") || line == "a=end-of-candidates" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
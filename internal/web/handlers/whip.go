@@ -5,83 +5,87 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/pion/interceptor"
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 	"go.uber.org/zap"
 )
 
 type WHIPHandler struct {
+	c          *entities.Config
 	l          *zap.SugaredLogger
 	videoTrack *webrtc.TrackLocalStaticRTP
 	audioTrack *webrtc.TrackLocalStaticRTP
+	rewriter   controllers.SDPRewriter
+	authorizer controllers.Authorizer
+	tcpMux     controllers.ICETCPMux
+	udpMux     controllers.ICEUDPMux
+	dscp       *controllers.DSCPMarker
 }
 
 // NewWHIPHandler creates a new WHIP handler with the given dependencies
 func NewWHIPHandler(
+	c *entities.Config,
 	log *zap.SugaredLogger,
 	tm *TrackManager, // Inject TrackManager instead of individual tracks
+	rewriter controllers.SDPRewriter,
+	authorizer controllers.Authorizer,
+	tcpMux controllers.ICETCPMux,
+	udpMux controllers.ICEUDPMux,
+	dscp *controllers.DSCPMarker,
 ) *WHIPHandler {
 	return &WHIPHandler{
+		c:          c,
 		l:          log,
 		videoTrack: tm.GetVideoTrack(),
 		audioTrack: tm.GetAudioTrack(),
+		rewriter:   rewriter,
+		authorizer: authorizer,
+		tcpMux:     tcpMux,
+		udpMux:     udpMux,
+		dscp:       dscp,
 	}
 }
 
 func (h *WHIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	// publishing isn't bound to a stream id, the token must allow publishing
+	if err := h.authorizer.Authorize(r, entities.RequestParams{Publish: true}); err != nil {
+		return err
+	}
+
 	offer, err := io.ReadAll(r.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read request body: %w", err)
 	}
-	h.l.Infof("Received WHIP Offer SDP:\n%s\n", string(offer))
-
-	// Create a MediaEngine object to configure the supported codec
-	m := &webrtc.MediaEngine{}
-
-	// Setup the codecs
-	if err = m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeH264,
-			ClockRate:   90000,
-			Channels:    0,
-			SDPFmtpLine: "",
-		},
-		PayloadType: 96,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		return fmt.Errorf("failed to register video codec: %w", err)
-	}
-
-	if err = m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeOpus,
-			ClockRate:   48000,
-			Channels:    2,
-			SDPFmtpLine: "minptime=10;useinbandfec=1",
-		},
-		PayloadType: 111,
-	}, webrtc.RTPCodecTypeAudio); err != nil {
-		return fmt.Errorf("failed to register audio codec: %w", err)
-	}
-
-	// Create and configure interceptor registry
-	i := &interceptor.Registry{}
+	// there's no session resource, a random id correlates the logs of the publisher
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	l := h.l.With("session", id)
+	logSDP(h.c, l, "whip", "offer", string(offer))
+
 	intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
 	if err != nil {
 		return fmt.Errorf("failed to create PLI interceptor: %w", err)
 	}
-	i.Add(intervalPliFactory)
 
-	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-		return fmt.Errorf("failed to register default interceptors: %w", err)
+	// Create the API object with the configured codecs, feedback and interceptors
+	api, err := newAPI(h.c, whipVideoCodecs, h.tcpMux, h.udpMux, h.dscp, intervalPliFactory)
+	if err != nil {
+		return err
 	}
 
-	// Create the API object with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
-
 	// Create a new RTCPeerConnection
-	peerConnection, err := api.NewPeerConnection(peerConnectionConfiguration)
+	configuration, err := newPeerConnectionConfiguration(h.c)
+	if err != nil {
+		return err
+	}
+	peerConnection, err := api.NewPeerConnection(configuration)
 	if err != nil {
 		return fmt.Errorf("failed to create peer connection: %w", err)
 	}
@@ -91,14 +95,14 @@ func (h *WHIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 		if candidate == nil {
 			return
 		}
-		h.l.Infof("Server ICE candidate (WHIP): Protocol: %s, Address: %s, Port: %d",
+		l.Infof("Server ICE candidate (WHIP): Protocol: %s, Address: %s, Port: %d",
 			candidate.Protocol,
 			candidate.Address,
 			candidate.Port)
 	})
 
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		h.l.Infof("ICE Connection State has changed (WHIP): %s", connectionState.String())
+		l.Infof("ICE Connection State has changed (WHIP): %s", connectionState.String())
 	})
 
 	// Add transceivers
@@ -113,12 +117,23 @@ func (h *WHIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 	// Handle incoming tracks
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		go func() {
+			var meter *bitrateMeter
+			if track.Kind() == webrtc.RTPCodecTypeVideo && h.c.WHIPMaxVideoBitRate > 0 {
+				meter = &bitrateMeter{}
+				done := make(chan struct{})
+				defer close(done)
+				go h.capBitRate(l, peerConnection, track, meter, done)
+			}
+
 			for {
 				pkt, _, err := track.ReadRTP()
 				if err != nil {
-					h.l.Errorf("Failed to read RTP packet: %v", err)
+					l.Errorf("Failed to read RTP packet: %v", err)
 					return
 				}
+				if meter != nil {
+					meter.add(len(pkt.Payload))
+				}
 
 				var writeErr error
 				if track.Kind() == webrtc.RTPCodecTypeVideo {
@@ -128,17 +143,45 @@ func (h *WHIPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 				}
 
 				if writeErr != nil {
-					h.l.Errorf("Failed to write RTP packet: %v", writeErr)
+					l.Errorf("Failed to write RTP packet: %v", writeErr)
 					return
 				}
 			}
 		}()
 	})
 
-	return h.writeAnswer(w, peerConnection, offer)
+	return h.writeAnswer(w, l, peerConnection, offer)
 }
 
-func (h *WHIPHandler) writeAnswer(w http.ResponseWriter, peerConnection *webrtc.PeerConnection, offer []byte) error {
+// capBitRate holds the publisher to Config.WHIPMaxVideoBitRate, sending REMB feedback for the video track every
+// bitrateWindow until done is closed. A publisher ignoring it (ex: without goog-remb support) is logged.
+func (h *WHIPHandler) capBitRate(l *zap.SugaredLogger, peerConnection *webrtc.PeerConnection, track *webrtc.TrackRemote, meter *bitrateMeter, done <-chan struct{}) {
+	maxBitRate := h.c.WHIPMaxVideoBitRate
+	ticker := time.NewTicker(bitrateWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(maxBitRate),
+			SSRCs:   []uint32{uint32(track.SSRC())},
+		}}); err != nil {
+			l.Warnw("failed to send REMB", "error", err)
+		}
+		// the encoder takes a while to adapt, only a sustained excess is worth logging
+		if bitRate := meter.Bitrate(); bitRate > maxBitRate*3/2 {
+			l.Warnw("the publisher exceeds the max video bit rate", "bitrate", bitRate, "max", maxBitRate)
+		}
+	}
+}
+
+// writeAnswer answers the offer, l is the logger of the session.
+func (h *WHIPHandler) writeAnswer(w http.ResponseWriter, l *zap.SugaredLogger, peerConnection *webrtc.PeerConnection, offer []byte) error {
 	// Validate SDP offer
 	sdpOffer := string(offer)
 	if sdpOffer == "" || !strings.Contains(sdpOffer, "ice-ufrag") {
@@ -169,13 +212,26 @@ func (h *WHIPHandler) writeAnswer(w http.ResponseWriter, peerConnection *webrtc.
 
 	// Block until ICE Gathering is complete
 	<-gatherComplete
+	l.Infow("ICE credentials",
+		"remote_ufrag", parseSDPFragment(sdpOffer).ufrag,
+		"local_ufrag", parseSDPFragment(peerConnection.LocalDescription().SDP).ufrag,
+	)
+	controllers.LogNegotiatedMedia(l, "whip", negotiatedMedia(peerConnection))
+
+	localSDP := controllers.WithVideoBandwidth(peerConnection.LocalDescription().SDP, h.c.WHIPMaxVideoBitRate)
+	answerSDP, err := controllers.LocalDescriptionSDP(h.c, h.rewriter, sdpOffer, localSDP, nil, h.c.ICEPreferredAddressFamily)
+	if err != nil {
+		return err
+	}
 
 	// Set WHIP response headers
 	w.Header().Add("Location", "/whip")
 	w.WriteHeader(http.StatusCreated)
 
+	logSDP(h.c, l, "whip", "answer", answerSDP)
+
 	// Write the answer to the response
-	_, err = fmt.Fprint(w, peerConnection.LocalDescription().SDP)
+	_, err = fmt.Fprint(w, answerSDP)
 	if err != nil {
 		return fmt.Errorf("failed to write response: %w", err)
 	}
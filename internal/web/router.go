@@ -1,8 +1,12 @@
 package web
 
 import (
+	"errors"
+	"expvar"
 	"net/http"
 
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
 	"github.com/flavioribeiro/donut/internal/web/handlers"
 	"go.uber.org/zap"
 )
@@ -16,6 +20,10 @@ func NewServeMux(
 	signaling *handlers.SignalingHandler,
 	whep *handlers.WHEPHandler,
 	whip *handlers.WHIPHandler,
+	session *handlers.SessionHandler,
+	sessions *handlers.SessionManager,
+	authorizer controllers.Authorizer,
+	c *entities.Config,
 	l *zap.SugaredLogger,
 ) *http.ServeMux {
 
@@ -26,9 +34,19 @@ func NewServeMux(
 	fs := http.FileServer(http.Dir("./static"))
 	mux.Handle("/demo/", setHTTPNoCaching(http.StripPrefix("/demo/", fs)))
 
-	mux.Handle("/doSignaling", setCors(errorHandler(l, signaling)))
-	mux.Handle("/whep", setCors(errorHandler(l, whep)))
-	mux.Handle("/whip", setCors(errorHandler(l, whip)))
+	mux.Handle("/doSignaling", accessLog(l, setCors(errorHandler(l, signaling))))
+	mux.Handle("/whep", accessLog(l, setCors(errorHandler(l, whep))))
+	mux.Handle("/whep/", accessLog(l, setCors(authorizeSession(l, authorizer, sessions, errorHandler(l, whep)))))
+	mux.Handle("/whip", accessLog(l, setCors(errorHandler(l, whip))))
+	mux.Handle("/session/", accessLog(l, setCors(authorizeSession(l, authorizer, sessions, errorHandler(l, session)))))
+	// the metrics, ex: the pipeline events counters (Config.PipelineEvents)
+	mux.Handle("/debug/vars", authorize(l, c, authorizer, expvar.Handler()))
+
+	// the playlist is rewritten with every segment
+	if c.HLSDir != "" {
+		hls := http.FileServer(http.Dir(c.HLSDir))
+		mux.Handle("/hls/", setCors(authorize(l, c, authorizer, setHTTPNoCaching(http.StripPrefix("/hls/", hls)))))
+	}
 
 	return mux
 }
@@ -36,10 +54,11 @@ func NewServeMux(
 func setCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:2345")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.Header().Set("Access-Control-Expose-Headers", "Location")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -55,14 +74,79 @@ func errorHandler(l *zap.SugaredLogger, next ErrorHTTPHandler) http.Handler {
 		err := next.ServeHTTP(w, r)
 		if err != nil {
 			l.Errorw("Handler error", "error", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), httpStatusFor(err))
 		}
 	})
 }
 
+// authorize guards the HLS stream and the metrics, their clients are authorized like the viewers starting the
+// default stream (Config.DefaultStreamID).
+func authorize(l *zap.SugaredLogger, c *entities.Config, authorizer controllers.Authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := authorizer.Authorize(r, entities.RequestParams{StreamURL: c.DefaultStreamURL, StreamID: c.DefaultStreamID}); err != nil {
+			l.Errorw("Handler error", "error", err)
+			http.Error(w, err.Error(), httpStatusFor(err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeSession guards the endpoints of the running sessions (ex: /session/{id}/bitrate or DELETE /whep/{id}),
+// the client is authorized like the viewer who started the session, ex: for the same stream.
+func authorizeSession(l *zap.SugaredLogger, authorizer controllers.Authorizer, sessions *handlers.SessionManager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := sessions.SessionOf(r.URL.Path)
+		if err == nil {
+			err = authorizer.Authorize(r, session.Params)
+		}
+		if err != nil {
+			l.Errorw("Handler error", "error", err)
+			http.Error(w, err.Error(), httpStatusFor(err))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func setHTTPNoCaching(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-store, no-cache, max-age=0, must-revalidate, proxy-revalidate")
 		next.ServeHTTP(w, r)
 	})
 }
+
+func httpStatusFor(err error) int {
+	switch {
+	case errors.Is(err, entities.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, entities.ErrInvalidRequestBody), errors.Is(err, entities.ErrInvalidBitRate):
+		// the client sent a request it must fix
+		return http.StatusBadRequest
+	case errors.Is(err, entities.ErrRelayURLNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, entities.ErrMissingSession), errors.Is(err, entities.ErrMissingPoster):
+		return http.StatusNotFound
+	case errors.Is(err, entities.ErrHTTPMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, entities.ErrStreamShared):
+		// the other viewers of the stream would be affected
+		return http.StatusConflict
+	case errors.Is(err, entities.ErrTrackNotNegotiated):
+		// the viewer can't play what the stream sends
+		return http.StatusNotAcceptable
+	case errors.Is(err, entities.ErrSRTConnectTimeout), errors.Is(err, entities.ErrSourceTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, entities.ErrSourceConnectionRefused), errors.Is(err, entities.ErrSourceUnreachable),
+		errors.Is(err, entities.ErrSourceRejected), errors.Is(err, entities.ErrSourceNotFound):
+		// the server is fine, the source isn't
+		return http.StatusBadGateway
+	case errors.Is(err, entities.ErrSRTStreamIDMismatch):
+		// the upstream publisher isn't the requested one
+		return http.StatusBadGateway
+	case errors.Is(err, entities.ErrEncoderNotFound):
+		// the running ffmpeg build can't serve the request
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
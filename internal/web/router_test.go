@@ -0,0 +1,100 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flavioribeiro/donut/internal/controllers"
+	"github.com/flavioribeiro/donut/internal/entities"
+	"github.com/flavioribeiro/donut/internal/mapper"
+	"github.com/flavioribeiro/donut/internal/web/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAuthorize(t *testing.T) {
+	c := &entities.Config{AuthMode: entities.AuthModeToken, AuthToken: "secret"}
+	authorizer, err := controllers.NewAuthorizer(c)
+	require.NoError(t, err)
+	handler := authorize(zap.NewNop().Sugar(), c, authorizer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for target, status := range map[string]int{
+		"/hls/live/index.m3u8":              http.StatusUnauthorized,
+		"/hls/live/index.m3u8?token=wrong":  http.StatusUnauthorized,
+		"/hls/live/index.m3u8?token=secret": http.StatusNoContent,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, status, w.Code, target)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func signJWT(secret, claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TestAuthorizeSession authorizes the session endpoints against the stream of the addressed session.
+func TestAuthorizeSession(t *testing.T) {
+	l := zap.NewNop().Sugar()
+	c := &entities.Config{AuthMode: entities.AuthModeJWT, AuthJWTSecret: "secret", DefaultStreamID: "live"}
+	authorizer, err := controllers.NewAuthorizer(c)
+	require.NoError(t, err)
+	sessions := handlers.NewSessionManager(c, l, mapper.NewMapper(l))
+	require.NoError(t, sessions.Add(&handlers.Session{ID: "abc", Params: entities.RequestParams{StreamID: "live"}}))
+	require.NoError(t, sessions.Add(&handlers.Session{ID: "def", Params: entities.RequestParams{StreamID: "other"}}))
+	handler := authorizeSession(l, authorizer, sessions, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	live := signJWT("secret", `{"stream_id":"live"}`)
+	other := signJWT("secret", `{"stream_id":"other"}`)
+	for _, tc := range []struct {
+		method, target, token string
+		status                int
+	}{
+		{http.MethodGet, "/session/abc", "", http.StatusUnauthorized},
+		{http.MethodPost, "/session/abc/bitrate", live, http.StatusNoContent},
+		{http.MethodDelete, "/whep/abc", live, http.StatusNoContent},
+		// a token for the default stream doesn't control the sessions of another stream
+		{http.MethodPost, "/session/def/bitrate", live, http.StatusUnauthorized},
+		{http.MethodDelete, "/whep/def", live, http.StatusUnauthorized},
+		// the viewers of another stream control their own sessions
+		{http.MethodGet, "/session/def/poster", other, http.StatusNoContent},
+		{http.MethodPatch, "/whep/def", other, http.StatusNoContent},
+		{http.MethodGet, "/session/unknown", live, http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Code, tc.method+" "+tc.target)
+	}
+}
+
+func TestHTTPStatusForInvalidRequests(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, httpStatusFor(fmt.Errorf("%w: unexpected EOF", entities.ErrInvalidRequestBody)))
+	assert.Equal(t, http.StatusBadRequest, httpStatusFor(entities.ErrInvalidBitRate))
+	assert.Equal(t, http.StatusConflict, httpStatusFor(fmt.Errorf("%w: 2 viewers", entities.ErrStreamShared)))
+	assert.Equal(t, http.StatusInternalServerError, httpStatusFor(errors.New("encoder failed")))
+}
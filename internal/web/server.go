@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"time"
 
 	"github.com/flavioribeiro/donut/internal/entities"
 	"go.uber.org/fx"
@@ -23,8 +24,11 @@ func NewHTTPServer(
 		"port", c.HTTPPort)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", c.HTTPHost, c.HTTPPort),
-		Handler: mux,
+		Addr:              fmt.Sprintf("%s:%d", c.HTTPHost, c.HTTPPort),
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(c.HTTPReadHeaderTimeoutMS) * time.Millisecond,
+		WriteTimeout:      time.Duration(c.HTTPWriteTimeoutMS) * time.Millisecond,
+		IdleTimeout:       time.Duration(c.HTTPIdleTimeoutMS) * time.Millisecond,
 	}
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
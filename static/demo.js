@@ -57,6 +57,9 @@ const setupWebRTC = (setRemoteSDPfn) => {
 
     const el = document.createElement(event.track.kind);
     el.srcObject = event.streams[0];
+    if (window.posterURL) {
+      el.poster = window.posterURL;
+    }
     el.autoplay = true
     el.controls = true;
     el.width = "640";
@@ -72,6 +75,16 @@ const setupWebRTC = (setRemoteSDPfn) => {
 
     e.channel.onmessage = (event) => {
       let msg = JSON.parse(event.data)
+      if (msg.Type === 'keepalive') {
+        // the server is alive, there's nothing to show
+        return;
+      }
+      if (msg.Type === 'poster') {
+        // the first frame is shown until the video plays
+        window.posterURL = msg.Message;
+        document.querySelectorAll('#remoteVideos video').forEach(el => el.poster = msg.Message);
+        return;
+      }
       if (msg.Message in metadataMessages) {
         // avoid logging dup messages
         return;